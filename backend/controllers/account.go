@@ -0,0 +1,187 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"grad_deploy/initializers"
+	"grad_deploy/models"
+	"grad_deploy/tools"
+	"grad_deploy/utils"
+)
+
+// findInvitation loads the account invited with the :token parameter,
+// writing the 404 response when there is no such invitation or it expired
+func findInvitation(c *gin.Context) (models.User, bool) {
+	var user models.User
+	token, err := uuid.Parse(c.Param("token"))
+	if err == nil {
+		err = initializers.FlowDB.First(&user, "verification_token = ?", token).Error
+	}
+	if err != nil || user.InvitedAt == nil || time.Since(*user.InvitedAt) > tools.InviteTTL() || user.Disabled() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found or expired"})
+		return models.User{}, false
+	}
+	return user, true
+}
+
+// setPassword stores password for user, ends any pending invitation or reset
+// and invalidates the access tokens issued so far. The account is only
+// updated while it still matches the token condition, so that a token works
+// once even when it is used twice at the same time; false means it was not.
+func setPassword(user *models.User, password, token string, args ...interface{}) (bool, error) {
+	hash, err := tools.HashPassword(password)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	verifiedAt := user.VerifiedAt
+	if verifiedAt == nil {
+		verifiedAt = &now
+	}
+	result := initializers.FlowDB.Model(user).Where(token, args...).Updates(map[string]interface{}{
+		"password":            hash,
+		"verified_at":         verifiedAt,
+		"password_changed_at": &now,
+		"verification_token":  nil,
+		"reset_token_hash":    "",
+		"reset_expires_at":    nil,
+	})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false, result.Error
+	}
+	user.Password = hash
+	user.VerifiedAt = verifiedAt
+	user.PasswordChangedAt = &now
+	user.VerificationToken = nil
+	user.ResetTokenHash = ""
+	user.ResetExpiresAt = nil
+	return true, nil
+}
+
+// validPassword writes the 400 response and returns false when password is
+// shorter than tools.MinPasswordLength
+func validPassword(c *gin.Context, password string) bool {
+	if err := tools.ValidatePassword(password); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+type SetPasswordRequest struct {
+	// Password needs at least tools.MinPasswordLength characters
+	Password string `json:"password" binding:"required"`
+}
+
+// GetInvitation shows who an invitation is for, for the page that accepts it
+func GetInvitation(c *gin.Context) {
+	user, ok := findInvitation(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"name":       user.Name,
+		"email":      user.Email,
+		"role":       user.Role,
+		"expires_at": user.InvitedAt.Add(tools.InviteTTL()),
+	})
+}
+
+// AcceptInvitation sets the password of an invited account, which can then log in
+func AcceptInvitation(c *gin.Context) {
+	var req SetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !validPassword(c, req.Password) {
+		return
+	}
+	user, ok := findInvitation(c)
+	if !ok {
+		return
+	}
+
+	updated, err := setPassword(&user, req.Password, "verification_token = ?", *user.VerificationToken)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set password"})
+		return
+	}
+	if !updated {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found or expired"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation accepted, you can now log in", "email": user.Email})
+}
+
+type PasswordResetRequest struct {
+	Email    string `json:"email" binding:"required,email"`
+	Language string `json:"language"`
+}
+
+// RequestPasswordReset emails a one-time reset link to an active account.
+// The answer is the same whether or not the account exists.
+func RequestPasswordReset(c *gin.Context) {
+	var req PasswordResetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if os.Getenv("PASSWORD_RESET_URL") == "" {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "PASSWORD_RESET_URL not configured"})
+		return
+	}
+
+	var user models.User
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	err := initializers.FlowDB.First(&user, "LOWER(email) = ?", email).Error
+	// Past the limit of the address the answer stays the same, without an email
+	if err == nil && user.VerifiedAt != nil && !user.Disabled() && !recipientLimited(user.Email, utils.TemplatePasswordReset) {
+		if _, err := sendPasswordReset(&user, req.Language, nil); err != nil {
+			log.Printf("Failed to send password reset to %s: %v", user.Email, err)
+		}
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "If an account exists for this email, a reset link has been sent"})
+}
+
+// ResetPassword sets a new password with a token from RequestPasswordReset.
+// The token works once.
+func ResetPassword(c *gin.Context) {
+	var req SetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !validPassword(c, req.Password) {
+		return
+	}
+
+	var user models.User
+	tokenHash := tools.HashResetToken(c.Param("token"))
+	err := initializers.FlowDB.First(&user, "reset_token_hash = ?", tokenHash).Error
+	if err != nil || user.ResetExpiresAt == nil || time.Now().After(*user.ResetExpiresAt) || user.Disabled() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Reset link not found or expired"})
+		return
+	}
+
+	updated, err := setPassword(&user, req.Password, "reset_token_hash = ?", tokenHash)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set password"})
+		return
+	}
+	if !updated {
+		// Used by another request since it was looked up
+		c.JSON(http.StatusNotFound, gin.H{"error": "Reset link not found or expired"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed, you can now log in", "email": user.Email})
+}
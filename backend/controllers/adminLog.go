@@ -21,7 +21,7 @@ func CreateAdminLog(c *gin.Context) {
 		return
 	}
 
-	if err := initializers.DB.Create(&input).Error; err != nil {
+	if err := initializers.FlowDB.Create(&input).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -32,7 +32,7 @@ func CreateAdminLog(c *gin.Context) {
 // GetAdminLogs returns all AdminLog entries
 func GetAdminLogs(c *gin.Context) {
 	var logs []models.AdminLog
-	if err := initializers.DB.Find(&logs).Error; err != nil {
+	if err := initializers.FlowDB.Find(&logs).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -49,7 +49,7 @@ func GetAdminLogByID(c *gin.Context) {
 	}
 
 	var log models.AdminLog
-	err = initializers.DB.First(&log, id).Error
+	err = initializers.FlowDB.First(&log, id).Error
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "record not found"})
 		return
@@ -72,7 +72,7 @@ func UpdateAdminLogByID(c *gin.Context) {
 	}
 
 	var log models.AdminLog
-	err = initializers.DB.First(&log, id).Error
+	err = initializers.FlowDB.First(&log, id).Error
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "record not found"})
 		return
@@ -91,7 +91,7 @@ func UpdateAdminLogByID(c *gin.Context) {
 	log.Action = input.Action
 	log.AdminID = input.AdminID
 
-	if err := initializers.DB.Save(&log).Error; err != nil {
+	if err := initializers.FlowDB.Save(&log).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -108,7 +108,7 @@ func DeleteAdminLogByID(c *gin.Context) {
 		return
 	}
 
-	if err := initializers.DB.Delete(&models.AdminLog{}, id).Error; err != nil {
+	if err := initializers.FlowDB.Delete(&models.AdminLog{}, id).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -1,12 +1,11 @@
 package controllers
 
 import (
+	"encoding/json"
 	"grad_deploy/initializers"
 	"grad_deploy/models"
+	"grad_deploy/tools"
 	"net/http"
-	"os"
-	"strconv"
-	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -18,11 +17,16 @@ type NewDataRequestRequest struct {
 	Email       string `json:"email" binding:"required,email"`
 	Format      string `json:"format" binding:"required"`
 	Purpose     string `json:"purpose" binding:"required"`
+	Language    string `json:"language" binding:"omitempty,oneof=id en"`
 	YearFrom    int    `json:"year_from"`
 	YearTo      int    `json:"year_to"`
 	Table       string `json:"table"`
 	Columns     string `json:"columns" `
-	SQLQuery    string `json:"sql_query"`
+	// SQLQuery is only accepted to turn it down, the SQL of a submitted
+	// request is generated from the fields above or written by an admin
+	SQLQuery string `json:"sql_query"`
+	// Filter, year range and columns generate SQLQuery
+	Filter *tools.QuerySpec `json:"filter"`
 }
 
 func NewDataRequest(c *gin.Context) {
@@ -33,6 +37,10 @@ func NewDataRequest(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if req.SQLQuery != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sql_query cannot be submitted, describe the data with columns, year_from, year_to and filter"})
+		return
+	}
 
 	// Create new data request
 	dataRequest := models.DataRequest{
@@ -42,32 +50,53 @@ func NewDataRequest(c *gin.Context) {
 		Email:       req.Email,
 		Format:      req.Format,
 		Purpose:     req.Purpose,
-		YearFrom:    req.YearFrom,
-		YearTo:      req.YearTo,
-		Table:       req.Table,
-		Columns:     req.Columns,
-		SQLQuery:    req.SQLQuery,
+		Language:    req.Language,
+		// Admins can pick another profile, see UpdateDataRequestMasking
+		MaskingProfile: tools.SuggestMaskingProfile(req.Purpose),
+		YearFrom:       req.YearFrom,
+		YearTo:         req.YearTo,
+		Table:          req.Table,
+		Columns:        req.Columns,
+	}
+
+	// Without structured fields the SQL is left for an admin to write
+	if hasQuerySpec(dataRequest, req.Filter) {
+		var spec tools.QuerySpec
+		if req.Filter != nil {
+			spec = *req.Filter
+		}
+		if _, err := generateQuery(&dataRequest, spec); err != nil {
+			respondGenerateError(c, err)
+			return
+		}
 	}
 
 	if err := initializers.FlowDB.Create(&dataRequest).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create data request"})
 		return
 	}
-
-	c.JSON(http.StatusOK, gin.H{"message": "Data request created successfully", "data": dataRequest})
+	recordCreated(dataRequest)
+	notifyCreated(dataRequest)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "Data request created successfully",
+		"data":           dataRequest,
+		"tracking_token": tools.TrackingToken(dataRequest.ID),
+	})
 }
 
 type NewSimpleDataRequestRequest struct {
-	Name        string   `json:"name" binding:"required"`
-	NIM         string   `json:"nim" binding:"required"`
-	PhoneNumber string   `json:"phone_number" binding:"required"`
-	Email       string   `json:"email" binding:"required,email"`
-	Format      string   `json:"format" binding:"required"`
-	Purpose     string   `json:"purpose" binding:"required"`
-	Select      []string `json:"select" binding:"required"`
-	Where       []string `json:"where"`
-	Limit       int      `json:"limit"`
-	OrderBy     []string `json:"order_by"`
+	Name        string             `json:"name" binding:"required"`
+	NIM         string             `json:"nim" binding:"required"`
+	PhoneNumber string             `json:"phone_number" binding:"required"`
+	Email       string             `json:"email" binding:"required,email"`
+	Format      string             `json:"format" binding:"required"`
+	Purpose     string             `json:"purpose" binding:"required"`
+	Language    string             `json:"language" binding:"omitempty,oneof=id en"`
+	Select      []string           `json:"select" binding:"required"`
+	Where       *tools.FilterGroup `json:"where"`
+	Limit       int                `json:"limit"`
+	OrderBy     []tools.SortSpec   `json:"order_by"`
 }
 
 func NewSimpleDataRequest(c *gin.Context) {
@@ -79,31 +108,6 @@ func NewSimpleDataRequest(c *gin.Context) {
 		return
 	}
 
-	// Get the fixed table name from environment
-	tableName := os.Getenv("FIXED_TABLE")
-	if tableName == "" {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "FIXED_TABLE not set in environment"})
-		return
-	}
-
-	// Construct SQL query
-	query := "SELECT " + strings.Join(req.Select, ", ") + " FROM " + tableName
-
-	// Add WHERE clause if provided
-	if len(req.Where) > 0 {
-		query += " WHERE " + strings.Join(req.Where, " AND ")
-	}
-
-	// Add ORDER BY clause if provided
-	if len(req.OrderBy) > 0 {
-		query += " ORDER BY " + strings.Join(req.OrderBy, ", ")
-	}
-
-	// Add LIMIT clause if provided
-	if req.Limit > 0 {
-		query += " LIMIT " + strconv.Itoa(req.Limit)
-	}
-
 	// Create new data request
 	dataRequest := models.DataRequest{
 		Name:        req.Name,
@@ -112,16 +116,39 @@ func NewSimpleDataRequest(c *gin.Context) {
 		Email:       req.Email,
 		Format:      req.Format,
 		Purpose:     req.Purpose,
-		Table:       tableName,
-		SQLQuery:    query,
+		Language:    req.Language,
+		// Admins can pick another profile, see UpdateDataRequestMasking
+		MaskingProfile: tools.SuggestMaskingProfile(req.Purpose),
+	}
+
+	// Compile the spec against FIXED_TABLE; values become query args, never raw SQL
+	spec := tools.QuerySpec{Select: req.Select, Where: req.Where, OrderBy: req.OrderBy, Limit: req.Limit}
+	if _, err := generateQuery(&dataRequest, spec); err != nil {
+		respondGenerateError(c, err)
+		return
 	}
 
 	if err := initializers.FlowDB.Create(&dataRequest).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create data request"})
 		return
 	}
+	recordCreated(dataRequest)
+	notifyCreated(dataRequest)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "Data request created successfully",
+		"data":           dataRequest,
+		"tracking_token": tools.TrackingToken(dataRequest.ID),
+	})
+}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Data request created successfully", "data": dataRequest})
+// recordCreated starts the timeline of a newly submitted request
+func recordCreated(dataRequest models.DataRequest) {
+	tools.RecordEvent(initializers.FlowDB, models.DataRequestEvent{
+		DataRequestID: dataRequest.ID,
+		Type:          models.EventCreated,
+		ToValue:       dataRequest.Status,
+	})
 }
 
 /* Example JSON input for NewSimpleDataRequest:
@@ -132,10 +159,20 @@ func NewSimpleDataRequest(c *gin.Context) {
 	"email": "john.doe@example.com",
 	"format": "CSV",
 	"purpose": "Research",
-	"select": ["id", "name", "year"],
-	"where": ["year > 2020", "department = 'Computer Science'"],
+	"select": ["nim", "nama", "ipk"],
+	"where": {
+		"logic": "AND",
+		"conditions": [{"column": "kode_prodi", "operator": "in", "values": ["55201", "55202"]}],
+		"groups": [{
+			"logic": "OR",
+			"conditions": [
+				{"column": "ipk", "operator": "gte", "value": 3.5},
+				{"column": "wisuda", "operator": "between", "values": ["2020-01-01", "2021-12-31"]}
+			]
+		}]
+	},
 	"limit": 100,
-	"order_by": ["year DESC", "name ASC"]
+	"order_by": [{"column": "ipk", "direction": "DESC"}, {"column": "nama"}]
 }
 */
 
@@ -261,18 +298,48 @@ func UpdateDataRequestByID(c *gin.Context) {
 	dataRequest.Email = req.Email
 	dataRequest.Format = req.Format
 	dataRequest.Purpose = req.Purpose
+	if req.Language != "" {
+		dataRequest.Language = req.Language
+	}
 	dataRequest.YearFrom = req.YearFrom
 	dataRequest.YearTo = req.YearTo
 	dataRequest.Table = req.Table
 	dataRequest.Columns = req.Columns
+	previousSQL := dataRequest.SQLQuery
 	dataRequest.SQLQuery = req.SQLQuery
 
+	// Without a query, build one from the structured fields (or the stored spec)
+	if req.SQLQuery == "" && (hasQuerySpec(dataRequest, req.Filter) || dataRequest.Filter != "") {
+		var spec tools.QuerySpec
+		if req.Filter != nil {
+			spec = *req.Filter
+		} else if dataRequest.Filter != "" && json.Unmarshal([]byte(dataRequest.Filter), &spec) != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Stored filter is not a valid query spec"})
+			return
+		}
+		if _, err := generateQuery(&dataRequest, spec); err != nil {
+			respondGenerateError(c, err)
+			return
+		}
+	}
+
 	// Query
 	if err := initializers.FlowDB.Save(&dataRequest).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update data request"})
 		return
 	}
 
+	if previousSQL != dataRequest.SQLQuery {
+		admin := currentUser(c)
+		tools.RecordEvent(initializers.FlowDB, models.DataRequestEvent{
+			DataRequestID: dataRequest.ID,
+			Type:          models.EventSQLEdited,
+			FromValue:     previousSQL,
+			ToValue:       dataRequest.SQLQuery,
+			ActorID:       &admin.ID,
+		})
+	}
+
 	c.JSON(http.StatusOK, gin.H{"message": "Data request updated successfully", "data": dataRequest})
 }
 
@@ -286,7 +353,10 @@ func UpdateDataRequestByID(c *gin.Context) {
     "purpose": "Research",
     "year_from": 2020,
     "year_to": 2021,
-    "table": "students",
-    "sql_query": "SELECT * FROM students WHERE year >= 2020 AND year <= 2021"
+    "columns": "nim, nama, ipk",
+    "filter": {"where": {"conditions": [{"column": "ipk", "operator": "gte", "value": 3}]}}
 }
+The server generates sql_query from table (default FIXED_TABLE), columns,
+filter and the year range on GRADUATION_DATE_COLUMN:
+SELECT "nim", "nama", "ipk" FROM "alumni" WHERE ("wisuda" >= '2020-01-01' AND "wisuda" < '2022-01-01' AND ("ipk" >= 3))
 */
@@ -0,0 +1,65 @@
+package controllers
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+
+	"grad_deploy/initializers"
+	"grad_deploy/models"
+	"grad_deploy/tools"
+)
+
+// GetDataRequestDisclosure runs the request's SQL, masked as its exports
+// would be, and reports the groups under k without returning any rows, so
+// admins can check a breakdown before approving the request.
+func GetDataRequestDisclosure(c *gin.Context) {
+	id := c.Param("id")
+	var dataRequest models.DataRequest
+	if err := initializers.FlowDB.First(&dataRequest, "id = ?", id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Data request not found"})
+		return
+	}
+	if dataRequest.SQLQuery == "" {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Data request has no SQL query"})
+		return
+	}
+	query, args := requestQuery(dataRequest)
+	if !allowQuery(c, query) {
+		return
+	}
+
+	masking, ok := maskingFor(c, &dataRequest, c.Query("masking_profile"))
+	if !ok {
+		return
+	}
+	masking, err := masking.ForQuery(query)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var declared map[string]string
+	if masking.Profile != nil {
+		columns, _ := tools.TableColumns(initializers.DB, os.Getenv("FIXED_TABLE"))
+		declared = tools.ColumnTypes(columns)
+	}
+
+	limits := tools.QueryLimitsForRole(currentUser(c).Role)
+	result := &previewTable{}
+	stats, err := tools.RunReadOnlyQuery(c.Request.Context(), initializers.DB, query, args, limits, masking.Wrap(result, declared))
+	if err != nil {
+		respondQueryError(c, err)
+		return
+	}
+
+	report := result.disclosure()
+	c.JSON(http.StatusOK, gin.H{
+		"disclosure": report,
+		"passed":     report.Passed(),
+		"enforced":   masking.Disclosure().Enabled(),
+		"masking":    masking.ProfileName(),
+		"rows":       stats.Rows,
+		"truncated":  stats.Truncated,
+	})
+}
@@ -0,0 +1,273 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"grad_deploy/initializers"
+	"grad_deploy/models"
+	"grad_deploy/tools"
+)
+
+// checkLink answers a download or file request whose link did not verify
+// and reports whether it did. A link bound to a recipient asks for their
+// address first, as the email query parameter.
+func checkLink(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, tools.ErrDownloadLinkExpired):
+		c.JSON(http.StatusGone, gin.H{"error": "Download link expired"})
+	case errors.Is(err, tools.ErrRecipientRequired):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Enter the email address this link was sent to", "confirm": "email"})
+	case errors.Is(err, tools.ErrRecipientMismatch):
+		c.JSON(http.StatusForbidden, gin.H{"error": "This link was sent to another email address", "confirm": "email"})
+	default:
+		// Same answer as a missing export, so links can't be probed for file names
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invalid download link"})
+	}
+	return false
+}
+
+// GetDownload serves a recorded export through a signed link made by
+// tools.NewDownloadURL, unless the link expired or the export was revoked.
+// Every download is counted and logged with the recipient who confirmed it.
+func GetDownload(c *gin.Context) {
+	name := c.Param("name")
+	link, err := tools.VerifyDownloadLink(name, c.Request.URL.Query())
+	if !checkLink(c, err) {
+		return
+	}
+
+	// Only recorded exports are served, a record is what revoking and
+	// expiring act on
+	var export models.ExportFile
+	err = initializers.FlowDB.First(&export, "name = ?", name).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Export not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up export"})
+		return
+	}
+	if export.RevokedAt != nil {
+		c.JSON(http.StatusGone, gin.H{"error": "This export has been revoked"})
+		return
+	}
+	if export.PurgedAt != nil {
+		c.JSON(http.StatusGone, gin.H{"error": "This export has expired and was deleted"})
+		return
+	}
+
+	if !serveExport(c, name, link.Format) {
+		return
+	}
+
+	now := time.Now()
+	initializers.FlowDB.Model(&models.ExportFile{}).Where("name = ?", name).Updates(map[string]interface{}{
+		"download_count":     gorm.Expr("download_count + 1"),
+		"last_downloaded_at": &now,
+	})
+	initializers.FlowDB.Create(&models.ExportDownload{
+		ExportName: name,
+		Format:     link.Format,
+		Recipient:  link.Recipient,
+		IP:         c.ClientIP(),
+		UserAgent:  c.Request.UserAgent(),
+		CreatedAt:  now,
+	})
+}
+
+type GetExportFilesRequest struct {
+	RequestID     string `form:"request_id" binding:"omitempty,uuid"`
+	Pinned        *bool  `form:"pinned"`
+	IncludePurged bool   `form:"include_purged"`
+	Page          int    `form:"page" binding:"omitempty,min=1"`
+	Limit         int    `form:"limit" binding:"omitempty,min=1,max=100"`
+}
+
+// GetExportFiles shows the storage used by exports and uploads and lists the
+// recorded exports, newest first
+func GetExportFiles(c *gin.Context) {
+	var req GetExportFilesRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	usage, err := tools.ExportStorageUsage(c.Request.Context(), initializers.FlowDB, initializers.Storage)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to measure storage usage"})
+		return
+	}
+
+	query := initializers.FlowDB.Model(&models.ExportFile{})
+	if req.RequestID != "" {
+		query = query.Where("data_request_id = ?", req.RequestID)
+	}
+	if req.Pinned != nil {
+		query = query.Where("pinned = ?", *req.Pinned)
+	}
+	if !req.IncludePurged {
+		query = query.Where("purged_at IS NULL")
+	}
+	query = query.Order("created_at DESC")
+
+	if req.Page > 0 && req.Limit > 0 {
+		query = query.Offset((req.Page - 1) * req.Limit).Limit(req.Limit)
+	}
+
+	var exports []models.ExportFile
+	if err := query.Find(&exports).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch exports"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"usage": usage, "retention": tools.ExportRetention().String(), "exports": exports})
+}
+
+// GetFile serves a stored upload, such as an email attachment, through a
+// signed link made by tools.NewFileURL.
+func GetFile(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	_, err := tools.VerifyFileLink(key, c.Request.URL.Query())
+	if !checkLink(c, err) {
+		return
+	}
+
+	serveObject(c, key)
+}
+
+// GetExportFile returns an export's metadata and download log, and for a
+// protected export who it was sent to
+func GetExportFile(c *gin.Context) {
+	name := c.Param("name")
+	var export models.ExportFile
+	if err := initializers.FlowDB.First(&export, "name = ?", name).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Export not found"})
+		return
+	}
+
+	var downloads []models.ExportDownload
+	if err := initializers.FlowDB.Where("export_name = ?", name).Order("created_at DESC").Find(&downloads).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch downloads"})
+		return
+	}
+
+	response := gin.H{"export": export, "downloads": downloads}
+	if export.Protected {
+		var deliveries []models.ProtectedDelivery
+		if err := initializers.FlowDB.Where("export_name = ?", name).Order("created_at DESC").Find(&deliveries).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch deliveries"})
+			return
+		}
+		response["deliveries"] = deliveries
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// RevokeExportFile invalidates every download link of an export
+func RevokeExportFile(c *gin.Context) {
+	name := c.Param("name")
+	var export models.ExportFile
+	if err := initializers.FlowDB.First(&export, "name = ?", name).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Export not found"})
+		return
+	}
+
+	if export.RevokedAt == nil {
+		admin := currentUser(c)
+		now := time.Now()
+		export.RevokedAt = &now
+		export.RevokedBy = &admin.ID
+		if err := initializers.FlowDB.Save(&export).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke export"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Export revoked", "export": export})
+}
+
+// PinExportFile keeps an export from ever being deleted by the janitor
+func PinExportFile(c *gin.Context) {
+	setExportPinned(c, true)
+}
+
+// UnpinExportFile lets the janitor delete an export again once it expires
+func UnpinExportFile(c *gin.Context) {
+	setExportPinned(c, false)
+}
+
+func setExportPinned(c *gin.Context, pinned bool) {
+	name := c.Param("name")
+	var export models.ExportFile
+	if err := initializers.FlowDB.First(&export, "name = ?", name).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Export not found"})
+		return
+	}
+	if export.PurgedAt != nil {
+		c.JSON(http.StatusGone, gin.H{"error": "This export has already been deleted"})
+		return
+	}
+
+	export.Pinned = pinned
+	export.PinnedBy = nil
+	if pinned {
+		admin := currentUser(c)
+		export.PinnedBy = &admin.ID
+	}
+	if err := initializers.FlowDB.Select("pinned", "pinned_by").Save(&export).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update export"})
+		return
+	}
+
+	message := "Export unpinned"
+	if pinned {
+		message = "Export pinned"
+	}
+	c.JSON(http.StatusOK, gin.H{"message": message, "export": export})
+}
+
+type NewDownloadLinkRequest struct {
+	// Recipient binds the link to the address it is sent to, which the
+	// downloader then has to confirm
+	Recipient string `json:"recipient" binding:"omitempty,email"`
+	Format    string `json:"format"`
+}
+
+// PostDownloadLink signs a new download link for an export
+func PostDownloadLink(c *gin.Context) {
+	var req NewDownloadLinkRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	name := c.Param("name")
+	stored, found := tools.FindExport(c.Request.Context(), initializers.Storage, name)
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	format := stored
+	if req.Format != "" && req.Format != stored {
+		var err error
+		if format, err = tools.NormalizeFormat(req.Format); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	link := tools.DownloadLink{Name: name, Format: format, Recipient: req.Recipient, Expires: time.Now().Add(tools.DownloadLinkTTL())}
+	c.JSON(http.StatusOK, gin.H{"url": link.URL(os.Getenv("BASE_URL")), "expires_at": link.Expires})
+}
@@ -1,26 +1,41 @@
 package controllers
 
 import (
+	"errors"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 
+	"grad_deploy/initializers"
+	"grad_deploy/models"
+	"grad_deploy/tools"
 	"grad_deploy/utils"
+	"grad_deploy/workers"
 )
 
 // requestBody holds form fields for email
 type requestBody struct {
-	Target         string `form:"target" binding:"required,email"`
-	Body           string `form:"body" binding:"required"`
-	Subject        string `form:"subject" binding:"required"`
-	RequestID      int    `form:"request_id" binding:"required"`
+	Target    string `form:"target" binding:"required,email"`
+	Body      string `form:"body"`
+	Subject   string `form:"subject"`
+	RequestID string `form:"request_id" binding:"required,uuid"`
+	// Template defaults to request_completed; subject and body override its text
+	Template       string `form:"template"`
+	Language       string `form:"language"`
 	IncludeResults bool   `form:"include_results"`
-	ResultFormat   string `form:"result_format" binding:"omitempty,oneof=csv json excel"`
+	ResultFormat   string `form:"result_format" binding:"omitempty,oneof=csv json ndjson excel xlsx parquet"`
 	CsvID          string `form:"csv_id"`
+	// Protect sends csv_id or the results as a password protected zip, with
+	// the password in a second email unless password_channel is admin
+	Protect         bool   `form:"protect"`
+	PasswordChannel string `form:"password_channel" binding:"omitempty,oneof=email admin"`
 }
 
-// PostEmail handles the request to send an email with CSV data link
+// PostEmail queues an email with the CSV data link for the outbox worker.
+// With include_results the results are attached in result_format as well.
+// With protect the file is password protected and who got it is recorded.
 func PostEmail(c *gin.Context) {
 	var req requestBody
 	// bind form fields (multipart/form-data)
@@ -37,58 +52,192 @@ func PostEmail(c *gin.Context) {
 	}
 
 	// After binding, validate fields
-	if req.RequestID <= 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "request_id is required"})
+	var dataRequest models.DataRequest
+	if err := initializers.FlowDB.First(&dataRequest, "id = ?", req.RequestID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Data request not found"})
 		return
 	}
 	if req.IncludeResults && req.ResultFormat == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "result_format is required when include_results is true"})
 		return
 	}
+	var resultFormat string
+	if req.IncludeResults {
+		var err error
+		if resultFormat, err = tools.NormalizeFormat(req.ResultFormat); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if req.Protect && req.CsvID == "" && !req.IncludeResults {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "protect requires csv_id or include_results"})
+		return
+	}
+
 	// Determine download link
-	var csvLink string
-	if req.CsvID != "" {
-		csvLink = baseURL + "/sql/" + req.CsvID
-	} else {
-		// handle file upload using util
-		file, err := c.FormFile("file")
+	var csvLink, csvFormat string
+	file, fileErr := c.FormFile("file")
+	switch {
+	case req.CsvID != "":
+		var found bool
+		csvFormat, found = tools.FindExport(c.Request.Context(), initializers.Storage, req.CsvID)
+		if !found {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+		csvLink = tools.NewDownloadURL(baseURL, req.CsvID, csvFormat, req.Target)
+	case fileErr == nil:
+		policy, err := utils.DefaultUploadPolicy()
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Either csv_id or file must be provided"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		// utilize HandleFileUpload to check and store the file, then link to it like to an export
+		key, err := utils.HandleFileUpload(c, initializers.Storage, policy, file, emailAttachmentDir)
+		var rejection *utils.UploadRejection
+		if errors.As(err, &rejection) {
+			c.JSON(rejection.Status, gin.H{"error": "File rejected", "reason": rejection.Reason})
 			return
 		}
-		// utilize HandleFileUpload to store file and get relative path
-		linkPath, err := utils.HandleFileUpload(c, file, "emailAttachments")
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload file"})
 			return
 		}
-		csvLink = baseURL + linkPath
+		csvLink = tools.NewFileURL(baseURL, key, req.Target)
+	case !req.IncludeResults:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Either csv_id, file or include_results must be provided"})
+		return
+	}
+
+	// The results are those of csv_id or of the data request
+	name, format := req.CsvID, csvFormat
+	if req.IncludeResults {
+		format = resultFormat
+		if name == "" {
+			var ok bool
+			if name, ok = resultExport(c, dataRequest, resultFormat); !ok {
+				return
+			}
+		}
+	}
+
+	// Send a password protected copy of them instead
+	var protected models.ExportFile
+	if req.Protect {
+		source, ok := recordedExport(c, name)
+		if !ok {
+			return
+		}
+		if source.DataRequestID == nil {
+			source.DataRequestID = &dataRequest.ID
+		}
+		if protected, ok = protectExport(c, source, format); !ok {
+			return
+		}
+		name, format = protected.Name, protected.Format
+		csvLink = tools.NewDownloadURL(baseURL, name, format, req.Target)
 	}
 
-	// Create email content
-	subject := "Permintaan Data Tracer Selesai"
+	// Attach them, falling back to a link when they are too large
+	var attachment, fallback string
+	if req.IncludeResults {
+		var ok bool
+		if attachment, fallback, ok = resultAttachment(c, name, format); !ok {
+			return
+		}
+		if csvLink == "" || fallback != "" {
+			csvLink = tools.NewDownloadURL(baseURL, name, format, req.Target)
+		}
+	}
+
+	// Create email content from the template in the requester's language
+	templateID := req.Template
+	if templateID == "" {
+		templateID = utils.TemplateRequestCompleted
+	}
+	if req.Language != "" {
+		dataRequest.Language = req.Language
+	}
+	email, err := requestEmail(dataRequest, templateID, csvLink)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	email.To = req.Target
+	email.Attachments = attachment
 	if req.Subject != "" {
-		subject = req.Subject
+		email.Subject = req.Subject
 	}
-	url := csvLink
-	body := "Data Anda telah siap untuk diunduh. Silakan klik tautan di bawah ini untuk mengunduh data Anda:\n"
 	if req.Body != "" {
-		body = req.Body
+		email.Body = req.Body
 	}
 
-	// Use the sendEmail function from utils package
+	// Delivery happens in the background, see workers.StartEmailWorker
+	admin := currentUser(c)
+	email.QueuedBy = &admin.ID
+	if err := workers.QueueEmail(&email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue email"})
+		return
+	}
+
+	response := gin.H{"message": "Email queued", "email": email}
+	if fallback != "" {
+		response["attachment_fallback"] = fallback
+	}
+	if req.Protect {
+		// The file is on its way, so failing to send the password is reported rather than fatal
+		delivery, err := deliverPassword(dataRequest, protected, req.Target, req.PasswordChannel, &email.ID, admin)
+		if err != nil {
+			response["password_error"] = err.Error()
+		} else {
+			response["delivery"] = delivery
+		}
+		if delivery.PasswordEmailID == nil {
+			response["password"] = protected.Password
+		}
+	}
+	c.JSON(http.StatusAccepted, response)
+}
+
+type GetEmailsRequest struct {
+	RequestID string `form:"request_id" binding:"omitempty,uuid"`
+	To        string `form:"to"`
+	Status    string `form:"status"`
+	Page      int    `form:"page" binding:"omitempty,min=1"`
+	Limit     int    `form:"limit" binding:"omitempty,min=1,max=100"`
+}
+
+// GetEmails lists the email outbox and history, newest first, optionally
+// filtered by data request, recipient and status
+func GetEmails(c *gin.Context) {
+	var req GetEmailsRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	query := initializers.FlowDB.Model(&models.EmailHistory{})
+	if req.RequestID != "" {
+		query = query.Where("data_request_id = ?", req.RequestID)
+	}
+	if req.To != "" {
+		query = query.Where("\"to\" ILIKE ?", "%"+req.To+"%")
+	}
+	if req.Status != "" && req.Status != "ALL" {
+		query = query.Where("status = ?", strings.ToLower(req.Status))
+	}
+	query = query.Order("created_at DESC")
 
-	emailData := utils.EmailData{
-		To:      req.Target,
-		Subject: subject,
-		URL:     url,
-		Body:    body,
+	if req.Page > 0 && req.Limit > 0 {
+		query = query.Offset((req.Page - 1) * req.Limit).Limit(req.Limit)
 	}
 
-	if err := utils.SendEmail(emailData); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send email"})
+	var emails []models.EmailHistory
+	if err := query.Find(&emails).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch emails"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Email sent successfully"})
+	c.JSON(http.StatusOK, gin.H{"emails": emails})
 }
@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"grad_deploy/initializers"
+	"grad_deploy/models"
+	"grad_deploy/tools"
+)
+
+// emailAttachmentDir is where uploads and result attachments of emails are stored
+const emailAttachmentDir = "emailAttachments"
+
+// resultExport returns the export holding the results of dataRequest in
+// format: the one it was fulfilled with when that can be served in format
+// and was not revoked, otherwise a new export of its SQL. It writes the
+// error response and returns false when there is none.
+func resultExport(c *gin.Context, dataRequest models.DataRequest, format string) (string, bool) {
+	ctx := c.Request.Context()
+	if _, ok := downloadableExport(dataRequest.ExportName); ok {
+		stored, found := tools.FindExport(ctx, initializers.Storage, dataRequest.ExportName)
+		if found && (stored == format || stored == "csv") {
+			return dataRequest.ExportName, true
+		}
+	}
+
+	if dataRequest.SQLQuery == "" {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Data request has no SQL query"})
+		return "", false
+	}
+	query, args := requestQuery(dataRequest)
+	if !allowQuery(c, query) {
+		return "", false
+	}
+
+	masking, ok := maskingFor(c, &dataRequest, "")
+	if !ok {
+		return "", false
+	}
+
+	admin := currentUser(c)
+	limits := tools.QueryLimitsForRole(admin.Role)
+	name, stats, err := tools.ExportQuery(ctx, initializers.DB, initializers.Storage, query, args, format, limits, masking, nil)
+	if err != nil {
+		respondQueryError(c, err)
+		return "", false
+	}
+
+	err = tools.RecordExport(initializers.FlowDB, initializers.Storage, models.ExportFile{
+		Name:           name,
+		Format:         format,
+		Rows:           stats.Rows,
+		DataRequestID:  &dataRequest.ID,
+		CreatedBy:      &admin.ID,
+		MaskingProfile: masking.ProfileName(),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record export"})
+		return "", false
+	}
+	tools.RecordEvent(initializers.FlowDB, models.DataRequestEvent{
+		DataRequestID: dataRequest.ID,
+		Type:          models.EventExported,
+		Details:       name + "." + format,
+		ActorID:       &admin.ID,
+	})
+	return name, true
+}
+
+// resultAttachment stores export name in format as an email attachment and
+// returns its key. When the result is too large to attach, the key is empty
+// and fallback says why, so the email carries a download link instead. It
+// writes the error response and returns false on other failures.
+func resultAttachment(c *gin.Context, name, format string) (key, fallback string, ok bool) {
+	key, err := tools.StoreResultAttachment(c.Request.Context(), initializers.DB, initializers.Storage,
+		name, format, tools.DefaultAttachmentLimits(), emailAttachmentDir)
+	switch {
+	case errors.Is(err, tools.ErrAttachmentTooLarge):
+		return "", err.Error() + ", a download link is sent instead", true
+	case errors.Is(err, tools.ErrObjectNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return "", "", false
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prepare attachment: " + err.Error()})
+		return "", "", false
+	}
+	return key, "", true
+}
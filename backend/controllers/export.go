@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"grad_deploy/initializers"
+	"grad_deploy/models"
+	"grad_deploy/tools"
+	"grad_deploy/workers"
+)
+
+type NewExportRequest struct {
+	SQL       string `json:"sql" binding:"required"`
+	Format    string `json:"format"`
+	RequestID string `json:"request_id"`
+	// MaskingProfile defaults to the data request's
+	MaskingProfile string `json:"masking_profile"`
+}
+
+// PostExport queues a background export of the query and returns the job ID
+func PostExport(c *gin.Context) {
+	var req NewExportRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !allowQuery(c, req.SQL) {
+		return
+	}
+
+	format, dataRequest, err := exportTarget(req.Format, req.RequestID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	masking, ok := maskingFor(c, dataRequest, req.MaskingProfile)
+	if !ok {
+		return
+	}
+
+	user := currentUser(c)
+	job := models.ExportJob{
+		SQL:            req.SQL,
+		Format:         format,
+		Status:         models.ExportQueued,
+		RowLimit:       tools.QueryLimitsForRole(user.Role).MaxRows,
+		RequestedBy:    user.ID,
+		MaskingProfile: masking.ProfileName(),
+	}
+	if dataRequest != nil {
+		job.DataRequestID = &dataRequest.ID
+	}
+	if err := initializers.FlowDB.Create(&job).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue export"})
+		return
+	}
+	workers.NotifyExport()
+
+	c.JSON(http.StatusAccepted, gin.H{"job_id": job.ID, "status": job.Status})
+}
+
+// GetExport reports the state and progress of an export job
+func GetExport(c *gin.Context) {
+	id := c.Param("id")
+	var job models.ExportJob
+
+	if err := initializers.FlowDB.First(&job, "id = ?", id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Export job not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"export": job})
+}
+
+// exportTarget resolves the optional data request an export is made for and
+// picks the format: the explicit one if given, otherwise the request's Format
+func exportTarget(format, requestID string) (string, *models.DataRequest, error) {
+	var dataRequest *models.DataRequest
+	if requestID != "" {
+		dataRequest = &models.DataRequest{}
+		if err := initializers.FlowDB.First(dataRequest, "id = ?", requestID).Error; err != nil {
+			return "", nil, errors.New("data request not found")
+		}
+		if format == "" {
+			format = dataRequest.Format
+		}
+	}
+
+	format, err := tools.NormalizeFormat(format)
+	return format, dataRequest, err
+}
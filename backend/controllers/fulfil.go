@@ -0,0 +1,220 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"grad_deploy/initializers"
+	"grad_deploy/models"
+	"grad_deploy/tools"
+	"grad_deploy/utils"
+	"grad_deploy/workers"
+)
+
+type FulfilDataRequestRequest struct {
+	SendEmail bool   `json:"send_email"`
+	Subject   string `json:"subject"`
+	Body      string `json:"body"`
+	// Protect links a password protected zip of the export instead
+	Protect bool `json:"protect"`
+	// PasswordChannel is how the requester gets the password: email (default) or admin
+	PasswordChannel string `json:"password_channel" binding:"omitempty,oneof=email admin"`
+	// AllowTruncated completes the request even when the result was cut off
+	// at the row limit, which is then recorded on the request
+	AllowTruncated bool `json:"allow_truncated"`
+}
+
+// FulfilDataRequest runs the request's stored SQL, writes the export in the
+// requested format, links it to the request, marks the request COMPLETED and
+// optionally queues an email with the download link to the requester. A
+// protected export's password goes out in a second email, or is left to the
+// admin.
+func FulfilDataRequest(c *gin.Context) {
+	id := c.Param("id")
+	var dataRequest models.DataRequest
+	if err := initializers.FlowDB.First(&dataRequest, "id = ?", id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Data request not found"})
+		return
+	}
+
+	var req FulfilDataRequestRequest
+	// The body is optional: without one the request is fulfilled without email
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if !checkTransition(c, dataRequest, models.StatusCompleted, "") {
+		return
+	}
+	if dataRequest.SQLQuery == "" {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Data request has no SQL query"})
+		return
+	}
+	query, args := requestQuery(dataRequest)
+	if !allowQuery(c, query) {
+		return
+	}
+
+	format, err := tools.NormalizeFormat(dataRequest.Format)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	baseURL := os.Getenv("BASE_URL")
+	if req.SendEmail && baseURL == "" {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "BASE_URL not configured"})
+		return
+	}
+
+	masking, ok := maskingFor(c, &dataRequest, "")
+	if !ok {
+		return
+	}
+
+	// Execute query and write the export file
+	admin := currentUser(c)
+	limits := tools.QueryLimitsForRole(admin.Role)
+	name, stats, err := tools.ExportQuery(c.Request.Context(), initializers.DB, initializers.Storage, query, args, format, limits, masking, nil)
+	if err != nil {
+		respondQueryError(c, err)
+		return
+	}
+	if stats.Truncated && !req.AllowTruncated {
+		initializers.Storage.Delete(c.Request.Context(), tools.ExportKey(name, format))
+		c.JSON(http.StatusConflict, gin.H{
+			"error":    fmt.Sprintf("The result has more than %d rows and would be cut off, narrow the query or fulfil with allow_truncated", limits.MaxRows),
+			"max_rows": limits.MaxRows,
+		})
+		return
+	}
+
+	// Record the export, and its protected copy, before linking them and
+	// completing the request
+	err = tools.RecordExport(initializers.FlowDB, initializers.Storage, models.ExportFile{
+		Name:           name,
+		Format:         format,
+		Rows:           stats.Rows,
+		DataRequestID:  &dataRequest.ID,
+		CreatedBy:      &admin.ID,
+		MaskingProfile: masking.ProfileName(),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record export"})
+		return
+	}
+	var protected models.ExportFile
+	if req.Protect {
+		protected, ok = protectExport(c, models.ExportFile{Name: name, Rows: stats.Rows, DataRequestID: &dataRequest.ID, MaskingProfile: masking.ProfileName()}, format)
+		if !ok {
+			tools.DiscardExport(initializers.FlowDB, initializers.Storage, name, format)
+			return
+		}
+	}
+	now := time.Now()
+	dataRequest.ExportName = name
+	dataRequest.ExportFormat = format
+	if req.Protect {
+		dataRequest.ExportName = protected.Name
+		dataRequest.ExportFormat = protected.Format
+	}
+	dataRequest.FulfilledBy = &admin.ID
+	dataRequest.FulfilledAt = &now
+	dataRequest.ExportTruncated = stats.Truncated
+	previous := dataRequest.Status
+	applyTransition(&dataRequest, models.StatusCompleted, "", admin)
+
+	// Another admin may have moved the request on while the query ran, the
+	// export is dropped then
+	fields := map[string]interface{}{
+		"export_name":      dataRequest.ExportName,
+		"export_format":    dataRequest.ExportFormat,
+		"fulfilled_by":     dataRequest.FulfilledBy,
+		"fulfilled_at":     dataRequest.FulfilledAt,
+		"export_truncated": dataRequest.ExportTruncated,
+	}
+	if !saveTransition(c, dataRequest, previous, fields) {
+		tools.DiscardExport(initializers.FlowDB, initializers.Storage, name, format)
+		if req.Protect {
+			tools.DiscardExport(initializers.FlowDB, initializers.Storage, protected.Name, protected.Format)
+		}
+		return
+	}
+
+	details := name + "." + format
+	if stats.Truncated {
+		details += fmt.Sprintf(" (truncated at %d rows)", stats.Rows)
+	}
+	tools.RecordEvent(initializers.FlowDB, models.DataRequestEvent{
+		DataRequestID: dataRequest.ID,
+		Type:          models.EventExported,
+		Details:       details,
+		ActorID:       &admin.ID,
+	})
+	recordStatusChange(dataRequest, previous)
+
+	history := models.RequestHistory{SQL: dataRequest.SQLQuery, Date: now}
+	if err := initializers.FlowDB.Create(&history).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save request history"})
+		return
+	}
+
+	response := gin.H{
+		"message":      "Data request fulfilled",
+		"data":         dataRequest,
+		"rows":         stats.Rows,
+		"truncated":    stats.Truncated,
+		"disclosure":   stats.Disclosure,
+		"email_queued": false,
+		"download_url": exportURL(dataRequest),
+	}
+
+	passwordSent := false
+	if req.SendEmail {
+		// The export is done either way, so failing to queue the mail is reported rather than fatal
+		if email, err := fulfilmentEmail(dataRequest, req, exportURL(dataRequest), admin); err != nil {
+			response["email_error"] = err.Error()
+		} else {
+			response["email_queued"] = true
+			response["email_id"] = email.ID
+			if req.Protect {
+				if delivery, err := deliverPassword(dataRequest, protected, email.To, req.PasswordChannel, &email.ID, admin); err != nil {
+					response["password_error"] = err.Error()
+				} else {
+					response["delivery"] = delivery
+					passwordSent = delivery.PasswordEmailID != nil
+				}
+			}
+		}
+	}
+	// Without a password email the admin passes the password on
+	if req.Protect && !passwordSent {
+		response["password"] = protected.Password
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// fulfilmentEmail queues the request_completed notification with the
+// download link, using the subject and body from req when given
+func fulfilmentEmail(dataRequest models.DataRequest, req FulfilDataRequestRequest, url string, admin models.User) (models.EmailHistory, error) {
+	email, err := requestEmail(dataRequest, utils.TemplateRequestCompleted, url)
+	if err != nil {
+		return email, err
+	}
+	email.QueuedBy = &admin.ID
+	if req.Subject != "" {
+		email.Subject = req.Subject
+	}
+	if req.Body != "" {
+		email.Body = req.Body
+	}
+	return email, workers.QueueEmail(&email)
+}
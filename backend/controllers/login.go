@@ -2,8 +2,10 @@ package controllers
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
     "grad_deploy/initializers"
     "grad_deploy/tools"
 	"grad_deploy/models"
@@ -11,6 +13,9 @@ import (
 
 var jwtSecret string
 
+// tokenLifetime is how long an access token issued by Login stays valid
+const tokenLifetime = 24 * time.Hour
+
 type LoginRequest struct {
 	Email    string `json:"email" binding:"required,email"`
 	Password string `json:"password" binding:"required,min=6"`
@@ -38,6 +43,10 @@ func Login(c *gin.Context) {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
 		return
 	}
+	if user.Disabled() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "This account is disabled"})
+		return
+	}
 
 
     
@@ -45,6 +54,10 @@ func Login(c *gin.Context) {
         Id : user.ID,
 		Email: user.Email,
 		Role: user.Role,
+		StandardClaims: jwt.StandardClaims{
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(tokenLifetime).Unix(),
+		},
 	}
 
 	// Create JWT token
@@ -67,4 +80,11 @@ func Login(c *gin.Context) {
 		"role":    user.Role,
 		"id":      user.ID,
 	})
-}
\ No newline at end of file
+}
+
+// currentUser returns the user attached to the request by middlewares.RequireAuth
+func currentUser(c *gin.Context) models.User {
+	value, _ := c.Get("user")
+	user, _ := value.(models.User)
+	return user
+}
@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"grad_deploy/initializers"
+	"grad_deploy/models"
+	"grad_deploy/tools"
+)
+
+// maskingFor returns the masking of a preview or export: profile when given,
+// otherwise the one of dataRequest, or DefaultMaskingProfile without one. It
+// writes the error response and returns false for an unknown profile.
+func maskingFor(c *gin.Context, dataRequest *models.DataRequest, profile string) (tools.Masking, bool) {
+	var requestID *uuid.UUID
+	if dataRequest != nil {
+		requestID = &dataRequest.ID
+		if profile == "" {
+			profile = dataRequest.MaskingProfile
+		}
+		// Requests made before profiles existed get the one their purpose suggests
+		if profile == "" {
+			profile = tools.SuggestMaskingProfile(dataRequest.Purpose)
+		}
+	}
+	// Ad hoc queries are masked too, unless an admin picks another profile
+	if profile == "" {
+		profile = tools.DefaultMaskingProfile
+	}
+
+	masking, err := tools.NewMasking(profile, requestID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return tools.Masking{}, false
+	}
+	return masking, true
+}
+
+// GetMaskingProfiles lists the masking profiles, with the one suggested for ?purpose=
+func GetMaskingProfiles(c *gin.Context) {
+	profiles, err := tools.MaskingProfiles()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := gin.H{"profiles": profiles, "default": tools.DefaultMaskingProfile}
+	if purpose := c.Query("purpose"); purpose != "" {
+		response["suggested"] = tools.SuggestMaskingProfile(purpose)
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+type UpdateMaskingRequest struct {
+	Profile string `json:"profile" binding:"required"`
+}
+
+// UpdateDataRequestMasking picks the masking profile of a data request
+func UpdateDataRequestMasking(c *gin.Context) {
+	var req UpdateMaskingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	id := c.Param("id")
+	var dataRequest models.DataRequest
+	if err := initializers.FlowDB.First(&dataRequest, "id = ?", id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Data request not found"})
+		return
+	}
+	if _, err := tools.FindMaskingProfile(req.Profile); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	previous := dataRequest.MaskingProfile
+	dataRequest.MaskingProfile = req.Profile
+	if err := initializers.FlowDB.Model(&dataRequest).Update("masking_profile", req.Profile).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update data request"})
+		return
+	}
+
+	if previous != req.Profile {
+		admin := currentUser(c)
+		tools.RecordEvent(initializers.FlowDB, models.DataRequestEvent{
+			DataRequestID: dataRequest.ID,
+			Type:          models.EventMaskingChanged,
+			FromValue:     previous,
+			ToValue:       req.Profile,
+			ActorID:       &admin.ID,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Masking profile updated", "data": dataRequest})
+}
@@ -0,0 +1,166 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"grad_deploy/initializers"
+	"grad_deploy/models"
+	"grad_deploy/tools"
+	"grad_deploy/utils"
+	"grad_deploy/workers"
+)
+
+// requestEmail renders a registered template for dataRequest in the
+// requester's language and returns the outbox entry for it, not yet queued.
+func requestEmail(dataRequest models.DataRequest, templateID, url string) (models.EmailHistory, error) {
+	data, err := utils.RenderRequestEmail(templateID, dataRequest.Language, dataRequest, url)
+	if err != nil {
+		return models.EmailHistory{}, err
+	}
+
+	return models.EmailHistory{
+		To:            data.To,
+		Name:          data.Name,
+		Subject:       data.Subject,
+		Body:          data.Body,
+		URL:           data.URL,
+		Button:        data.Button,
+		Language:      data.Language,
+		Template:      templateID,
+		DataRequestID: &dataRequest.ID,
+	}, nil
+}
+
+// trackingURL is the page where the requester can follow dataRequest with
+// its tracking token: TRACKING_URL, or else the status endpoint at BASE_URL
+func trackingURL(dataRequest models.DataRequest) string {
+	base := os.Getenv("TRACKING_URL")
+	if base == "" {
+		base = strings.TrimSuffix(os.Getenv("BASE_URL"), "/") + "/track"
+	}
+	return strings.TrimSuffix(base, "/") + "/" + tools.TrackingToken(dataRequest.ID)
+}
+
+// notifyCreated queues the acknowledgement for a newly submitted request. The
+// submission already succeeded, so failures are only logged.
+func notifyCreated(dataRequest models.DataRequest) {
+	if recipientLimited(dataRequest.Email, utils.TemplateRequestReceived) {
+		log.Printf("Not confirming data request %s, %s got too many confirmations lately", dataRequest.ID, dataRequest.Email)
+		return
+	}
+	email, err := requestEmail(dataRequest, utils.TemplateRequestReceived, trackingURL(dataRequest))
+	if err == nil {
+		err = workers.QueueEmail(&email)
+	}
+	if err != nil {
+		log.Printf("Failed to queue confirmation for data request %s: %v", dataRequest.ID, err)
+	}
+}
+
+// defaultEmailRecipientLimit is how many emails of one template an address
+// gets per hour through the public routes, unless EMAIL_RECIPIENT_LIMIT is set
+const defaultEmailRecipientLimit = 3
+
+// recipientLimited reports whether to already got its share of emails from
+// template in the past hour, so anonymous calls cannot flood an inbox
+func recipientLimited(to, template string) bool {
+	limit, err := strconv.Atoi(os.Getenv("EMAIL_RECIPIENT_LIMIT"))
+	if err != nil || limit < 1 {
+		limit = defaultEmailRecipientLimit
+	}
+
+	var count int64
+	err = initializers.FlowDB.Model(&models.EmailHistory{}).
+		Where(`LOWER("to") = ? AND template = ? AND created_at > ?`, strings.ToLower(strings.TrimSpace(to)), template, time.Now().Add(-time.Hour)).
+		Count(&count).Error
+	if err != nil {
+		log.Printf("Failed to count recent emails to %s: %v", to, err)
+		return false
+	}
+	return count >= int64(limit)
+}
+
+// exportURL is a signed download link, bound to the requester's address, of
+// the export attached to dataRequest, if any
+func exportURL(dataRequest models.DataRequest) string {
+	if dataRequest.ExportName == "" {
+		return ""
+	}
+	return tools.NewDownloadURL(os.Getenv("BASE_URL"), dataRequest.ExportName, dataRequest.ExportFormat, dataRequest.Email)
+}
+
+type PreviewEmailRequest struct {
+	RequestID string `json:"request_id" binding:"required,uuid"`
+	// Template defaults to the notification for the request's current status
+	Template string `json:"template"`
+	// Language defaults to the request's language
+	Language string `json:"language"`
+	// URL defaults to the request's export download link
+	URL string `json:"url"`
+}
+
+// PostEmailPreview renders a notification for a data request without sending it
+func PostEmailPreview(c *gin.Context) {
+	var req PreviewEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var dataRequest models.DataRequest
+	if err := initializers.FlowDB.First(&dataRequest, "id = ?", req.RequestID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Data request not found"})
+		return
+	}
+
+	templateID := req.Template
+	if templateID == "" {
+		var ok bool
+		if templateID, ok = utils.TemplateForStatus(dataRequest.Status); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No notification for status " + dataRequest.Status + ", choose a template"})
+			return
+		}
+	}
+	language := req.Language
+	if language == "" {
+		language = dataRequest.Language
+	}
+	url := req.URL
+	if url == "" {
+		url = exportURL(dataRequest)
+	}
+
+	data, err := utils.RenderRequestEmail(templateID, language, dataRequest, url)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	html, err := utils.RenderEmailHTML(data)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"preview": gin.H{
+		"template": templateID,
+		"language": data.Language,
+		"to":       data.To,
+		"subject":  data.Subject,
+		"body":     data.Body,
+		"button":   data.Button,
+		"url":      data.URL,
+		"html":     html,
+	}})
+}
+
+// GetEmailTemplates lists the notification templates and their languages
+func GetEmailTemplates(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"templates": utils.EmailTemplateIDs(), "languages": utils.EmailLanguages})
+}
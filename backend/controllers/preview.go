@@ -1,72 +1,123 @@
 package controllers
 
 import (
+	"database/sql"
+	"fmt"
 	"grad_deploy/initializers"
+	"grad_deploy/models"
 	"grad_deploy/tools"
 	"net/http"
+	"os"
 
 	"github.com/gin-gonic/gin"
 )
 
-// PostSQLPreview handles SQL preview requests and returns the result as a JSON table
+// previewRowLimit is the most rows a preview returns and holds in memory,
+// whatever the role of the admin may export
+const previewRowLimit = 200
+
+// PostSQLPreview handles SQL preview requests and returns the first
+// previewRowLimit rows as a JSON table, masked like an export for the same
+// data request would be. Rows in small groups are reported rather than
+// suppressed, so the admin can see them; disclosure_enforced tells whether
+// exports would suppress or flag them.
 func PostSQLPreview(c *gin.Context) {
 	var body struct {
-		SQL string `json:"sql" binding:"required"`
+		SQL            string `json:"sql" binding:"required"`
+		RequestID      string `json:"request_id"`
+		MaskingProfile string `json:"masking_profile"`
 	}
 	if err := c.ShouldBindJSON(&body); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
 		return
 	}
 
-	if !tools.IsSelectOnly(body.SQL) {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only SELECT statements are allowed"})
+	if !allowQuery(c, body.SQL) {
 		return
 	}
 
-	// Execute query
-	rows, err := initializers.DB.Raw(body.SQL).Rows()
+	var dataRequest *models.DataRequest
+	if body.RequestID != "" {
+		dataRequest = &models.DataRequest{}
+		if err := initializers.FlowDB.First(dataRequest, "id = ?", body.RequestID).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "data request not found"})
+			return
+		}
+	}
+	masking, ok := maskingFor(c, dataRequest, body.MaskingProfile)
+	if !ok {
+		return
+	}
+	masking, err := masking.ForQuery(body.SQL)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	var declared map[string]string
+	if masking.Profile != nil {
+		columns, _ := tools.TableColumns(initializers.DB, os.Getenv("FIXED_TABLE"))
+		declared = tools.ColumnTypes(columns)
+	}
 
-	defer rows.Close()
-
-	cols, err := rows.Columns()
+	// Execute query
+	limits := tools.QueryLimitsForRole(currentUser(c).Role)
+	if limits.MaxRows > previewRowLimit {
+		limits.MaxRows = previewRowLimit
+	}
+	preview := &previewTable{}
+	stats, err := tools.RunReadOnlyQuery(c.Request.Context(), initializers.DB, body.SQL, nil, limits, masking.Wrap(preview, declared))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondQueryError(c, err)
 		return
 	}
 
-	// Build table: header + rows
-	table := make([][]interface{}, 0)
+	c.JSON(http.StatusOK, gin.H{
+		"table":     preview.table,
+		"rows":      stats.Rows,
+		"truncated": stats.Truncated,
+		"timed_out": stats.TimedOut,
+		"masking":   masking.ProfileName(),
+		// Reported for every preview, enforced on exports depending on the masking
+		"disclosure":          preview.disclosure(),
+		"disclosure_enforced": masking.Disclosure().Enabled(),
+	})
+}
+
+// previewTable builds a JSON table: header + rows
+type previewTable struct {
+	table [][]interface{}
+	// sources of the columns, for the small-cell check
+	sources []tools.ColumnSource
+}
+
+func (p *previewTable) ColumnSources(sources []tools.ColumnSource) {
+	p.sources = sources
+}
+
+func (p *previewTable) Columns(cols []*sql.ColumnType) error {
 	header := make([]interface{}, len(cols))
 	for i, col := range cols {
-		header[i] = col
+		header[i] = col.Name()
 	}
-	table = append(table, header)
+	p.table = append(p.table, header)
+	return nil
+}
 
-	// Prepare row placeholders
-	values := make([]interface{}, len(cols))
-	ptrs := make([]interface{}, len(cols))
-	for i := range values {
-		ptrs[i] = &values[i]
+// disclosure runs the small-cell check over the table
+func (p *previewTable) disclosure() tools.DisclosureReport {
+	if len(p.table) == 0 {
+		return tools.CheckDisclosure(tools.DefaultDisclosure(), nil, nil, nil)
 	}
-	for rows.Next() {
-		if err := rows.Scan(ptrs...); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-		row := make([]interface{}, len(cols))
-		for i, val := range values {
-			row[i] = val
-		}
-		table = append(table, row)
-	}
-	if err := rows.Err(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	names := make([]string, len(p.table[0]))
+	for i, name := range p.table[0] {
+		names[i] = fmt.Sprint(name)
 	}
+	return tools.CheckDisclosure(tools.DefaultDisclosure(), names, p.sources, p.table[1:])
+}
 
-	c.JSON(http.StatusOK, gin.H{"table": table})
+func (p *previewTable) Row(values []interface{}) error {
+	row := make([]interface{}, len(values))
+	copy(row, values)
+	p.table = append(p.table, row)
+	return nil
 }
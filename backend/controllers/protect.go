@@ -0,0 +1,183 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"grad_deploy/initializers"
+	"grad_deploy/models"
+	"grad_deploy/tools"
+	"grad_deploy/utils"
+	"grad_deploy/workers"
+)
+
+// recordedExport loads the record of the export called name. It writes the
+// error response and returns false when there is none.
+func recordedExport(c *gin.Context, name string) (models.ExportFile, bool) {
+	var export models.ExportFile
+	err := initializers.FlowDB.First(&export, "name = ?", name).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Export not found"})
+		return models.ExportFile{}, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up export"})
+		return models.ExportFile{}, false
+	}
+	return export, true
+}
+
+// protectExport stores a password protected copy of export source in format
+// under a new password, and records it like source. It writes the error
+// response and returns false on failure.
+func protectExport(c *gin.Context, source models.ExportFile, format string) (models.ExportFile, bool) {
+	password, err := tools.NewExportPassword()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate password"})
+		return models.ExportFile{}, false
+	}
+	name, err := tools.ProtectExport(c.Request.Context(), initializers.DB, initializers.Storage, source.Name, format, password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to protect export: " + err.Error()})
+		return models.ExportFile{}, false
+	}
+
+	admin := currentUser(c)
+	protected := models.ExportFile{
+		Name:          name,
+		Format:        tools.ProtectedFormat,
+		Rows:          source.Rows,
+		DataRequestID: source.DataRequestID,
+		CreatedBy:     &admin.ID,
+		Protected:     true,
+		SourceName:    source.Name,
+		Password:      password,
+		// The archive holds the source as it was masked
+		MaskingProfile: source.MaskingProfile,
+	}
+	if err := tools.RecordExport(initializers.FlowDB, initializers.Storage, protected); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record export"})
+		return models.ExportFile{}, false
+	}
+	if source.DataRequestID != nil {
+		tools.RecordEvent(initializers.FlowDB, models.DataRequestEvent{
+			DataRequestID: *source.DataRequestID,
+			Type:          models.EventExported,
+			Details:       name + "." + tools.ProtectedFormat + " (password protected " + source.Name + "." + format + ")",
+			ActorID:       &admin.ID,
+		})
+	}
+	return protected, true
+}
+
+// deliverPassword records that protected was sent to recipient for
+// dataRequest, in the email emailID if any, and queues a separate email with
+// its password unless channel is PasswordByAdmin.
+func deliverPassword(dataRequest models.DataRequest, protected models.ExportFile, recipient, channel string, emailID *uint, admin models.User) (models.ProtectedDelivery, error) {
+	if channel == "" {
+		channel = models.PasswordByEmail
+	}
+	delivery := models.ProtectedDelivery{
+		ExportName:      protected.Name,
+		DataRequestID:   &dataRequest.ID,
+		Recipient:       recipient,
+		PasswordChannel: channel,
+		EmailID:         emailID,
+		DeliveredBy:     &admin.ID,
+	}
+
+	if channel == models.PasswordByEmail {
+		data, err := utils.RenderPasswordEmail(dataRequest.Language, dataRequest, tools.ExportKey(protected.Name, protected.Format), protected.Password)
+		if err != nil {
+			return delivery, err
+		}
+		email := models.EmailHistory{
+			To:            recipient,
+			Name:          data.Name,
+			Subject:       data.Subject,
+			Body:          data.Body,
+			Language:      data.Language,
+			Template:      utils.TemplateExportPassword,
+			DataRequestID: &dataRequest.ID,
+			QueuedBy:      &admin.ID,
+		}
+		if err := workers.QueueEmail(&email); err != nil {
+			return delivery, err
+		}
+		delivery.PasswordEmailID = &email.ID
+	}
+
+	return delivery, initializers.FlowDB.Create(&delivery).Error
+}
+
+type ProtectExportRequest struct {
+	// Format of the protected file, defaults to the export's
+	Format string `json:"format"`
+}
+
+// PostProtectExport stores a password protected copy of an export. The
+// password is returned to the admin, who passes it on apart from the file.
+func PostProtectExport(c *gin.Context) {
+	var req ProtectExportRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	name := c.Param("name")
+	stored, found := tools.FindExport(c.Request.Context(), initializers.Storage, name)
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	if stored == tools.ProtectedFormat {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "This export is already password protected"})
+		return
+	}
+	format := stored
+	if req.Format != "" {
+		var err error
+		if format, err = tools.NormalizeFormat(req.Format); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	source, ok := recordedExport(c, name)
+	if !ok {
+		return
+	}
+	protected, ok := protectExport(c, source, format)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"message": "Protected export created", "export": protected, "password": protected.Password})
+}
+
+// GetExportPassword shows the password of a protected export and who it was sent to
+func GetExportPassword(c *gin.Context) {
+	name := c.Param("name")
+	var export models.ExportFile
+	if err := initializers.FlowDB.First(&export, "name = ?", name).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Export not found"})
+		return
+	}
+	if !export.Protected {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "This export is not password protected"})
+		return
+	}
+
+	var deliveries []models.ProtectedDelivery
+	if err := initializers.FlowDB.Where("export_name = ?", name).Order("created_at DESC").Find(&deliveries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch deliveries"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"password": export.Password, "source_name": export.SourceName, "deliveries": deliveries})
+}
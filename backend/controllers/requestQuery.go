@@ -0,0 +1,168 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"grad_deploy/initializers"
+	"grad_deploy/models"
+	"grad_deploy/tools"
+)
+
+// defaultGraduationColumn is the column year_from/year_to filter on unless
+// GRADUATION_DATE_COLUMN is set
+const defaultGraduationColumn = "wisuda"
+
+// errTableColumns means the columns of the queried table could not be read
+var errTableColumns = errors.New("failed to read table columns")
+
+// hasQuerySpec reports whether a request carries structured fields the SQL can be built from
+func hasQuerySpec(dataRequest models.DataRequest, spec *tools.QuerySpec) bool {
+	return spec != nil || dataRequest.YearFrom != 0 || dataRequest.YearTo != 0 || dataRequest.Columns != ""
+}
+
+// generateQuery builds SQLQuery from the structured fields of dataRequest:
+// Table (default FIXED_TABLE), Columns or else the select list in spec, the
+// filters in spec and the year range. The spec is stored in Filter so the
+// query can be regenerated after the fields are edited. SQLQuery gets the
+// rendered query, the returned one with its args is what runs.
+func generateQuery(dataRequest *models.DataRequest, spec tools.QuerySpec) (tools.CompiledQuery, error) {
+	table := dataRequest.Table
+	if table == "" {
+		table = os.Getenv("FIXED_TABLE")
+	}
+	if table == "" {
+		return tools.CompiledQuery{}, errors.New("no table given and FIXED_TABLE not set")
+	}
+	if !tools.DefaultSQLPolicy().Tables[strings.ToLower(table)] {
+		return tools.CompiledQuery{}, fmt.Errorf("table %q may not be queried", table)
+	}
+
+	columns, err := tools.TableColumns(initializers.DB, table)
+	if err != nil || len(columns) == 0 {
+		return tools.CompiledQuery{}, errTableColumns
+	}
+
+	// Columns is what admins edit, so it wins over the select list of the spec
+	if dataRequest.Columns != "" {
+		spec.Select = nil
+		for _, column := range strings.Split(dataRequest.Columns, ",") {
+			if column = strings.TrimSpace(column); column != "" {
+				spec.Select = append(spec.Select, column)
+			}
+		}
+	}
+
+	// The year range is kept in YearFrom/YearTo, not in the stored spec
+	compiled := spec
+	graduationColumn := os.Getenv("GRADUATION_DATE_COLUMN")
+	if graduationColumn == "" {
+		graduationColumn = defaultGraduationColumn
+	}
+	years, err := tools.YearRangeFilter(graduationColumn, columns, dataRequest.YearFrom, dataRequest.YearTo)
+	if err != nil {
+		return tools.CompiledQuery{}, err
+	}
+	if years != nil {
+		if spec.Where != nil {
+			years.Groups = append(years.Groups, *spec.Where)
+		}
+		compiled.Where = years
+	}
+
+	query, err := compiled.Compile(table, columns)
+	if err != nil {
+		return tools.CompiledQuery{}, err
+	}
+	filter, err := json.Marshal(spec)
+	if err != nil {
+		return tools.CompiledQuery{}, err
+	}
+
+	dataRequest.Table = table
+	dataRequest.Columns = strings.Join(spec.Select, ",")
+	dataRequest.Filter = string(filter)
+	dataRequest.SQLQuery = query.Display
+	return query, nil
+}
+
+// requestQuery returns the SQL to run for dataRequest and its args. While
+// SQLQuery is still the query generated from the structured fields it runs
+// with its values as args; once edited by hand it runs as stored.
+func requestQuery(dataRequest models.DataRequest) (string, []interface{}) {
+	if dataRequest.Filter == "" && !hasQuerySpec(dataRequest, nil) {
+		return dataRequest.SQLQuery, nil
+	}
+	var spec tools.QuerySpec
+	if dataRequest.Filter != "" {
+		if err := json.Unmarshal([]byte(dataRequest.Filter), &spec); err != nil {
+			return dataRequest.SQLQuery, nil
+		}
+	}
+
+	// dataRequest is a copy, generating does not touch the caller's
+	stored := dataRequest.SQLQuery
+	query, err := generateQuery(&dataRequest, spec)
+	if err != nil || query.Display != stored {
+		return stored, nil
+	}
+	return query.SQL, query.Args
+}
+
+// respondGenerateError writes the response for an error from generateQuery
+func respondGenerateError(c *gin.Context, err error) {
+	if errors.Is(err, errTableColumns) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read table columns"})
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+}
+
+// RegenerateDataRequestQuery rebuilds the stored SQL of a data request from
+// its table, columns, year range and filter spec, replacing any manual edits.
+func RegenerateDataRequestQuery(c *gin.Context) {
+	id := c.Param("id")
+	var dataRequest models.DataRequest
+	if err := initializers.FlowDB.First(&dataRequest, "id = ?", id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Data request not found"})
+		return
+	}
+
+	var spec tools.QuerySpec
+	if dataRequest.Filter != "" {
+		if err := json.Unmarshal([]byte(dataRequest.Filter), &spec); err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Stored filter is not a valid query spec"})
+			return
+		}
+	}
+
+	previousSQL := dataRequest.SQLQuery
+	if _, err := generateQuery(&dataRequest, spec); err != nil {
+		respondGenerateError(c, err)
+		return
+	}
+	if err := initializers.FlowDB.Save(&dataRequest).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update data request"})
+		return
+	}
+
+	if previousSQL != dataRequest.SQLQuery {
+		admin := currentUser(c)
+		tools.RecordEvent(initializers.FlowDB, models.DataRequestEvent{
+			DataRequestID: dataRequest.ID,
+			Type:          models.EventSQLEdited,
+			FromValue:     previousSQL,
+			ToValue:       dataRequest.SQLQuery,
+			Note:          "Regenerated from filter",
+			ActorID:       &admin.ID,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "SQL regenerated successfully", "data": dataRequest})
+}
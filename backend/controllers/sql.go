@@ -1,11 +1,12 @@
 package controllers
 
 import (
-	"encoding/csv"
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
-	"path/filepath"
+	"path"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -16,79 +17,57 @@ import (
 
 func PostSQL(c *gin.Context) {
 	var body struct {
-		SQL string `json:"sql" binding:"required"`
+		SQL       string `json:"sql" binding:"required"`
+		Format    string `json:"format"`
+		RequestID string `json:"request_id"`
+		// MaskingProfile defaults to the data request's
+		MaskingProfile string `json:"masking_profile"`
 	}
 	if err := c.ShouldBindJSON(&body); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
 		return
 	}
 
-	if !tools.IsSelectOnly(body.SQL) {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only SELECT statements are allowed"})
+	if !allowQuery(c, body.SQL) {
 		return
 	}
 
-	// Execute query
-	rows, err := initializers.DB.Raw(body.SQL).Rows()
+	format, dataRequest, err := exportTarget(body.Format, body.RequestID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	defer rows.Close()
 
-	cols, err := rows.Columns()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	masking, ok := maskingFor(c, dataRequest, body.MaskingProfile)
+	if !ok {
 		return
 	}
 
-	// Prepare CSV file
-	name, err := tools.RandomName(16)
+	// Execute query and write the export file
+	admin := currentUser(c)
+	limits := tools.QueryLimitsForRole(admin.Role)
+	name, stats, err := tools.ExportQuery(c.Request.Context(), initializers.DB, initializers.Storage, body.SQL, nil, format, limits, masking, nil)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate file name"})
-		return
-	}
-	os.MkdirAll("uploads", os.ModePerm)
-	path := filepath.Join("uploads", fmt.Sprintf("req-%s.csv", name))
-	file, err := os.Create(path)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondQueryError(c, err)
 		return
 	}
-	defer file.Close()
-
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
 
-	// Write header
-	if err := writer.Write(cols); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	export := models.ExportFile{Name: name, Format: format, Rows: stats.Rows, CreatedBy: &admin.ID, MaskingProfile: masking.ProfileName()}
+	if dataRequest != nil {
+		export.DataRequestID = &dataRequest.ID
+	}
+	if err := tools.RecordExport(initializers.FlowDB, initializers.Storage, export); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record export"})
 		return
 	}
 
-	// Write rows
-	values := make([]interface{}, len(cols))
-	ptrs := make([]interface{}, len(cols))
-	for i := range values {
-		ptrs[i] = &values[i]
-	}
-	for rows.Next() {
-		if err := rows.Scan(ptrs...); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-		record := make([]string, len(cols))
-		for i, val := range values {
-			if val == nil {
-				record[i] = ""
-			} else {
-				record[i] = fmt.Sprint(val)
-			}
-		}
-		if err := writer.Write(record); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
+	if dataRequest != nil {
+		tools.RecordEvent(initializers.FlowDB, models.DataRequestEvent{
+			DataRequestID: dataRequest.ID,
+			Type:          models.EventExported,
+			Details:       name + "." + format,
+			ActorID:       &admin.ID,
+		})
 	}
 
 	// Post to request history
@@ -102,15 +81,115 @@ func PostSQL(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"csv_id": name})
+	c.JSON(http.StatusOK, gin.H{
+		"csv_id":     name,
+		"format":     format,
+		"rows":       stats.Rows,
+		"truncated":  stats.Truncated,
+		"timed_out":  stats.TimedOut,
+		"masking":    masking.ProfileName(),
+		"disclosure": stats.Disclosure,
+	})
 }
 
+// GetSQL downloads an export for an admin. ?format= re-encodes a CSV export
+// in another format. Requesters get signed links to GET /downloads/:name instead.
 func GetSQL(c *gin.Context) {
-	name := c.Param("name")
-	path := filepath.Join("uploads", fmt.Sprintf("req-%s.csv", name))
-	if _, err := os.Stat(path); os.IsNotExist(err) {
+	serveExport(c, c.Param("name"), c.Query("format"))
+}
+
+// serveExport sends export name as an attachment, converted from CSV when
+// format differs from the stored one. It reports whether the file was served.
+func serveExport(c *gin.Context, name, format string) bool {
+	ctx := c.Request.Context()
+	stored, found := tools.FindExport(ctx, initializers.Storage, name)
+	if !found {
 		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
-		return
+		return false
+	}
+
+	if format == "" || format == stored {
+		format = stored
+	} else {
+		var err error
+		if format, err = tools.NormalizeFormat(format); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return false
+		}
+	}
+	if format != stored && stored != "csv" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "This export is only available as " + stored})
+		return false
+	}
+
+	key := tools.ExportKey(name, stored)
+	if format == stored {
+		return serveObject(c, key)
+	}
+
+	file, _, err := initializers.Storage.Open(ctx, key)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	defer file.Close()
+
+	columns, _ := tools.TableColumns(initializers.DB, os.Getenv("FIXED_TABLE"))
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, tools.ExportKey(name, format)))
+	if err := tools.ConvertCSV(file, c.Writer, format, tools.ColumnTypes(columns)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// serveObject sends the stored object key as an attachment. It reports
+// whether the object was served.
+func serveObject(c *gin.Context, key string) bool {
+	file, info, err := initializers.Storage.Open(c.Request.Context(), key)
+	if errors.Is(err, tools.ErrObjectNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	defer file.Close()
+
+	c.DataFromReader(http.StatusOK, info.Size, tools.ContentType(key), file, map[string]string{
+		"Content-Disposition": fmt.Sprintf(`attachment; filename="%s"`, path.Base(key)),
+	})
+	return true
+}
+
+// allowQuery checks query against the SQL policy and writes the rejection
+// response when it is not allowed.
+func allowQuery(c *gin.Context, query string) bool {
+	err := tools.ValidateQuery(query, tools.DefaultSQLPolicy())
+	if err == nil {
+		return true
+	}
+
+	var violation *tools.SQLViolation
+	if errors.As(err, &violation) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Query rejected: " + violation.Error(), "violation": violation})
+		return false
+	}
+
+	c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	return false
+}
+
+// respondQueryError reports a failed tools.RunReadOnlyQuery call.
+func respondQueryError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, context.Canceled):
+		// The client went away, nobody is left to answer
+		c.Abort()
+	case errors.Is(err, tools.ErrQueryTimeout):
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "Query timed out", "timed_out": true})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 	}
-	c.FileAttachment(path, filepath.Base(path))
 }
@@ -0,0 +1,166 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"grad_deploy/initializers"
+	"grad_deploy/models"
+	"grad_deploy/tools"
+	"grad_deploy/utils"
+	"grad_deploy/workers"
+)
+
+type UpdateStatusRequest struct {
+	Status string `json:"status" binding:"required"`
+	Notes  string `json:"notes"`
+	// Notify queues the notification for the new status to the requester
+	Notify bool `json:"notify"`
+}
+
+// UpdateDataRequestStatus moves a data request to a new status if the
+// workflow allows it, recording the note and the acting admin
+func UpdateDataRequestStatus(c *gin.Context) {
+	id := c.Param("id")
+	var dataRequest models.DataRequest
+	if err := initializers.FlowDB.First(&dataRequest, "id = ?", id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Data request not found"})
+		return
+	}
+
+	var req UpdateStatusRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Status = strings.ToUpper(strings.TrimSpace(req.Status))
+	admin := currentUser(c)
+
+	// Same status with notes only adds a note to the timeline
+	if req.Status == dataRequest.Status && strings.TrimSpace(req.Notes) != "" {
+		tools.RecordEvent(initializers.FlowDB, models.DataRequestEvent{
+			DataRequestID: dataRequest.ID,
+			Type:          models.EventNote,
+			Note:          strings.TrimSpace(req.Notes),
+			ActorID:       &admin.ID,
+		})
+		c.JSON(http.StatusOK, gin.H{"message": "Note added successfully", "data": dataRequest})
+		return
+	}
+
+	if !checkTransition(c, dataRequest, req.Status, req.Notes) {
+		return
+	}
+
+	previous := dataRequest.Status
+	applyTransition(&dataRequest, req.Status, req.Notes, admin)
+	if !saveTransition(c, dataRequest, previous, nil) {
+		return
+	}
+	recordStatusChange(dataRequest, previous)
+
+	response := gin.H{"message": "Status updated successfully", "data": dataRequest}
+	if req.Notify {
+		if templateID, ok := utils.TemplateForStatus(dataRequest.Status); ok {
+			// Link the download once there is one, otherwise the tracking page
+			url := exportURL(dataRequest)
+			if url == "" {
+				url = trackingURL(dataRequest)
+			}
+			email, err := requestEmail(dataRequest, templateID, url)
+			email.QueuedBy = &admin.ID
+			if err == nil {
+				err = workers.QueueEmail(&email)
+			}
+			if err != nil {
+				response["email_error"] = err.Error()
+			} else {
+				response["email_id"] = email.ID
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// checkTransition validates a status change against the workflow and writes
+// the error response when it is not allowed.
+func checkTransition(c *gin.Context, dataRequest models.DataRequest, status, notes string) bool {
+	if !models.IsValidStatus(status) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown status " + status})
+		return false
+	}
+
+	if err := models.CheckTransition(dataRequest.Status, status); err != nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   err.Error(),
+			"from":    dataRequest.Status,
+			"to":      status,
+			"allowed": models.AllowedTransitions(dataRequest.Status),
+		})
+		return false
+	}
+
+	if models.StatusRequiresNote(status) && strings.TrimSpace(notes) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Notes are required when changing status to " + status})
+		return false
+	}
+
+	return true
+}
+
+// saveTransition stores the change applyTransition made, and the columns in
+// fields, only while the request is still in the previous status. When another
+// admin changed it first nothing is written and it answers 409.
+func saveTransition(c *gin.Context, dataRequest models.DataRequest, previous string, fields map[string]interface{}) bool {
+	updates := map[string]interface{}{
+		"status":            dataRequest.Status,
+		"status_note":       dataRequest.StatusNote,
+		"status_changed_by": dataRequest.StatusChangedBy,
+		"status_changed_at": dataRequest.StatusChangedAt,
+	}
+	for column, value := range fields {
+		updates[column] = value
+	}
+
+	result := initializers.FlowDB.Model(&models.DataRequest{}).
+		Where("id = ? AND status = ?", dataRequest.ID, previous).
+		Updates(updates)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update status"})
+		return false
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Data request is no longer " + previous + ", it was changed meanwhile",
+			"from":  previous,
+			"to":    dataRequest.Status,
+		})
+		return false
+	}
+	return true
+}
+
+// recordStatusChange adds the change applyTransition made to the timeline
+func recordStatusChange(dataRequest models.DataRequest, previous string) {
+	tools.RecordEvent(initializers.FlowDB, models.DataRequestEvent{
+		DataRequestID: dataRequest.ID,
+		Type:          models.EventStatusChanged,
+		FromValue:     previous,
+		ToValue:       dataRequest.Status,
+		Note:          dataRequest.StatusNote,
+		ActorID:       dataRequest.StatusChangedBy,
+	})
+}
+
+// applyTransition sets the new status on dataRequest without saving it
+func applyTransition(dataRequest *models.DataRequest, status, notes string, admin models.User) {
+	now := time.Now()
+	dataRequest.Status = status
+	dataRequest.StatusNote = strings.TrimSpace(notes)
+	dataRequest.StatusChangedBy = &admin.ID
+	dataRequest.StatusChangedAt = &now
+}
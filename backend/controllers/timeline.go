@@ -0,0 +1,78 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"grad_deploy/initializers"
+	"grad_deploy/models"
+)
+
+// TimelineActor is the admin behind a timeline event
+type TimelineActor struct {
+	ID    uuid.UUID `json:"id"`
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+}
+
+type TimelineEntry struct {
+	models.DataRequestEvent
+	Actor *TimelineActor `json:"actor"`
+}
+
+// GetDataRequestTimeline returns every recorded event of a data request, oldest first
+func GetDataRequestTimeline(c *gin.Context) {
+	id := c.Param("id")
+	var dataRequest models.DataRequest
+	if err := initializers.FlowDB.First(&dataRequest, "id = ?", id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Data request not found"})
+		return
+	}
+
+	timeline, err := loadTimeline(dataRequest.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch timeline"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"timeline": timeline})
+}
+
+func loadTimeline(dataRequestID uuid.UUID) ([]TimelineEntry, error) {
+	var events []models.DataRequestEvent
+	err := initializers.FlowDB.Where("data_request_id = ?", dataRequestID).
+		Order("created_at ASC").
+		Find(&events).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// Look up the acting admins in one query
+	actorIDs := make([]uuid.UUID, 0)
+	for _, event := range events {
+		if event.ActorID != nil {
+			actorIDs = append(actorIDs, *event.ActorID)
+		}
+	}
+	actors := make(map[uuid.UUID]*TimelineActor)
+	if len(actorIDs) > 0 {
+		var users []models.User
+		if err := initializers.FlowDB.Where("id IN ?", actorIDs).Find(&users).Error; err != nil {
+			return nil, err
+		}
+		for _, user := range users {
+			actors[user.ID] = &TimelineActor{ID: user.ID, Name: user.Name, Email: user.Email}
+		}
+	}
+
+	timeline := make([]TimelineEntry, len(events))
+	for i, event := range events {
+		timeline[i] = TimelineEntry{DataRequestEvent: event}
+		if event.ActorID != nil {
+			timeline[i].Actor = actors[*event.ActorID]
+		}
+	}
+	return timeline, nil
+}
@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"grad_deploy/initializers"
+	"grad_deploy/models"
+	"grad_deploy/tools"
+)
+
+// trackedEvents are the timeline events a requester may see. Notes, SQL
+// edits and export file names stay internal.
+var trackedEvents = []string{models.EventCreated, models.EventStatusChanged, models.EventEmailSent}
+
+// TrackedRequest is the part of a data request shown to its requester.
+// It deliberately leaves out NIM, phone number, email and the SQL.
+type TrackedRequest struct {
+	ID              string     `json:"id"`
+	Status          string     `json:"status"`
+	StatusNote      string     `json:"status_note,omitempty"`
+	Purpose         string     `json:"purpose"`
+	Format          string     `json:"format"`
+	CreatedAt       time.Time  `json:"created_at"`
+	StatusChangedAt *time.Time `json:"status_changed_at"`
+	FulfilledAt     *time.Time `json:"fulfilled_at"`
+}
+
+// TrackedEvent is a timeline entry shown to the requester
+type TrackedEvent struct {
+	Type      string    `json:"type"`
+	From      string    `json:"from,omitempty"`
+	To        string    `json:"to,omitempty"`
+	Note      string    `json:"note,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// GetTrackedRequest shows the status, timeline and, once completed, the
+// download link of the data request a tracking token belongs to.
+func GetTrackedRequest(c *gin.Context) {
+	id, err := tools.ParseTrackingToken(c.Param("token"))
+	var dataRequest models.DataRequest
+	if err == nil {
+		err = initializers.FlowDB.First(&dataRequest, "id = ?", id).Error
+	}
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Data request not found"})
+		return
+	}
+
+	var events []models.DataRequestEvent
+	err = initializers.FlowDB.Where("data_request_id = ? AND type IN ?", dataRequest.ID, trackedEvents).
+		Order("created_at ASC").
+		Find(&events).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch timeline"})
+		return
+	}
+
+	timeline := make([]TrackedEvent, len(events))
+	for i, event := range events {
+		timeline[i] = TrackedEvent{Type: event.Type, CreatedAt: event.CreatedAt}
+		if event.Type == models.EventStatusChanged {
+			timeline[i].From = event.FromValue
+			timeline[i].To = event.ToValue
+			timeline[i].Note = event.Note
+		}
+	}
+
+	response := gin.H{
+		"request": TrackedRequest{
+			ID:              dataRequest.ID.String(),
+			Status:          dataRequest.Status,
+			StatusNote:      dataRequest.StatusNote,
+			Purpose:         dataRequest.Purpose,
+			Format:          dataRequest.Format,
+			CreatedAt:       dataRequest.CreatedAt,
+			StatusChangedAt: dataRequest.StatusChangedAt,
+			FulfilledAt:     dataRequest.FulfilledAt,
+		},
+		"timeline": timeline,
+	}
+	if dataRequest.Status == models.StatusCompleted && dataRequest.ExportName != "" {
+		if _, ok := downloadableExport(dataRequest.ExportName); ok {
+			// Not bound to the requester, so the link doesn't reveal their address
+			response["download_url"] = tools.NewDownloadURL(os.Getenv("BASE_URL"), dataRequest.ExportName, dataRequest.ExportFormat, "")
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// downloadableExport loads the recorded export called name and reports
+// whether it can still be downloaded, i.e. was neither revoked nor purged
+func downloadableExport(name string) (models.ExportFile, bool) {
+	var export models.ExportFile
+	if err := initializers.FlowDB.First(&export, "name = ?", name).Error; err != nil {
+		return models.ExportFile{}, false
+	}
+	return export, export.RevokedAt == nil && export.PurgedAt == nil
+}
@@ -0,0 +1,386 @@
+package controllers
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"grad_deploy/initializers"
+	"grad_deploy/models"
+	"grad_deploy/tools"
+	"grad_deploy/utils"
+	"grad_deploy/workers"
+)
+
+// accountURL is the frontend page for an invitation or reset token, under the
+// base URL in env, or "" when it is not configured
+func accountURL(env, token string) string {
+	base := os.Getenv(env)
+	if base == "" {
+		return ""
+	}
+	return strings.TrimSuffix(base, "/") + "/" + token
+}
+
+// queueAccountEmail queues template id to user with a link to url that expires at expires
+func queueAccountEmail(id, language string, user models.User, url string, expires time.Time, queuedBy *uuid.UUID) (models.EmailHistory, error) {
+	data, err := utils.RenderAccountEmail(id, language, user, url, expires)
+	if err != nil {
+		return models.EmailHistory{}, err
+	}
+	email := models.EmailHistory{
+		To:       data.To,
+		Name:     data.Name,
+		Subject:  data.Subject,
+		Body:     data.Body,
+		URL:      data.URL,
+		Button:   data.Button,
+		Language: data.Language,
+		Template: id,
+		QueuedBy: queuedBy,
+	}
+	return email, workers.QueueEmail(&email)
+}
+
+// inviteUser gives user a new invitation and queues the email with its link.
+// Any earlier invitation stops working.
+func inviteUser(user *models.User, language string, admin models.User) (models.EmailHistory, error) {
+	token := uuid.New()
+	now := time.Now()
+	user.VerificationToken = &token
+	user.InvitedAt = &now
+	user.InvitedBy = &admin.ID
+	err := initializers.FlowDB.Model(user).Updates(map[string]interface{}{
+		"verification_token": user.VerificationToken,
+		"invited_at":         user.InvitedAt,
+		"invited_by":         user.InvitedBy,
+	}).Error
+	if err != nil {
+		return models.EmailHistory{}, err
+	}
+	return queueAccountEmail(utils.TemplateAccountInvite, language, *user, accountURL("INVITE_URL", token.String()), now.Add(tools.InviteTTL()), &admin.ID)
+}
+
+// sendPasswordReset gives user a new one-time reset token and queues the
+// email with its link. Any earlier token stops working.
+func sendPasswordReset(user *models.User, language string, queuedBy *uuid.UUID) (models.EmailHistory, error) {
+	token, hash, err := tools.NewResetToken()
+	if err != nil {
+		return models.EmailHistory{}, err
+	}
+	expires := time.Now().Add(tools.PasswordResetTTL())
+	user.ResetTokenHash = hash
+	user.ResetExpiresAt = &expires
+	err = initializers.FlowDB.Model(user).Updates(map[string]interface{}{
+		"reset_token_hash": hash,
+		"reset_expires_at": &expires,
+	}).Error
+	if err != nil {
+		return models.EmailHistory{}, err
+	}
+	return queueAccountEmail(utils.TemplatePasswordReset, language, *user, accountURL("PASSWORD_RESET_URL", token), expires, queuedBy)
+}
+
+// findUser loads the user in the :id parameter, writing the 404 response when there is none
+func findUser(c *gin.Context) (models.User, bool) {
+	var user models.User
+	if err := initializers.FlowDB.First(&user, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return user, false
+	}
+	return user, true
+}
+
+// emailTaken reports whether another account than id already uses email
+func emailTaken(email string, id uuid.UUID) bool {
+	var count int64
+	initializers.FlowDB.Model(&models.User{}).Where("LOWER(email) = ? AND id <> ?", email, id).Count(&count)
+	return count > 0
+}
+
+// GetUsers lists the accounts, optionally only those with ?role=
+func GetUsers(c *gin.Context) {
+	query := initializers.FlowDB.Order("name")
+	if role := strings.ToUpper(c.Query("role")); role != "" {
+		query = query.Where("role = ?", role)
+	}
+
+	var users []models.User
+	if err := query.Find(&users).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch users"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": users})
+}
+
+func GetUserByID(c *gin.Context) {
+	user, ok := findUser(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": user})
+}
+
+type CreateUserRequest struct {
+	Name  string `json:"name" binding:"required"`
+	Email string `json:"email" binding:"required,email"`
+	Role  string `json:"role" binding:"omitempty,oneof=ADMIN USER"`
+	// Password creates a verified account right away; without one the
+	// account is invited by email to set its own. It needs at least
+	// tools.MinPasswordLength characters.
+	Password string `json:"password"`
+	// Language of the invitation email
+	Language string `json:"language"`
+}
+
+// CreateUser adds an account, either with a password or by invitation
+func CreateUser(c *gin.Context) {
+	var req CreateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Password != "" && !validPassword(c, req.Password) {
+		return
+	}
+	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+	if req.Role == "" {
+		req.Role = models.RoleUser
+	}
+	if req.Password == "" && os.Getenv("INVITE_URL") == "" {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "INVITE_URL not configured"})
+		return
+	}
+	if emailTaken(req.Email, uuid.Nil) {
+		c.JSON(http.StatusConflict, gin.H{"error": "An account with this email already exists"})
+		return
+	}
+
+	user := models.User{ID: uuid.New(), Name: strings.TrimSpace(req.Name), Email: req.Email, Role: req.Role}
+	if req.Password != "" {
+		hash, err := tools.HashPassword(req.Password)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+			return
+		}
+		now := time.Now()
+		user.Password = hash
+		user.VerifiedAt = &now
+		user.PasswordChangedAt = &now
+	}
+	if err := initializers.FlowDB.Create(&user).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		return
+	}
+
+	response := gin.H{"message": "User created"}
+	if req.Password == "" {
+		// The account exists either way, so failing to queue the invitation is reported rather than fatal
+		if email, err := inviteUser(&user, req.Language, currentUser(c)); err != nil {
+			response["email_error"] = err.Error()
+		} else {
+			response["email_id"] = email.ID
+		}
+	}
+	response["data"] = user
+	c.JSON(http.StatusCreated, response)
+}
+
+type UpdateUserRequest struct {
+	Name  string `json:"name"`
+	Email string `json:"email" binding:"omitempty,email"`
+	Role  string `json:"role" binding:"omitempty,oneof=ADMIN USER"`
+}
+
+// UpdateUserByID changes the name, email or role of an account. Admins
+// cannot take away their own role.
+func UpdateUserByID(c *gin.Context) {
+	user, ok := findUser(c)
+	if !ok {
+		return
+	}
+	var req UpdateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	admin := currentUser(c)
+	if req.Role != "" && req.Role != user.Role && user.ID == admin.ID {
+		c.JSON(http.StatusConflict, gin.H{"error": "You cannot change your own role"})
+		return
+	}
+	if email := strings.ToLower(strings.TrimSpace(req.Email)); email != "" {
+		if emailTaken(email, user.ID) {
+			c.JSON(http.StatusConflict, gin.H{"error": "An account with this email already exists"})
+			return
+		}
+		user.Email = email
+	}
+	if name := strings.TrimSpace(req.Name); name != "" {
+		user.Name = name
+	}
+	if req.Role != "" {
+		user.Role = req.Role
+	}
+
+	err := initializers.FlowDB.Model(&user).Updates(map[string]interface{}{
+		"name":  user.Name,
+		"email": user.Email,
+		"role":  user.Role,
+	}).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User updated", "data": user})
+}
+
+// DeleteUserByID removes an account other than the caller's
+func DeleteUserByID(c *gin.Context) {
+	user, ok := findUser(c)
+	if !ok {
+		return
+	}
+	if user.ID == currentUser(c).ID {
+		c.JSON(http.StatusConflict, gin.H{"error": "You cannot delete your own account"})
+		return
+	}
+	if err := initializers.FlowDB.Delete(&user).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete user"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User deleted"})
+}
+
+// DisableUser stops an account other than the caller's from logging in or
+// using its tokens, and drops its pending password reset
+func DisableUser(c *gin.Context) {
+	user, ok := findUser(c)
+	if !ok {
+		return
+	}
+	admin := currentUser(c)
+	if user.ID == admin.ID {
+		c.JSON(http.StatusConflict, gin.H{"error": "You cannot disable your own account"})
+		return
+	}
+
+	if !user.Disabled() {
+		now := time.Now()
+		user.DisabledAt = &now
+		user.DisabledBy = &admin.ID
+		user.ResetTokenHash = ""
+		user.ResetExpiresAt = nil
+		err := initializers.FlowDB.Model(&user).Updates(map[string]interface{}{
+			"disabled_at":      user.DisabledAt,
+			"disabled_by":      user.DisabledBy,
+			"reset_token_hash": "",
+			"reset_expires_at": nil,
+		}).Error
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable user"})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User disabled", "data": user})
+}
+
+// EnableUser lets a disabled account log in again
+func EnableUser(c *gin.Context) {
+	user, ok := findUser(c)
+	if !ok {
+		return
+	}
+	user.DisabledAt = nil
+	user.DisabledBy = nil
+	err := initializers.FlowDB.Model(&user).Updates(map[string]interface{}{"disabled_at": nil, "disabled_by": nil}).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable user"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User enabled", "data": user})
+}
+
+type AccountEmailRequest struct {
+	Language string `json:"language"`
+}
+
+// bindAccountEmail reads the optional body of the endpoints that email an account
+func bindAccountEmail(c *gin.Context) (AccountEmailRequest, bool) {
+	var req AccountEmailRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return req, false
+		}
+	}
+	return req, true
+}
+
+// ResendInvitation sends a new invitation to an account that has not set a password yet
+func ResendInvitation(c *gin.Context) {
+	user, ok := findUser(c)
+	if !ok {
+		return
+	}
+	req, ok := bindAccountEmail(c)
+	if !ok {
+		return
+	}
+	if user.VerifiedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "This account has already accepted its invitation"})
+		return
+	}
+	if user.Disabled() {
+		c.JSON(http.StatusConflict, gin.H{"error": "This account is disabled"})
+		return
+	}
+	if os.Getenv("INVITE_URL") == "" {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "INVITE_URL not configured"})
+		return
+	}
+
+	email, err := inviteUser(&user, req.Language, currentUser(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send invitation: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "Invitation sent", "email_id": email.ID, "data": user})
+}
+
+// PostUserPasswordReset emails an account a link to choose a new password
+func PostUserPasswordReset(c *gin.Context) {
+	user, ok := findUser(c)
+	if !ok {
+		return
+	}
+	req, ok := bindAccountEmail(c)
+	if !ok {
+		return
+	}
+	if user.VerifiedAt == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "This account has not accepted its invitation yet"})
+		return
+	}
+	if user.Disabled() {
+		c.JSON(http.StatusConflict, gin.H{"error": "This account is disabled"})
+		return
+	}
+	if os.Getenv("PASSWORD_RESET_URL") == "" {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "PASSWORD_RESET_URL not configured"})
+		return
+	}
+
+	admin := currentUser(c)
+	email, err := sendPasswordReset(&user, req.Language, &admin.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send password reset: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "Password reset sent", "email_id": email.ID})
+}
@@ -0,0 +1,15 @@
+package initializers
+
+import (
+	"log"
+
+	"grad_deploy/tools"
+)
+
+// CheckSecrets stops the server when a signing secret is missing or too
+// short, rather than issue tokens and links anyone could forge
+func CheckSecrets() {
+	if err := tools.CheckSecrets(); err != nil {
+		log.Fatal("Invalid secrets: " + err.Error())
+	}
+}
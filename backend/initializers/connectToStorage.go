@@ -0,0 +1,18 @@
+package initializers
+
+import (
+	"log"
+
+	"grad_deploy/tools"
+)
+
+// Storage holds exports and uploads, see tools.NewStorage
+var Storage tools.Storage
+
+func ConnectToStorage() {
+	var err error
+	Storage, err = tools.NewStorage()
+	if err != nil {
+		log.Fatal("Failed to set up storage: " + err.Error())
+	}
+}
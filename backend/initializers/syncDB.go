@@ -7,5 +7,11 @@ func SyncDatabase() {
 		&models.User{},
 		&models.DataRequest{},
 		&models.AdminLog{},
+		&models.ExportJob{},
+		&models.DataRequestEvent{},
+		&models.EmailHistory{},
+		&models.ExportFile{},
+		&models.ExportDownload{},
+		&models.ProtectedDelivery{},
 	)
 }
@@ -9,13 +9,26 @@ import (
 
 	"grad_deploy/controllers"
 	"grad_deploy/initializers"
+	"grad_deploy/middlewares"
+	"grad_deploy/workers"
 )
 
 func main() {
 	initializers.LoadEnv()
+	initializers.CheckSecrets()
 	initializers.ConnectToDb()
+	initializers.ConnectToStorage()
 	initializers.SyncDatabase()
+	workers.StartExportWorkers()
+	workers.StartEmailWorker()
+	workers.StartExportJanitor()
 
+	r := setupRouter()
+
+	log.Fatal(r.Run())
+}
+
+func setupRouter() *gin.Engine {
 	// Konfigurasi CORS dengan withCredentials
 	config := cors.DefaultConfig()
 	config.AllowAllOrigins = true // Mengizinkan semua origin
@@ -27,30 +40,81 @@ func main() {
 
 	r.Use(cors.New(config))
 
+	// Public routes: login, request submission and what requesters need around it.
+	// The ones that queue an email are rate limited per IP.
+	limited := middlewares.PublicRateLimit()
 	r.POST("/login", controllers.Login)
-	r.POST("/sql", controllers.PostSQL)
-	// Register SQL preview endpoint
-	r.POST("/sql/preview", controllers.PostSQLPreview)
-	r.GET("/sql/:name", controllers.GetSQL)
 	r.GET("/table-info", controllers.GetTableInfo)
-	r.POST("/email", controllers.PostEmail)
+	r.POST("/data-requests/", limited, controllers.NewDataRequest)
+	r.POST("/data-requests/simple", limited, controllers.NewSimpleDataRequest)
+	r.GET("/track/:token", controllers.GetTrackedRequest)
+	r.GET("/downloads/:name", controllers.GetDownload)
+	r.GET("/files/*key", controllers.GetFile)
+	r.GET("/invitations/:token", controllers.GetInvitation)
+	r.POST("/invitations/:token", controllers.AcceptInvitation)
+	r.POST("/password-reset", limited, controllers.RequestPasswordReset)
+	r.POST("/password-reset/:token", controllers.ResetPassword)
+
+	// Everything below requires a valid token belonging to an ADMIN
+	admin := r.Group("/", middlewares.RequireAuth, middlewares.RequireAdmin)
+
+	admin.POST("/sql", controllers.PostSQL)
+	admin.GET("/sql/:name", controllers.GetSQL)
+	// Register SQL preview endpoint
+	admin.POST("/sql/preview", controllers.PostSQLPreview)
+	admin.POST("/email", controllers.PostEmail)
+	admin.GET("/emails", controllers.GetEmails)
+	admin.GET("/emails/templates", controllers.GetEmailTemplates)
+	admin.POST("/emails/preview", controllers.PostEmailPreview)
+	// Background export jobs
+	admin.POST("/exports", controllers.PostExport)
+	admin.GET("/exports/:id", controllers.GetExport)
+	// Export files, their retention and signed download links
+	admin.GET("/export-files", controllers.GetExportFiles)
+	admin.GET("/export-files/:name", controllers.GetExportFile)
+	admin.POST("/export-files/:name/pin", controllers.PinExportFile)
+	admin.DELETE("/export-files/:name/pin", controllers.UnpinExportFile)
+	admin.POST("/export-files/:name/revoke", controllers.RevokeExportFile)
+	admin.POST("/export-files/:name/links", controllers.PostDownloadLink)
+	admin.POST("/export-files/:name/protect", controllers.PostProtectExport)
+	admin.GET("/export-files/:name/password", controllers.GetExportPassword)
+	// Masking profiles and the one suggested for a purpose
+	admin.GET("/masking-profiles", controllers.GetMaskingProfiles)
+
 	// Analytics endpoints
-	r.GET("/analytics", controllers.GetAnalytics)
-	r.GET("/analytics/filtered", controllers.GetAnalyticsFiltered)
-	// r.GET("/request-history", controllers.GetRequestHistory)
+	admin.GET("/analytics", controllers.GetAnalytics)
+	admin.GET("/analytics/filtered", controllers.GetAnalyticsFiltered)
+	// admin.GET("/request-history", controllers.GetRequestHistory)
 
-	dataRequests := r.Group("/data-requests")
+	dataRequests := admin.Group("/data-requests")
 	{
-		dataRequests.POST("/", controllers.NewDataRequest)
-		dataRequests.POST("/simple", controllers.NewSimpleDataRequest)
 		dataRequests.GET("/", controllers.GetAllDataRequests)
 		dataRequests.GET("/filter", controllers.GetFilteredDataRequests)
 		dataRequests.GET("/:id", controllers.GetDataRequestByID)
 		dataRequests.PUT("/:id", controllers.UpdateDataRequestByID)
 		dataRequests.DELETE("/:id", controllers.DeleteDataRequestByID)
+		dataRequests.POST("/:id/regenerate", controllers.RegenerateDataRequestQuery)
+		dataRequests.PUT("/:id/status", controllers.UpdateDataRequestStatus)
+		dataRequests.GET("/:id/timeline", controllers.GetDataRequestTimeline)
+		dataRequests.POST("/:id/fulfil", controllers.FulfilDataRequest)
+		dataRequests.PUT("/:id/masking", controllers.UpdateDataRequestMasking)
+		dataRequests.GET("/:id/disclosure", controllers.GetDataRequestDisclosure)
+	}
+
+	users := admin.Group("/users")
+	{
+		users.GET("/", controllers.GetUsers)
+		users.POST("/", controllers.CreateUser)
+		users.GET("/:id", controllers.GetUserByID)
+		users.PUT("/:id", controllers.UpdateUserByID)
+		users.DELETE("/:id", controllers.DeleteUserByID)
+		users.POST("/:id/disable", controllers.DisableUser)
+		users.POST("/:id/enable", controllers.EnableUser)
+		users.POST("/:id/invite", controllers.ResendInvitation)
+		users.POST("/:id/reset-password", controllers.PostUserPasswordReset)
 	}
 
-	adminLogs := r.Group("/admin-logs")
+	adminLogs := admin.Group("/admin-logs")
 	{
 		adminLogs.POST("/", controllers.CreateAdminLog)
 		adminLogs.GET("/", controllers.GetAdminLogs)
@@ -59,5 +123,5 @@ func main() {
 		adminLogs.PUT("/:id", controllers.UpdateAdminLogByID)
 	}
 
-	log.Fatal(r.Run())
+	return r
 }
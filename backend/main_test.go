@@ -0,0 +1,1175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"grad_deploy/initializers"
+	"grad_deploy/models"
+	"grad_deploy/tools"
+)
+
+// publicRoutes lists every route that may be called without a token.
+// Any route registered in setupRouter that is not listed here must be admin-only.
+var publicRoutes = map[string]bool{
+	"POST /login":                 true,
+	"GET /table-info":             true,
+	"POST /data-requests/":        true,
+	"POST /data-requests/simple":  true,
+	"GET /track/:token":           true,
+	"GET /downloads/:name":        true,
+	"GET /files/*key":             true,
+	"GET /invitations/:token":     true,
+	"POST /invitations/:token":    true,
+	"POST /password-reset":        true,
+	"POST /password-reset/:token": true,
+}
+
+type testCaller struct {
+	name  string
+	token string
+}
+
+// setupTestDB points both databases at an in-memory SQLite database holding
+// one ADMIN and one USER account, and returns tokens for them.
+func setupTestDB(t *testing.T) (adminToken, userToken string) {
+	t.Helper()
+	t.Setenv("JWT_SECRET", "test-secret")
+
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open sqlite: %v", err)
+	}
+	err = db.Exec(`CREATE TABLE users (
+		id TEXT PRIMARY KEY, name TEXT, email TEXT UNIQUE, role TEXT,
+		password TEXT, verified_at DATETIME, verification_token TEXT,
+		invited_at DATETIME, invited_by TEXT, disabled_at DATETIME, disabled_by TEXT,
+		password_changed_at DATETIME, reset_token_hash TEXT, reset_expires_at DATETIME)`).Error
+	if err != nil {
+		t.Fatalf("create users: %v", err)
+	}
+	initializers.DB = db
+	initializers.FlowDB = db
+	initializers.Storage = &tools.LocalStorage{Dir: t.TempDir()}
+
+	adminID, userID := uuid.New(), uuid.New()
+	db.Exec("INSERT INTO users (id, name, email, role) VALUES (?, 'Admin', 'admin@example.com', 'ADMIN')", adminID)
+	db.Exec("INSERT INTO users (id, name, email, role) VALUES (?, 'User', 'user@example.com', 'USER')", userID)
+
+	return newTestToken(t, adminID, "ADMIN", time.Hour), newTestToken(t, userID, "USER", time.Hour)
+}
+
+func newTestToken(t *testing.T, id uuid.UUID, role string, ttl time.Duration) string {
+	t.Helper()
+	token, err := tools.NewAccessToken(tools.UserClaims{
+		Id:             id,
+		Role:           role,
+		StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(ttl).Unix()},
+	})
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+	return token
+}
+
+func doRequest(r *gin.Engine, method, path, token string) int {
+	req := httptest.NewRequest(method, path, strings.NewReader(""))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+func isAuthError(code int) bool {
+	return code == http.StatusUnauthorized || code == http.StatusForbidden
+}
+
+func TestRouteAuthorization(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	adminToken, userToken := setupTestDB(t)
+	r := setupRouter()
+
+	callers := []testCaller{{"anonymous", ""}, {"USER", userToken}, {"ADMIN", adminToken}}
+
+	for _, route := range r.Routes() {
+		key := route.Method + " " + route.Path
+		path := strings.NewReplacer(":id", uuid.Nil.String(), ":name", "missing").Replace(route.Path)
+
+		for _, caller := range callers {
+			t.Run(fmt.Sprintf("%s as %s", key, caller.name), func(t *testing.T) {
+				code := doRequest(r, route.Method, path, caller.token)
+
+				switch {
+				case publicRoutes[key]:
+					if isAuthError(code) {
+						t.Errorf("public route returned %d", code)
+					}
+				case caller.name == "anonymous":
+					if code != http.StatusUnauthorized {
+						t.Errorf("want 401, got %d", code)
+					}
+				case caller.name == "USER":
+					if code != http.StatusForbidden {
+						t.Errorf("want 403, got %d", code)
+					}
+				default:
+					if isAuthError(code) {
+						t.Errorf("admin was refused with %d", code)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestRejectedTokens(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	adminToken, _ := setupTestDB(t)
+	r := setupRouter()
+
+	expired := newTestToken(t, uuid.New(), "ADMIN", -time.Hour)
+	unknownUser := newTestToken(t, uuid.New(), "ADMIN", time.Hour)
+
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, tools.UserClaims{Role: "ADMIN"}).
+		SignedString([]byte("another-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]string{
+		"garbage":      "not-a-jwt",
+		"expired":      expired,
+		"unknown user": unknownUser,
+		"forged":       forged,
+	}
+	for name, token := range cases {
+		t.Run(name, func(t *testing.T) {
+			if code := doRequest(r, http.MethodGet, "/analytics", token); code != http.StatusUnauthorized {
+				t.Errorf("want 401, got %d", code)
+			}
+		})
+	}
+
+	t.Run("missing bearer prefix", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/analytics", nil)
+		req.Header.Set("Authorization", adminToken)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("want 401, got %d", w.Code)
+		}
+	})
+}
+
+func TestTrackRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestDB(t)
+	t.Setenv("BASE_URL", "http://localhost:8080")
+	r := setupRouter()
+
+	db := initializers.FlowDB
+	err := db.Exec(`CREATE TABLE data_requests (
+		id TEXT PRIMARY KEY, name TEXT, nim TEXT, phone_number TEXT, email TEXT, format TEXT,
+		purpose TEXT, status TEXT, status_note TEXT, sql_query TEXT, export_name TEXT, created_at DATETIME)`).Error
+	if err == nil {
+		err = db.Exec(`CREATE TABLE data_request_events (
+			id TEXT PRIMARY KEY, data_request_id TEXT, type TEXT, from_value TEXT, to_value TEXT,
+			note TEXT, details TEXT, actor_id TEXT, created_at DATETIME)`).Error
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	createExportTables(t, db)
+
+	id := uuid.New()
+	db.Exec(`INSERT INTO data_requests VALUES (?, 'Siti', '13519999', '081234567890', 'siti@example.com', 'CSV',
+		'Skripsi', 'COMPLETED', '', 'SELECT * FROM alumni', 'abc123', ?)`, id, time.Now())
+	db.Exec(`INSERT INTO export_files (name, format, created_at) VALUES ('abc123', 'csv', ?)`, time.Now())
+	events := [][]string{
+		{"CREATED", "", "PENDING", ""},
+		{"NOTE", "", "", "internal remark"},
+		{"SQL_EDITED", "", "SELECT nim FROM alumni", ""},
+		{"STATUS_CHANGED", "PENDING", "COMPLETED", ""},
+	}
+	for i, e := range events {
+		db.Exec(`INSERT INTO data_request_events VALUES (?, ?, ?, ?, ?, ?, '', NULL, ?)`,
+			uuid.New(), id, e[0], e[1], e[2], e[3], time.Now().Add(time.Duration(i)*time.Second))
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/track/"+tools.TrackingToken(id), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d: %s", w.Code, w.Body)
+	}
+	body := w.Body.String()
+	for _, secret := range []string{"13519999", "081234567890", "siti@example.com", "SELECT", "internal remark"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("response exposes %q: %s", secret, body)
+		}
+	}
+	for _, want := range []string{`"status":"COMPLETED"`, "http://localhost:8080/downloads/abc123?", "STATUS_CHANGED"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("response lacks %q: %s", want, body)
+		}
+	}
+
+	// No link to an export that was revoked, or that was never recorded
+	db.Exec(`UPDATE export_files SET revoked_at = ? WHERE name = 'abc123'`, time.Now())
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/track/"+tools.TrackingToken(id), nil))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "download_url") {
+		t.Errorf("revoked export: got %d: %s", w.Code, w.Body)
+	}
+	db.Exec(`DELETE FROM export_files`)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/track/"+tools.TrackingToken(id), nil))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "download_url") {
+		t.Errorf("unrecorded export: got %d: %s", w.Code, w.Body)
+	}
+
+	for _, token := range []string{id.String(), "garbage", tools.TrackingToken(uuid.New())} {
+		if code := doRequest(r, http.MethodGet, "/track/"+token, ""); code != http.StatusNotFound {
+			t.Errorf("token %q: want 404, got %d", token, code)
+		}
+	}
+}
+
+// createExportTables creates the tables recording exports, their downloads
+// and deliveries
+func createExportTables(t *testing.T, db *gorm.DB) {
+	t.Helper()
+	err := db.Exec(`CREATE TABLE export_files (
+		name TEXT PRIMARY KEY, format TEXT, rows INTEGER DEFAULT 0, size INTEGER DEFAULT 0,
+		data_request_id TEXT, created_by TEXT, created_at DATETIME, expires_at DATETIME,
+		pinned BOOLEAN DEFAULT false, pinned_by TEXT, purged_at DATETIME, revoked_at DATETIME, revoked_by TEXT,
+		download_count INTEGER DEFAULT 0, last_downloaded_at DATETIME,
+		protected BOOLEAN DEFAULT false, source_name TEXT, password TEXT, masking_profile TEXT)`).Error
+	if err == nil {
+		err = db.Exec(`CREATE TABLE export_downloads (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, export_name TEXT, format TEXT, recipient TEXT,
+			ip TEXT, user_agent TEXT, created_at DATETIME)`).Error
+	}
+	if err == nil {
+		err = db.Exec(`CREATE TABLE protected_deliveries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, export_name TEXT, data_request_id TEXT, recipient TEXT,
+			password_channel TEXT, email_id INTEGER, password_email_id INTEGER, delivered_by TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP)`).Error
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	adminToken, _ := setupTestDB(t)
+	r := setupRouter()
+
+	content := "nim,nama\n13519999,Siti\n"
+	err := initializers.Storage.Put(context.Background(), "req-abc123.csv", strings.NewReader(content), int64(len(content)), "text/csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := initializers.FlowDB
+	createExportTables(t, db)
+	db.Exec(`INSERT INTO export_files (name, format, created_at) VALUES ('abc123', 'csv', ?)`, time.Now())
+
+	link := tools.NewDownloadURL("", "abc123", "csv", "siti@example.com")
+	if strings.Contains(link, "siti") {
+		t.Errorf("link reveals the recipient: %s", link)
+	}
+	// The downloader has to confirm the address the link was sent to
+	for path, want := range map[string]int{
+		link:                               http.StatusUnauthorized,
+		link + "&email=":                   http.StatusUnauthorized,
+		link + "&email=budi%40example.com": http.StatusForbidden,
+	} {
+		if code := doRequest(r, http.MethodGet, path, ""); code != want {
+			t.Errorf("%s: want %d, got %d", path, want, code)
+		}
+	}
+	link += "&email=Siti%40example.com"
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, link, nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "13519999,Siti") {
+		t.Fatalf("want the export, got %d: %s", w.Code, w.Body)
+	}
+
+	var count int
+	db.Raw("SELECT download_count FROM export_files WHERE name = 'abc123'").Scan(&count)
+	var recipient string
+	db.Raw("SELECT recipient FROM export_downloads WHERE export_name = 'abc123'").Scan(&recipient)
+	if count != 1 || recipient != "siti@example.com" {
+		t.Errorf("download not recorded: count %d, recipient %q", count, recipient)
+	}
+
+	// A file in the storage is only served while it is recorded as an export
+	err = initializers.Storage.Put(context.Background(), "req-loose.csv", strings.NewReader(content), int64(len(content)), "text/csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired := tools.DownloadLink{Name: "abc123", Format: "csv", Expires: time.Now().Add(-time.Minute)}
+	for path, want := range map[string]int{
+		"/downloads/abc123":                                   http.StatusNotFound,
+		tools.NewDownloadURL("", "loose", "csv", ""):          http.StatusNotFound,
+		strings.Replace(link, "format=csv", "format=xlsx", 1): http.StatusForbidden,
+		expired.URL(""):                                       http.StatusGone,
+	} {
+		if code := doRequest(r, http.MethodGet, path, ""); code != want {
+			t.Errorf("%s: want %d, got %d", path, want, code)
+		}
+	}
+
+	err = initializers.Storage.Put(context.Background(), "emailAttachments/letter.pdf", strings.NewReader("%PDF-1.4"), 8, "application/pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileLink := tools.NewFileURL("", "emailAttachments/letter.pdf", "siti@example.com")
+	if code := doRequest(r, http.MethodGet, fileLink, ""); code != http.StatusUnauthorized {
+		t.Errorf("unconfirmed attachment link: want 401, got %d", code)
+	}
+	fileLink += "&email=siti%40example.com"
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, fileLink, nil))
+	if w.Code != http.StatusOK || w.Body.String() != "%PDF-1.4" || w.Header().Get("Content-Type") != "application/pdf" {
+		t.Errorf("want the attachment, got %d %q: %s", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+	for _, path := range []string{
+		"/files/emailAttachments/letter.pdf",
+		strings.Replace(fileLink, "bound=1&", "", 1),
+	} {
+		if code := doRequest(r, http.MethodGet, path, ""); code != http.StatusNotFound {
+			t.Errorf("%s: want 404, got %d", path, code)
+		}
+	}
+	for _, path := range []string{
+		strings.Replace(fileLink, "letter.pdf", "other.pdf", 1),
+		strings.Replace(fileLink, "/files/emailAttachments/letter.pdf", "/files/req-abc123.csv", 1),
+	} {
+		if code := doRequest(r, http.MethodGet, path, ""); code != http.StatusForbidden {
+			t.Errorf("%s: want 403, got %d", path, code)
+		}
+	}
+
+	if code := doRequest(r, http.MethodPost, "/export-files/abc123/revoke", adminToken); code != http.StatusOK {
+		t.Fatalf("revoke: want 200, got %d", code)
+	}
+	if code := doRequest(r, http.MethodGet, link, ""); code != http.StatusGone {
+		t.Errorf("revoked export: want 410, got %d", code)
+	}
+}
+
+func TestProtectedExport(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	adminToken, _ := setupTestDB(t)
+	t.Setenv("BASE_URL", "http://localhost:8080")
+	r := setupRouter()
+
+	content := "nim,nama\n13519999,Siti\n"
+	err := initializers.Storage.Put(context.Background(), "req-abc123.csv", strings.NewReader(content), int64(len(content)), "text/csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := initializers.FlowDB
+	createExportTables(t, db)
+	err = db.Exec(`CREATE TABLE data_requests (
+		id TEXT PRIMARY KEY, name TEXT, email TEXT, format TEXT, language TEXT, status TEXT, created_at DATETIME)`).Error
+	if err == nil {
+		err = db.AutoMigrate(&models.EmailHistory{})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := uuid.New()
+	db.Exec(`INSERT INTO data_requests VALUES (?, 'Siti', 'siti@example.com', 'CSV', 'en', 'COMPLETED', ?)`, id, time.Now())
+
+	form := url.Values{"target": {"dosen@example.com"}, "request_id": {id.String()}, "csv_id": {"abc123"}, "protect": {"true"}}
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/email", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// Only a recorded export can be protected
+	if w := send(); w.Code != http.StatusNotFound {
+		t.Errorf("unrecorded export: want 404, got %d: %s", w.Code, w.Body)
+	}
+	if w := sendJSON(r, http.MethodPost, "/export-files/abc123/protect", adminToken, `{}`); w.Code != http.StatusNotFound {
+		t.Errorf("unrecorded export: want 404, got %d: %s", w.Code, w.Body)
+	}
+	db.Exec(`INSERT INTO export_files (name, format, created_at) VALUES ('abc123', 'csv', ?)`, time.Now())
+
+	w := send()
+	if w.Code != http.StatusAccepted || strings.Contains(w.Body.String(), `"password"`) {
+		t.Fatalf("protected email: got %d: %s", w.Code, w.Body)
+	}
+
+	var protected models.ExportFile
+	if err := db.First(&protected, "protected = ?", true).Error; err != nil || protected.SourceName != "abc123" || protected.Password == "" {
+		t.Fatalf("protected export not recorded: %+v, %v", protected, err)
+	}
+	var emails []models.EmailHistory
+	db.Order("id").Find(&emails)
+	if len(emails) != 2 || !strings.Contains(emails[0].URL, "/downloads/"+protected.Name+"?") ||
+		strings.Contains(emails[0].Body, protected.Password) || !strings.Contains(emails[1].Body, protected.Password) ||
+		emails[1].URL != "" || emails[1].To != "dosen@example.com" {
+		t.Errorf("want a link email and a separate password email, got %+v", emails)
+	}
+	var delivery models.ProtectedDelivery
+	db.First(&delivery, "export_name = ?", protected.Name)
+	if delivery.Recipient != "dosen@example.com" || delivery.PasswordChannel != models.PasswordByEmail ||
+		delivery.EmailID == nil || *delivery.EmailID != emails[0].ID || delivery.PasswordEmailID == nil || *delivery.PasswordEmailID != emails[1].ID {
+		t.Errorf("delivery not recorded: %+v", delivery)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tools.NewDownloadURL("", protected.Name, "zip", "dosen@example.com")+"&email=dosen%40example.com", nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "PK") || strings.Contains(w.Body.String(), "Siti") {
+		t.Errorf("want the encrypted zip, got %d: %q", w.Code, w.Body)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/export-files/"+protected.Name+"/password", nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), protected.Password) || !strings.Contains(w.Body.String(), "dosen@example.com") {
+		t.Errorf("password: got %d: %s", w.Code, w.Body)
+	}
+	if code := doRequest(r, http.MethodGet, "/export-files/missing/password", adminToken); code != http.StatusNotFound {
+		t.Errorf("unrecorded export password: want 404, got %d", code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/export-files/abc123/protect", strings.NewReader(`{"format": "json"}`))
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"password":"`) || strings.Count(w.Body.String(), `"protected":true`) != 1 {
+		t.Errorf("protect: got %d: %s", w.Code, w.Body)
+	}
+	if code := doRequest(r, http.MethodPost, "/export-files/"+protected.Name+"/protect", adminToken); code != http.StatusBadRequest {
+		t.Errorf("protecting a protected export: want 400, got %d", code)
+	}
+}
+
+func TestEmailResultsSkipsRevokedExport(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	adminToken, _ := setupTestDB(t)
+	t.Setenv("BASE_URL", "http://localhost:8080")
+	r := setupRouter()
+
+	content := "nim,nama\n13519999,Siti\n"
+	err := initializers.Storage.Put(context.Background(), "req-abc123.csv", strings.NewReader(content), int64(len(content)), "text/csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := initializers.FlowDB
+	createExportTables(t, db)
+	err = db.Exec(`CREATE TABLE data_requests (
+		id TEXT PRIMARY KEY, name TEXT, email TEXT, format TEXT, language TEXT, status TEXT,
+		export_name TEXT, export_format TEXT, sql_query TEXT, created_at DATETIME)`).Error
+	if err == nil {
+		err = db.AutoMigrate(&models.EmailHistory{})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := uuid.New()
+	db.Exec(`INSERT INTO data_requests VALUES (?, 'Siti', 'siti@example.com', 'CSV', 'en', 'COMPLETED', 'abc123', 'csv', NULL, ?)`, id, time.Now())
+	db.Exec(`INSERT INTO export_files (name, format, created_at, revoked_at) VALUES ('abc123', 'csv', ?, ?)`, time.Now(), time.Now())
+
+	send := func() *httptest.ResponseRecorder {
+		form := url.Values{"target": {"dosen@example.com"}, "request_id": {id.String()}, "include_results": {"true"}, "result_format": {"csv"}}
+		req := httptest.NewRequest(http.MethodPost, "/email", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// The revoked export is not sent again, and there is no SQL to export anew
+	if w := send(); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("revoked export: want 422, got %d: %s", w.Code, w.Body)
+	}
+	var sent int64
+	db.Model(&models.EmailHistory{}).Count(&sent)
+	if sent != 0 {
+		t.Errorf("%d emails queued with a revoked export", sent)
+	}
+
+	db.Exec(`UPDATE export_files SET revoked_at = NULL WHERE name = 'abc123'`)
+	if w := send(); w.Code != http.StatusAccepted {
+		t.Errorf("valid export: want 202, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestNewDataRequestRejectsSQL(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestDB(t)
+	r := setupRouter()
+
+	body := `{"name": "Siti", "nim": "13519999", "phone_number": "081234567890", "email": "siti@example.com",
+		"format": "CSV", "purpose": "Skripsi", "sql_query": "SELECT * FROM users"}`
+	w := sendJSON(r, http.MethodPost, "/data-requests/", "", body)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "sql_query") {
+		t.Errorf("got %d: %s", w.Code, w.Body)
+	}
+}
+
+// TestConfirmationTrackingLink submits a request with TRACKING_URL unset, so
+// the confirmation links the status endpoint of the API itself
+func TestConfirmationTrackingLink(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestDB(t)
+	t.Setenv("BASE_URL", "http://localhost:8080/")
+	t.Setenv("TRACKING_URL", "")
+	r := setupRouter()
+
+	createDataRequestTables(t, initializers.FlowDB)
+
+	body := `{"name": "Siti", "nim": "13519999", "phone_number": "081234567890", "email": "siti@example.com",
+		"format": "CSV", "purpose": "Skripsi"}`
+	w := sendJSON(r, http.MethodPost, "/data-requests/", "", body)
+	var created struct {
+		TrackingToken string `json:"tracking_token"`
+	}
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &created) != nil || created.TrackingToken == "" {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+
+	email := lastEmail(t, "siti@example.com")
+	if email.URL != "http://localhost:8080/track/"+created.TrackingToken {
+		t.Errorf("tracking link: %q", email.URL)
+	}
+	if code := doRequest(r, http.MethodGet, strings.TrimPrefix(email.URL, "http://localhost:8080"), ""); code != http.StatusOK {
+		t.Errorf("following the link: %d", code)
+	}
+}
+
+// createDataRequestTables creates the data requests with every column, their
+// events and the email history
+func createDataRequestTables(t *testing.T, db *gorm.DB) {
+	t.Helper()
+	err := db.Exec(`CREATE TABLE data_requests (
+		id TEXT PRIMARY KEY DEFAULT (lower(hex(randomblob(4)) || '-' || hex(randomblob(2)) || '-' ||
+			hex(randomblob(2)) || '-' || hex(randomblob(2)) || '-' || hex(randomblob(6)))),
+		name TEXT, nim TEXT, phone_number TEXT,
+		email TEXT, format TEXT, purpose TEXT, status TEXT DEFAULT 'PENDING', language TEXT DEFAULT 'id',
+		year_from INTEGER, year_to INTEGER, "table" TEXT, columns TEXT, filter TEXT, sql_query TEXT,
+		masking_profile TEXT, status_note TEXT, status_changed_by TEXT, status_changed_at DATETIME,
+		export_name TEXT, export_format TEXT, fulfilled_by TEXT, fulfilled_at DATETIME,
+		export_truncated BOOLEAN DEFAULT false, created_at DATETIME)`).Error
+	if err == nil {
+		err = db.Exec(`CREATE TABLE data_request_events (
+			id TEXT PRIMARY KEY, data_request_id TEXT, type TEXT, from_value TEXT, to_value TEXT,
+			note TEXT, details TEXT, actor_id TEXT, created_at DATETIME)`).Error
+	}
+	if err == nil {
+		err = db.AutoMigrate(&models.EmailHistory{})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// beforeUpdate runs change once, just before the next gorm update, as if
+// another admin got there first
+func beforeUpdate(t *testing.T, db *gorm.DB, change string, args ...interface{}) {
+	t.Helper()
+	done := false
+	name := "test:" + t.Name()
+	err := db.Callback().Update().Before("gorm:update").Register(name, func(tx *gorm.DB) {
+		if !done {
+			done = true
+			tx.Session(&gorm.Session{NewDB: true}).Exec(change, args...)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Callback().Update().Remove(name) })
+}
+
+// statusEvents counts the status changes recorded for a request
+func statusEvents(db *gorm.DB, id uuid.UUID) int64 {
+	var count int64
+	db.Model(&models.DataRequestEvent{}).Where("data_request_id = ? AND type = ?", id, models.EventStatusChanged).Count(&count)
+	return count
+}
+
+func TestStatusChangeConflict(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	adminToken, _ := setupTestDB(t)
+	r := setupRouter()
+
+	db := initializers.FlowDB
+	createDataRequestTables(t, db)
+	id := uuid.New()
+	db.Exec(`INSERT INTO data_requests (id, name, email, purpose, status, created_at) VALUES (?, 'Siti', 'siti@example.com', 'Skripsi', 'PENDING', ?)`, id, time.Now())
+
+	// Another admin rejects the request between the check and the update
+	beforeUpdate(t, db, `UPDATE data_requests SET status = 'REJECTED' WHERE id = ?`, id)
+	w := sendJSON(r, http.MethodPut, "/data-requests/"+id.String()+"/status", adminToken, `{"status": "APPROVED"}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("want 409, got %d: %s", w.Code, w.Body)
+	}
+	var status string
+	db.Raw(`SELECT status FROM data_requests WHERE id = ?`, id).Scan(&status)
+	if status != models.StatusRejected || statusEvents(db, id) != 0 {
+		t.Errorf("lost update: status %s, %d events", status, statusEvents(db, id))
+	}
+
+	db.Exec(`UPDATE data_requests SET status = 'PENDING' WHERE id = ?`, id)
+	w = sendJSON(r, http.MethodPut, "/data-requests/"+id.String()+"/status", adminToken, `{"status": "APPROVED"}`)
+	db.Raw(`SELECT status FROM data_requests WHERE id = ?`, id).Scan(&status)
+	if w.Code != http.StatusOK || status != models.StatusApproved || statusEvents(db, id) != 1 {
+		t.Errorf("got %d, status %s, %d events: %s", w.Code, status, statusEvents(db, id), w.Body)
+	}
+}
+
+// setupFulfil adds an alumni table with rows of nim to the test database and
+// an APPROVED data request for them, which it returns
+func setupFulfil(t *testing.T, nims ...string) uuid.UUID {
+	t.Helper()
+	t.Setenv("FIXED_TABLE", "alumni")
+	db := initializers.FlowDB
+	createDataRequestTables(t, db)
+	createExportTables(t, db)
+	err := db.Exec(`CREATE TABLE alumni (nim TEXT)`).Error
+	if err == nil {
+		err = db.Exec(`CREATE TABLE request_histories (
+			id TEXT PRIMARY KEY DEFAULT (lower(hex(randomblob(16)))), sql TEXT, date DATETIME, csv_id TEXT)`).Error
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, nim := range nims {
+		db.Exec(`INSERT INTO alumni VALUES (?)`, nim)
+	}
+
+	id := uuid.New()
+	db.Exec(`INSERT INTO data_requests (id, name, email, format, purpose, status, sql_query, masking_profile, created_at)
+		VALUES (?, 'Siti', 'siti@example.com', 'CSV', 'Skripsi', 'APPROVED', 'SELECT nim FROM alumni', 'full', ?)`, id, time.Now())
+	return id
+}
+
+func TestFulfilConflict(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	adminToken, _ := setupTestDB(t)
+	r := setupRouter()
+	id := setupFulfil(t, "13519999")
+	db := initializers.FlowDB
+
+	// The request is rejected while its query runs: the export is dropped
+	beforeUpdate(t, db, `UPDATE data_requests SET status = 'REJECTED' WHERE id = ?`, id)
+	w := sendJSON(r, http.MethodPost, "/data-requests/"+id.String()+"/fulfil", adminToken, `{"protect": true}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("want 409, got %d: %s", w.Code, w.Body)
+	}
+	var dataRequest models.DataRequest
+	db.First(&dataRequest, "id = ?", id)
+	var exports int64
+	db.Model(&models.ExportFile{}).Count(&exports)
+	stored, _ := initializers.Storage.(*tools.LocalStorage).List(context.Background(), "")
+	if dataRequest.Status != models.StatusRejected || dataRequest.ExportName != "" || exports != 0 || len(stored) != 0 || statusEvents(db, id) != 0 {
+		t.Errorf("lost race left %+v, %d export records, files %v, %d events", dataRequest, exports, stored, statusEvents(db, id))
+	}
+
+	db.Exec(`UPDATE data_requests SET status = 'APPROVED' WHERE id = ?`, id)
+	w = sendJSON(r, http.MethodPost, "/data-requests/"+id.String()+"/fulfil", adminToken, `{}`)
+	db.First(&dataRequest, "id = ?", id)
+	if w.Code != http.StatusOK || dataRequest.Status != models.StatusCompleted || dataRequest.ExportName == "" || statusEvents(db, id) != 1 {
+		t.Errorf("got %d, %+v: %s", w.Code, dataRequest, w.Body)
+	}
+}
+
+func TestFulfilTruncated(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	adminToken, _ := setupTestDB(t)
+	t.Setenv("SQL_ROW_LIMIT_ADMIN", "2")
+	r := setupRouter()
+	id := setupFulfil(t, "13519997", "13519998", "13519999")
+	db := initializers.FlowDB
+
+	// A result over the row limit does not complete the request on its own
+	w := sendJSON(r, http.MethodPost, "/data-requests/"+id.String()+"/fulfil", adminToken, `{}`)
+	var dataRequest models.DataRequest
+	db.First(&dataRequest, "id = ?", id)
+	stored, _ := initializers.Storage.(*tools.LocalStorage).List(context.Background(), "")
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), `"max_rows":2`) || dataRequest.Status != models.StatusApproved || len(stored) != 0 {
+		t.Fatalf("got %d, status %s, files %v: %s", w.Code, dataRequest.Status, stored, w.Body)
+	}
+
+	// Allowed explicitly, the truncation is kept on the request and its timeline
+	w = sendJSON(r, http.MethodPost, "/data-requests/"+id.String()+"/fulfil", adminToken, `{"allow_truncated": true}`)
+	db.First(&dataRequest, "id = ?", id)
+	if w.Code != http.StatusOK || dataRequest.Status != models.StatusCompleted || !dataRequest.ExportTruncated {
+		t.Fatalf("got %d, %+v: %s", w.Code, dataRequest, w.Body)
+	}
+	var event models.DataRequestEvent
+	db.First(&event, "data_request_id = ? AND type = ?", id, models.EventExported)
+	if !strings.Contains(event.Details, "truncated at 2 rows") {
+		t.Errorf("export event: %q", event.Details)
+	}
+}
+
+func TestDataRequestMasking(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	adminToken, _ := setupTestDB(t)
+	r := setupRouter()
+
+	db := initializers.FlowDB
+	err := db.Exec(`CREATE TABLE data_requests (
+		id TEXT PRIMARY KEY, name TEXT, email TEXT, purpose TEXT, status TEXT, masking_profile TEXT, created_at DATETIME)`).Error
+	if err == nil {
+		err = db.Exec(`CREATE TABLE data_request_events (
+			id TEXT PRIMARY KEY, data_request_id TEXT, type TEXT, from_value TEXT, to_value TEXT,
+			note TEXT, details TEXT, actor_id TEXT, created_at DATETIME)`).Error
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := uuid.New()
+	db.Exec(`INSERT INTO data_requests VALUES (?, 'Siti', 'siti@example.com', 'Skripsi', 'PENDING', 'research', ?)`, id, time.Now())
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send(http.MethodGet, "/masking-profiles?purpose=Laporan+akreditasi", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"suggested":"statistics"`) {
+		t.Errorf("profiles: got %d: %s", w.Code, w.Body)
+	}
+
+	if w := send(http.MethodPut, "/data-requests/"+id.String()+"/masking", `{"profile": "nope"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown profile: want 400, got %d", w.Code)
+	}
+	if w := send(http.MethodPut, "/data-requests/"+id.String()+"/masking", `{"profile": "full"}`); w.Code != http.StatusOK {
+		t.Fatalf("update: got %d: %s", w.Code, w.Body)
+	}
+	var profile, from string
+	db.Raw("SELECT masking_profile FROM data_requests WHERE id = ?", id).Scan(&profile)
+	db.Raw("SELECT from_value FROM data_request_events WHERE data_request_id = ? AND type = 'MASKING_CHANGED' AND to_value = 'full'", id).Scan(&from)
+	if profile != "full" || from != "research" {
+		t.Errorf("profile %q, change from %q", profile, from)
+	}
+
+	// Ad hoc queries get the default profile, and renaming a column or
+	// computing from it does not get past it
+	t.Setenv("FIXED_TABLE", "alumni")
+	db.Exec(`CREATE TABLE alumni (nim TEXT, nama TEXT, kode_prodi TEXT)`)
+	db.Exec(`INSERT INTO alumni VALUES ('13519001', 'Siti Aminah', '135')`)
+	w = send(http.MethodPost, "/sql/preview", `{"sql": "SELECT nim AS id, upper(nama) AS besar, nama AS n, kode_prodi FROM alumni"}`)
+	var preview struct {
+		Table   [][]interface{} `json:"table"`
+		Masking string          `json:"masking"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &preview)
+	if w.Code != http.StatusOK || preview.Masking != tools.DefaultMaskingProfile || len(preview.Table) != 2 {
+		t.Fatalf("preview: got %d: %s", w.Code, w.Body)
+	}
+	if fmt.Sprint(preview.Table[0]) != "[id kode_prodi]" || preview.Table[1][0] == "13519001" || strings.Contains(w.Body.String(), "Siti") {
+		t.Errorf("preview not masked: %s", w.Body)
+	}
+}
+
+func TestPreviewPage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	adminToken, _ := setupTestDB(t)
+	t.Setenv("FIXED_TABLE", "numbers")
+	r := setupRouter()
+	err := initializers.DB.Exec(`CREATE TABLE numbers AS WITH RECURSIVE r(n) AS (SELECT 1 UNION ALL SELECT n + 1 FROM r WHERE n < 300) SELECT n FROM r`).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An admin may export 100 000 rows, a preview stops at its page of 200
+	w := sendJSON(r, http.MethodPost, "/sql/preview", adminToken, `{"sql": "SELECT n FROM numbers", "masking_profile": "full"}`)
+	var preview struct {
+		Table     [][]interface{} `json:"table"`
+		Rows      int             `json:"rows"`
+		Truncated bool            `json:"truncated"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &preview)
+	if w.Code != http.StatusOK || len(preview.Table) != 201 || preview.Rows != 200 || !preview.Truncated {
+		t.Errorf("got %d, %d table rows, %d rows, truncated %v", w.Code, len(preview.Table), preview.Rows, preview.Truncated)
+	}
+}
+
+// setupUserTests adds the email outbox to setupTestDB and configures the
+// account links, returning the router and the admin's token
+func setupUserTests(t *testing.T) (*gin.Engine, string) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	adminToken, _ := setupTestDB(t)
+	t.Setenv("INVITE_URL", "http://localhost:5173/invite")
+	t.Setenv("PASSWORD_RESET_URL", "http://localhost:5173/reset-password/")
+	if err := initializers.FlowDB.AutoMigrate(&models.EmailHistory{}); err != nil {
+		t.Fatal(err)
+	}
+	return setupRouter(), adminToken
+}
+
+func sendJSON(r *gin.Engine, method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// login returns the token Login issues, or "" with the status code when it refuses
+func login(t *testing.T, r *gin.Engine, email, password string) (string, int) {
+	t.Helper()
+	w := sendJSON(r, http.MethodPost, "/login", "", fmt.Sprintf(`{"email": %q, "password": %q}`, email, password))
+	var body struct {
+		Token string `json:"token"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return body.Token, w.Code
+}
+
+// lastEmail is the most recently queued email to address
+func lastEmail(t *testing.T, to string) models.EmailHistory {
+	t.Helper()
+	var email models.EmailHistory
+	if err := initializers.FlowDB.Order("id DESC").First(&email, "\"to\" = ?", to).Error; err != nil {
+		t.Fatalf("no email to %s: %v", to, err)
+	}
+	return email
+}
+
+func userByEmail(t *testing.T, email string) models.User {
+	t.Helper()
+	var user models.User
+	if err := initializers.FlowDB.First(&user, "email = ?", email).Error; err != nil {
+		t.Fatalf("no user %s: %v", email, err)
+	}
+	return user
+}
+
+func TestUserCRUD(t *testing.T) {
+	r, adminToken := setupUserTests(t)
+
+	w := sendJSON(r, http.MethodPost, "/users/", adminToken, `{"name": "Rina", "email": "Rina@Example.com", "role": "ADMIN", "password": "rahasia123"}`)
+	if w.Code != http.StatusCreated || strings.Contains(w.Body.String(), "rahasia123") || strings.Contains(w.Body.String(), `"password"`) {
+		t.Fatalf("create: got %d: %s", w.Code, w.Body)
+	}
+	rina := userByEmail(t, "rina@example.com")
+	if rina.Role != models.RoleAdmin || rina.VerifiedAt == nil || rina.Password == "rahasia123" {
+		t.Errorf("created user: %+v", rina)
+	}
+	if _, code := login(t, r, "rina@example.com", "rahasia123"); code != http.StatusOK {
+		t.Errorf("login as created user: got %d", code)
+	}
+
+	if w := sendJSON(r, http.MethodPost, "/users/", adminToken, `{"name": "Rina", "email": "rina@example.com", "password": "rahasia123"}`); w.Code != http.StatusConflict {
+		t.Errorf("duplicate email: want 409, got %d", w.Code)
+	}
+	for _, body := range []string{`{"email": "x@example.com"}`, `{"name": "X", "email": "x@example.com", "role": "ROOT"}`, `{"name": "X", "email": "x@example.com", "password": "short"}`} {
+		if w := sendJSON(r, http.MethodPost, "/users/", adminToken, body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: want 400, got %d", body, w.Code)
+		}
+	}
+
+	w = sendJSON(r, http.MethodGet, "/users/?role=admin", adminToken, "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "rina@example.com") || strings.Contains(w.Body.String(), "user@example.com") {
+		t.Errorf("list admins: got %d: %s", w.Code, w.Body)
+	}
+
+	path := "/users/" + rina.ID.String()
+	w = sendJSON(r, http.MethodPut, path, adminToken, `{"name": "Rina Kusuma", "role": "USER"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"name":"Rina Kusuma"`) || userByEmail(t, "rina@example.com").Role != models.RoleUser {
+		t.Errorf("update: got %d: %s", w.Code, w.Body)
+	}
+	if w := sendJSON(r, http.MethodPut, path, adminToken, `{"email": "admin@example.com"}`); w.Code != http.StatusConflict {
+		t.Errorf("taking another account's email: want 409, got %d", w.Code)
+	}
+	if w := sendJSON(r, http.MethodGet, path, adminToken, ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Rina Kusuma") {
+		t.Errorf("get: got %d: %s", w.Code, w.Body)
+	}
+
+	admin := userByEmail(t, "admin@example.com")
+	if w := sendJSON(r, http.MethodPut, "/users/"+admin.ID.String(), adminToken, `{"role": "USER"}`); w.Code != http.StatusConflict {
+		t.Errorf("demoting yourself: want 409, got %d", w.Code)
+	}
+	if w := sendJSON(r, http.MethodDelete, "/users/"+admin.ID.String(), adminToken, ""); w.Code != http.StatusConflict {
+		t.Errorf("deleting yourself: want 409, got %d", w.Code)
+	}
+	if w := sendJSON(r, http.MethodDelete, path, adminToken, ""); w.Code != http.StatusOK {
+		t.Errorf("delete: got %d: %s", w.Code, w.Body)
+	}
+	if w := sendJSON(r, http.MethodGet, path, adminToken, ""); w.Code != http.StatusNotFound {
+		t.Errorf("deleted user: want 404, got %d", w.Code)
+	}
+}
+
+func TestUserInvitation(t *testing.T) {
+	r, adminToken := setupUserTests(t)
+
+	w := sendJSON(r, http.MethodPost, "/users/", adminToken, `{"name": "Budi", "email": "budi@example.com", "language": "en"}`)
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"email_id"`) || strings.Contains(w.Body.String(), "verification_token") {
+		t.Fatalf("invite: got %d: %s", w.Code, w.Body)
+	}
+	email := lastEmail(t, "budi@example.com")
+	token := strings.TrimPrefix(email.URL, "http://localhost:5173/invite/")
+	if email.Template != "account_invite" || email.Language != "en" || email.QueuedBy == nil || token == email.URL {
+		t.Fatalf("invitation email: %+v", email)
+	}
+	if _, code := login(t, r, "budi@example.com", "whatever1"); code != http.StatusUnauthorized {
+		t.Errorf("login before accepting: want 401, got %d", code)
+	}
+
+	w = sendJSON(r, http.MethodGet, "/invitations/"+token, "", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"email":"budi@example.com"`) {
+		t.Errorf("show invitation: got %d: %s", w.Code, w.Body)
+	}
+	if w := sendJSON(r, http.MethodPost, "/invitations/"+token, "", `{"password": "short"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("short password: want 400, got %d", w.Code)
+	}
+	// Resending replaces the link
+	if w := sendJSON(r, http.MethodPost, "/users/"+userByEmail(t, "budi@example.com").ID.String()+"/invite", adminToken, ""); w.Code != http.StatusAccepted {
+		t.Fatalf("resend: got %d: %s", w.Code, w.Body)
+	}
+	if w := sendJSON(r, http.MethodPost, "/invitations/"+token, "", `{"password": "budi-rahasia"}`); w.Code != http.StatusNotFound {
+		t.Errorf("replaced invitation: want 404, got %d", w.Code)
+	}
+	token = strings.TrimPrefix(lastEmail(t, "budi@example.com").URL, "http://localhost:5173/invite/")
+
+	if w := sendJSON(r, http.MethodPost, "/invitations/"+token, "", `{"password": "budi-rahasia"}`); w.Code != http.StatusOK {
+		t.Fatalf("accept: got %d: %s", w.Code, w.Body)
+	}
+	if budi := userByEmail(t, "budi@example.com"); budi.VerifiedAt == nil || budi.VerificationToken != nil {
+		t.Errorf("accepted user: %+v", budi)
+	}
+	if _, code := login(t, r, "budi@example.com", "budi-rahasia"); code != http.StatusOK {
+		t.Errorf("login after accepting: got %d", code)
+	}
+	if w := sendJSON(r, http.MethodPost, "/invitations/"+token, "", `{"password": "another-one"}`); w.Code != http.StatusNotFound {
+		t.Errorf("accepting twice: want 404, got %d", w.Code)
+	}
+	if w := sendJSON(r, http.MethodPost, "/users/"+userByEmail(t, "budi@example.com").ID.String()+"/invite", adminToken, ""); w.Code != http.StatusConflict {
+		t.Errorf("inviting a verified account: want 409, got %d", w.Code)
+	}
+
+	// Invitations expire
+	sendJSON(r, http.MethodPost, "/users/", adminToken, `{"name": "Sari", "email": "sari@example.com"}`)
+	token = strings.TrimPrefix(lastEmail(t, "sari@example.com").URL, "http://localhost:5173/invite/")
+	initializers.FlowDB.Model(&models.User{}).Where("email = ?", "sari@example.com").Update("invited_at", time.Now().Add(-tools.InviteTTL()-time.Minute))
+	if w := sendJSON(r, http.MethodPost, "/invitations/"+token, "", `{"password": "sari-rahasia"}`); w.Code != http.StatusNotFound {
+		t.Errorf("expired invitation: want 404, got %d", w.Code)
+	}
+	if w := sendJSON(r, http.MethodGet, "/invitations/not-a-token", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown invitation: want 404, got %d", w.Code)
+	}
+
+	t.Setenv("INVITE_URL", "")
+	if w := sendJSON(r, http.MethodPost, "/users/", adminToken, `{"name": "Tono", "email": "tono@example.com"}`); w.Code != http.StatusInternalServerError {
+		t.Errorf("invite without INVITE_URL: want 500, got %d", w.Code)
+	}
+}
+
+func TestDisableUser(t *testing.T) {
+	r, adminToken := setupUserTests(t)
+	sendJSON(r, http.MethodPost, "/users/", adminToken, `{"name": "Rina", "email": "rina@example.com", "role": "ADMIN", "password": "rahasia123"}`)
+	rina := userByEmail(t, "rina@example.com")
+	rinaToken, _ := login(t, r, "rina@example.com", "rahasia123")
+	if code := doRequest(r, http.MethodGet, "/users/", rinaToken); code != http.StatusOK {
+		t.Fatalf("before disabling: got %d", code)
+	}
+
+	path := "/users/" + rina.ID.String()
+	if w := sendJSON(r, http.MethodPost, path+"/disable", adminToken, ""); w.Code != http.StatusOK || userByEmail(t, "rina@example.com").DisabledAt == nil {
+		t.Fatalf("disable: got %d: %s", w.Code, w.Body)
+	}
+	if _, code := login(t, r, "rina@example.com", "rahasia123"); code != http.StatusForbidden {
+		t.Errorf("login while disabled: want 403, got %d", code)
+	}
+	if code := doRequest(r, http.MethodGet, "/users/", rinaToken); code != http.StatusUnauthorized {
+		t.Errorf("token of a disabled account: want 401, got %d", code)
+	}
+	if w := sendJSON(r, http.MethodPost, "/password-reset", "", `{"email": "rina@example.com"}`); w.Code != http.StatusAccepted {
+		t.Errorf("reset request: got %d", w.Code)
+	}
+	var resets int64
+	initializers.FlowDB.Model(&models.EmailHistory{}).Where("template = ?", "password_reset").Count(&resets)
+	if resets != 0 {
+		t.Error("a disabled account was sent a reset link")
+	}
+
+	admin := userByEmail(t, "admin@example.com")
+	if w := sendJSON(r, http.MethodPost, "/users/"+admin.ID.String()+"/disable", adminToken, ""); w.Code != http.StatusConflict {
+		t.Errorf("disabling yourself: want 409, got %d", w.Code)
+	}
+
+	if w := sendJSON(r, http.MethodPost, path+"/enable", adminToken, ""); w.Code != http.StatusOK {
+		t.Fatalf("enable: got %d: %s", w.Code, w.Body)
+	}
+	if _, code := login(t, r, "rina@example.com", "rahasia123"); code != http.StatusOK {
+		t.Errorf("login after enabling: got %d", code)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	r, adminToken := setupUserTests(t)
+	sendJSON(r, http.MethodPost, "/users/", adminToken, `{"name": "Rina", "email": "rina@example.com", "role": "ADMIN", "password": "rahasia123"}`)
+	rina := userByEmail(t, "rina@example.com")
+	oldToken := newTestToken(t, rina.ID, "ADMIN", time.Hour)
+
+	// Unknown addresses get the same answer and no email
+	w := sendJSON(r, http.MethodPost, "/password-reset", "", `{"email": "nobody@example.com"}`)
+	known := sendJSON(r, http.MethodPost, "/password-reset", "", `{"email": "RINA@example.com"}`)
+	if w.Code != http.StatusAccepted || known.Code != http.StatusAccepted || w.Body.String() != known.Body.String() {
+		t.Errorf("reset request: got %d %s and %d %s", w.Code, w.Body, known.Code, known.Body)
+	}
+	email := lastEmail(t, "rina@example.com")
+	token := strings.TrimPrefix(email.URL, "http://localhost:5173/reset-password/")
+	if email.Template != "password_reset" || email.QueuedBy != nil || token == email.URL {
+		t.Fatalf("reset email: %+v", email)
+	}
+	if stored := userByEmail(t, "rina@example.com").ResetTokenHash; stored == token || stored != tools.HashResetToken(token) {
+		t.Errorf("reset token stored as %q", stored)
+	}
+
+	if w := sendJSON(r, http.MethodPost, "/password-reset/"+token, "", `{"password": "short"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("short password: want 400, got %d", w.Code)
+	}
+	if w := sendJSON(r, http.MethodPost, "/password-reset/"+token, "", `{"password": "baru-rahasia"}`); w.Code != http.StatusOK {
+		t.Fatalf("reset: got %d: %s", w.Code, w.Body)
+	}
+	if w := sendJSON(r, http.MethodPost, "/password-reset/"+token, "", `{"password": "lagi-rahasia"}`); w.Code != http.StatusNotFound {
+		t.Errorf("reusing the token: want 404, got %d", w.Code)
+	}
+	if _, code := login(t, r, "rina@example.com", "rahasia123"); code != http.StatusUnauthorized {
+		t.Errorf("old password: want 401, got %d", code)
+	}
+	newToken, code := login(t, r, "rina@example.com", "baru-rahasia")
+	if code != http.StatusOK || doRequest(r, http.MethodGet, "/users/", newToken) != http.StatusOK {
+		t.Errorf("new password: got %d", code)
+	}
+	if code := doRequest(r, http.MethodGet, "/users/", oldToken); code != http.StatusUnauthorized {
+		t.Errorf("token issued before the reset: want 401, got %d", code)
+	}
+
+	// Admins can send the link, which expires
+	if w := sendJSON(r, http.MethodPost, "/users/"+rina.ID.String()+"/reset-password", adminToken, `{"language": "en"}`); w.Code != http.StatusAccepted {
+		t.Fatalf("admin reset: got %d: %s", w.Code, w.Body)
+	}
+	email = lastEmail(t, "rina@example.com")
+	if email.QueuedBy == nil || email.Language != "en" {
+		t.Errorf("admin reset email: %+v", email)
+	}
+	token = strings.TrimPrefix(email.URL, "http://localhost:5173/reset-password/")
+	initializers.FlowDB.Model(&models.User{}).Where("id = ?", rina.ID).Update("reset_expires_at", time.Now().Add(-time.Minute))
+	if w := sendJSON(r, http.MethodPost, "/password-reset/"+token, "", `{"password": "lagi-rahasia"}`); w.Code != http.StatusNotFound {
+		t.Errorf("expired token: want 404, got %d", w.Code)
+	}
+
+	sendJSON(r, http.MethodPost, "/users/", adminToken, `{"name": "Budi", "email": "budi@example.com"}`)
+	if w := sendJSON(r, http.MethodPost, "/users/"+userByEmail(t, "budi@example.com").ID.String()+"/reset-password", adminToken, ""); w.Code != http.StatusConflict {
+		t.Errorf("resetting an invited account: want 409, got %d", w.Code)
+	}
+}
+
+func TestPasswordResetOnce(t *testing.T) {
+	r, adminToken := setupUserTests(t)
+	if w := sendJSON(r, http.MethodPost, "/users/", adminToken, `{"name": "Rina", "email": "rina@example.com", "password": "pendek"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("short password: want 400, got %d", w.Code)
+	}
+	sendJSON(r, http.MethodPost, "/users/", adminToken, `{"name": "Rina", "email": "rina@example.com", "password": "rahasia123"}`)
+	sendJSON(r, http.MethodPost, "/password-reset", "", `{"email": "rina@example.com"}`)
+	token := strings.TrimPrefix(lastEmail(t, "rina@example.com").URL, "http://localhost:5173/reset-password/")
+
+	// The same token used at once changes the password only once
+	codes := make(chan int, 8)
+	for i := 0; i < cap(codes); i++ {
+		go func(i int) {
+			codes <- sendJSON(r, http.MethodPost, "/password-reset/"+token, "", fmt.Sprintf(`{"password": "rahasia-%d"}`, i)).Code
+		}(i)
+	}
+	changed := 0
+	for i := 0; i < cap(codes); i++ {
+		if <-codes == http.StatusOK {
+			changed++
+		}
+	}
+	if changed != 1 {
+		t.Errorf("token used %d times", changed)
+	}
+}
+
+func TestPublicRateLimit(t *testing.T) {
+	t.Setenv("PUBLIC_RATE_LIMIT", "2")
+	r, _ := setupUserTests(t)
+
+	reset := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/password-reset", strings.NewReader(`{"email": "nobody@example.com"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	for i := 0; i < 2; i++ {
+		if w := reset("192.0.2.1:1234"); w.Code != http.StatusAccepted {
+			t.Fatalf("call %d: got %d: %s", i+1, w.Code, w.Body)
+		}
+	}
+	// The limit is shared by the routes that queue email, and per IP
+	if w := reset("192.0.2.1:1234"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("over the limit: got %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := sendJSON(r, http.MethodPost, "/data-requests/", "", `{}`); w.Code != http.StatusTooManyRequests {
+		t.Errorf("data request over the limit: got %d", w.Code)
+	}
+	if w := reset("192.0.2.2:1234"); w.Code != http.StatusAccepted {
+		t.Errorf("another IP: got %d", w.Code)
+	}
+}
+
+func TestRecipientEmailLimit(t *testing.T) {
+	t.Setenv("EMAIL_RECIPIENT_LIMIT", "2")
+	r, adminToken := setupUserTests(t)
+	sendJSON(r, http.MethodPost, "/users/", adminToken, `{"name": "Rina", "email": "rina@example.com", "role": "ADMIN", "password": "rahasia123"}`)
+
+	// Every call gets the same answer, the inbox only the first two links
+	for i := 0; i < 4; i++ {
+		if w := sendJSON(r, http.MethodPost, "/password-reset", "", `{"email": "rina@example.com"}`); w.Code != http.StatusAccepted {
+			t.Fatalf("call %d: got %d: %s", i+1, w.Code, w.Body)
+		}
+	}
+	var count int64
+	initializers.FlowDB.Model(&models.EmailHistory{}).Where(`"to" = ? AND template = ?`, "rina@example.com", "password_reset").Count(&count)
+	if count != 2 {
+		t.Errorf("%d reset emails, want 2", count)
+	}
+}
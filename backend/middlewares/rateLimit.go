@@ -0,0 +1,72 @@
+package middlewares
+
+import (
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultPublicRateLimit is how many calls an IP may make to the public
+// routes that queue emails per hour, unless PUBLIC_RATE_LIMIT is set
+const defaultPublicRateLimit = 20
+
+// PublicRateLimit guards the public routes that queue emails, so anonymous
+// callers cannot use them to flood the outbox
+func PublicRateLimit() gin.HandlerFunc {
+	limit, err := strconv.Atoi(os.Getenv("PUBLIC_RATE_LIMIT"))
+	if err != nil || limit < 1 {
+		limit = defaultPublicRateLimit
+	}
+	return RateLimit(limit, time.Hour)
+}
+
+// rateWindow counts the calls of one client since start
+type rateWindow struct {
+	start time.Time
+	calls int
+}
+
+// RateLimit lets every client IP make limit calls per window to the routes
+// it guards, together, and answers 429 with Retry-After beyond that. The
+// counts are kept in memory, per instance.
+func RateLimit(limit int, window time.Duration) gin.HandlerFunc {
+	var mu sync.Mutex
+	clients := make(map[string]*rateWindow)
+	lastSweep := time.Now()
+
+	return func(c *gin.Context) {
+		now := time.Now()
+		ip := c.ClientIP()
+
+		mu.Lock()
+		// Forget the clients whose window ended, so the map stays small
+		if now.Sub(lastSweep) > window {
+			for key, client := range clients {
+				if now.Sub(client.start) >= window {
+					delete(clients, key)
+				}
+			}
+			lastSweep = now
+		}
+		client, ok := clients[ip]
+		if !ok || now.Sub(client.start) >= window {
+			client = &rateWindow{start: now}
+			clients[ip] = client
+		}
+		client.calls++
+		calls, retry := client.calls, client.start.Add(window).Sub(now)
+		mu.Unlock()
+
+		if calls > limit {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests, try again later"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,48 @@
+package middlewares
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"grad_deploy/initializers"
+	"grad_deploy/models"
+	"grad_deploy/tools"
+)
+
+// RequireAuth validates the bearer token issued by controllers.Login and
+// attaches the matching user to the context under "user".
+func RequireAuth(c *gin.Context) {
+	// Token is sent as "Bearer <token>"
+	header := c.GetHeader("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing bearer token"})
+		return
+	}
+
+	claims, err := tools.CheckToken(strings.TrimPrefix(header, "Bearer "))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+		return
+	}
+
+	// The account may have been removed since the token was issued
+	var user models.User
+	if err := initializers.FlowDB.First(&user, "id = ?", claims.Id).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+		return
+	}
+	if user.Disabled() {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "This account is disabled"})
+		return
+	}
+	// Changing the password signs out everywhere else
+	if user.PasswordChangedAt != nil && claims.IssuedAt < user.PasswordChangedAt.Unix() {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+		return
+	}
+
+	c.Set("user", user)
+	c.Next()
+}
@@ -0,0 +1,38 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Data request event types
+const (
+	EventCreated       = "CREATED"
+	EventStatusChanged = "STATUS_CHANGED"
+	EventNote          = "NOTE"
+	EventSQLEdited     = "SQL_EDITED"
+	EventExported      = "EXPORTED"
+	EventEmailSent     = "EMAIL_SENT"
+	// EventMaskingChanged holds the old and new masking profile
+	EventMaskingChanged = "MASKING_CHANGED"
+)
+
+// DataRequestEvent is one entry in a data request's timeline.
+// FromValue/ToValue hold the old and new status or SQL, Details anything else
+// (export name, email recipient). ActorID is empty for requester actions.
+type DataRequestEvent struct {
+	ID            uuid.UUID  `gorm:"type:uuid;default:uuid_generate_v4();primaryKey" json:"id"`
+	DataRequestID uuid.UUID  `gorm:"type:uuid;not null;index" json:"data_request_id"`
+	Type          string     `gorm:"type:varchar(50);not null" json:"type"`
+	FromValue     string     `gorm:"type:text" json:"from,omitempty"`
+	ToValue       string     `gorm:"type:text" json:"to,omitempty"`
+	Note          string     `gorm:"type:text" json:"note,omitempty"`
+	Details       string     `gorm:"type:text" json:"details,omitempty"`
+	ActorID       *uuid.UUID `gorm:"type:uuid" json:"actor_id"`
+	CreatedAt     time.Time  `gorm:"autoCreateTime;default:CURRENT_TIMESTAMP" json:"created_at"`
+}
+
+func (DataRequestEvent) TableName() string {
+	return "data_request_events"
+}
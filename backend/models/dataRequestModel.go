@@ -12,6 +12,8 @@ type DataRequest struct {
 	Format      string    `gorm:"not null" json:"format"`
 	Purpose     string    `gorm:"not null" json:"pourpose"`
 	Status      string    `gorm:"not null;default:PENDING" json:"status"`
+	// Language of the emails sent to the requester ("id" or "en")
+	Language string `gorm:"not null;default:id" json:"language"`
 
 	YearFrom int    `gorm:"" json:"year_from"`
 	YearTo   int    `gorm:"" json:"year_to"`
@@ -19,6 +21,23 @@ type DataRequest struct {
 	Columns  string `gorm:"" json:"columns"`
 	Filter   string `gorm:"" json:"filter"`
 	SQLQuery string `gorm:"" json:"sql_query"`
+	// MaskingProfile is applied to previews and exports for the request,
+	// suggested from the purpose when the request is made
+	MaskingProfile string `gorm:"size:64" json:"masking_profile"`
+
+	// Last status change, see PUT /data-requests/:id/status
+	StatusNote      string     `gorm:"" json:"status_note"`
+	StatusChangedBy *uuid.UUID `gorm:"type:uuid" json:"status_changed_by"`
+	StatusChangedAt *time.Time `gorm:"" json:"status_changed_at"`
+
+	// Set when the request is fulfilled via POST /data-requests/:id/fulfil
+	ExportName   string     `gorm:"" json:"export_name"`
+	ExportFormat string     `gorm:"" json:"export_format"`
+	FulfilledBy  *uuid.UUID `gorm:"type:uuid" json:"fulfilled_by"`
+	FulfilledAt  *time.Time `gorm:"" json:"fulfilled_at"`
+	// ExportTruncated is set when the request was completed with an export
+	// cut off at the row limit, see allow_truncated
+	ExportTruncated bool `gorm:"not null;default:false" json:"export_truncated"`
 
 	CreatedAt time.Time `gorm:"not null;default:now()" json:"created_at"`
 }
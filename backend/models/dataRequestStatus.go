@@ -0,0 +1,53 @@
+package models
+
+import "fmt"
+
+// Data request statuses
+const (
+	StatusPending          = "PENDING"
+	StatusApproved         = "APPROVED"
+	StatusInProgress       = "IN_PROGRESS"
+	StatusCompleted        = "COMPLETED"
+	StatusRejected         = "REJECTED"
+	StatusRequiresRevision = "REQUIRES_REVISION"
+)
+
+// statusTransitions lists where a request may go from each status.
+// COMPLETED and REJECTED are final.
+var statusTransitions = map[string][]string{
+	StatusPending:          {StatusApproved, StatusRejected, StatusRequiresRevision},
+	StatusApproved:         {StatusInProgress, StatusCompleted, StatusRejected, StatusRequiresRevision},
+	StatusInProgress:       {StatusCompleted, StatusRejected, StatusRequiresRevision},
+	StatusRequiresRevision: {StatusPending, StatusRejected},
+	StatusCompleted:        {},
+	StatusRejected:         {},
+}
+
+// IsValidStatus reports whether status is one of the known statuses.
+func IsValidStatus(status string) bool {
+	_, ok := statusTransitions[status]
+	return ok
+}
+
+// AllowedTransitions returns the statuses a request in status may move to.
+func AllowedTransitions(status string) []string {
+	return statusTransitions[status]
+}
+
+// StatusRequiresNote reports whether moving to status needs an explanation for the requester.
+func StatusRequiresNote(status string) bool {
+	return status == StatusRejected || status == StatusRequiresRevision
+}
+
+// CheckTransition returns an error unless a request may move from one status to another.
+func CheckTransition(from, to string) error {
+	if !IsValidStatus(to) {
+		return fmt.Errorf("unknown status %q", to)
+	}
+	for _, allowed := range statusTransitions[from] {
+		if allowed == to {
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot change status from %s to %s", from, to)
+}
@@ -1,18 +1,49 @@
 package models
 
-import "time"
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Email outbox states
+const (
+	EmailQueued  = "queued"
+	EmailSending = "sending"
+	EmailSent    = "sent"
+	EmailFailed  = "failed"
+)
 
 // EmailHistory represents a record of an email send attempt.
 type EmailHistory struct {
 	ID           uint       `gorm:"primaryKey;autoIncrement" json:"id"`
 	From         string     `gorm:"size:255;not null" json:"from"`
-	To           string     `gorm:"size:255;not null" json:"to"`
+	To           string     `gorm:"size:255;not null;index" json:"to"`
 	Subject      string     `gorm:"size:255" json:"subject"`
 	Body         string     `gorm:"type:text" json:"body"`
-	Status       string     `gorm:"size:50;not null" json:"status"` // e.g. "queued", "sent", "failed"
+	Status       string     `gorm:"size:50;not null;index" json:"status"` // e.g. "queued", "sent", "failed"
 	ErrorMessage string     `gorm:"type:text" json:"error_message,omitempty"`
 	RetryCount   int        `gorm:"default:0" json:"retry_count"`
 	SentAt       *time.Time `json:"sent_at,omitempty"`
 	CreatedAt    time.Time  `json:"created_at"`
 	UpdatedAt    time.Time  `json:"updated_at"`
+
+	// Template fields besides Subject and Body
+	Name     string `gorm:"size:255" json:"name"`
+	URL      string `gorm:"type:text" json:"url"`
+	Button   string `gorm:"size:255" json:"button"`
+	Language string `gorm:"size:8" json:"language"`
+	// Attachments are the comma separated storage keys of the files to attach
+	Attachments string `gorm:"type:text" json:"attachments"`
+	// Template is the registered template the email was rendered from, if any
+	Template string `gorm:"size:64" json:"template"`
+	// DataRequestID links the email to the data request it is about, if any
+	DataRequestID *uuid.UUID `gorm:"type:uuid;index" json:"data_request_id"`
+	QueuedBy      *uuid.UUID `gorm:"type:uuid" json:"queued_by"`
+	// NextAttemptAt is when the outbox worker may next try to deliver the email
+	NextAttemptAt time.Time `gorm:"index" json:"next_attempt_at"`
+	// ClaimedAt and HeartbeatAt are set while a worker delivers the email, see
+	// workers.StartEmailWorker
+	ClaimedAt   *time.Time `json:"claimed_at,omitempty"`
+	HeartbeatAt *time.Time `json:"heartbeat_at,omitempty"`
 }
@@ -0,0 +1,73 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ExportFile is an export kept in the storage, named like its key
+// (req-<name>.<format>). Revoking it invalidates every download link.
+// The export janitor deletes the object after ExpiresAt unless it is pinned,
+// and keeps the record with PurgedAt set.
+// A protected export is a password protected zip archive of the export
+// SourceName; its password is only shown to admins.
+type ExportFile struct {
+	Name          string     `gorm:"primaryKey;size:32" json:"name"`
+	Format        string     `gorm:"not null" json:"format"`
+	Rows          int        `gorm:"not null;default:0" json:"rows"`
+	Size          int64      `gorm:"not null;default:0" json:"size"`
+	DataRequestID *uuid.UUID `gorm:"type:uuid;index" json:"data_request_id"`
+	CreatedBy     *uuid.UUID `gorm:"type:uuid" json:"created_by"`
+	CreatedAt     time.Time  `gorm:"not null;default:now()" json:"created_at"`
+	ExpiresAt     *time.Time `gorm:"index" json:"expires_at"`
+	// MaskingProfile was applied to the result, if any
+	MaskingProfile string `gorm:"size:64" json:"masking_profile,omitempty"`
+
+	Pinned   bool       `gorm:"not null;default:false" json:"pinned"`
+	PinnedBy *uuid.UUID `gorm:"type:uuid" json:"pinned_by"`
+	PurgedAt *time.Time `json:"purged_at"`
+
+	RevokedAt *time.Time `json:"revoked_at"`
+	RevokedBy *uuid.UUID `gorm:"type:uuid" json:"revoked_by"`
+
+	DownloadCount    int        `gorm:"not null;default:0" json:"download_count"`
+	LastDownloadedAt *time.Time `json:"last_downloaded_at"`
+
+	Protected  bool   `gorm:"not null;default:false" json:"protected"`
+	SourceName string `gorm:"size:32" json:"source_name,omitempty"`
+	Password   string `gorm:"size:64" json:"-"`
+}
+
+// Channels the password of a protected export is delivered through
+const (
+	// PasswordByEmail sends the password in a separate email
+	PasswordByEmail = "email"
+	// PasswordByAdmin leaves it to an admin to pass on the password shown to them
+	PasswordByAdmin = "admin"
+)
+
+// ProtectedDelivery records that a protected export was sent to Recipient,
+// with the emails carrying the file and its password when they were queued.
+type ProtectedDelivery struct {
+	ID              uint       `gorm:"primaryKey;autoIncrement" json:"id"`
+	ExportName      string     `gorm:"size:32;not null;index" json:"export_name"`
+	DataRequestID   *uuid.UUID `gorm:"type:uuid;index" json:"data_request_id"`
+	Recipient       string     `gorm:"not null;index" json:"recipient"`
+	PasswordChannel string     `gorm:"size:16;not null" json:"password_channel"`
+	EmailID         *uint      `json:"email_id"`
+	PasswordEmailID *uint      `json:"password_email_id"`
+	DeliveredBy     *uuid.UUID `gorm:"type:uuid" json:"delivered_by"`
+	CreatedAt       time.Time  `gorm:"not null;default:now()" json:"created_at"`
+}
+
+// ExportDownload logs one download of an export through a signed link.
+type ExportDownload struct {
+	ID         uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	ExportName string    `gorm:"size:32;not null;index" json:"export_name"`
+	Format     string    `gorm:"not null" json:"format"`
+	Recipient  string    `json:"recipient"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `gorm:"not null;default:now()" json:"created_at"`
+}
@@ -0,0 +1,40 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Export job states
+const (
+	ExportQueued    = "QUEUED"
+	ExportRunning   = "RUNNING"
+	ExportCompleted = "COMPLETED"
+	ExportFailed    = "FAILED"
+)
+
+// ExportJob is a query export executed in the background by the export workers.
+type ExportJob struct {
+	ID          uuid.UUID `gorm:"type:uuid;default:uuid_generate_v4()" json:"id"`
+	SQL         string    `gorm:"not null" json:"sql"`
+	Format      string    `gorm:"not null;default:csv" json:"format"`
+	Status      string    `gorm:"not null;default:QUEUED;index" json:"status"`
+	RowLimit    int       `gorm:"not null" json:"row_limit"`
+	RowsWritten int       `gorm:"not null;default:0" json:"rows_written"`
+	Truncated   bool      `gorm:"not null;default:false" json:"truncated"`
+	// SmallCellRows counts rows in groups under k, suppressed or flagged
+	SmallCellRows int       `gorm:"not null;default:0" json:"small_cell_rows"`
+	FileName      string    `json:"file_name"`
+	Error         string    `json:"error,omitempty"`
+	RequestedBy   uuid.UUID `gorm:"type:uuid" json:"requested_by"`
+	// DataRequestID links the export to the data request it was made for, if any
+	DataRequestID *uuid.UUID `gorm:"type:uuid" json:"data_request_id"`
+	// MaskingProfile is applied to the result, if set
+	MaskingProfile string     `gorm:"size:64" json:"masking_profile"`
+	CreatedAt      time.Time  `gorm:"not null;default:now()" json:"created_at"`
+	StartedAt      *time.Time `json:"started_at"`
+	// HeartbeatAt is renewed while a worker runs the job, see workers.StartExportWorkers
+	HeartbeatAt *time.Time `json:"heartbeat_at"`
+	FinishedAt  *time.Time `json:"finished_at"`
+}
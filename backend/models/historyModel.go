@@ -7,8 +7,8 @@ import (
 )
 
 type RequestHistory struct {
-	ID                uuid.UUID  `gorm:"type:uuid;default:uuid_generate_v4()" json:"id"`
-	SQL               string     `gorm:"not null" json:"sql"`
-    Date              time.Time  `gorm:"not null" json:"date"`
-	CsvID             uuid.UUID  `gorm:"type:uuid;default:uuid_generate_v4()" json:"csv_id"`
-}
\ No newline at end of file
+	ID    uuid.UUID `gorm:"type:uuid;default:uuid_generate_v4()" json:"id"`
+	SQL   string    `gorm:"not null" json:"sql"`
+	Date  time.Time `gorm:"not null" json:"date"`
+	CsvID uuid.UUID `gorm:"type:uuid;default:uuid_generate_v4()" json:"csv_id"`
+}
@@ -6,12 +6,37 @@ import (
 	"github.com/google/uuid"
 )
 
+// User roles
+const (
+	RoleAdmin = "ADMIN"
+	RoleUser  = "USER"
+)
+
 type User struct {
-	ID                uuid.UUID  `gorm:"type:uuid;default:uuid_generate_v4()" json:"id"`
-	Name              string     `gorm:"not null" json:"name"`
-	Email             string     `gorm:"unique;not null" json:"email"`
-	Role              string     `gorm:"default:USER" json:"role"`
-	Password          string     `json:"-"`
-	VerifiedAt        *time.Time `gorm:"default:null" json:"verified_at"`
-	VerificationToken *uuid.UUID `gorm:"default:null" json:"verification_token"`
+	ID       uuid.UUID `gorm:"type:uuid;default:uuid_generate_v4()" json:"id"`
+	Name     string    `gorm:"not null" json:"name"`
+	Email    string    `gorm:"unique;not null" json:"email"`
+	Role     string    `gorm:"default:USER" json:"role"`
+	Password string    `json:"-"`
+	// VerifiedAt is set once the account has a password of its own
+	VerifiedAt *time.Time `gorm:"default:null" json:"verified_at"`
+	// VerificationToken is the pending invitation, see POST /invitations/:token
+	VerificationToken *uuid.UUID `gorm:"default:null" json:"-"`
+	InvitedAt         *time.Time `gorm:"default:null" json:"invited_at"`
+	InvitedBy         *uuid.UUID `gorm:"type:uuid" json:"invited_by"`
+
+	// A disabled account can neither log in nor use the tokens it holds
+	DisabledAt *time.Time `gorm:"default:null" json:"disabled_at"`
+	DisabledBy *uuid.UUID `gorm:"type:uuid" json:"disabled_by"`
+
+	// PasswordChangedAt invalidates the access tokens issued before it
+	PasswordChangedAt *time.Time `gorm:"default:null" json:"password_changed_at"`
+	// ResetTokenHash is the SHA-256 of the pending one-time password reset token
+	ResetTokenHash string     `gorm:"size:64;index" json:"-"`
+	ResetExpiresAt *time.Time `gorm:"default:null" json:"-"`
+}
+
+// Disabled reports whether the account is disabled
+func (u User) Disabled() bool {
+	return u.DisabledAt != nil
 }
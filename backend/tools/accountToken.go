@@ -0,0 +1,61 @@
+package tools
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultInviteTTL        = 7 * 24 * time.Hour
+	defaultPasswordResetTTL = time.Hour
+	// resetTokenLength is the length of password reset tokens, about 190 bits
+	resetTokenLength = 32
+)
+
+// MinPasswordLength is the shortest password an account may set
+const MinPasswordLength = 8
+
+// ValidatePassword checks that password is long enough for an account
+func ValidatePassword(password string) error {
+	if utf8.RuneCountInString(password) < MinPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", MinPasswordLength)
+	}
+	return nil
+}
+
+// InviteTTL is how long an account invitation can be accepted: INVITE_TTL, default 7 days
+func InviteTTL() time.Duration {
+	if ttl, err := time.ParseDuration(os.Getenv("INVITE_TTL")); err == nil && ttl > 0 {
+		return ttl
+	}
+	return defaultInviteTTL
+}
+
+// PasswordResetTTL is how long a password reset token can be used:
+// PASSWORD_RESET_TTL, default one hour
+func PasswordResetTTL() time.Duration {
+	if ttl, err := time.ParseDuration(os.Getenv("PASSWORD_RESET_TTL")); err == nil && ttl > 0 {
+		return ttl
+	}
+	return defaultPasswordResetTTL
+}
+
+// NewResetToken returns a one-time password reset token for the email and
+// the hash stored in its place
+func NewResetToken() (token, hash string, err error) {
+	token, err = RandomName(resetTokenLength)
+	if err != nil {
+		return "", "", err
+	}
+	return token, HashResetToken(token), nil
+}
+
+// HashResetToken is how a reset token is looked up without storing it
+func HashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
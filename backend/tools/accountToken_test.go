@@ -0,0 +1,30 @@
+package tools
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAccountTokenTTLs(t *testing.T) {
+	t.Setenv("INVITE_TTL", "")
+	t.Setenv("PASSWORD_RESET_TTL", "soon")
+	if InviteTTL() != defaultInviteTTL || PasswordResetTTL() != defaultPasswordResetTTL {
+		t.Errorf("defaults: %v, %v", InviteTTL(), PasswordResetTTL())
+	}
+	t.Setenv("INVITE_TTL", "72h")
+	t.Setenv("PASSWORD_RESET_TTL", "15m")
+	if InviteTTL() != 72*time.Hour || PasswordResetTTL() != 15*time.Minute {
+		t.Errorf("configured: %v, %v", InviteTTL(), PasswordResetTTL())
+	}
+}
+
+func TestNewResetToken(t *testing.T) {
+	token, hash, err := NewResetToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, _ := NewResetToken()
+	if len(token) != resetTokenLength || token == other || hash != HashResetToken(token) || hash == HashResetToken(other) || len(hash) != 64 {
+		t.Errorf("token %q, hash %q", token, hash)
+	}
+}
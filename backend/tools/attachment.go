@@ -0,0 +1,167 @@
+package tools
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Result attachments are zipped above defaultAttachCompressBytes and replaced
+// by a download link above defaultAttachMaxBytes, unless EMAIL_ATTACH_COMPRESS_BYTES
+// and EMAIL_ATTACH_MAX_BYTES are set.
+const (
+	defaultAttachCompressBytes = 1 << 20
+	defaultAttachMaxBytes      = 10 << 20
+)
+
+// ErrAttachmentTooLarge means a result is too large to attach, even compressed
+var ErrAttachmentTooLarge = errors.New("result is too large to attach")
+
+// AttachmentLimits decides how results are attached to emails
+type AttachmentLimits struct {
+	// CompressAbove is the size above which a result is zipped
+	CompressAbove int64
+	// MaxBytes is the largest attachment, after compression
+	MaxBytes int64
+}
+
+// DefaultAttachmentLimits reads EMAIL_ATTACH_COMPRESS_BYTES (default 1 MiB)
+// and EMAIL_ATTACH_MAX_BYTES (default 10 MiB).
+func DefaultAttachmentLimits() AttachmentLimits {
+	limits := AttachmentLimits{CompressAbove: defaultAttachCompressBytes, MaxBytes: defaultAttachMaxBytes}
+	if size, err := strconv.ParseInt(os.Getenv("EMAIL_ATTACH_COMPRESS_BYTES"), 10, 64); err == nil && size >= 0 {
+		limits.CompressAbove = size
+	}
+	if size, err := strconv.ParseInt(os.Getenv("EMAIL_ATTACH_MAX_BYTES"), 10, 64); err == nil && size > 0 {
+		limits.MaxBytes = size
+	}
+	return limits
+}
+
+// StoreResultAttachment copies export name in format, converted from CSV
+// when it is stored as CSV, to a new object under dir that the email worker
+// attaches. Results over limits.CompressAbove are zipped first. It returns
+// the key of the attachment, or ErrAttachmentTooLarge when it would still
+// exceed limits.MaxBytes. db is the data database, for the column types of
+// conversions.
+func StoreResultAttachment(ctx context.Context, db *gorm.DB, store Storage, name, format string, limits AttachmentLimits, dir string) (string, error) {
+	result, size, err := stageExport(ctx, db, store, name, format)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(result.Name())
+	defer result.Close()
+
+	// Protected exports are zip archives already
+	file, fileName := result, ExportKey(name, format)
+	if size > limits.CompressAbove && format != ProtectedFormat {
+		zipped, err := os.CreateTemp("", "attachment-*.zip")
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(zipped.Name())
+		defer zipped.Close()
+
+		if err := zipInto(zipped, result, fileName, limits.MaxBytes); err != nil {
+			return "", err
+		}
+		file, fileName = zipped, fileName+".zip"
+		if size, err = file.Seek(0, io.SeekCurrent); err != nil {
+			return "", err
+		}
+	}
+	if size > limits.MaxBytes {
+		return "", ErrAttachmentTooLarge
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	key := path.Join(dir, uuid.New().String(), fileName)
+	if err := store.Put(ctx, key, file, size, ContentType(key)); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// stageExport copies export name in format to a temporary file, converting
+// it when it is stored as CSV, and returns the file rewound with its size.
+// The caller closes and removes the file.
+func stageExport(ctx context.Context, db *gorm.DB, store Storage, name, format string) (*os.File, int64, error) {
+	stored, found := FindExport(ctx, store, name)
+	if !found {
+		return nil, 0, ErrObjectNotFound
+	}
+	if format != stored && stored != "csv" {
+		return nil, 0, fmt.Errorf("export %s is only available as %s", name, stored)
+	}
+
+	source, _, err := store.Open(ctx, ExportKey(name, stored))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer source.Close()
+
+	file, err := os.CreateTemp("", "export-*."+format)
+	if err != nil {
+		return nil, 0, err
+	}
+	if format == stored {
+		_, err = io.Copy(file, source)
+	} else {
+		columns, _ := TableColumns(db, os.Getenv("FIXED_TABLE"))
+		err = ConvertCSV(source, file, format, ColumnTypes(columns))
+	}
+	var size int64
+	if err == nil {
+		size, err = file.Seek(0, io.SeekCurrent)
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, 0, err
+	}
+	return file, size, nil
+}
+
+// zipInto writes a zip archive holding the content of src as name to dst,
+// giving up with ErrAttachmentTooLarge as soon as it exceeds maxBytes
+func zipInto(dst io.Writer, src io.ReadSeeker, name string, maxBytes int64) error {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	archive := zip.NewWriter(&limitedWriter{w: dst, remaining: maxBytes})
+	entry, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate})
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(entry, src); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// limitedWriter fails with ErrAttachmentTooLarge once more than remaining bytes are written
+type limitedWriter struct {
+	w         io.Writer
+	remaining int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.remaining {
+		return 0, ErrAttachmentTooLarge
+	}
+	l.remaining -= int64(len(p))
+	return l.w.Write(p)
+}
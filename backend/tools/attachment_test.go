@@ -0,0 +1,86 @@
+package tools
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"testing"
+)
+
+func readObject(t *testing.T, store Storage, key string) []byte {
+	t.Helper()
+	file, _, err := store.Open(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	content, _ := io.ReadAll(file)
+	return content
+}
+
+func TestStoreResultAttachment(t *testing.T) {
+	db, store := setupExportStorage(t)
+	ctx := context.Background()
+
+	var csv strings.Builder
+	csv.WriteString("nim,nama\n")
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&csv, "1351%04d,Siti\n", i)
+	}
+	content := csv.String()
+	if err := store.Put(ctx, ExportKey("abc", "csv"), strings.NewReader(content), int64(len(content)), "text/csv"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Small enough to attach as is
+	limits := AttachmentLimits{CompressAbove: 1 << 20, MaxBytes: 1 << 20}
+	key, err := StoreResultAttachment(ctx, db, store, "abc", "csv", limits, "emailAttachments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path.Base(key) != "req-abc.csv" || !strings.HasPrefix(key, "emailAttachments/") || string(readObject(t, store, key)) != content {
+		t.Errorf("unexpected attachment %s", key)
+	}
+
+	// Converted from CSV
+	key, err = StoreResultAttachment(ctx, db, store, "abc", "json", limits, "emailAttachments")
+	if err != nil || path.Base(key) != "req-abc.json" || !bytes.Contains(readObject(t, store, key), []byte(`"nama":"Siti"`)) {
+		t.Errorf("json attachment %s, %v", key, err)
+	}
+
+	// Compressed above the threshold
+	limits = AttachmentLimits{CompressAbove: 1024, MaxBytes: int64(len(content)) / 2}
+	key, err = StoreResultAttachment(ctx, db, store, "abc", "csv", limits, "emailAttachments")
+	if err != nil || path.Base(key) != "req-abc.csv.zip" {
+		t.Fatalf("zipped attachment %s, %v", key, err)
+	}
+	zipped := readObject(t, store, key)
+	archive, err := zip.NewReader(bytes.NewReader(zipped), int64(len(zipped)))
+	if err != nil || len(archive.File) != 1 || archive.File[0].Name != "req-abc.csv" {
+		t.Fatalf("bad archive: %v", err)
+	}
+	entry, _ := archive.File[0].Open()
+	if unzipped, _ := io.ReadAll(entry); string(unzipped) != content {
+		t.Error("archive content differs from the export")
+	}
+
+	// Too large even compressed
+	limits = AttachmentLimits{CompressAbove: 1024, MaxBytes: 512}
+	if _, err := StoreResultAttachment(ctx, db, store, "abc", "csv", limits, "emailAttachments"); !errors.Is(err, ErrAttachmentTooLarge) {
+		t.Errorf("want ErrAttachmentTooLarge, got %v", err)
+	}
+	// Too large and never compressed
+	limits = AttachmentLimits{CompressAbove: 1 << 30, MaxBytes: 1024}
+	if _, err := StoreResultAttachment(ctx, db, store, "abc", "csv", limits, "emailAttachments"); !errors.Is(err, ErrAttachmentTooLarge) {
+		t.Errorf("want ErrAttachmentTooLarge, got %v", err)
+	}
+
+	if _, err := StoreResultAttachment(ctx, db, store, "missing", "csv", limits, "emailAttachments"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("missing export: want ErrObjectNotFound, got %v", err)
+	}
+}
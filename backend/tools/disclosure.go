@@ -0,0 +1,461 @@
+package tools
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Disclosure control actions for rows in groups smaller than k
+const (
+	DisclosureSuppress = "suppress"
+	DisclosureFlag     = "flag"
+)
+
+// DisclosureFlagColumn is added to results checked with DisclosureFlag; it is
+// true on the rows of small groups
+const DisclosureFlagColumn = "small_cell"
+
+const (
+	defaultDisclosureK = 5
+	// maxDisclosureExamples is how many small groups a report spells out
+	maxDisclosureExamples = 10
+	// maxDisclosureRows is how many affected row indexes a report lists
+	maxDisclosureRows = 1000
+)
+
+// nullKey stands for NULL in group keys, so it never equals a stored value
+const nullKey = "\x00NULL"
+
+func init() {
+	// Held back rows are spilled with gob, see disclosureCheck
+	gob.Register(time.Time{})
+	gob.Register(json.Number(""))
+}
+
+var (
+	defaultQuasiIdentifiers = []string{"kode_prodi", "kode_kota", "jenis_kelamin", "tahun_lulus"}
+	defaultCountColumns     = []string{"count", "jumlah", "total", "n"}
+)
+
+// Disclosure is a small-cell check on query results. Rows sharing the values
+// of the quasi-identifier columns form a group; a group is small when fewer
+// than K alumni are in it. Each row is one alumnus, unless the result has one
+// of CountColumns, as breakdowns do, which then holds the row's group size.
+type Disclosure struct {
+	K                int      `json:"k"`
+	QuasiIdentifiers []string `json:"quasi_identifiers"`
+	CountColumns     []string `json:"count_columns"`
+	Action           string   `json:"action"`
+}
+
+// DefaultDisclosure reads the check from DISCLOSURE_K, DISCLOSURE_ACTION and
+// the comma separated DISCLOSURE_QUASI_IDENTIFIERS and DISCLOSURE_COUNT_COLUMNS.
+// A k of 0 or 1 turns it off.
+func DefaultDisclosure() Disclosure {
+	d := Disclosure{
+		K:                defaultDisclosureK,
+		QuasiIdentifiers: defaultQuasiIdentifiers,
+		CountColumns:     defaultCountColumns,
+		Action:           DisclosureSuppress,
+	}
+	if k, err := strconv.Atoi(os.Getenv("DISCLOSURE_K")); err == nil && k >= 0 {
+		d.K = k
+	}
+	if columns := splitColumns(os.Getenv("DISCLOSURE_QUASI_IDENTIFIERS")); len(columns) > 0 {
+		d.QuasiIdentifiers = columns
+	}
+	if columns := splitColumns(os.Getenv("DISCLOSURE_COUNT_COLUMNS")); len(columns) > 0 {
+		d.CountColumns = columns
+	}
+	if action := strings.ToLower(strings.TrimSpace(os.Getenv("DISCLOSURE_ACTION"))); action == DisclosureFlag {
+		d.Action = action
+	}
+	return d
+}
+
+func splitColumns(list string) []string {
+	var columns []string
+	for _, column := range strings.Split(list, ",") {
+		if column = strings.ToLower(strings.TrimSpace(column)); column != "" {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+// Enabled reports whether the check can find anything
+func (d Disclosure) Enabled() bool {
+	return d.K > 1
+}
+
+// DisclosureGroup is one small group: its quasi-identifier values, nil for NULL, and size
+type DisclosureGroup struct {
+	Values map[string]interface{} `json:"values"`
+	Size   int                    `json:"size"`
+}
+
+// DisclosureColumn tells how much one quasi-identifier adds to the small groups
+type DisclosureColumn struct {
+	Name string `json:"name"`
+	// SmallAlone counts values of the column that are rare on their own
+	SmallAlone int `json:"small_alone"`
+	// SmallWithout counts the small groups left when the column is left out
+	SmallWithout int `json:"small_without"`
+}
+
+// DisclosureReport is the outcome of a Disclosure check on one result.
+// Rows indexes the affected rows in result order, starting at 0, up to
+// maxDisclosureRows of them. Causes are the columns to drop or coarsen: the
+// ones rare on their own, otherwise the ones whose removal helps most.
+type DisclosureReport struct {
+	K                int                `json:"k"`
+	Action           string             `json:"action"`
+	QuasiIdentifiers []string           `json:"quasi_identifiers"`
+	CountColumn      string             `json:"count_column,omitempty"`
+	Groups           int                `json:"groups"`
+	SmallGroups      int                `json:"small_groups"`
+	AffectedRows     int                `json:"affected_rows"`
+	Rows             []int              `json:"rows,omitempty"`
+	Causes           []string           `json:"causes,omitempty"`
+	Columns          []DisclosureColumn `json:"columns,omitempty"`
+	Examples         []DisclosureGroup  `json:"examples,omitempty"`
+}
+
+// Passed reports whether no group is small
+func (r DisclosureReport) Passed() bool {
+	return r.SmallGroups == 0
+}
+
+// CheckDisclosure runs d over a buffered result, e.g. a preview table.
+// sources, when known, are those of the columns, see QueryLineage.
+func CheckDisclosure(d Disclosure, columns []string, sources []ColumnSource, rows [][]interface{}) DisclosureReport {
+	groups := newDisclosureGroups(d, columns, sources)
+	for _, row := range rows {
+		groups.add(row)
+	}
+	report, _ := groups.report()
+	return report
+}
+
+// disclosureGroups collects the quasi-identifier values and weight of every row
+type disclosureGroups struct {
+	d       Disclosure
+	names   []string
+	columns []int
+	// count is the index of the count column, -1 when there is none
+	count     int
+	countName string
+	keys      [][]string
+	weights   []int
+}
+
+// newDisclosureGroups finds the quasi-identifiers and the count column of a
+// result by name. With sources a column computed from a quasi-identifier is
+// one too, whatever it is called, and the first column counting rows is the
+// count column.
+func newDisclosureGroups(d Disclosure, names []string, sources []ColumnSource) *disclosureGroups {
+	g := &disclosureGroups{d: d, count: -1}
+	taken := make([]bool, len(names))
+	for _, qi := range d.QuasiIdentifiers {
+		for i, name := range names {
+			if taken[i] || !strings.EqualFold(name, qi) && (sources == nil || !sources[i].Uses(qi)) {
+				continue
+			}
+			taken[i] = true
+			g.names = append(g.names, name)
+			g.columns = append(g.columns, i)
+		}
+	}
+	for i := range sources {
+		if sources[i].Count && !taken[i] {
+			g.count, g.countName = i, names[i]
+			return g
+		}
+	}
+	for _, counter := range d.CountColumns {
+		for i, name := range names {
+			if g.count < 0 && !taken[i] && strings.EqualFold(name, counter) {
+				g.count, g.countName = i, name
+			}
+		}
+	}
+	return g
+}
+
+// applies reports whether the result has anything to check
+func (g *disclosureGroups) applies() bool {
+	return g.d.Enabled() && len(g.columns) > 0
+}
+
+func (g *disclosureGroups) add(values []interface{}) {
+	if !g.applies() {
+		return
+	}
+	key := make([]string, len(g.columns))
+	for i, column := range g.columns {
+		key[i] = disclosureValue(values[column])
+	}
+	weight := 1
+	if g.count >= 0 {
+		// A NULL or unreadable count publishes nobody
+		weight = 0
+		if n, err := strconv.ParseFloat(disclosureValue(values[g.count]), 64); err == nil {
+			weight = int(math.Round(n))
+		}
+	}
+	g.keys = append(g.keys, key)
+	g.weights = append(g.weights, weight)
+}
+
+// disclosureValue renders a scanned or masked value for comparison
+func disclosureValue(val interface{}) string {
+	if b, ok := val.([]byte); ok {
+		val = string(b)
+	}
+	if val == nil {
+		return nullKey
+	}
+	return formatText(timestampCell, val)
+}
+
+// sizes groups the rows by the quasi-identifiers in include and returns each
+// row's group key with the group sizes
+func (g *disclosureGroups) sizes(include []bool) ([]string, map[string]int) {
+	rowKeys := make([]string, len(g.keys))
+	sizes := make(map[string]int)
+	for i, key := range g.keys {
+		var parts []string
+		for j, part := range key {
+			if include[j] {
+				parts = append(parts, part)
+			}
+		}
+		rowKeys[i] = strings.Join(parts, "\x1f")
+		sizes[rowKeys[i]] += g.weights[i]
+	}
+	return rowKeys, sizes
+}
+
+func (g *disclosureGroups) small(size int) bool {
+	return size > 0 && size < g.d.K
+}
+
+func (g *disclosureGroups) countSmall(sizes map[string]int) int {
+	small := 0
+	for _, size := range sizes {
+		if g.small(size) {
+			small++
+		}
+	}
+	return small
+}
+
+// report checks the collected rows and marks the ones in small groups
+func (g *disclosureGroups) report() (DisclosureReport, []bool) {
+	report := DisclosureReport{K: g.d.K, Action: g.d.Action, QuasiIdentifiers: g.names, CountColumn: g.countName}
+	affected := make([]bool, len(g.keys))
+	if !g.applies() {
+		return report, affected
+	}
+
+	all := make([]bool, len(g.columns))
+	for j := range all {
+		all[j] = true
+	}
+	rowKeys, sizes := g.sizes(all)
+	report.Groups = len(sizes)
+	report.SmallGroups = g.countSmall(sizes)
+
+	examples := make(map[string]bool)
+	for i, key := range rowKeys {
+		if !g.small(sizes[key]) {
+			continue
+		}
+		affected[i] = true
+		report.AffectedRows++
+		if len(report.Rows) < maxDisclosureRows {
+			report.Rows = append(report.Rows, i)
+		}
+		if !examples[key] && len(report.Examples) < maxDisclosureExamples {
+			examples[key] = true
+			group := DisclosureGroup{Values: make(map[string]interface{}, len(g.names)), Size: sizes[key]}
+			for j, name := range g.names {
+				if g.keys[i][j] != nullKey {
+					group.Values[name] = g.keys[i][j]
+				} else {
+					group.Values[name] = nil
+				}
+			}
+			report.Examples = append(report.Examples, group)
+		}
+	}
+	if report.SmallGroups == 0 {
+		return report, affected
+	}
+
+	best := report.SmallGroups
+	for j, name := range g.names {
+		alone := make([]bool, len(g.columns))
+		alone[j] = true
+		_, aloneSizes := g.sizes(alone)
+		without := append([]bool{}, all...)
+		without[j] = false
+		_, withoutSizes := g.sizes(without)
+
+		column := DisclosureColumn{Name: name, SmallAlone: g.countSmall(aloneSizes), SmallWithout: g.countSmall(withoutSizes)}
+		report.Columns = append(report.Columns, column)
+		if column.SmallAlone > 0 {
+			report.Causes = append(report.Causes, name)
+		}
+		if column.SmallWithout < best {
+			best = column.SmallWithout
+		}
+	}
+	if len(report.Causes) == 0 {
+		for _, column := range report.Columns {
+			if column.SmallWithout == best && best < report.SmallGroups {
+				report.Causes = append(report.Causes, column.Name)
+			}
+		}
+	}
+	return report, affected
+}
+
+// disclosureCheck holds back the rows for a ResultWriter until the whole
+// result is known, then writes them with d.Action applied. Only the group
+// keys stay in memory; the rows themselves are spilled to a temporary file.
+type disclosureCheck struct {
+	next     typedRowHandler
+	d        Disclosure
+	declared map[string]string
+	sources  []ColumnSource
+	groups   *disclosureGroups
+	spill    *os.File
+	buffer   *bufio.Writer
+	encoder  *gob.Encoder
+	held     int
+	report   DisclosureReport
+}
+
+func (d Disclosure) check(writer ResultWriter, declared map[string]string) (*disclosureCheck, error) {
+	next, ok := writer.(typedRowHandler)
+	if !ok {
+		return nil, fmt.Errorf("disclosure control needs a typed result writer")
+	}
+	return &disclosureCheck{next: next, d: d, declared: declared}, nil
+}
+
+func (c *disclosureCheck) ColumnSources(sources []ColumnSource) {
+	c.sources = sources
+}
+
+func (c *disclosureCheck) Columns(cols []*sql.ColumnType) error {
+	names := make([]string, len(cols))
+	types := make([]string, len(cols))
+	for i, col := range cols {
+		names[i] = col.Name()
+		types[i] = strings.ToLower(col.DatabaseTypeName())
+		if declared, ok := c.declared[col.Name()]; ok {
+			types[i] = declared
+		}
+	}
+	return c.typedColumns(names, types)
+}
+
+func (c *disclosureCheck) typedColumns(names, types []string) error {
+	c.groups = newDisclosureGroups(c.d, names, c.sources)
+	if c.groups.applies() && c.d.Action == DisclosureFlag {
+		names = append(append([]string{}, names...), DisclosureFlagColumn)
+		types = append(append([]string{}, types...), "boolean")
+	}
+	return c.next.typedColumns(names, types)
+}
+
+func (c *disclosureCheck) Row(values []interface{}) error {
+	if !c.groups.applies() {
+		return c.next.Row(values)
+	}
+	if c.spill == nil {
+		spill, err := os.CreateTemp("", "disclosure-*")
+		if err != nil {
+			return err
+		}
+		c.spill, c.buffer = spill, bufio.NewWriter(spill)
+		c.encoder = gob.NewEncoder(c.buffer)
+	}
+
+	row := make([]interface{}, len(values))
+	for i, val := range values {
+		row[i] = spillValue(val)
+	}
+	if err := c.encoder.Encode(row); err != nil {
+		return err
+	}
+	c.held++
+	c.groups.add(values)
+	return nil
+}
+
+// spillValue turns a scanned or masked value into one gob can hold and the
+// writers treat the same
+func spillValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case nil, string, int64, float64, bool, time.Time, json.Number:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return normalizeValue(textCell, val)
+}
+
+// flush writes the held back rows, suppressing or flagging the ones in small groups
+func (c *disclosureCheck) flush() error {
+	report, affected := c.groups.report()
+	c.report = report
+	if c.spill == nil {
+		return nil
+	}
+	defer c.close()
+
+	if err := c.buffer.Flush(); err != nil {
+		return err
+	}
+	if _, err := c.spill.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	decoder := gob.NewDecoder(bufio.NewReader(c.spill))
+	for i := 0; i < c.held; i++ {
+		var row []interface{}
+		if err := decoder.Decode(&row); err != nil {
+			return err
+		}
+		switch {
+		case c.d.Action == DisclosureFlag:
+			row = append(row, affected[i])
+		case affected[i]:
+			continue
+		}
+		if err := c.next.Row(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close removes the spilled rows
+func (c *disclosureCheck) close() {
+	if c.spill != nil {
+		c.spill.Close()
+		os.Remove(c.spill.Name())
+		c.spill = nil
+	}
+}
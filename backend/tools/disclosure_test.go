@@ -0,0 +1,185 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+// breakdown is a count by program, city and sex, as researchers ask for
+var breakdown = [][]interface{}{
+	{"135", "3273", "L", int64(40)},
+	{"135", "3273", "P", int64(38)},
+	{"135", "3171", "L", int64(12)},
+	{"135", "3171", "P", int64(2)},
+	{"182", "3273", "L", int64(9)},
+	{"182", "3273", "P", int64(7)},
+	{"182", "9471", "L", int64(1)},
+	{"182", "9471", "P", nil},
+}
+
+var breakdownColumns = []string{"kode_prodi", "kode_kota", "jenis_kelamin", "jumlah"}
+
+func TestCheckDisclosure(t *testing.T) {
+	d := Disclosure{K: 5, QuasiIdentifiers: []string{"kode_prodi", "kode_kota", "jenis_kelamin"}, CountColumns: []string{"count", "jumlah"}, Action: DisclosureSuppress}
+	report := CheckDisclosure(d, breakdownColumns, nil, breakdown)
+	if report.Passed() || report.CountColumn != "jumlah" || report.Groups != 8 {
+		t.Fatalf("report: %+v", report)
+	}
+	// The NULL count publishes nobody, so only 2 and 1 are small
+	if report.SmallGroups != 2 || report.AffectedRows != 2 || len(report.Rows) != 2 || report.Rows[0] != 3 || report.Rows[1] != 6 {
+		t.Errorf("small groups: %+v", report)
+	}
+	if len(report.Examples) != 2 || report.Examples[1].Size != 1 || report.Examples[1].Values["kode_kota"] != "9471" {
+		t.Errorf("examples: %+v", report.Examples)
+	}
+	// A single alumnus comes from 9471, and leaving out the city fixes both cells
+	if len(report.Causes) != 1 || report.Causes[0] != "kode_kota" {
+		t.Errorf("causes: %v, columns: %+v", report.Causes, report.Columns)
+	}
+
+	// Row level results count one alumnus per row
+	rows := [][]interface{}{{"135", "L"}, {"135", "L"}, {"135", "P"}, {[]byte("182"), "L"}}
+	report = CheckDisclosure(Disclosure{K: 2, QuasiIdentifiers: []string{"kode_prodi", "jenis_kelamin"}}, []string{"KODE_PRODI", "jenis_kelamin"}, nil, rows)
+	if report.SmallGroups != 2 || report.Rows[0] != 2 || report.Rows[1] != 3 {
+		t.Errorf("row level: %+v", report)
+	}
+	// kode_prodi 182 is rare on its own
+	if len(report.Causes) != 2 || report.Causes[0] != "KODE_PRODI" {
+		t.Errorf("row level causes: %v", report.Causes)
+	}
+
+	// Renamed quasi-identifiers and counts are found by their sources
+	query := "SELECT kode_prodi AS p, substr(kode_kota, 1, 4) AS k, jenis_kelamin AS s, count(*) AS banyak FROM alumni GROUP BY 1, 2, 3"
+	lineage, err := NewQueryLineage(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"p", "k", "s", "banyak"}
+	report = CheckDisclosure(d, names, lineage.Sources(names), breakdown)
+	if report.CountColumn != "banyak" || len(report.QuasiIdentifiers) != 3 || report.SmallGroups != 2 {
+		t.Errorf("renamed columns: %+v", report)
+	}
+
+	for _, off := range []Disclosure{{K: 1, QuasiIdentifiers: d.QuasiIdentifiers}, {K: 5, QuasiIdentifiers: []string{"angkatan"}}} {
+		if report := CheckDisclosure(off, breakdownColumns, nil, breakdown); !report.Passed() || report.Groups != 0 {
+			t.Errorf("%+v checked: %+v", off, report)
+		}
+	}
+}
+
+// checkedCSV writes breakdown through d into a CSV writer and returns it with the report
+func checkedCSV(t *testing.T, d Disclosure) (string, DisclosureReport) {
+	t.Helper()
+	var out bytes.Buffer
+	writer, _ := NewResultWriter("csv", &out, nil)
+	check, err := d.check(writer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := check.typedColumns(breakdownColumns, []string{"text", "text", "text", "bigint"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range breakdown {
+		if err := check.Row(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := check.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.String(), check.report
+}
+
+func TestDisclosureCheck(t *testing.T) {
+	d := Disclosure{K: 5, QuasiIdentifiers: []string{"kode_prodi", "kode_kota", "jenis_kelamin"}, CountColumns: []string{"jumlah"}, Action: DisclosureSuppress}
+	out, report := checkedCSV(t, d)
+	if strings.Contains(out, "3171,P") || strings.Contains(out, "9471,L") || !strings.Contains(out, "182,9471,P,\n") {
+		t.Errorf("suppressed:\n%s", out)
+	}
+	if report.AffectedRows != 2 {
+		t.Errorf("report: %+v", report)
+	}
+
+	d.Action = DisclosureFlag
+	out, _ = checkedCSV(t, d)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if lines[0] != "kode_prodi,kode_kota,jenis_kelamin,jumlah,small_cell" || len(lines) != 9 || lines[4] != "135,3171,P,2,true" || lines[1] != "135,3273,L,40,false" {
+		t.Errorf("flagged:\n%s", out)
+	}
+
+	// Nothing to group on, the rows pass untouched
+	d.QuasiIdentifiers = []string{"angkatan"}
+	out, report = checkedCSV(t, d)
+	if strings.Contains(out, "small_cell") || len(strings.Split(strings.TrimSpace(out), "\n")) != 9 || !report.Passed() {
+		t.Errorf("unchecked:\n%s", out)
+	}
+}
+
+func TestExportQueryDisclosure(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "alumni.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Exec(`CREATE TABLE alumni (nim TEXT, kode_prodi TEXT, jenis_kelamin TEXT)`)
+	for i := 0; i < 6; i++ {
+		db.Exec(`INSERT INTO alumni VALUES (?, '135', 'L')`, fmt.Sprintf("1351900%d", i))
+	}
+	db.Exec(`INSERT INTO alumni VALUES ('18219001', '182', 'P'), ('18219002', '182', 'P')`)
+
+	// The held back rows go to a temporary file, which is gone afterwards
+	spillDir := t.TempDir()
+	t.Setenv("TMPDIR", spillDir)
+	store := &LocalStorage{Dir: t.TempDir()}
+	research, _ := FindMaskingProfile("research")
+	mask := Masking{Profile: &research, Salt: RandomMaskingSalt()}
+	name, stats, err := ExportQuery(context.Background(), db, store, "SELECT kode_prodi AS prodi, jenis_kelamin FROM alumni", nil, "csv", QueryLimits{MaxRows: 100, Timeout: time.Minute}, mask, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Rows != 6 || stats.Disclosure == nil || stats.Disclosure.AffectedRows != 2 {
+		t.Errorf("stats: %+v, disclosure %+v", stats, stats.Disclosure)
+	}
+
+	file, _, err := store.Open(context.Background(), ExportKey(name, "csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	content, _ := io.ReadAll(file)
+	if strings.Contains(string(content), "182") || strings.Count(string(content), "135,L\n") != 6 {
+		t.Errorf("stored export:\n%s", content)
+	}
+	if spilled, _ := filepath.Glob(filepath.Join(spillDir, "disclosure-*")); len(spilled) != 0 {
+		t.Errorf("spilled rows left behind: %v", spilled)
+	}
+}
+
+func TestDefaultDisclosure(t *testing.T) {
+	if d := DefaultDisclosure(); d.K != 5 || d.Action != DisclosureSuppress || d.QuasiIdentifiers[0] != "kode_prodi" {
+		t.Errorf("defaults: %+v", d)
+	}
+	t.Setenv("DISCLOSURE_K", "10")
+	t.Setenv("DISCLOSURE_ACTION", "Flag")
+	t.Setenv("DISCLOSURE_QUASI_IDENTIFIERS", " Angkatan , ,kode_prodi")
+	if d := DefaultDisclosure(); d.K != 10 || d.Action != DisclosureFlag || strings.Join(d.QuasiIdentifiers, ",") != "angkatan,kode_prodi" {
+		t.Errorf("configured: %+v", d)
+	}
+
+	full, _ := FindMaskingProfile("full")
+	research, _ := FindMaskingProfile("research")
+	if (Masking{Profile: &full}).Disclosure().Enabled() || (Masking{}).Disclosure().Enabled() || !(Masking{Profile: &research}).Disclosure().Enabled() {
+		t.Error("disclosure control does not follow the masking profile")
+	}
+}
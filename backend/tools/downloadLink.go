@@ -0,0 +1,189 @@
+package tools
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultDownloadLinkTTL is how long download links stay valid unless DOWNLOAD_LINK_TTL is set
+const defaultDownloadLinkTTL = 7 * 24 * time.Hour
+
+var (
+	ErrInvalidDownloadLink = errors.New("invalid download link")
+	ErrDownloadLinkExpired = errors.New("download link expired")
+	// ErrRecipientRequired means the link is bound to a recipient and the
+	// downloader has yet to confirm the address with the email parameter
+	ErrRecipientRequired = errors.New("download link needs the recipient's email")
+	// ErrRecipientMismatch means the confirmed address is not the one the
+	// link was sent to
+	ErrRecipientMismatch = errors.New("email does not match the download link")
+)
+
+// DownloadLink is what a signed download URL grants: one export in one
+// format until Expires, optionally bound to the Recipient it was sent to.
+// A bound link does not carry the address: the downloader has to type it in
+// as the email parameter, and it only verifies when that matches.
+type DownloadLink struct {
+	Name      string
+	Format    string
+	Recipient string
+	Expires   time.Time
+}
+
+// DownloadLinkTTL is the lifetime of new download links: DOWNLOAD_LINK_TTL
+// (a Go duration) or a week.
+func DownloadLinkTTL() time.Duration {
+	if ttl, err := time.ParseDuration(os.Getenv("DOWNLOAD_LINK_TTL")); err == nil && ttl > 0 {
+		return ttl
+	}
+	return defaultDownloadLinkTTL
+}
+
+// downloadSecret signs download links: DOWNLOAD_SECRET, or JWT_SECRET when unset
+func downloadSecret() []byte {
+	if secret := os.Getenv("DOWNLOAD_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	return []byte(os.Getenv("JWT_SECRET"))
+}
+
+// signLink signs the newline separated parts of a link with downloadSecret
+func signLink(parts ...string) string {
+	mac := hmac.New(sha256.New, downloadSecret())
+	mac.Write([]byte(strings.Join(parts, "\n")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (l DownloadLink) signature() string {
+	return signLink("download", l.Name, l.Format, strings.ToLower(l.Recipient), strconv.FormatInt(l.Expires.Unix(), 10))
+}
+
+// URL returns the signed link under baseURL, e.g. BASE_URL/downloads/<name>?format=csv&expires=...&sig=...
+func (l DownloadLink) URL(baseURL string) string {
+	query := url.Values{}
+	query.Set("format", l.Format)
+	query.Set("expires", strconv.FormatInt(l.Expires.Unix(), 10))
+	if l.Recipient != "" {
+		query.Set("bound", "1")
+	}
+	query.Set("sig", l.signature())
+	return baseURL + "/downloads/" + url.PathEscape(l.Name) + "?" + query.Encode()
+}
+
+// NewDownloadURL signs a link to export name in format for recipient ("" for
+// anyone holding the link) that expires after DownloadLinkTTL.
+func NewDownloadURL(baseURL, name, format, recipient string) string {
+	link := DownloadLink{Name: name, Format: format, Recipient: recipient, Expires: time.Now().Add(DownloadLinkTTL())}
+	return link.URL(baseURL)
+}
+
+// linkRecipient is the address a downloader confirmed for a bound link, or
+// ErrRecipientRequired when they have yet to
+func linkRecipient(query url.Values) (string, error) {
+	if query.Get("bound") == "" {
+		return "", nil
+	}
+	recipient := strings.ToLower(strings.TrimSpace(query.Get("email")))
+	if recipient == "" {
+		return "", ErrRecipientRequired
+	}
+	return recipient, nil
+}
+
+// badSignature is the error for a link whose signature does not verify: a
+// wrong address when the downloader confirmed one, else a forged link
+func badSignature(query url.Values) error {
+	if query.Get("bound") != "" {
+		return ErrRecipientMismatch
+	}
+	return ErrInvalidDownloadLink
+}
+
+// VerifyDownloadLink checks the signature and expiry of a download request
+// for export name with the given query parameters, and for a bound link the
+// address confirmed in email.
+func VerifyDownloadLink(name string, query url.Values) (DownloadLink, error) {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return DownloadLink{}, ErrInvalidDownloadLink
+	}
+	recipient, err := linkRecipient(query)
+	if err != nil {
+		return DownloadLink{}, err
+	}
+	link := DownloadLink{
+		Name:      name,
+		Format:    query.Get("format"),
+		Recipient: recipient,
+		Expires:   time.Unix(expires, 0),
+	}
+
+	if !hmac.Equal([]byte(query.Get("sig")), []byte(link.signature())) {
+		return DownloadLink{}, badSignature(query)
+	}
+	if time.Now().After(link.Expires) {
+		return link, ErrDownloadLinkExpired
+	}
+	return link, nil
+}
+
+// FileLink is what a signed file URL grants: one stored object that is not
+// an export, such as an email attachment, until Expires, optionally bound to
+// the Recipient it was sent to the same way as a DownloadLink.
+type FileLink struct {
+	Key       string
+	Recipient string
+	Expires   time.Time
+}
+
+func (l FileLink) signature() string {
+	return signLink("file", l.Key, strings.ToLower(l.Recipient), strconv.FormatInt(l.Expires.Unix(), 10))
+}
+
+// URL returns the signed link under baseURL, e.g. BASE_URL/files/emailAttachments/<uuid>.pdf?expires=...&sig=...
+func (l FileLink) URL(baseURL string) string {
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(l.Expires.Unix(), 10))
+	if l.Recipient != "" {
+		query.Set("bound", "1")
+	}
+	query.Set("sig", l.signature())
+	return baseURL + "/files/" + (&url.URL{Path: l.Key}).EscapedPath() + "?" + query.Encode()
+}
+
+// NewFileURL signs a link to the stored object key for recipient ("" for
+// anyone holding the link) that expires after DownloadLinkTTL.
+func NewFileURL(baseURL, key, recipient string) string {
+	link := FileLink{Key: key, Recipient: recipient, Expires: time.Now().Add(DownloadLinkTTL())}
+	return link.URL(baseURL)
+}
+
+// VerifyFileLink checks the signature and expiry of a request for the stored
+// object key with the given query parameters, and for a bound link the
+// address confirmed in email.
+func VerifyFileLink(key string, query url.Values) (FileLink, error) {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || !ValidKey(key) {
+		return FileLink{}, ErrInvalidDownloadLink
+	}
+	recipient, err := linkRecipient(query)
+	if err != nil {
+		return FileLink{}, err
+	}
+	link := FileLink{Key: key, Recipient: recipient, Expires: time.Unix(expires, 0)}
+
+	if !hmac.Equal([]byte(query.Get("sig")), []byte(link.signature())) {
+		return FileLink{}, badSignature(query)
+	}
+	if time.Now().After(link.Expires) {
+		return link, ErrDownloadLinkExpired
+	}
+	return link, nil
+}
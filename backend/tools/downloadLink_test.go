@@ -0,0 +1,117 @@
+package tools
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func parseDownloadURL(t *testing.T, raw string) (string, url.Values) {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimPrefix(u.Path, "/downloads/"), u.Query()
+}
+
+func TestDownloadLink(t *testing.T) {
+	t.Setenv("DOWNLOAD_SECRET", "download-secret")
+	name, query := parseDownloadURL(t, NewDownloadURL("http://localhost:8080", "abc123", "csv", "Siti@example.com"))
+
+	// A bound link doesn't carry the address, the downloader confirms it
+	if _, err := VerifyDownloadLink(name, query); err != ErrRecipientRequired {
+		t.Fatalf("unconfirmed: want ErrRecipientRequired, got %v", err)
+	}
+	query.Set("email", "Siti@example.com")
+
+	link, err := VerifyDownloadLink(name, query)
+	if err != nil {
+		t.Fatalf("VerifyDownloadLink: %v", err)
+	}
+	if link.Name != "abc123" || link.Format != "csv" || link.Recipient != "siti@example.com" {
+		t.Errorf("unexpected link %+v", link)
+	}
+	if ttl := time.Until(link.Expires); ttl <= 0 || ttl > DownloadLinkTTL() {
+		t.Errorf("expires in %v", ttl)
+	}
+
+	tamper := func(key, value string) url.Values {
+		changed := url.Values{}
+		for k, v := range query {
+			changed[k] = v
+		}
+		changed.Set(key, value)
+		return changed
+	}
+	for label, bad := range map[string]url.Values{
+		"other format":    tamper("format", "xlsx"),
+		"other recipient": tamper("email", "budi@example.com"),
+		"later expiry":    tamper("expires", "9999999999"),
+		"no signature":    tamper("sig", ""),
+	} {
+		if _, err := VerifyDownloadLink(name, bad); err != ErrRecipientMismatch {
+			t.Errorf("%s: want ErrRecipientMismatch, got %v", label, err)
+		}
+	}
+	if _, err := VerifyDownloadLink("other", query); err != ErrRecipientMismatch {
+		t.Errorf("other export: want ErrRecipientMismatch, got %v", err)
+	}
+	// Dropping the binding doesn't make the link anyone's
+	unbound := tamper("bound", "")
+	if _, err := VerifyDownloadLink(name, unbound); err != ErrInvalidDownloadLink {
+		t.Errorf("unbound: want ErrInvalidDownloadLink, got %v", err)
+	}
+
+	// Recipients are compared case-insensitively
+	if _, err := VerifyDownloadLink(name, tamper("email", " siti@EXAMPLE.com")); err != nil {
+		t.Errorf("differently cased recipient rejected: %v", err)
+	}
+
+	t.Setenv("DOWNLOAD_SECRET", "another-secret")
+	if _, err := VerifyDownloadLink(name, query); err != ErrRecipientMismatch {
+		t.Errorf("link signed with another secret: want ErrRecipientMismatch, got %v", err)
+	}
+}
+
+func TestDownloadLinkUnbound(t *testing.T) {
+	t.Setenv("DOWNLOAD_SECRET", "download-secret")
+	name, query := parseDownloadURL(t, NewDownloadURL("", "abc123", "csv", ""))
+	if query.Has("bound") {
+		t.Fatalf("unbound link asks for an address: %v", query)
+	}
+	link, err := VerifyDownloadLink(name, query)
+	if err != nil || link.Recipient != "" {
+		t.Errorf("unbound link: %+v, %v", link, err)
+	}
+	query.Set("format", "xlsx")
+	if _, err := VerifyDownloadLink(name, query); err != ErrInvalidDownloadLink {
+		t.Errorf("other format: want ErrInvalidDownloadLink, got %v", err)
+	}
+}
+
+func TestDownloadLinkExpired(t *testing.T) {
+	t.Setenv("DOWNLOAD_SECRET", "download-secret")
+	expired := DownloadLink{Name: "abc123", Format: "csv", Expires: time.Now().Add(-time.Minute)}
+	name, query := parseDownloadURL(t, expired.URL(""))
+
+	if _, err := VerifyDownloadLink(name, query); err != ErrDownloadLinkExpired {
+		t.Errorf("want ErrDownloadLinkExpired, got %v", err)
+	}
+}
+
+func TestDownloadLinkTTL(t *testing.T) {
+	t.Setenv("DOWNLOAD_LINK_TTL", "")
+	if got := DownloadLinkTTL(); got != defaultDownloadLinkTTL {
+		t.Errorf("default TTL = %v", got)
+	}
+	t.Setenv("DOWNLOAD_LINK_TTL", "48h")
+	if got := DownloadLinkTTL(); got != 48*time.Hour {
+		t.Errorf("TTL = %v, want 48h", got)
+	}
+	t.Setenv("DOWNLOAD_LINK_TTL", "soon")
+	if got := DownloadLinkTTL(); got != defaultDownloadLinkTTL {
+		t.Errorf("invalid TTL = %v, want default", got)
+	}
+}
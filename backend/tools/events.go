@@ -0,0 +1,17 @@
+package tools
+
+import (
+	"log"
+
+	"gorm.io/gorm"
+
+	"grad_deploy/models"
+)
+
+// RecordEvent appends an event to a data request's timeline. A failure is
+// logged rather than returned so it never undoes the action being recorded.
+func RecordEvent(db *gorm.DB, event models.DataRequestEvent) {
+	if err := db.Create(&event).Error; err != nil {
+		log.Printf("Failed to record %s event for data request %s: %v", event.Type, event.DataRequestID, err)
+	}
+}
@@ -0,0 +1,181 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"grad_deploy/models"
+)
+
+// ExportDir is where LocalStorage keeps exports and uploads unless STORAGE_DIR is set
+const ExportDir = "uploads"
+
+// ExportFormats are the file formats an export can be written in
+var ExportFormats = []string{"csv", "json", "ndjson", "xlsx", "parquet"}
+
+// storedFormats are the formats exports can be stored in: ExportFormats and
+// ProtectedFormat
+var storedFormats = append(append([]string{}, ExportFormats...), ProtectedFormat)
+
+// progressInterval is how many rows are written between progress callbacks
+const progressInterval = 1000
+
+// NormalizeFormat maps user supplied formats ("CSV", "excel", "") to one of ExportFormats.
+func NormalizeFormat(format string) (string, error) {
+	format = strings.ToLower(strings.TrimSpace(format))
+	switch format {
+	case "":
+		return "csv", nil
+	case "excel", "xls":
+		return "xlsx", nil
+	case "jsonl":
+		return "ndjson", nil
+	}
+	for _, known := range ExportFormats {
+		if format == known {
+			return format, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported export format %q", format)
+}
+
+// ExportKey returns the storage key an export called name is stored under.
+func ExportKey(name, format string) string {
+	return fmt.Sprintf("req-%s.%s", name, format)
+}
+
+// ExportQuery runs query with args through RunReadOnlyQuery and streams the result,
+// masked by mask and checked for small cells by mask.Disclosure(), to a
+// temporary file, which is then stored in store. It returns the generated
+// export name. onProgress, when set, is called with the number of rows read
+// so far.
+func ExportQuery(ctx context.Context, db *gorm.DB, store Storage, query string, args []interface{}, format string, limits QueryLimits, mask Masking, onProgress func(rows int)) (string, QueryStats, error) {
+	name, err := RandomName(16)
+	if err != nil {
+		return "", QueryStats{}, err
+	}
+	if mask, err = mask.ForQuery(query); err != nil {
+		return "", QueryStats{}, err
+	}
+
+	// Nothing partial ever reaches the storage, the temporary file is always removed
+	file, err := os.CreateTemp("", "export-*."+format)
+	if err != nil {
+		return "", QueryStats{}, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	// Declared types of the fixed table are more precise than the driver's
+	columns, _ := TableColumns(db, os.Getenv("FIXED_TABLE"))
+	declared := ColumnTypes(columns)
+	writer, err := NewResultWriter(format, file, declared)
+	if err != nil {
+		return "", QueryStats{}, err
+	}
+
+	// The small-cell check sees the result as it leaves, after masking
+	var next RowHandler = writer
+	var check *disclosureCheck
+	if control := mask.Disclosure(); control.Enabled() {
+		if check, err = control.check(writer, declared); err != nil {
+			return "", QueryStats{}, err
+		}
+		defer check.close()
+		next = check
+	}
+
+	handler := &progressRows{RowHandler: mask.Wrap(next, declared), onProgress: onProgress}
+	stats, err := RunReadOnlyQuery(ctx, db, query, args, limits, handler)
+	if err == nil && check != nil {
+		err = check.flush()
+		stats.Disclosure = &check.report
+		if check.d.Action == DisclosureSuppress {
+			stats.Rows -= check.report.AffectedRows
+		}
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return "", stats, err
+	}
+
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		key := ExportKey(name, format)
+		err = store.Put(ctx, key, file, size, ContentType(key))
+	}
+	if err != nil {
+		return "", stats, err
+	}
+
+	return name, stats, nil
+}
+
+// FindExport returns the format of the first object stored for export name.
+func FindExport(ctx context.Context, store Storage, name string) (string, bool) {
+	for _, format := range storedFormats {
+		if _, err := store.Stat(ctx, ExportKey(name, format)); err == nil {
+			return format, true
+		}
+	}
+	return "", false
+}
+
+// progressRows reports every progressInterval rows handed to the wrapped handler
+type progressRows struct {
+	RowHandler
+	onProgress func(rows int)
+	rows       int
+}
+
+func (p *progressRows) Row(values []interface{}) error {
+	if err := p.RowHandler.Row(values); err != nil {
+		return err
+	}
+
+	p.rows++
+	if p.onProgress != nil && p.rows%progressInterval == 0 {
+		p.onProgress(p.rows)
+	}
+	return nil
+}
+
+// RecordExport stores the metadata of a written export, filling in its size
+// and when it expires. Downloads are only served for recorded exports, so
+// when the record cannot be written the file is deleted and the error
+// returned: the export failed.
+func RecordExport(db *gorm.DB, store Storage, export models.ExportFile) error {
+	if info, err := store.Stat(context.Background(), ExportKey(export.Name, export.Format)); err == nil {
+		export.Size = info.Size
+	}
+	if export.ExpiresAt == nil {
+		expires := time.Now().Add(ExportRetention())
+		export.ExpiresAt = &expires
+	}
+	if err := db.Create(&export).Error; err != nil {
+		store.Delete(context.Background(), ExportKey(export.Name, export.Format))
+		return fmt.Errorf("record export %s: %w", export.Name, err)
+	}
+	return nil
+}
+
+// DiscardExport deletes a recorded export that ended up unused, its file and
+// its record
+func DiscardExport(db *gorm.DB, store Storage, name, format string) {
+	store.Delete(context.Background(), ExportKey(name, format))
+	if err := db.Delete(&models.ExportFile{}, "name = ?", name).Error; err != nil {
+		log.Printf("Failed to delete the record of export %s: %v", name, err)
+	}
+}
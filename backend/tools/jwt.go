@@ -53,11 +53,15 @@ func valid(authorization []string) bool {
 }
 
 func parseAccessToken(accessToken string) (*UserClaims, error) {
-	parsedAccessToken, _ := jwt.ParseWithClaims(accessToken, &UserClaims{}, func(token *jwt.Token) (interface{}, error) {
+	parsedAccessToken, err := jwt.ParseWithClaims(accessToken, &UserClaims{}, func(token *jwt.Token) (interface{}, error) {
+		// Only accept the HMAC tokens issued by NewAccessToken
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.New("unexpected signing method")
+		}
 		return []byte(os.Getenv("JWT_SECRET")), nil
 	})
 
-	if parsedAccessToken == nil {
+	if err != nil || parsedAccessToken == nil || !parsedAccessToken.Valid {
 		return nil, errors.New("invalid token")
 	}
 
@@ -0,0 +1,510 @@
+package tools
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Masking actions a profile applies to a column. Generalize takes an optional
+// parameter after a colon: the decimals numbers are rounded to (default 1) or
+// the characters text keeps (default 3). Dates and timestamps become their year.
+const (
+	MaskPass       = "pass"
+	MaskHash       = "hash"
+	MaskRedact     = "redact"
+	MaskGeneralize = "generalize"
+	MaskDrop       = "drop"
+)
+
+// MaskRedacted replaces redacted values
+const MaskRedacted = "***"
+
+// maskHashLength is how many hex digits of the HMAC a hashed value keeps
+const maskHashLength = 16
+
+// DefaultMaskingProfile is suggested for purposes no profile claims
+const DefaultMaskingProfile = "research"
+
+// MaskingProfile decides what happens to each result column, by name.
+// Columns not listed get Default, or pass through when it is empty.
+type MaskingProfile struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Purposes are words in a request's purpose that suggest this profile
+	Purposes []string          `json:"purposes"`
+	Columns  map[string]string `json:"columns"`
+	Default  string            `json:"default"`
+	// SkipDisclosure leaves results out of the small-cell check, for
+	// profiles whose results identify alumni anyway
+	SkipDisclosure bool `json:"skip_disclosure"`
+}
+
+// builtinMaskingProfiles cover the columns of the tracer view: nim, nama,
+// jenis_kelamin and ipk
+var builtinMaskingProfiles = []MaskingProfile{
+	{
+		Name:           "full",
+		Description:    "Everything as stored, for the tracer study team itself",
+		Columns:        map[string]string{},
+		SkipDisclosure: true,
+	},
+	{
+		Name:        "research",
+		Description: "Pseudonymous records for theses and research: NIM hashed, names dropped, GPA rounded",
+		Purposes:    []string{"skripsi", "tesis", "disertasi", "penelitian", "riset", "thesis", "research"},
+		Columns:     map[string]string{"nim": MaskHash, "nama": MaskDrop, "ipk": MaskGeneralize},
+	},
+	{
+		Name:        "statistics",
+		Description: "Generalized records for reports and accreditation: NIM cut to program and year, names dropped, GPA rounded",
+		Purposes:    []string{"akreditasi", "statistik", "laporan", "evaluasi", "accreditation", "statistics", "report"},
+		Columns:     map[string]string{"nim": MaskGeneralize + ":5", "nama": MaskDrop, "ipk": MaskGeneralize},
+	},
+	{
+		Name:           "contact",
+		Description:    "Names and NIM for alumni relations, without grades",
+		Purposes:       []string{"alumni", "undangan", "reuni", "kontak", "invitation", "contact"},
+		Columns:        map[string]string{"ipk": MaskDrop},
+		SkipDisclosure: true,
+	},
+}
+
+// MaskingProfiles returns the built-in profiles, replaced or extended by the
+// JSON array in the file MASKING_PROFILES names, if set, sorted by name.
+func MaskingProfiles() ([]MaskingProfile, error) {
+	profiles := make(map[string]MaskingProfile, len(builtinMaskingProfiles))
+	for _, profile := range builtinMaskingProfiles {
+		profiles[profile.Name] = profile
+	}
+
+	if path := os.Getenv("MASKING_PROFILES"); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("masking profiles: %w", err)
+		}
+		var configured []MaskingProfile
+		if err := json.Unmarshal(content, &configured); err != nil {
+			return nil, fmt.Errorf("masking profiles: %w", err)
+		}
+		for _, profile := range configured {
+			if err := profile.validate(); err != nil {
+				return nil, err
+			}
+			profiles[profile.Name] = profile
+		}
+	}
+
+	list := make([]MaskingProfile, 0, len(profiles))
+	for _, profile := range profiles {
+		list = append(list, profile)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// FindMaskingProfile returns the profile called name
+func FindMaskingProfile(name string) (MaskingProfile, error) {
+	profiles, err := MaskingProfiles()
+	if err != nil {
+		return MaskingProfile{}, err
+	}
+	for _, profile := range profiles {
+		if profile.Name == name {
+			return profile, nil
+		}
+	}
+	return MaskingProfile{}, fmt.Errorf("unknown masking profile %q", name)
+}
+
+// identifierColumns are the columns of the tracer view that identify an
+// alumnus on their own
+var identifierColumns = []string{"nim", "nama"}
+
+// SuggestMaskingProfile picks the profile for a request's stated purpose: the
+// one with a purpose word in it, or DefaultMaskingProfile when none or
+// several do. Profiles that skip the small-cell check or pass identifiers
+// through are never suggested, an admin has to choose them.
+func SuggestMaskingProfile(purpose string) string {
+	profiles, err := MaskingProfiles()
+	if err != nil {
+		return DefaultMaskingProfile
+	}
+	words := strings.FieldsFunc(strings.ToLower(purpose), func(r rune) bool {
+		return !('a' <= r && r <= 'z' || '0' <= r && r <= '9')
+	})
+	var matched []string
+	for _, profile := range profiles {
+		if profile.suggestible() && profile.matches(words) {
+			matched = append(matched, profile.Name)
+		}
+	}
+	if len(matched) != 1 {
+		return DefaultMaskingProfile
+	}
+	return matched[0]
+}
+
+// matches reports whether one of words is a purpose of the profile
+func (p MaskingProfile) matches(words []string) bool {
+	for _, keyword := range p.Purposes {
+		for _, word := range words {
+			if word == strings.ToLower(keyword) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// suggestible reports whether the profile may be suggested without an admin
+// choosing it: it is checked for small cells and masks every identifier
+func (p MaskingProfile) suggestible() bool {
+	if p.SkipDisclosure {
+		return false
+	}
+	for _, column := range identifierColumns {
+		if action, _ := p.rule(column); action == MaskPass {
+			return false
+		}
+	}
+	return true
+}
+
+func (p MaskingProfile) validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("masking profile without a name")
+	}
+	for column, rule := range p.Columns {
+		if _, _, err := parseMaskRule(rule); err != nil {
+			return fmt.Errorf("masking profile %s, column %s: %w", p.Name, column, err)
+		}
+	}
+	if p.Default != "" {
+		if _, _, err := parseMaskRule(p.Default); err != nil {
+			return fmt.Errorf("masking profile %s, default: %w", p.Name, err)
+		}
+	}
+	return nil
+}
+
+// rule returns the action and parameter for column
+func (p MaskingProfile) rule(column string) (string, int) {
+	rule, ok := p.Columns[column]
+	if !ok {
+		rule = p.Default
+	}
+	action, param, err := parseMaskRule(rule)
+	if err != nil {
+		// Profiles are validated when loaded; anything else is hidden to be safe
+		return MaskRedact, 0
+	}
+	return action, param
+}
+
+// parseMaskRule splits "generalize:5" into its action and parameter; -1 means none
+func parseMaskRule(rule string) (string, int, error) {
+	if rule == "" {
+		return MaskPass, -1, nil
+	}
+	action, arg, hasArg := strings.Cut(strings.ToLower(strings.TrimSpace(rule)), ":")
+	switch action {
+	case MaskPass, MaskHash, MaskRedact, MaskDrop:
+		if hasArg {
+			return "", 0, fmt.Errorf("%s takes no parameter", action)
+		}
+		return action, -1, nil
+	case MaskGeneralize:
+		if !hasArg {
+			return action, -1, nil
+		}
+		param, err := strconv.Atoi(arg)
+		if err != nil || param < 0 {
+			return "", 0, fmt.Errorf("invalid generalize parameter %q", arg)
+		}
+		return action, param, nil
+	}
+	return "", 0, fmt.Errorf("unknown masking action %q", action)
+}
+
+// maskingSecret derives per request salts: MASKING_SECRET, or JWT_SECRET when unset
+func maskingSecret() []byte {
+	if secret := os.Getenv("MASKING_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	return []byte(os.Getenv("JWT_SECRET"))
+}
+
+// MaskingSalt is the salt hashed columns of data request id use, so a value
+// hashes the same in every export of a request but differently across requests
+func MaskingSalt(id uuid.UUID) []byte {
+	mac := hmac.New(sha256.New, maskingSecret())
+	mac.Write([]byte("masking:"))
+	mac.Write(id[:])
+	return mac.Sum(nil)
+}
+
+// RandomMaskingSalt is the salt of results that belong to no data request
+func RandomMaskingSalt() []byte {
+	salt := make([]byte, sha256.Size)
+	rand.Read(salt)
+	return salt
+}
+
+// Masking is a profile applied with a salt. The zero Masking leaves results as they are.
+type Masking struct {
+	Profile *MaskingProfile
+	Salt    []byte
+	// lineage follows result columns back to table columns, see ForQuery
+	lineage *QueryLineage
+}
+
+// NewMasking applies the profile called profile, salted for data request
+// requestID if there is one. An empty profile masks nothing.
+func NewMasking(profile string, requestID *uuid.UUID) (Masking, error) {
+	if profile == "" {
+		return Masking{}, nil
+	}
+	found, err := FindMaskingProfile(profile)
+	if err != nil {
+		return Masking{}, err
+	}
+	salt := RandomMaskingSalt()
+	if requestID != nil {
+		salt = MaskingSalt(*requestID)
+	}
+	return Masking{Profile: &found, Salt: salt}, nil
+}
+
+// Wrap returns a handler that masks the result before handing it to
+// handler. declared maps column names to their declared types, e.g. from
+// TableColumns, which decide how values are generalized.
+func (m Masking) Wrap(handler RowHandler, declared map[string]string) RowHandler {
+	if m.Profile == nil && m.lineage == nil {
+		return handler
+	}
+	return &maskedRows{next: handler, masking: m, declared: declared}
+}
+
+// ForQuery returns m for the results of query: columns are then masked by
+// the table columns they come from rather than by their names, so an alias
+// or expression gets the rule of what it reads.
+func (m Masking) ForQuery(query string) (Masking, error) {
+	lineage, err := NewQueryLineage(query)
+	if err != nil {
+		return Masking{}, err
+	}
+	m.lineage = lineage
+	return m, nil
+}
+
+// rule returns the action and parameter for a result column: the rule of the
+// table column it is, the strictest rule of the ones it is computed from, or
+// the rule for its own name when it reads none. What is computed from hashed
+// columns is redacted, as it would no longer hash like them.
+func (m Masking) rule(name string, source ColumnSource) (string, int) {
+	switch {
+	case m.Profile == nil:
+		return MaskPass, -1
+	case len(source.Columns) == 0:
+		return m.Profile.rule(name)
+	case source.Direct && len(source.Columns) == 1:
+		return m.Profile.rule(source.Columns[0])
+	}
+
+	action, param := MaskPass, -1
+	stricter := func(column string) {
+		a, p := m.Profile.rule(column)
+		switch {
+		case a == MaskPass:
+		case a == MaskDrop || action == MaskDrop:
+			action, param = MaskDrop, -1
+		case a == MaskGeneralize && (action == MaskPass || action == MaskGeneralize && param == p):
+			action, param = a, p
+		default:
+			action, param = MaskRedact, -1
+		}
+	}
+	for _, column := range source.Columns {
+		if column != "*" {
+			stricter(column)
+			continue
+		}
+		// A whole row: every listed column, and "" for the ones not listed
+		for listed := range m.Profile.Columns {
+			stricter(listed)
+		}
+		stricter("")
+	}
+	return action, param
+}
+
+// ProfileName is the name of the applied profile, "" when there is none
+func (m Masking) ProfileName() string {
+	if m.Profile == nil {
+		return ""
+	}
+	return m.Profile.Name
+}
+
+// Disclosure is the small-cell check exports under the profile go through:
+// DefaultDisclosure, unless there is no profile or it skips the check
+func (m Masking) Disclosure() Disclosure {
+	if m.Profile == nil || m.Profile.SkipDisclosure {
+		return Disclosure{}
+	}
+	return DefaultDisclosure()
+}
+
+// typedRowHandler takes column names with resolved types rather than the
+// driver's column types, so masking can change a column's type
+type typedRowHandler interface {
+	RowHandler
+	typedColumns(names, types []string) error
+}
+
+type maskedColumn struct {
+	action string
+	param  int
+	kind   cellKind
+}
+
+// SourcedRowHandler is a RowHandler that is told where the result columns
+// come from, see QueryLineage. ColumnSources is called before Columns, and
+// only when the sources are known.
+type SourcedRowHandler interface {
+	RowHandler
+	ColumnSources(sources []ColumnSource)
+}
+
+// maskedRows applies a Masking to every row on the way to next
+type maskedRows struct {
+	next     RowHandler
+	masking  Masking
+	declared map[string]string
+	columns  []maskedColumn
+}
+
+func (m *maskedRows) Columns(cols []*sql.ColumnType) error {
+	names := make([]string, len(cols))
+	for i, col := range cols {
+		names[i] = col.Name()
+	}
+	sources := m.masking.lineage.Sources(names)
+
+	m.columns = make([]maskedColumn, len(cols))
+	var kept []*sql.ColumnType
+	var keptNames, types []string
+	var keptSources []ColumnSource
+	for i, col := range cols {
+		var source ColumnSource
+		if sources != nil {
+			source = sources[i]
+		}
+		// A column as stored has the declared type of the table column
+		declaredName := col.Name()
+		if source.Direct && len(source.Columns) == 1 {
+			declaredName = source.Columns[0]
+		}
+		dataType, ok := m.declared[declaredName]
+		if !ok {
+			dataType = strings.ToLower(col.DatabaseTypeName())
+		}
+		action, param := m.masking.rule(col.Name(), source)
+		m.columns[i] = maskedColumn{action: action, param: param, kind: kindOf(dataType)}
+		if action == MaskDrop {
+			continue
+		}
+
+		switch {
+		case action == MaskHash, action == MaskRedact:
+			dataType = "text"
+		case action == MaskGeneralize && (m.columns[i].kind == dateCell || m.columns[i].kind == timestampCell):
+			dataType = "integer"
+		}
+		kept = append(kept, col)
+		keptNames = append(keptNames, col.Name())
+		types = append(types, dataType)
+		keptSources = append(keptSources, source)
+	}
+
+	if sourced, ok := m.next.(SourcedRowHandler); ok && sources != nil {
+		sourced.ColumnSources(keptSources)
+	}
+	if typed, ok := m.next.(typedRowHandler); ok {
+		return typed.typedColumns(keptNames, types)
+	}
+	return m.next.Columns(kept)
+}
+
+func (m *maskedRows) Row(values []interface{}) error {
+	masked := make([]interface{}, 0, len(values))
+	for i, val := range values {
+		col := m.columns[i]
+		if col.action == MaskDrop {
+			continue
+		}
+		masked = append(masked, col.mask(val, m.masking.Salt))
+	}
+	return m.next.Row(masked)
+}
+
+// mask applies the column's action to one value; NULL stays NULL
+func (c maskedColumn) mask(val interface{}, salt []byte) interface{} {
+	if c.action == MaskPass {
+		return val
+	}
+	val = normalizeValue(c.kind, val)
+	if val == nil {
+		return nil
+	}
+
+	switch c.action {
+	case MaskHash:
+		mac := hmac.New(sha256.New, salt)
+		mac.Write([]byte(formatText(c.kind, val)))
+		return hex.EncodeToString(mac.Sum(nil))[:maskHashLength]
+	case MaskRedact:
+		return MaskRedacted
+	}
+
+	// Generalize
+	switch v := val.(type) {
+	case time.Time:
+		return int64(v.Year())
+	case bool:
+		return v
+	case string:
+		keep := c.param
+		if keep < 0 {
+			keep = 3
+		}
+		runes := []rune(v)
+		if len(runes) <= keep {
+			return v
+		}
+		return string(runes[:keep]) + strings.Repeat("*", len(runes)-keep)
+	}
+	number, err := strconv.ParseFloat(formatText(c.kind, val), 64)
+	if err != nil {
+		return MaskRedacted
+	}
+	decimals := c.param
+	if decimals < 0 {
+		decimals = 1
+	}
+	scale := math.Pow(10, float64(decimals))
+	return json.Number(strconv.FormatFloat(math.Round(number*scale)/scale, 'f', decimals, 64))
+}
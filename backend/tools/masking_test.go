@@ -0,0 +1,170 @@
+package tools
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// alumniDeclared are the declared types of the test alumni table, as TableColumns reports them
+var alumniDeclared = map[string]string{
+	"nim": "character varying", "nama": "character varying", "jenis_kelamin": "character varying",
+	"ipk": "numeric(3,2)", "lulus": "date",
+}
+
+// maskedCSV feeds the test alumni table through masking into a CSV writer,
+// the way RunReadOnlyQuery would, and returns the output
+func maskedCSV(t *testing.T, masking Masking) string {
+	t.Helper()
+	return maskedQueryCSV(t, masking, `SELECT nim, nama, jenis_kelamin, ipk, lulus FROM alumni`)
+}
+
+// maskedQueryCSV is maskedCSV for the result of query
+func maskedQueryCSV(t *testing.T, masking Masking, query string) string {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Exec(`CREATE TABLE IF NOT EXISTS alumni (nim TEXT, nama TEXT, jenis_kelamin TEXT, ipk NUMERIC, lulus TEXT)`)
+	db.Exec(`DELETE FROM alumni`)
+	db.Exec(`INSERT INTO alumni VALUES ('13519001', 'Siti Aminah', 'P', '3.85', '2023-07-20'),
+		('13519001', 'Siti Aminah', 'P', '3.85', '2023-07-20'), ('13520002', 'Budi', 'L', NULL, '2024-04-01')`)
+
+	rows, err := db.Raw(query).Rows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	cols, _ := rows.ColumnTypes()
+
+	var out bytes.Buffer
+	writer, _ := NewResultWriter("csv", &out, alumniDeclared)
+	handler := masking.Wrap(writer, alumniDeclared)
+	if err := handler.Columns(cols); err != nil {
+		t.Fatal(err)
+	}
+	values := make([]interface{}, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	for rows.Next() {
+		rows.Scan(ptrs...)
+		if err := handler.Row(values); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestMasking(t *testing.T) {
+	if out := maskedCSV(t, Masking{}); !strings.Contains(out, "13519001,Siti Aminah,P,3.85,2023-07-20") {
+		t.Errorf("no masking changed the result:\n%s", out)
+	}
+
+	research, _ := FindMaskingProfile("research")
+	requestID := uuid.New()
+	out := maskedCSV(t, Masking{Profile: &research, Salt: MaskingSalt(requestID)})
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if lines[0] != "nim,jenis_kelamin,ipk,lulus" || strings.Contains(out, "Siti") || strings.Contains(out, "13519001") {
+		t.Fatalf("research profile:\n%s", out)
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{16},P,3.9,2023-07-20$`).MatchString(lines[1]) || lines[1] != lines[2] {
+		t.Errorf("want the same hash and a rounded GPA, got %q and %q", lines[1], lines[2])
+	}
+	if !strings.HasSuffix(lines[3], ",L,,2024-04-01") {
+		t.Errorf("NULL GPA not kept: %q", lines[3])
+	}
+
+	// Another request hashes the same NIM differently
+	other := maskedCSV(t, Masking{Profile: &research, Salt: MaskingSalt(uuid.New())})
+	if strings.Split(other, "\n")[1][:16] == lines[1][:16] {
+		t.Error("hashes are linkable across requests")
+	}
+
+	profile := MaskingProfile{Name: "custom", Columns: map[string]string{"nim": "generalize:5", "nama": "redact", "ipk": "generalize:0", "lulus": "generalize"}}
+	out = maskedCSV(t, Masking{Profile: &profile, Salt: RandomMaskingSalt()})
+	if !strings.Contains(out, "nim,nama,jenis_kelamin,ipk,lulus\n13519***,***,P,4,2023\n") {
+		t.Errorf("custom profile:\n%s", out)
+	}
+}
+
+func TestMaskingFollowsSources(t *testing.T) {
+	research, _ := FindMaskingProfile("research")
+	query := `SELECT nim AS id, upper(nama) AS besar, n, ipk AS nilai, jenis_kelamin || nim AS kode, lulus
+		FROM (SELECT nama || '' AS n, * FROM alumni) s`
+	masking, err := Masking{Profile: &research, Salt: RandomMaskingSalt()}.ForQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := maskedQueryCSV(t, masking, query)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if lines[0] != "id,nilai,kode,lulus" || strings.Contains(strings.ToLower(out), "siti") || strings.Contains(out, "13519001") {
+		t.Fatalf("aliases and expressions got past the profile:\n%s", out)
+	}
+	// The alias is hashed like nim and rounded like ipk; what is computed from nim is redacted
+	if !regexp.MustCompile(`^[0-9a-f]{16},3.9,\*\*\*,2023-07-20$`).MatchString(lines[1]) {
+		t.Errorf("masked row: %q", lines[1])
+	}
+
+	// A whole row gets the strictest rule of the table
+	masking, _ = masking.ForQuery(`SELECT a FROM alumni a`)
+	if action, _ := masking.rule("a", masking.lineage.Sources([]string{"a"})[0]); action != MaskDrop {
+		t.Errorf("whole row: %s", action)
+	}
+}
+
+func TestMaskingProfiles(t *testing.T) {
+	for purpose, want := range map[string]string{
+		"Penelitian untuk skripsi":           "research",
+		"Laporan akreditasi program studi":   "statistics",
+		"Keperluan lain":                     DefaultMaskingProfile,
+		"statistik-nya, bukan penelitiannya": "statistics",
+		// contact passes names through and skips the small-cell check, so
+		// only an admin picks it
+		"Undangan reuni alumni": DefaultMaskingProfile,
+		"penelitian alumni":     "research",
+		// Several profiles match
+		"Laporan statistik untuk penelitian": DefaultMaskingProfile,
+	} {
+		if got := SuggestMaskingProfile(purpose); got != want {
+			t.Errorf("%q: got %s, want %s", purpose, got, want)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "profiles.json")
+	os.WriteFile(path, []byte(`[{"name": "research", "columns": {"nim": "drop"}}, {"name": "open", "default": "redact"}]`), 0o600)
+	t.Setenv("MASKING_PROFILES", path)
+	profiles, err := MaskingProfiles()
+	if err != nil || len(profiles) != 5 {
+		t.Fatalf("got %d profiles, %v", len(profiles), err)
+	}
+	if research, _ := FindMaskingProfile("research"); research.Columns["nim"] != MaskDrop {
+		t.Errorf("configured profile did not replace the built-in one: %+v", research)
+	}
+	if _, err := FindMaskingProfile("nope"); err == nil {
+		t.Error("unknown profile found")
+	}
+
+	for _, broken := range []string{`[{"name": "x", "columns": {"nim": "shuffle"}}]`, `[{"name": "x", "default": "hash:2"}]`, `[{"columns": {}}]`, `{`} {
+		os.WriteFile(path, []byte(broken), 0o600)
+		if _, err := MaskingProfiles(); err == nil {
+			t.Errorf("%s accepted", broken)
+		}
+	}
+	if _, err := NewMasking("research", nil); err == nil {
+		t.Error("masking built while the profiles are broken")
+	}
+}
@@ -0,0 +1,200 @@
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// parquetKind is the physical/logical encoding chosen for a column
+type parquetKind int
+
+const (
+	parquetString parquetKind = iota
+	parquetInt
+	parquetDouble
+	parquetDecimal
+	parquetDate
+	parquetTimestamp
+	parquetBool
+)
+
+// numericType matches constrained numerics such as "numeric(3,2)"
+var numericType = regexp.MustCompile(`^(?:numeric|decimal)\((\d+)(?:,\s*(\d+))?\)$`)
+
+// maxInt64Precision is the most decimal digits an int64 backed DECIMAL can hold
+const maxInt64Precision = 18
+
+type parquetColumn struct {
+	kind  parquetKind
+	scale int
+	index int
+}
+
+// parquetEncoder writes all columns as optional fields so NULLs survive.
+// Constrained numerics become DECIMAL, unconstrained ones strings to keep
+// their precision, dates DATE and timestamps TIMESTAMP(MICROS).
+type parquetEncoder struct {
+	out     io.Writer
+	writer  *parquet.Writer
+	columns []parquetColumn
+}
+
+func (e *parquetEncoder) begin(cols []resultColumn) error {
+	group := parquet.Group{}
+	// Parquet field names must be unique, query columns need not be
+	names := uniqueColumnNames(cols)
+	e.columns = make([]parquetColumn, len(cols))
+
+	for i, col := range cols {
+		node, column := parquetNode(col)
+		group[names[i]] = parquet.Optional(node)
+		e.columns[i] = column
+	}
+
+	// Group fields are laid out in name order, which decides the column index
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+	for i, name := range names {
+		e.columns[i].index = sort.SearchStrings(sorted, name)
+	}
+
+	e.writer = parquet.NewWriter(e.out, parquet.NewSchema("result", group))
+	return nil
+}
+
+func parquetNode(col resultColumn) (parquet.Node, parquetColumn) {
+	t := strings.ToLower(col.Type)
+	switch col.Kind {
+	case dateCell:
+		return parquet.Date(), parquetColumn{kind: parquetDate}
+	case timestampCell:
+		return parquet.Timestamp(parquet.Microsecond), parquetColumn{kind: parquetTimestamp}
+	case boolCell:
+		return parquet.Leaf(parquet.BooleanType), parquetColumn{kind: parquetBool}
+	case numberCell:
+		if match := numericType.FindStringSubmatch(t); match != nil {
+			precision, _ := strconv.Atoi(match[1])
+			scale, _ := strconv.Atoi(match[2])
+			if precision <= maxInt64Precision {
+				return parquet.Decimal(scale, precision, parquet.Int64Type), parquetColumn{kind: parquetDecimal, scale: scale}
+			}
+		}
+		switch {
+		case strings.HasPrefix(t, "int"), t == "smallint", t == "bigint":
+			return parquet.Int(64), parquetColumn{kind: parquetInt}
+		case t == "real", strings.HasPrefix(t, "double"), strings.HasPrefix(t, "float"):
+			return parquet.Leaf(parquet.DoubleType), parquetColumn{kind: parquetDouble}
+		}
+	}
+	return parquet.String(), parquetColumn{kind: parquetString}
+}
+
+func (e *parquetEncoder) row(cols []resultColumn, values []interface{}) error {
+	row := make(parquet.Row, len(values))
+	for i, val := range values {
+		column := e.columns[i]
+		if val == nil {
+			row[column.index] = parquet.NullValue().Level(0, 0, column.index)
+			continue
+		}
+
+		value, err := parquetValue(column, cols[i].Kind, val)
+		if err != nil {
+			return fmt.Errorf("column %s: %w", cols[i].Name, err)
+		}
+		row[column.index] = value.Level(0, 1, column.index)
+	}
+
+	_, err := e.writer.WriteRows([]parquet.Row{row})
+	return err
+}
+
+func parquetValue(column parquetColumn, kind cellKind, val interface{}) (parquet.Value, error) {
+	switch column.kind {
+	case parquetInt:
+		switch v := val.(type) {
+		case int64:
+			return parquet.Int64Value(v), nil
+		case json.Number:
+			if n, err := v.Int64(); err == nil {
+				return parquet.Int64Value(n), nil
+			}
+		}
+	case parquetDouble:
+		switch v := val.(type) {
+		case float64:
+			return parquet.DoubleValue(v), nil
+		case int64:
+			return parquet.DoubleValue(float64(v)), nil
+		case json.Number:
+			if f, err := v.Float64(); err == nil {
+				return parquet.DoubleValue(f), nil
+			}
+		}
+	case parquetDecimal:
+		if unscaled, err := unscaledDecimal(formatText(kind, val), column.scale); err == nil {
+			return parquet.Int64Value(unscaled), nil
+		}
+	case parquetDate:
+		if t, ok := val.(time.Time); ok {
+			y, m, d := t.Date()
+			days := time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / 86400
+			return parquet.Int32Value(int32(days)), nil
+		}
+	case parquetTimestamp:
+		if t, ok := val.(time.Time); ok {
+			return parquet.Int64Value(t.UnixMicro()), nil
+		}
+	case parquetBool:
+		if b, ok := val.(bool); ok {
+			return parquet.BooleanValue(b), nil
+		}
+	default:
+		return parquet.ByteArrayValue([]byte(formatText(kind, val))), nil
+	}
+	return parquet.Value{}, fmt.Errorf("cannot encode %v", val)
+}
+
+// unscaledDecimal turns "3.59" with scale 2 into 359 without going through a
+// float. Digits beyond scale are rounded half away from zero, as Postgres
+// rounds numerics: "3.595" is 360 and "-3.595" is -360.
+func unscaledDecimal(text string, scale int) (int64, error) {
+	whole, fraction, _ := strings.Cut(text, ".")
+	roundUp := false
+	if len(fraction) > scale {
+		if strings.Trim(fraction[scale:], "0123456789") != "" {
+			return 0, fmt.Errorf("invalid decimal %q", text)
+		}
+		roundUp = fraction[scale] >= '5'
+		fraction = fraction[:scale]
+	}
+	fraction += strings.Repeat("0", scale-len(fraction))
+
+	unscaled, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil || !roundUp {
+		return unscaled, err
+	}
+	if strings.HasPrefix(whole, "-") {
+		if unscaled == math.MinInt64 {
+			return 0, fmt.Errorf("decimal %q out of range", text)
+		}
+		return unscaled - 1, nil
+	}
+	if unscaled == math.MaxInt64 {
+		return 0, fmt.Errorf("decimal %q out of range", text)
+	}
+	return unscaled + 1, nil
+}
+
+func (e *parquetEncoder) Close() error {
+	return e.writer.Close()
+}
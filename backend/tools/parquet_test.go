@@ -0,0 +1,132 @@
+package tools
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// typedResult is a result with a column of every kind, a full row and a NULL row
+var (
+	typedNames = []string{"nim", "ipk", "wisuda", "angkatan", "aktif", "dibuat", "nilai", "saldo", "nim"}
+	typedTypes = []string{"character varying(20)", "numeric(3,2)", "date", "integer", "boolean",
+		"timestamp with time zone", "double precision", "numeric", "text"}
+	typedRows = [][]interface{}{
+		{"13520001", []byte("3.595"), time.Date(2024, 8, 30, 0, 0, 0, 0, time.UTC), int64(2020), true,
+			time.Date(2024, 9, 1, 8, 30, 0, 0, time.UTC), 1.5, []byte("12345678901234567890.5"), "kedua"},
+		{nil, nil, nil, nil, nil, nil, nil, nil, nil},
+	}
+)
+
+// writeTyped writes typedRows in format
+func writeTyped(t *testing.T, format string) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	writer, err := NewResultWriter(format, &out, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.(*resultWriter).typedColumns(typedNames, typedTypes); err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range typedRows {
+		if err := writer.Row(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestUnscaledDecimal(t *testing.T) {
+	cases := []struct {
+		text  string
+		scale int
+		want  int64
+	}{
+		{"3.59", 2, 359},
+		{"3.5", 2, 350},
+		{"3", 2, 300},
+		{"3.594", 2, 359},
+		{"3.595", 2, 360},
+		{"3.5999", 2, 360},
+		{"-3.595", 2, -360},
+		{"-3.594", 2, -359},
+		{"-0.005", 2, -1},
+		{"9.995", 2, 1000},
+		{"2.5", 0, 3},
+		{"-2.5", 0, -3},
+	}
+	for _, tc := range cases {
+		if got, err := unscaledDecimal(tc.text, tc.scale); err != nil || got != tc.want {
+			t.Errorf("%s with scale %d: got %d (%v), want %d", tc.text, tc.scale, got, err, tc.want)
+		}
+	}
+
+	for _, text := range []string{"3.5x9", "abc", "9223372036854775807.5"} {
+		if got, err := unscaledDecimal(text, 0); err == nil {
+			t.Errorf("%s: got %d", text, got)
+		}
+	}
+}
+
+func TestParquetOutput(t *testing.T) {
+	data := writeTyped(t, "parquet")
+	reader := parquet.NewReader(bytes.NewReader(data))
+	defer reader.Close()
+
+	schema := reader.Schema()
+	byName := map[string]int{}
+	for i, path := range schema.Columns() {
+		byName[path[0]] = i
+	}
+	if len(byName) != len(typedNames) || byName["nim_2"] == 0 {
+		t.Fatalf("columns: %v", schema.Columns())
+	}
+	for name, logical := range map[string]string{"ipk": "DECIMAL(3,2)", "wisuda": "DATE", "dibuat": "TIMESTAMP(isAdjustedToUTC=true,unit=MICROS)", "saldo": "STRING", "nim": "STRING"} {
+		field, _ := schema.Lookup(name)
+		if got := field.Node.Type().LogicalType().String(); got != logical {
+			t.Errorf("%s is %s, want %s", name, got, logical)
+		}
+	}
+
+	rows := make([]parquet.Row, 3)
+	n, err := reader.ReadRows(rows)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("%d rows", n)
+	}
+
+	full := rows[0]
+	if got := full[byName["ipk"]].Int64(); got != 360 {
+		t.Errorf("ipk 3.595 stored as %d, want 360", got)
+	}
+	if got := full[byName["wisuda"]].Int32(); got != 19965 {
+		t.Errorf("wisuda: %d days", got)
+	}
+	if got := full[byName["dibuat"]].Int64(); got != time.Date(2024, 9, 1, 8, 30, 0, 0, time.UTC).UnixMicro() {
+		t.Errorf("dibuat: %d", got)
+	}
+	if full[byName["angkatan"]].Int64() != 2020 || !full[byName["aktif"]].Boolean() || full[byName["nilai"]].Double() != 1.5 {
+		t.Errorf("row: %v", full)
+	}
+	if got := string(full[byName["saldo"]].ByteArray()); got != "12345678901234567890.5" {
+		t.Errorf("unconstrained numeric: %s", got)
+	}
+	if string(full[byName["nim"]].ByteArray()) != "13520001" || string(full[byName["nim_2"]].ByteArray()) != "kedua" {
+		t.Errorf("duplicate names: %v", full)
+	}
+
+	for i, value := range rows[1] {
+		if !value.IsNull() {
+			t.Errorf("column %d of the NULL row: %v", i, value)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package tools
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"hash"
+	"io"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+	"gorm.io/gorm"
+)
+
+// WinZip AES encryption (AE-2) with a 256 bit key, as read by 7-Zip, WinZip,
+// WinRAR and macOS Archive Utility. See https://www.winzip.com/en/support/aes-encryption/
+const (
+	zipMethodAES     = 99
+	zipExtraAES      = 0x9901
+	zipAESStrength   = 3
+	zipAESKeyLen     = 32
+	zipAESSaltLen    = 16
+	zipAESAuthLen    = 10
+	zipAESIterations = 1000
+)
+
+// ProtectedFormat is the format of protected exports: zip archives holding
+// the export encrypted with a password
+const ProtectedFormat = "zip"
+
+// ProtectedPasswordLength is the length of the passwords NewExportPassword makes
+const ProtectedPasswordLength = 20
+
+// NewExportPassword generates a random password for a protected export
+func NewExportPassword() (string, error) {
+	return RandomName(ProtectedPasswordLength)
+}
+
+// ProtectExport stores export name in format, converted from CSV when it is
+// stored as CSV, as a new export in ProtectedFormat encrypted with password.
+// It returns the name of the new export. db is the data database, for the
+// column types of conversions.
+func ProtectExport(ctx context.Context, db *gorm.DB, store Storage, name, format, password string) (string, error) {
+	source, _, err := stageExport(ctx, db, store, name, format)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(source.Name())
+	defer source.Close()
+
+	archive, err := os.CreateTemp("", "export-*."+ProtectedFormat)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+	if err := WriteProtectedZip(archive, source, ExportKey(name, format), password); err != nil {
+		return "", err
+	}
+
+	protected, err := RandomName(16)
+	if err != nil {
+		return "", err
+	}
+	size, err := archive.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = archive.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		key := ExportKey(protected, ProtectedFormat)
+		err = store.Put(ctx, key, archive, size, ContentType(key))
+	}
+	if err != nil {
+		return "", err
+	}
+	return protected, nil
+}
+
+// WriteProtectedZip writes a zip archive to dst holding the content of src
+// as name, deflated and encrypted with AES-256 under password.
+func WriteProtectedZip(dst io.Writer, src io.Reader, name, password string) error {
+	salt := make([]byte, zipAESSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	keys := pbkdf2.Key([]byte(password), salt, zipAESIterations, 2*zipAESKeyLen+2, sha1.New)
+	block, err := aes.NewCipher(keys[:zipAESKeyLen])
+	if err != nil {
+		return err
+	}
+
+	// The sizes go in the local header, so the encrypted data is staged first
+	staged, err := os.CreateTemp("", "protected-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(staged.Name())
+	defer staged.Close()
+
+	if _, err := staged.Write(append(salt, keys[2*zipAESKeyLen:]...)); err != nil {
+		return err
+	}
+	encrypted := &aesWriter{
+		w:      staged,
+		stream: &zipAESStream{block: block, pos: aes.BlockSize},
+		mac:    hmac.New(sha1.New, keys[zipAESKeyLen:2*zipAESKeyLen]),
+	}
+	deflate, err := flate.NewWriter(encrypted, flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+	size, err := io.Copy(deflate, src)
+	if err != nil {
+		return err
+	}
+	if err := deflate.Close(); err != nil {
+		return err
+	}
+	if _, err := staged.Write(encrypted.mac.Sum(nil)[:zipAESAuthLen]); err != nil {
+		return err
+	}
+	compressed, err := staged.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := staged.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	// AE-2 leaves the CRC out; the authentication code covers the data instead
+	extra := make([]byte, 11)
+	binary.LittleEndian.PutUint16(extra[0:], zipExtraAES)
+	binary.LittleEndian.PutUint16(extra[2:], 7)
+	binary.LittleEndian.PutUint16(extra[4:], 2)
+	copy(extra[6:], "AE")
+	extra[8] = zipAESStrength
+	binary.LittleEndian.PutUint16(extra[9:], zip.Deflate)
+
+	archive := zip.NewWriter(dst)
+	entry, err := archive.CreateRaw(&zip.FileHeader{
+		Name:               name,
+		Method:             zipMethodAES,
+		Flags:              0x1, // encrypted
+		Modified:           time.Now(),
+		Extra:              extra,
+		CompressedSize64:   uint64(compressed),
+		UncompressedSize64: uint64(size),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(entry, staged); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// aesWriter encrypts what is written to it and authenticates the result
+type aesWriter struct {
+	w      io.Writer
+	stream cipher.Stream
+	mac    hash.Hash
+}
+
+func (a *aesWriter) Write(p []byte) (int, error) {
+	encrypted := make([]byte, len(p))
+	a.stream.XORKeyStream(encrypted, p)
+	a.mac.Write(encrypted)
+	return a.w.Write(encrypted)
+}
+
+// zipAESStream is AES in counter mode as WinZip uses it: a little endian
+// counter starting at 1
+type zipAESStream struct {
+	block   cipher.Block
+	counter [aes.BlockSize]byte
+	key     [aes.BlockSize]byte
+	pos     int
+}
+
+func (s *zipAESStream) XORKeyStream(dst, src []byte) {
+	for i := range src {
+		if s.pos == aes.BlockSize {
+			for j := range s.counter {
+				s.counter[j]++
+				if s.counter[j] != 0 {
+					break
+				}
+			}
+			s.block.Encrypt(s.key[:], s.counter[:])
+			s.pos = 0
+		}
+		dst[i] = src[i] ^ s.key[s.pos]
+		s.pos++
+	}
+}
@@ -0,0 +1,123 @@
+package tools
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// decryptZipEntry opens an AE-2 entry the way 7-Zip does, following the
+// WinZip specification rather than the writer's code
+func decryptZipEntry(t *testing.T, file *zip.File, password string) ([]byte, error) {
+	t.Helper()
+	if file.Method != zipMethodAES || file.Flags&0x1 == 0 {
+		t.Fatalf("entry is not AES encrypted: method %d, flags %#x", file.Method, file.Flags)
+	}
+	extra := file.Extra
+	if len(extra) < 11 || binary.LittleEndian.Uint16(extra) != 0x9901 || string(extra[6:8]) != "AE" || extra[8] != 3 {
+		t.Fatalf("bad AES extra field %x", extra)
+	}
+
+	raw, err := file.OpenRaw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(raw)
+	salt, verifier := data[:16], data[16:18]
+	encrypted, code := data[18:len(data)-10], data[len(data)-10:]
+
+	keys := pbkdf2.Key([]byte(password), salt, 1000, 66, sha1.New)
+	if !bytes.Equal(keys[64:], verifier) {
+		return nil, errors.New("wrong password")
+	}
+	mac := hmac.New(sha1.New, keys[32:64])
+	mac.Write(encrypted)
+	if !bytes.Equal(mac.Sum(nil)[:10], code) {
+		return nil, errors.New("authentication failed")
+	}
+
+	block, _ := aes.NewCipher(keys[:32])
+	deflated := make([]byte, len(encrypted))
+	for i := 0; i < len(encrypted); i += aes.BlockSize {
+		var counter, stream [aes.BlockSize]byte
+		binary.LittleEndian.PutUint64(counter[:], uint64(i/aes.BlockSize+1))
+		block.Encrypt(stream[:], counter[:])
+		for j := i; j < min(i+aes.BlockSize, len(encrypted)); j++ {
+			deflated[j] = encrypted[j] ^ stream[j-i]
+		}
+	}
+	return io.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+}
+
+func TestWriteProtectedZip(t *testing.T) {
+	content := strings.Repeat("13519999,Siti Aminah,3.85,P\n", 500)
+	var archive bytes.Buffer
+	if err := WriteProtectedZip(&archive, strings.NewReader(content), "req-abc.csv", "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	if err != nil || len(reader.File) != 1 {
+		t.Fatalf("bad archive: %v", err)
+	}
+	file := reader.File[0]
+	if file.Name != "req-abc.csv" || file.UncompressedSize64 != uint64(len(content)) {
+		t.Errorf("unexpected entry %s of %d bytes", file.Name, file.UncompressedSize64)
+	}
+	if bytes.Contains(archive.Bytes(), []byte("Siti Aminah")) {
+		t.Error("archive holds the content in clear")
+	}
+
+	decrypted, err := decryptZipEntry(t, file, "s3cret")
+	if err != nil || string(decrypted) != content {
+		t.Errorf("decrypted %d bytes, %v", len(decrypted), err)
+	}
+	if _, err := decryptZipEntry(t, file, "guess"); err == nil {
+		t.Error("wrong password accepted")
+	}
+}
+
+func TestProtectExport(t *testing.T) {
+	db, store := setupExportStorage(t)
+	ctx := context.Background()
+	content := "nim,nama\n13519999,Siti\n"
+	if err := store.Put(ctx, ExportKey("abc", "csv"), strings.NewReader(content), int64(len(content)), "text/csv"); err != nil {
+		t.Fatal(err)
+	}
+
+	name, err := ProtectExport(ctx, db, store, "abc", "json", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format, found := FindExport(ctx, store, name); !found || format != ProtectedFormat {
+		t.Fatalf("protected export %s stored as %q", name, format)
+	}
+
+	archive := readObject(t, store, ExportKey(name, ProtectedFormat))
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil || reader.File[0].Name != "req-abc.json" {
+		t.Fatalf("bad archive: %v", err)
+	}
+	decrypted, err := decryptZipEntry(t, reader.File[0], "s3cret")
+	if err != nil || !bytes.Contains(decrypted, []byte(`"nama":"Siti"`)) {
+		t.Errorf("decrypted %q, %v", decrypted, err)
+	}
+
+	// A protected export is attached as it is
+	limits := AttachmentLimits{CompressAbove: 0, MaxBytes: 1 << 20}
+	key, err := StoreResultAttachment(ctx, db, store, name, ProtectedFormat, limits, "emailAttachments")
+	if err != nil || !strings.HasSuffix(key, "/req-"+name+".zip") || !bytes.Equal(readObject(t, store, key), archive) {
+		t.Errorf("attachment %s, %v", key, err)
+	}
+}
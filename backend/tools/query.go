@@ -0,0 +1,204 @@
+package tools
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	pg_query "github.com/pganalyze/pg_query_go/v6"
+	"gorm.io/gorm"
+)
+
+// ErrQueryTimeout is returned by RunReadOnlyQuery when the statement timeout is hit.
+var ErrQueryTimeout = errors.New("query timed out")
+
+// queryCanceled is the Postgres error code for a statement cancelled by statement_timeout
+const queryCanceled = "57014"
+
+// defaultRowLimits caps result sizes for roles without a SQL_ROW_LIMIT_<ROLE> override.
+var defaultRowLimits = map[string]int{
+	"ADMIN": 100000,
+}
+
+const (
+	defaultRowLimit       = 1000
+	defaultStatementLimit = 30 * time.Second
+)
+
+// QueryLimits bounds a single read-only query.
+type QueryLimits struct {
+	Timeout time.Duration
+	MaxRows int
+}
+
+// QueryStats reports how a read-only query ended.
+type QueryStats struct {
+	Rows      int  `json:"rows"`
+	Truncated bool `json:"truncated"`
+	TimedOut  bool `json:"timed_out"`
+	// Disclosure is the small-cell check of exports, when one applied
+	Disclosure *DisclosureReport `json:"disclosure,omitempty"`
+}
+
+// RowHandler receives the result of RunReadOnlyQuery as it streams in.
+// The values slice is reused between rows, so copy it to keep it.
+type RowHandler interface {
+	Columns(cols []*sql.ColumnType) error
+	Row(values []interface{}) error
+}
+
+// QueryLimitsForRole reads SQL_STATEMENT_TIMEOUT (a Go duration) and
+// SQL_ROW_LIMIT_<ROLE> from the environment.
+func QueryLimitsForRole(role string) QueryLimits {
+	limits := QueryLimits{Timeout: defaultStatementLimit, MaxRows: defaultRowLimit}
+
+	if timeout, err := time.ParseDuration(os.Getenv("SQL_STATEMENT_TIMEOUT")); err == nil && timeout > 0 {
+		limits.Timeout = timeout
+	}
+
+	role = strings.ToUpper(role)
+	if max, ok := defaultRowLimits[role]; ok {
+		limits.MaxRows = max
+	}
+	if max, err := strconv.Atoi(os.Getenv("SQL_ROW_LIMIT_" + role)); err == nil && max > 0 {
+		limits.MaxRows = max
+	}
+
+	return limits
+}
+
+// RunReadOnlyQuery runs query with args for its $n placeholders inside a READ
+// ONLY transaction with a statement_timeout and at most limits.MaxRows rows,
+// streaming the result to handler. The query is cancelled when ctx is, e.g.
+// when the client disconnects.
+func RunReadOnlyQuery(ctx context.Context, db *gorm.DB, query string, args []interface{}, limits QueryLimits, handler RowHandler) (QueryStats, error) {
+	var stats QueryStats
+
+	// Fetch one extra row so we can tell whether the result was cut off
+	capped, err := capQuery(query, limits.MaxRows+1)
+	if err != nil {
+		return stats, err
+	}
+
+	// statement_timeout is Postgres only, elsewhere (SQLite in tests) the
+	// context is the only timeout
+	postgres := db.Dialector.Name() == "postgres"
+	deadline := limits.Timeout
+	if postgres {
+		// Backstop in case the server side timeout never fires
+		deadline += 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, deadline)
+	defer cancel()
+
+	tx := db.WithContext(ctx).Begin(&sql.TxOptions{ReadOnly: true})
+	if tx.Error != nil {
+		return stats, tx.Error
+	}
+	// Nothing is ever written, so the transaction is always rolled back
+	defer tx.Rollback()
+
+	if postgres {
+		if err := tx.Exec(fmt.Sprintf("SET LOCAL statement_timeout = %d", limits.Timeout.Milliseconds())).Error; err != nil {
+			return stats, err
+		}
+	}
+
+	// Straight to the driver, gorm would rewrite ? in the query if given args
+	rows, err := tx.Statement.ConnPool.QueryContext(ctx, capped, args...)
+	if err != nil {
+		return stats, queryError(ctx, err, &stats)
+	}
+	defer rows.Close()
+
+	cols, err := rows.ColumnTypes()
+	if err != nil {
+		return stats, err
+	}
+	if err := handler.Columns(cols); err != nil {
+		return stats, err
+	}
+
+	values := make([]interface{}, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	for rows.Next() {
+		if stats.Rows == limits.MaxRows {
+			stats.Truncated = true
+			break
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return stats, err
+		}
+		if err := handler.Row(values); err != nil {
+			return stats, err
+		}
+		stats.Rows++
+	}
+	if err := rows.Err(); err != nil {
+		return stats, queryError(ctx, err, &stats)
+	}
+
+	return stats, nil
+}
+
+// queryError turns statement timeouts into ErrQueryTimeout and leaves
+// client cancellations as context.Canceled.
+func queryError(ctx context.Context, err error, stats *QueryStats) error {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return context.Canceled
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &pgErr) && pgErr.Code == queryCanceled) {
+		stats.TimedOut = true
+		return ErrQueryTimeout
+	}
+	return err
+}
+
+// capQuery returns query limited to max rows. It is rebuilt from its parse
+// tree, which drops comments and trailing semicolons. The limit goes into the
+// statement itself so that duplicate output column names keep working; only a
+// limit of the query's own that is not a plain number (LIMIT ALL, WITH TIES,
+// an expression) makes it fall back to a subquery.
+func capQuery(query string, max int) (string, error) {
+	tree, err := pg_query.Parse(query)
+	if err != nil {
+		return "", fmt.Errorf("invalid SQL: %w", err)
+	}
+	var stmt *pg_query.SelectStmt
+	if len(tree.Stmts) == 1 {
+		stmt = tree.Stmts[0].Stmt.GetSelectStmt()
+	}
+	if stmt == nil {
+		return "", errors.New("only a single SELECT statement can be run")
+	}
+
+	limit := int64(max)
+	switch own := stmt.LimitCount.GetAConst(); {
+	case stmt.LimitCount == nil:
+	case own != nil && !own.Isnull && own.GetIval() != nil && stmt.LimitOption == pg_query.LimitOption_LIMIT_OPTION_COUNT:
+		if ival := int64(own.GetIval().Ival); ival < limit {
+			limit = ival
+		}
+	default:
+		deparsed, err := pg_query.Deparse(tree)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("SELECT * FROM (%s) AS capped_query LIMIT %d", deparsed, max), nil
+	}
+
+	stmt.LimitCount = pg_query.MakeAConstIntNode(limit, -1)
+	stmt.LimitOption = pg_query.LimitOption_LIMIT_OPTION_COUNT
+	return pg_query.Deparse(tree)
+}
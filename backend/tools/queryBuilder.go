@@ -0,0 +1,339 @@
+package tools
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// maxFilterDepth is how deeply filter groups may be nested
+const maxFilterDepth = 5
+
+// Filter operators a FilterCondition may use, mapped to their SQL
+var filterOperators = map[string]string{
+	"eq":          "=",
+	"neq":         "<>",
+	"gt":          ">",
+	"gte":         ">=",
+	"lt":          "<",
+	"lte":         "<=",
+	"like":        "LIKE",
+	"ilike":       "ILIKE",
+	"in":          "IN",
+	"not_in":      "NOT IN",
+	"between":     "BETWEEN",
+	"is_null":     "IS NULL",
+	"is_not_null": "IS NOT NULL",
+}
+
+// FilterCondition compares one column with a value. "in" and "not_in" take
+// Values, "between" takes exactly two Values, "is_null" and "is_not_null"
+// take none and every other operator takes Value.
+type FilterCondition struct {
+	Column   string        `json:"column"`
+	Operator string        `json:"operator"`
+	Value    interface{}   `json:"value,omitempty"`
+	Values   []interface{} `json:"values,omitempty"`
+}
+
+// FilterGroup joins conditions and nested groups with AND (the default) or OR.
+type FilterGroup struct {
+	Logic      string            `json:"logic,omitempty"`
+	Conditions []FilterCondition `json:"conditions,omitempty"`
+	Groups     []FilterGroup     `json:"groups,omitempty"`
+}
+
+// SortSpec orders the result by a column, ASC (the default) or DESC.
+type SortSpec struct {
+	Column    string `json:"column"`
+	Direction string `json:"direction,omitempty"`
+}
+
+// QuerySpec is a structured SELECT on a single table. An empty Select means
+// every column and a zero Limit means no limit.
+type QuerySpec struct {
+	Select  []string     `json:"select"`
+	Where   *FilterGroup `json:"where,omitempty"`
+	OrderBy []SortSpec   `json:"order_by,omitempty"`
+	Limit   int          `json:"limit,omitempty"`
+}
+
+// CompiledQuery is SQL with $n placeholders and the arguments that fill them.
+// Display is the same query with the values written in as escaped literals,
+// for showing it to admins; it is never what runs.
+type CompiledQuery struct {
+	SQL     string
+	Args    []interface{}
+	Display string
+}
+
+// Compile turns the spec into a parameterized query on table. Every column
+// must be one of columns, normally TableColumns of FIXED_TABLE.
+func (spec QuerySpec) Compile(table string, columns []ColumnInfo) (CompiledQuery, error) {
+	c := queryCompiler{columns: columnSet(columns)}
+	query, err := c.compile(spec, table, columns)
+	if err != nil {
+		return CompiledQuery{}, err
+	}
+	literal := queryCompiler{columns: c.columns, literal: true}
+	display, err := literal.compile(spec, table, columns)
+	if err != nil {
+		return CompiledQuery{}, err
+	}
+	return CompiledQuery{SQL: query, Args: c.args, Display: display}, nil
+}
+
+type queryCompiler struct {
+	columns map[string]bool
+	literal bool
+	args    []interface{}
+}
+
+func columnSet(columns []ColumnInfo) map[string]bool {
+	set := make(map[string]bool, len(columns))
+	for _, col := range columns {
+		set[col.ColumnName] = true
+	}
+	return set
+}
+
+func (c *queryCompiler) compile(spec QuerySpec, table string, columns []ColumnInfo) (string, error) {
+	if table == "" {
+		return "", errors.New("no table to query")
+	}
+	if spec.Limit < 0 {
+		return "", errors.New("limit must not be negative")
+	}
+
+	selected := spec.Select
+	if len(selected) == 0 {
+		for _, col := range columns {
+			selected = append(selected, col.ColumnName)
+		}
+	}
+	fields := make([]string, len(selected))
+	for i, name := range selected {
+		column, err := c.column(name)
+		if err != nil {
+			return "", err
+		}
+		fields[i] = column
+	}
+
+	var query strings.Builder
+	query.WriteString("SELECT " + strings.Join(fields, ", ") + " FROM " + quoteTable(table))
+
+	if spec.Where != nil {
+		where, err := c.group(*spec.Where, 1)
+		if err != nil {
+			return "", err
+		}
+		query.WriteString(" WHERE " + where)
+	}
+
+	if len(spec.OrderBy) > 0 {
+		orders := make([]string, len(spec.OrderBy))
+		for i, sort := range spec.OrderBy {
+			column, err := c.column(sort.Column)
+			if err != nil {
+				return "", err
+			}
+			direction := strings.ToUpper(strings.TrimSpace(sort.Direction))
+			switch direction {
+			case "":
+				direction = "ASC"
+			case "ASC", "DESC":
+			default:
+				return "", fmt.Errorf("unknown sort direction %q", sort.Direction)
+			}
+			orders[i] = column + " " + direction
+		}
+		query.WriteString(" ORDER BY " + strings.Join(orders, ", "))
+	}
+
+	if spec.Limit > 0 {
+		query.WriteString(" LIMIT " + strconv.Itoa(spec.Limit))
+	}
+	return query.String(), nil
+}
+
+func (c *queryCompiler) group(group FilterGroup, depth int) (string, error) {
+	if depth > maxFilterDepth {
+		return "", fmt.Errorf("filter groups are nested deeper than %d levels", maxFilterDepth)
+	}
+
+	logic := strings.ToUpper(strings.TrimSpace(group.Logic))
+	switch logic {
+	case "":
+		logic = "AND"
+	case "AND", "OR":
+	default:
+		return "", fmt.Errorf("unknown filter logic %q", group.Logic)
+	}
+	if len(group.Conditions) == 0 && len(group.Groups) == 0 {
+		return "", errors.New("filter group is empty")
+	}
+
+	var parts []string
+	for _, cond := range group.Conditions {
+		part, err := c.condition(cond)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, part)
+	}
+	for _, nested := range group.Groups {
+		part, err := c.group(nested, depth+1)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, part)
+	}
+	return "(" + strings.Join(parts, " "+logic+" ") + ")", nil
+}
+
+func (c *queryCompiler) condition(cond FilterCondition) (string, error) {
+	column, err := c.column(cond.Column)
+	if err != nil {
+		return "", err
+	}
+	operator := strings.ToLower(strings.TrimSpace(cond.Operator))
+	sql, ok := filterOperators[operator]
+	if !ok {
+		return "", fmt.Errorf("unknown filter operator %q", cond.Operator)
+	}
+
+	switch operator {
+	case "is_null", "is_not_null":
+		if cond.Value != nil || len(cond.Values) > 0 {
+			return "", fmt.Errorf("operator %s takes no value", operator)
+		}
+		return column + " " + sql, nil
+
+	case "in", "not_in":
+		if len(cond.Values) == 0 {
+			return "", fmt.Errorf("operator %s needs values", operator)
+		}
+		items := make([]string, len(cond.Values))
+		for i, value := range cond.Values {
+			if items[i], err = c.value(value); err != nil {
+				return "", err
+			}
+		}
+		return column + " " + sql + " (" + strings.Join(items, ", ") + ")", nil
+
+	case "between":
+		if len(cond.Values) != 2 {
+			return "", errors.New("operator between needs exactly two values")
+		}
+		low, err := c.value(cond.Values[0])
+		if err != nil {
+			return "", err
+		}
+		high, err := c.value(cond.Values[1])
+		if err != nil {
+			return "", err
+		}
+		return column + " BETWEEN " + low + " AND " + high, nil
+	}
+
+	if len(cond.Values) > 0 {
+		return "", fmt.Errorf("operator %s takes a single value", operator)
+	}
+	value, err := c.value(cond.Value)
+	if err != nil {
+		return "", err
+	}
+	return column + " " + sql + " " + value, nil
+}
+
+// column quotes name after checking it is a column of the table
+func (c *queryCompiler) column(name string) (string, error) {
+	if !c.columns[name] {
+		return "", fmt.Errorf("unknown column %q", name)
+	}
+	return pq.QuoteIdentifier(name), nil
+}
+
+// value adds a placeholder for v, or its literal when compiling literally
+func (c *queryCompiler) value(v interface{}) (string, error) {
+	var arg interface{}
+	var literal string
+
+	switch v := v.(type) {
+	case string:
+		arg, literal = v, pq.QuoteLiteral(v)
+	case bool:
+		arg, literal = v, strings.ToUpper(strconv.FormatBool(v))
+	case float64:
+		arg, literal = v, strconv.FormatFloat(v, 'f', -1, 64)
+	case int:
+		arg, literal = v, strconv.Itoa(v)
+	case int64:
+		arg, literal = v, strconv.FormatInt(v, 10)
+	case json.Number:
+		if _, err := strconv.ParseFloat(string(v), 64); err != nil {
+			return "", fmt.Errorf("invalid number %q", string(v))
+		}
+		arg, literal = string(v), string(v)
+	case nil:
+		return "", errors.New("missing filter value, use is_null to match NULL")
+	default:
+		return "", fmt.Errorf("unsupported filter value %v", v)
+	}
+
+	if c.literal {
+		return literal, nil
+	}
+	c.args = append(c.args, arg)
+	return "$" + strconv.Itoa(len(c.args)), nil
+}
+
+// quoteTable quotes each part of a possibly schema qualified table name
+func quoteTable(table string) string {
+	parts := strings.Split(table, ".")
+	for i, part := range parts {
+		parts[i] = pq.QuoteIdentifier(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+// YearRangeFilter matches rows whose column falls within the years from..to,
+// either end left open when zero. Numeric columns hold a year and are compared
+// directly; anything else is treated as a date. It returns nil without a range.
+func YearRangeFilter(column string, columns []ColumnInfo, from, to int) (*FilterGroup, error) {
+	if from == 0 && to == 0 {
+		return nil, nil
+	}
+	if from < 0 || to < 0 || (to != 0 && from > to) {
+		return nil, fmt.Errorf("invalid year range %d-%d", from, to)
+	}
+
+	dataType, ok := ColumnTypes(columns)[column]
+	if !ok {
+		return nil, fmt.Errorf("graduation date column %q not found", column)
+	}
+
+	group := &FilterGroup{}
+	if kindOf(dataType) == numberCell {
+		if from != 0 {
+			group.Conditions = append(group.Conditions, FilterCondition{Column: column, Operator: "gte", Value: from})
+		}
+		if to != 0 {
+			group.Conditions = append(group.Conditions, FilterCondition{Column: column, Operator: "lte", Value: to})
+		}
+		return group, nil
+	}
+
+	if from != 0 {
+		group.Conditions = append(group.Conditions, FilterCondition{Column: column, Operator: "gte", Value: fmt.Sprintf("%04d-01-01", from)})
+	}
+	if to != 0 {
+		group.Conditions = append(group.Conditions, FilterCondition{Column: column, Operator: "lt", Value: fmt.Sprintf("%04d-01-01", to+1)})
+	}
+	return group, nil
+}
@@ -0,0 +1,220 @@
+package tools
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testColumns = []ColumnInfo{
+	{ColumnName: "nim", DataType: "character varying(20)"},
+	{ColumnName: "nama", DataType: "text"},
+	{ColumnName: "ipk", DataType: "numeric(3,2)"},
+	{ColumnName: "wisuda", DataType: "date"},
+	{ColumnName: "kode_prodi", DataType: "character varying(10)"},
+}
+
+func TestCompile(t *testing.T) {
+	cases := []struct {
+		name    string
+		spec    QuerySpec
+		sql     string
+		args    []interface{}
+		display string
+	}{
+		{
+			name: "all columns",
+			spec: QuerySpec{},
+			sql:  `SELECT "nim", "nama", "ipk", "wisuda", "kode_prodi" FROM "alumni"`,
+		},
+		{
+			name: "select, sort and limit",
+			spec: QuerySpec{
+				Select:  []string{"nim", "ipk"},
+				OrderBy: []SortSpec{{Column: "ipk", Direction: "desc"}, {Column: "nim"}},
+				Limit:   10,
+			},
+			sql: `SELECT "nim", "ipk" FROM "alumni" ORDER BY "ipk" DESC, "nim" ASC LIMIT 10`,
+		},
+		{
+			name: "nested groups",
+			spec: QuerySpec{
+				Select: []string{"nim"},
+				Where: &FilterGroup{
+					Conditions: []FilterCondition{{Column: "kode_prodi", Operator: "in", Values: []interface{}{"55201", "55202"}}},
+					Groups: []FilterGroup{{
+						Logic: "or",
+						Conditions: []FilterCondition{
+							{Column: "ipk", Operator: "gte", Value: 3.5},
+							{Column: "wisuda", Operator: "between", Values: []interface{}{"2020-01-01", "2021-12-31"}},
+							{Column: "nama", Operator: "is_null"},
+						},
+					}},
+				},
+			},
+			sql: `SELECT "nim" FROM "alumni" WHERE ("kode_prodi" IN ($1, $2) AND ` +
+				`("ipk" >= $3 OR "wisuda" BETWEEN $4 AND $5 OR "nama" IS NULL))`,
+			args: []interface{}{"55201", "55202", 3.5, "2020-01-01", "2021-12-31"},
+			display: `SELECT "nim" FROM "alumni" WHERE ("kode_prodi" IN ('55201', '55202') AND ` +
+				`("ipk" >= 3.5 OR "wisuda" BETWEEN '2020-01-01' AND '2021-12-31' OR "nama" IS NULL))`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			query, err := tc.spec.Compile("alumni", testColumns)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if query.SQL != tc.sql {
+				t.Errorf("sql:\n got %s\nwant %s", query.SQL, tc.sql)
+			}
+			if !reflect.DeepEqual(query.Args, tc.args) {
+				t.Errorf("args: got %#v, want %#v", query.Args, tc.args)
+			}
+			// Without values the rendered query is the query itself
+			if tc.display == "" {
+				tc.display = tc.sql
+			}
+			if query.Display != tc.display {
+				t.Errorf("display:\n got %s\nwant %s", query.Display, tc.display)
+			}
+		})
+	}
+}
+
+// A spec stored as JSON and read back must compile to the same query and
+// args. Both the query and its rendered form must pass the SQL policy, with
+// the values in the args and escaped in the rendering.
+func TestCompileRoundTrip(t *testing.T) {
+	spec := QuerySpec{
+		Select: []string{"nim", "nama"},
+		Where: &FilterGroup{
+			Logic: "OR",
+			Conditions: []FilterCondition{
+				{Column: "nama", Operator: "ilike", Value: "%O'Brien%"},
+				{Column: "nama", Operator: "eq", Value: `back\slash'); DROP TABLE users; --`},
+				{Column: "kode_prodi", Operator: "not_in", Values: []interface{}{"x", 1.5}},
+			},
+		},
+		OrderBy: []SortSpec{{Column: "nama"}},
+		Limit:   5,
+	}
+
+	stored, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded QuerySpec
+	if err := json.Unmarshal(stored, &loaded); err != nil {
+		t.Fatal(err)
+	}
+
+	original, err := spec.Compile("alumni", testColumns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := loaded.Compile("alumni", testColumns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(original, reloaded) {
+		t.Errorf("round trip changed the query:\n got %#v\nwant %#v", reloaded, original)
+	}
+
+	wantSQL := `SELECT "nim", "nama" FROM "alumni" WHERE ("nama" ILIKE $1 OR "nama" = $2 OR "kode_prodi" NOT IN ($3, $4)) ORDER BY "nama" ASC LIMIT 5`
+	wantArgs := []interface{}{"%O'Brien%", `back\slash'); DROP TABLE users; --`, "x", 1.5}
+	if reloaded.SQL != wantSQL {
+		t.Errorf("sql:\n got %s\nwant %s", reloaded.SQL, wantSQL)
+	}
+	if !reflect.DeepEqual(reloaded.Args, wantArgs) {
+		t.Errorf("args: got %#v, want %#v", reloaded.Args, wantArgs)
+	}
+
+	policy := SQLPolicy{Tables: toSet([]string{"alumni"}), Functions: toSet(nil)}
+	for _, query := range []string{reloaded.SQL, reloaded.Display} {
+		if err := ValidateQuery(query, policy); err != nil {
+			t.Fatalf("query rejected: %v\n%s", err, query)
+		}
+	}
+	if !strings.Contains(reloaded.Display, `'%O''Brien%'`) {
+		t.Errorf("quote not escaped: %s", reloaded.Display)
+	}
+}
+
+func TestCompileRejects(t *testing.T) {
+	cases := map[string]QuerySpec{
+		"unknown select column": {Select: []string{"password"}},
+		"injected column":       {Select: []string{"nim; DROP TABLE users"}},
+		"unknown sort column":   {OrderBy: []SortSpec{{Column: "1"}}},
+		"bad sort direction":    {OrderBy: []SortSpec{{Column: "nim", Direction: "DESC; --"}}},
+		"negative limit":        {Limit: -1},
+		"empty group":           {Where: &FilterGroup{}},
+		"bad logic":             {Where: &FilterGroup{Logic: "XOR", Conditions: []FilterCondition{{Column: "nim", Operator: "is_null"}}}},
+		"unknown operator":      {Where: &FilterGroup{Conditions: []FilterCondition{{Column: "nim", Operator: "= 1 OR 1"}}}},
+		"unknown where column":  {Where: &FilterGroup{Conditions: []FilterCondition{{Column: "1=1 --", Operator: "is_null"}}}},
+		"missing value":         {Where: &FilterGroup{Conditions: []FilterCondition{{Column: "nim", Operator: "eq"}}}},
+		"object value":          {Where: &FilterGroup{Conditions: []FilterCondition{{Column: "nim", Operator: "eq", Value: map[string]interface{}{}}}}},
+		"between one value":     {Where: &FilterGroup{Conditions: []FilterCondition{{Column: "ipk", Operator: "between", Values: []interface{}{1.0}}}}},
+		"empty in":              {Where: &FilterGroup{Conditions: []FilterCondition{{Column: "nim", Operator: "in"}}}},
+		"is_null with value":    {Where: &FilterGroup{Conditions: []FilterCondition{{Column: "nim", Operator: "is_null", Value: "x"}}}},
+	}
+
+	deep := FilterGroup{Conditions: []FilterCondition{{Column: "nim", Operator: "is_null"}}}
+	for i := 0; i < maxFilterDepth; i++ {
+		deep = FilterGroup{Groups: []FilterGroup{deep}}
+	}
+	cases["too deep"] = QuerySpec{Where: &deep}
+
+	for name, spec := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := spec.Compile("alumni", testColumns); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestYearRangeFilter(t *testing.T) {
+	columns := append(testColumns, ColumnInfo{ColumnName: "angkatan", DataType: "integer"})
+	spec := QuerySpec{Select: []string{"nim"}}
+
+	cases := []struct {
+		name     string
+		column   string
+		from, to int
+		sql      string
+		args     []interface{}
+	}{
+		{"date range", "wisuda", 2020, 2021, `SELECT "nim" FROM "alumni" WHERE ("wisuda" >= $1 AND "wisuda" < $2)`, []interface{}{"2020-01-01", "2022-01-01"}},
+		{"open end", "wisuda", 2020, 0, `SELECT "nim" FROM "alumni" WHERE ("wisuda" >= $1)`, []interface{}{"2020-01-01"}},
+		{"year column", "angkatan", 2018, 2019, `SELECT "nim" FROM "alumni" WHERE ("angkatan" >= $1 AND "angkatan" <= $2)`, []interface{}{2018, 2019}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			where, err := YearRangeFilter(tc.column, columns, tc.from, tc.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			spec.Where = where
+			query, err := spec.Compile("alumni", columns)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if query.SQL != tc.sql || !reflect.DeepEqual(query.Args, tc.args) {
+				t.Errorf("got %s %#v\nwant %s %#v", query.SQL, query.Args, tc.sql, tc.args)
+			}
+		})
+	}
+
+	if where, err := YearRangeFilter("wisuda", columns, 0, 0); where != nil || err != nil {
+		t.Errorf("no range: got %v, %v", where, err)
+	}
+	if _, err := YearRangeFilter("wisuda", columns, 2022, 2020); err == nil {
+		t.Error("reversed range accepted")
+	}
+	if _, err := YearRangeFilter("missing", columns, 2020, 2021); err == nil {
+		t.Error("unknown column accepted")
+	}
+}
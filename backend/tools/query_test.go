@@ -0,0 +1,180 @@
+package tools
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func TestCapQuery(t *testing.T) {
+	cases := map[string]string{
+		"SELECT nim FROM alumni":                                           "SELECT nim FROM alumni LIMIT 11",
+		"SELECT nim FROM alumni -- all of them":                            "SELECT nim FROM alumni LIMIT 11",
+		"SELECT nim FROM alumni;\n":                                        "SELECT nim FROM alumni LIMIT 11",
+		"SELECT a.nim, b.nim FROM alumni a JOIN alumni b ON true":          "SELECT a.nim, b.nim FROM alumni a JOIN alumni b ON true LIMIT 11",
+		"SELECT nim FROM alumni ORDER BY ipk DESC LIMIT 3":                 "SELECT nim FROM alumni ORDER BY ipk DESC LIMIT 3",
+		"SELECT nim FROM alumni LIMIT 500 OFFSET 20":                       "SELECT nim FROM alumni LIMIT 11 OFFSET 20",
+		"SELECT nim FROM alumni FETCH FIRST 5 ROWS ONLY":                   "SELECT nim FROM alumni LIMIT 5",
+		"SELECT nim FROM alumni UNION SELECT nim FROM alumni":              "SELECT nim FROM alumni UNION SELECT nim FROM alumni LIMIT 11",
+		"SELECT nim FROM alumni LIMIT ALL":                                 "SELECT * FROM (SELECT nim FROM alumni LIMIT ALL) AS capped_query LIMIT 11",
+		"SELECT nim FROM alumni ORDER BY ipk FETCH FIRST 5 ROWS WITH TIES": "SELECT * FROM (SELECT nim FROM alumni ORDER BY ipk FETCH FIRST 5 ROWS WITH TIES) AS capped_query LIMIT 11",
+	}
+	for query, want := range cases {
+		if got, err := capQuery(query, 11); err != nil || got != want {
+			t.Errorf("%q:\n got %q (%v)\nwant %q", query, got, err, want)
+		}
+	}
+
+	for _, query := range []string{"SELECT 1; SELECT 2", "DELETE FROM alumni", "SELEC 1"} {
+		if got, err := capQuery(query, 11); err == nil {
+			t.Errorf("%q capped to %q", query, got)
+		}
+	}
+}
+
+// collectRows keeps the column names and rows of a result
+type collectRows struct {
+	columns []string
+	rows    [][]interface{}
+}
+
+func (c *collectRows) Columns(cols []*sql.ColumnType) error {
+	for _, col := range cols {
+		c.columns = append(c.columns, col.Name())
+	}
+	return nil
+}
+
+func (c *collectRows) Row(values []interface{}) error {
+	c.rows = append(c.rows, append([]interface{}{}, values...))
+	return nil
+}
+
+// setupNumbers returns a database with a numbers table holding 1 to 10. It is
+// kept in a file, as an in-memory one goes away with a connection that a
+// cancelled query closes.
+func setupNumbers(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "numbers.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Exec(`CREATE TABLE numbers AS WITH RECURSIVE r(n) AS (SELECT 1 UNION ALL SELECT n + 1 FROM r WHERE n < 10) SELECT n FROM r`).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestRunReadOnlyQuery(t *testing.T) {
+	db := setupNumbers(t)
+	limits := QueryLimits{Timeout: time.Second, MaxRows: 5}
+
+	var result collectRows
+	stats, err := RunReadOnlyQuery(context.Background(), db, "SELECT n, n * 2 AS n FROM numbers ORDER BY n; -- both", nil, limits, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stats.Truncated || stats.Rows != 5 || len(result.rows) != 5 || fmt.Sprint(result.rows[4]) != "[5 10]" {
+		t.Errorf("truncated: %+v, rows %v", stats, result.rows)
+	}
+	if strings.Join(result.columns, ",") != "n,n" {
+		t.Errorf("columns: %v", result.columns)
+	}
+
+	// Exactly MaxRows rows is not truncated, placeholders take their args
+	result = collectRows{}
+	stats, err = RunReadOnlyQuery(context.Background(), db, "SELECT n FROM numbers WHERE n > $1 AND n <> $2", []interface{}{5, 20}, limits, &result)
+	if err != nil || stats.Truncated || stats.Rows != 5 || fmt.Sprint(result.rows[0]) != "[6]" {
+		t.Errorf("complete: %+v, %v, rows %v", stats, err, result.rows)
+	}
+
+	// The query's own smaller limit wins
+	stats, err = RunReadOnlyQuery(context.Background(), db, "SELECT n FROM numbers LIMIT 2", nil, limits, &collectRows{})
+	if err != nil || stats.Truncated || stats.Rows != 2 {
+		t.Errorf("own limit: %+v, %v", stats, err)
+	}
+}
+
+// slowRows takes a while over every row, so that a query runs into its timeout
+type slowRows struct {
+	collectRows
+}
+
+func (s *slowRows) Row(values []interface{}) error {
+	time.Sleep(30 * time.Millisecond)
+	return s.collectRows.Row(values)
+}
+
+func TestRunReadOnlyQueryTimeout(t *testing.T) {
+	db := setupNumbers(t)
+
+	var result slowRows
+	stats, err := RunReadOnlyQuery(context.Background(), db, "SELECT n FROM numbers", nil, QueryLimits{Timeout: 100 * time.Millisecond, MaxRows: 50}, &result)
+	if !errors.Is(err, ErrQueryTimeout) || !stats.TimedOut || len(result.rows) == 10 {
+		t.Errorf("want a timeout, got %+v, %v", stats, err)
+	}
+
+	// A client going away is not a timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	stats, err = RunReadOnlyQuery(ctx, db, "SELECT n FROM numbers", nil, QueryLimits{Timeout: time.Minute, MaxRows: 50}, &slowRows{})
+	if !errors.Is(err, context.Canceled) || stats.TimedOut {
+		t.Errorf("want cancelled, got %+v, %v", stats, err)
+	}
+}
+
+// TestRunReadOnlyQueryPostgres checks what only Postgres enforces, the read
+// only transaction and statement_timeout. It runs with POSTGRES_TEST_DSN set,
+// e.g. host=localhost user=postgres password=postgres dbname=postgres.
+func TestRunReadOnlyQueryPostgres(t *testing.T) {
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_TEST_DSN not set")
+	}
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Temporary tables are per connection
+	sqlDB, _ := db.DB()
+	sqlDB.SetMaxOpenConns(1)
+	err = db.Exec("CREATE TEMPORARY TABLE numbers AS SELECT generate_series(1, 10) AS n; CREATE TEMPORARY SEQUENCE numbers_seq").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := QueryLimits{Timeout: time.Second, MaxRows: 5}
+
+	stats, err := RunReadOnlyQuery(context.Background(), db, "SELECT n, n FROM numbers -- duplicate names", nil, limits, &collectRows{})
+	if err != nil || !stats.Truncated || stats.Rows != 5 {
+		t.Errorf("truncated: %+v, %v", stats, err)
+	}
+
+	for _, write := range []string{
+		"WITH gone AS (DELETE FROM numbers RETURNING n) SELECT * FROM gone",
+		"SELECT nextval('numbers_seq')",
+	} {
+		if _, err := RunReadOnlyQuery(context.Background(), db, write, nil, limits, &collectRows{}); err == nil || !strings.Contains(err.Error(), "read-only transaction") {
+			t.Errorf("%s: want a read-only error, got %v", write, err)
+		}
+	}
+	var count int64
+	if db.Raw("SELECT count(*) FROM numbers").Scan(&count); count != 10 {
+		t.Errorf("%d rows left", count)
+	}
+
+	stats, err = RunReadOnlyQuery(context.Background(), db, "SELECT pg_sleep(5)", nil, QueryLimits{Timeout: 100 * time.Millisecond, MaxRows: 5}, &collectRows{})
+	if !errors.Is(err, ErrQueryTimeout) || !stats.TimedOut {
+		t.Errorf("want a timeout, got %+v, %v", stats, err)
+	}
+}
@@ -0,0 +1,318 @@
+package tools
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ResultWriter encodes a query result in one export format. It receives rows
+// as a RowHandler; nothing is guaranteed to reach the output before Close.
+type ResultWriter interface {
+	RowHandler
+	Close() error
+}
+
+// resultColumn is a result column with the Postgres type used to encode it
+type resultColumn struct {
+	Name string
+	Type string
+	Kind cellKind
+}
+
+// resultEncoder is implemented by each format; resultWriter adapts it to ResultWriter
+type resultEncoder interface {
+	begin(cols []resultColumn) error
+	row(cols []resultColumn, values []interface{}) error
+	Close() error
+}
+
+type resultWriter struct {
+	encoder  resultEncoder
+	declared map[string]string
+	cols     []resultColumn
+}
+
+// NewResultWriter returns the writer for format (see NormalizeFormat) writing to out.
+// declared maps column names to their declared types, e.g. from TableColumns;
+// columns missing from it use the type reported by the driver.
+func NewResultWriter(format string, out io.Writer, declared map[string]string) (ResultWriter, error) {
+	encoder, err := newResultEncoder(format, out)
+	if err != nil {
+		return nil, err
+	}
+	return &resultWriter{encoder: encoder, declared: declared}, nil
+}
+
+func newResultEncoder(format string, out io.Writer) (resultEncoder, error) {
+	switch format {
+	case "csv":
+		return &csvEncoder{writer: csv.NewWriter(out)}, nil
+	case "json":
+		return &jsonEncoder{out: bufio.NewWriter(out), array: true}, nil
+	case "ndjson":
+		return &jsonEncoder{out: bufio.NewWriter(out)}, nil
+	case "xlsx":
+		return newXLSXEncoder(out)
+	case "parquet":
+		return &parquetEncoder{out: out}, nil
+	}
+	return nil, fmt.Errorf("unsupported export format %q", format)
+}
+
+func (w *resultWriter) Columns(cols []*sql.ColumnType) error {
+	names := make([]string, len(cols))
+	types := make([]string, len(cols))
+	for i, col := range cols {
+		names[i] = col.Name()
+		types[i] = col.DatabaseTypeName()
+	}
+	return w.begin(names, types)
+}
+
+func (w *resultWriter) begin(names, driverTypes []string) error {
+	types := make([]string, len(names))
+	for i, name := range names {
+		types[i] = strings.ToLower(driverTypes[i])
+		if declared, ok := w.declared[name]; ok {
+			types[i] = declared
+		}
+	}
+	return w.typedColumns(names, types)
+}
+
+// typedColumns starts the output with columns of the given types, ignoring the declared ones
+func (w *resultWriter) typedColumns(names, types []string) error {
+	w.cols = make([]resultColumn, len(names))
+	for i, name := range names {
+		w.cols[i] = resultColumn{Name: name, Type: types[i], Kind: kindOf(types[i])}
+	}
+	return w.encoder.begin(w.cols)
+}
+
+func (w *resultWriter) Row(values []interface{}) error {
+	normalized := make([]interface{}, len(values))
+	for i, val := range values {
+		normalized[i] = normalizeValue(w.cols[i].Kind, val)
+	}
+	return w.encoder.row(w.cols, normalized)
+}
+
+func (w *resultWriter) Close() error {
+	return w.encoder.Close()
+}
+
+// normalizeValue turns a scanned value, or a string read back from a CSV
+// export, into nil, string, int64, float64, bool, time.Time or json.Number.
+// Exact numerics stay json.Number so no precision is lost on the way out.
+func normalizeValue(kind cellKind, val interface{}) interface{} {
+	if b, ok := val.([]byte); ok {
+		val = string(b)
+	}
+	if val == nil || (val == "" && kind != textCell) {
+		return nil
+	}
+
+	switch v := val.(type) {
+	case int64, float64, bool, time.Time:
+		return v
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case float32:
+		return float64(v)
+	case string:
+		switch kind {
+		case numberCell:
+			if _, err := strconv.ParseFloat(v, 64); err == nil {
+				return json.Number(v)
+			}
+		case dateCell, timestampCell:
+			for _, layout := range timeLayouts {
+				if t, err := time.Parse(layout, v); err == nil {
+					return t
+				}
+			}
+		case boolCell:
+			if b, err := strconv.ParseBool(v); err == nil {
+				return b
+			}
+		}
+		return v
+	}
+	return fmt.Sprint(val)
+}
+
+// formatText renders a normalized value for text formats. Dates use ISO-8601.
+func formatText(kind cellKind, val interface{}) string {
+	switch v := val.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		if kind == dateCell {
+			return v.Format("2006-01-02")
+		}
+		return v.Format(time.RFC3339Nano)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case json.Number:
+		return v.String()
+	}
+	return fmt.Sprint(val)
+}
+
+// csvEncoder writes a header line and one line per row; NULL is an empty field
+type csvEncoder struct {
+	writer *csv.Writer
+}
+
+func (e *csvEncoder) begin(cols []resultColumn) error {
+	header := make([]string, len(cols))
+	for i, col := range cols {
+		header[i] = col.Name
+	}
+	return e.writer.Write(header)
+}
+
+func (e *csvEncoder) row(cols []resultColumn, values []interface{}) error {
+	record := make([]string, len(values))
+	for i, val := range values {
+		record[i] = formatText(cols[i].Kind, val)
+	}
+	return e.writer.Write(record)
+}
+
+func (e *csvEncoder) Close() error {
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+// uniqueColumnNames returns the names of cols, with later duplicates renamed
+// name_2, name_3 and so on, for formats that need unique field names
+func uniqueColumnNames(cols []resultColumn) []string {
+	names := make([]string, len(cols))
+	taken := make(map[string]bool, len(cols))
+	for i, col := range cols {
+		name := col.Name
+		for n := 2; taken[name]; n++ {
+			name = fmt.Sprintf("%s_%d", col.Name, n)
+		}
+		taken[name] = true
+		names[i] = name
+	}
+	return names
+}
+
+// jsonEncoder writes one object per row, keeping column order, either as a
+// JSON array or as newline delimited JSON. Duplicate column names are
+// renamed, as JSON objects keep only one value per key.
+type jsonEncoder struct {
+	out   *bufio.Writer
+	array bool
+	rows  int
+	keys  [][]byte
+}
+
+func (e *jsonEncoder) begin(cols []resultColumn) error {
+	e.keys = make([][]byte, len(cols))
+	for i, name := range uniqueColumnNames(cols) {
+		e.keys[i], _ = json.Marshal(name)
+	}
+	if e.array {
+		_, err := e.out.WriteString("[")
+		return err
+	}
+	return nil
+}
+
+func (e *jsonEncoder) row(cols []resultColumn, values []interface{}) error {
+	if e.array && e.rows > 0 {
+		e.out.WriteString(",")
+	}
+	if e.array {
+		e.out.WriteString("\n  ")
+	}
+	e.rows++
+
+	e.out.WriteString("{")
+	for i, val := range values {
+		if i > 0 {
+			e.out.WriteString(",")
+		}
+		e.out.Write(e.keys[i])
+		e.out.WriteString(":")
+
+		if t, ok := val.(time.Time); ok {
+			val = formatText(cols[i].Kind, t)
+		}
+		encoded, err := json.Marshal(val)
+		if err != nil {
+			return err
+		}
+		e.out.Write(encoded)
+	}
+	_, err := e.out.WriteString("}")
+	if !e.array {
+		e.out.WriteString("\n")
+	}
+	return err
+}
+
+func (e *jsonEncoder) Close() error {
+	if e.array {
+		e.out.WriteString("\n]\n")
+	}
+	return e.out.Flush()
+}
+
+// ConvertCSV re-encodes a CSV export in another format, using declared column
+// types since the CSV itself carries none.
+func ConvertCSV(in io.Reader, out io.Writer, format string, declared map[string]string) error {
+	reader := csv.NewReader(in)
+	header, err := reader.Read()
+	if err != nil {
+		return err
+	}
+
+	writer, err := NewResultWriter(format, out, declared)
+	if err != nil {
+		return err
+	}
+	w := writer.(*resultWriter)
+
+	untyped := make([]string, len(header))
+	for i := range untyped {
+		untyped[i] = "text"
+	}
+	if err := w.begin(header, untyped); err != nil {
+		return err
+	}
+
+	values := make([]interface{}, len(header))
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		for i := range values {
+			values[i] = record[i]
+		}
+		if err := w.Row(values); err != nil {
+			return err
+		}
+	}
+
+	return w.Close()
+}
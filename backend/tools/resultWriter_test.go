@@ -0,0 +1,149 @@
+package tools
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCSVOutput(t *testing.T) {
+	lines := strings.Split(strings.TrimSuffix(string(writeTyped(t, "csv")), "\n"), "\n")
+	want := []string{
+		"nim,ipk,wisuda,angkatan,aktif,dibuat,nilai,saldo,nim",
+		"13520001,3.595,2024-08-30,2020,true,2024-09-01T08:30:00Z,1.5,12345678901234567890.5,kedua",
+		",,,,,,,,",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestJSONOutput(t *testing.T) {
+	out := writeTyped(t, "json")
+	var rows []map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(out))
+	decoder.UseNumber()
+	if err := decoder.Decode(&rows); err != nil {
+		t.Fatalf("%v:\n%s", err, out)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("%d rows", len(rows))
+	}
+
+	// Exact numerics keep every digit, dates are ISO-8601
+	full := rows[0]
+	for key, want := range map[string]string{"ipk": "3.595", "saldo": "12345678901234567890.5", "angkatan": "2020", "wisuda": "2024-08-30", "dibuat": "2024-09-01T08:30:00Z"} {
+		if got := fmt.Sprint(full[key]); got != want {
+			t.Errorf("%s: %s, want %s", key, got, want)
+		}
+	}
+	if full["aktif"] != true {
+		t.Errorf("aktif: %v", full["aktif"])
+	}
+	// Columns keep their order, and a duplicate name is renamed so every value survives
+	if !strings.HasPrefix(string(out), "[\n  {\"nim\":\"13520001\",\"ipk\":3.595,") || full["nim"] != "13520001" || full["nim_2"] != "kedua" || len(full) != len(typedNames) {
+		t.Errorf("output:\n%s", out)
+	}
+	for key, value := range rows[1] {
+		if value != nil {
+			t.Errorf("%s of the NULL row: %v", key, value)
+		}
+	}
+
+	// An empty result is still an array
+	var empty bytes.Buffer
+	writer, _ := NewResultWriter("json", &empty, nil)
+	writer.(*resultWriter).typedColumns([]string{"nim"}, []string{"text"})
+	if err := writer.Close(); err != nil || json.Unmarshal(empty.Bytes(), &rows) != nil || len(rows) != 0 {
+		t.Errorf("empty result: %q", empty.String())
+	}
+}
+
+func TestNDJSONOutput(t *testing.T) {
+	lines := strings.Split(strings.TrimSuffix(string(writeTyped(t, "ndjson")), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("%d lines: %q", len(lines), lines)
+	}
+	for _, line := range lines {
+		var row map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &row); err != nil || len(row) != len(typedNames) {
+			t.Errorf("line %q: %v", line, err)
+		}
+	}
+	if lines[1] != `{"nim":null,"ipk":null,"wisuda":null,"angkatan":null,"aktif":null,"dibuat":null,"nilai":null,"saldo":null,"nim_2":null}` {
+		t.Errorf("NULL row: %s", lines[1])
+	}
+}
+
+func TestNormalizeValue(t *testing.T) {
+	day := time.Date(2024, 8, 30, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		kind cellKind
+		in   interface{}
+		want interface{}
+	}{
+		{textCell, []byte("Budi"), "Budi"},
+		{textCell, "", ""},
+		{numberCell, "", nil},
+		{numberCell, []byte("3.50"), json.Number("3.50")},
+		{numberCell, "n/a", "n/a"},
+		{numberCell, int32(7), int64(7)},
+		{numberCell, float32(1.5), 1.5},
+		{dateCell, "2024-08-30", day},
+		{timestampCell, "2024-08-30 00:00:00", day},
+		{timestampCell, "2024-08-30T00:00:00Z", day},
+		{boolCell, "true", true},
+		{boolCell, "ya", "ya"},
+		{textCell, nil, nil},
+	}
+	for _, tc := range cases {
+		got := normalizeValue(tc.kind, tc.in)
+		if gotTime, ok := got.(time.Time); ok {
+			if !gotTime.Equal(tc.want.(time.Time)) {
+				t.Errorf("%v as %d: %v, want %v", tc.in, tc.kind, got, tc.want)
+			}
+		} else if got != tc.want {
+			t.Errorf("%v as %d: %#v, want %#v", tc.in, tc.kind, got, tc.want)
+		}
+	}
+}
+
+func TestDeclaredTypes(t *testing.T) {
+	// The driver only knows the column is numeric, the table says how exact
+	var out bytes.Buffer
+	writer, _ := NewResultWriter("parquet", &out, map[string]string{"ipk": "numeric(3,2)"})
+	w := writer.(*resultWriter)
+	if err := w.begin([]string{"ipk", "nilai"}, []string{"NUMERIC", "NUMERIC"}); err != nil {
+		t.Fatal(err)
+	}
+	if w.cols[0].Type != "numeric(3,2)" || w.cols[1].Type != "numeric" || w.cols[1].Kind != numberCell {
+		t.Errorf("columns: %+v", w.cols)
+	}
+	writer.Close()
+
+	if _, err := NewResultWriter("pdf", &out, nil); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
+
+func TestConvertCSV(t *testing.T) {
+	in := "nim,ipk,wisuda\n13520001,3.50,2024-08-30\n13520002,,\n"
+	declared := map[string]string{"ipk": "numeric(3,2)", "wisuda": "date"}
+
+	var out bytes.Buffer
+	if err := ConvertCSV(strings.NewReader(in), &out, "ndjson", declared); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"nim":"13520001","ipk":3.50,"wisuda":"2024-08-30"}` + "\n" + `{"nim":"13520002","ipk":null,"wisuda":null}` + "\n"
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+
+	out.Reset()
+	if err := ConvertCSV(strings.NewReader(in), &out, "csv", declared); err != nil || out.String() != in {
+		t.Errorf("CSV round trip: %q, %v", out.String(), err)
+	}
+}
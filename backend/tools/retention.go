@@ -0,0 +1,131 @@
+package tools
+
+import (
+	"context"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"grad_deploy/models"
+)
+
+// defaultExportRetention is how long exports are kept unless EXPORT_RETENTION is set
+const defaultExportRetention = 30 * 24 * time.Hour
+
+// ExportRetention is how long exports and other stored files are kept:
+// EXPORT_RETENTION (a Go duration) or 30 days.
+func ExportRetention() time.Duration {
+	if retention, err := time.ParseDuration(os.Getenv("EXPORT_RETENTION")); err == nil && retention > 0 {
+		return retention
+	}
+	return defaultExportRetention
+}
+
+// CleanupResult counts what a CleanExports run deleted
+type CleanupResult struct {
+	Expired int   `json:"expired"`
+	Orphans int   `json:"orphans"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// CleanExports deletes the objects of unpinned exports that expired before
+// now and marks them purged. Objects in store that belong to no live export,
+// such as old email attachments and exports from before exports were
+// recorded, are deleted once they are older than ExportRetention.
+func CleanExports(ctx context.Context, db *gorm.DB, store Storage, now time.Time) (CleanupResult, error) {
+	var result CleanupResult
+
+	var expired []models.ExportFile
+	err := db.Where("purged_at IS NULL AND pinned = ? AND expires_at < ?", false, now).Find(&expired).Error
+	if err != nil {
+		return result, err
+	}
+	for _, export := range expired {
+		if err := store.Delete(ctx, ExportKey(export.Name, export.Format)); err != nil {
+			log.Printf("Failed to delete expired export %s: %v", export.Name, err)
+			continue
+		}
+		if err := db.Model(&export).Update("purged_at", now).Error; err != nil {
+			return result, err
+		}
+		result.Expired++
+		result.Bytes += export.Size
+	}
+
+	objects, err := store.List(ctx, "")
+	if err != nil {
+		return result, err
+	}
+	cutoff := now.Add(-ExportRetention())
+	for _, object := range objects {
+		if !object.ModTime.Before(cutoff) {
+			continue
+		}
+		if name, ok := exportName(object.Key); ok {
+			var live int64
+			if err := db.Model(&models.ExportFile{}).Where("name = ? AND purged_at IS NULL", name).Count(&live).Error; err != nil {
+				return result, err
+			}
+			if live > 0 {
+				continue
+			}
+		}
+		if err := store.Delete(ctx, object.Key); err != nil {
+			log.Printf("Failed to delete orphaned upload %s: %v", object.Key, err)
+			continue
+		}
+		result.Orphans++
+		result.Bytes += object.Size
+	}
+	return result, nil
+}
+
+// exportName returns the export name of a key made by ExportKey
+func exportName(key string) (string, bool) {
+	if strings.Contains(key, "/") || !strings.HasPrefix(key, "req-") {
+		return "", false
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(key, "req-"), path.Ext(key)), true
+}
+
+// StorageUsage summarizes the space used in the storage
+type StorageUsage struct {
+	Files        int   `json:"files"`
+	Bytes        int64 `json:"bytes"`
+	Exports      int64 `json:"exports"`
+	ExportBytes  int64 `json:"export_bytes"`
+	Pinned       int64 `json:"pinned"`
+	PinnedBytes  int64 `json:"pinned_bytes"`
+	Expired      int64 `json:"expired"`
+	ExpiredBytes int64 `json:"expired_bytes"`
+}
+
+// ExportStorageUsage counts the objects in store and the live exports
+// recorded in db, with the pinned ones and those waiting for the janitor.
+func ExportStorageUsage(ctx context.Context, db *gorm.DB, store Storage) (StorageUsage, error) {
+	var usage StorageUsage
+	objects, err := store.List(ctx, "")
+	if err != nil {
+		return usage, err
+	}
+	for _, object := range objects {
+		usage.Files++
+		usage.Bytes += object.Size
+	}
+
+	live := func() *gorm.DB {
+		return db.Model(&models.ExportFile{}).Select("COUNT(*), COALESCE(SUM(size), 0)").Where("purged_at IS NULL")
+	}
+	if err := live().Row().Scan(&usage.Exports, &usage.ExportBytes); err != nil {
+		return usage, err
+	}
+	if err := live().Where("pinned = ?", true).Row().Scan(&usage.Pinned, &usage.PinnedBytes); err != nil {
+		return usage, err
+	}
+	err = live().Where("pinned = ? AND expires_at < ?", false, time.Now()).Row().Scan(&usage.Expired, &usage.ExpiredBytes)
+	return usage, err
+}
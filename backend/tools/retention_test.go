@@ -0,0 +1,144 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+
+	"grad_deploy/models"
+)
+
+// setupExportStorage returns local storage in an empty directory and an
+// in-memory database with an export_files table.
+func setupExportStorage(t *testing.T) (*gorm.DB, *LocalStorage) {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Exec(`CREATE TABLE export_files (
+		name TEXT PRIMARY KEY, format TEXT, rows INTEGER DEFAULT 0, size INTEGER DEFAULT 0,
+		data_request_id TEXT, created_by TEXT, created_at DATETIME, expires_at DATETIME,
+		pinned BOOLEAN DEFAULT false, pinned_by TEXT, purged_at DATETIME, revoked_at DATETIME, revoked_by TEXT,
+		download_count INTEGER DEFAULT 0, last_downloaded_at DATETIME,
+		protected BOOLEAN DEFAULT false, source_name TEXT, password TEXT, masking_profile TEXT)`).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, &LocalStorage{Dir: t.TempDir()}
+}
+
+// putObject stores 100 bytes under key, last modified at modified
+func putObject(t *testing.T, store *LocalStorage, key string, modified time.Time) {
+	t.Helper()
+	if err := store.Put(context.Background(), key, bytes.NewReader(make([]byte, 100)), 100, ""); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(store.Dir, filepath.FromSlash(key))
+	if err := os.Chtimes(file, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecordExport(t *testing.T) {
+	db, store := setupExportStorage(t)
+	ctx := context.Background()
+	putObject(t, store, ExportKey("abc", "csv"), time.Now())
+	if err := RecordExport(db, store, models.ExportFile{Name: "abc", Format: "csv"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// An export that cannot be recorded could never be downloaded, it is removed
+	putObject(t, store, ExportKey("abc", "json"), time.Now())
+	if err := RecordExport(db, store, models.ExportFile{Name: "abc", Format: "json"}); err == nil {
+		t.Error("duplicate record accepted")
+	}
+	if _, err := store.Stat(ctx, ExportKey("abc", "json")); err == nil {
+		t.Error("unrecorded export kept")
+	}
+
+	DiscardExport(db, store, "abc", "csv")
+	var count int64
+	db.Model(&models.ExportFile{}).Count(&count)
+	if _, err := store.Stat(ctx, ExportKey("abc", "csv")); err == nil || count != 0 {
+		t.Errorf("discarded export left behind: %v, %d records", err, count)
+	}
+}
+
+func TestCleanExports(t *testing.T) {
+	t.Setenv("EXPORT_RETENTION", "720h")
+	db, store := setupExportStorage(t)
+	ctx := context.Background()
+	now := time.Now()
+	old := now.Add(-1000 * time.Hour)
+
+	for _, name := range []string{"expired", "pinned", "fresh", "purged", "untracked"} {
+		putObject(t, store, ExportKey(name, "csv"), old)
+	}
+	putObject(t, store, "emailAttachments/old.pdf", old)
+	putObject(t, store, "emailAttachments/new.pdf", now)
+	putObject(t, store, ExportKey("recent", "csv"), now)
+
+	RecordExport(db, store, models.ExportFile{Name: "fresh", Format: "csv"})
+	past := now.Add(-time.Hour)
+	RecordExport(db, store, models.ExportFile{Name: "expired", Format: "csv", ExpiresAt: &past})
+	RecordExport(db, store, models.ExportFile{Name: "pinned", Format: "csv", ExpiresAt: &past, Pinned: true})
+	RecordExport(db, store, models.ExportFile{Name: "purged", Format: "csv", ExpiresAt: &past, PurgedAt: &past})
+
+	var fresh models.ExportFile
+	db.First(&fresh, "name = ?", "fresh")
+	if fresh.Size != 100 || fresh.ExpiresAt == nil || fresh.ExpiresAt.Sub(now) < 719*time.Hour {
+		t.Errorf("RecordExport did not fill size and expiry: %+v", fresh)
+	}
+
+	usage, err := ExportStorageUsage(ctx, db, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := StorageUsage{Files: 8, Bytes: 800, Exports: 3, ExportBytes: 300, Pinned: 1, PinnedBytes: 100, Expired: 1, ExpiredBytes: 100}
+	if usage != want {
+		t.Errorf("usage = %+v, want %+v", usage, want)
+	}
+
+	result, err := CleanExports(ctx, db, store, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// purged, untracked and old.pdf are orphans
+	if want := (CleanupResult{Expired: 1, Orphans: 3, Bytes: 400}); result != want {
+		t.Errorf("result = %+v, want %+v", result, want)
+	}
+
+	for key, kept := range map[string]bool{
+		ExportKey("expired", "csv"):   false,
+		ExportKey("pinned", "csv"):    true,
+		ExportKey("fresh", "csv"):     true,
+		ExportKey("purged", "csv"):    false,
+		ExportKey("untracked", "csv"): false,
+		ExportKey("recent", "csv"):    true,
+		"emailAttachments/old.pdf":    false,
+		"emailAttachments/new.pdf":    true,
+	} {
+		if _, err := store.Stat(ctx, key); (err == nil) != kept {
+			t.Errorf("%s: kept = %v, want %v", key, err == nil, kept)
+		}
+	}
+
+	var expired models.ExportFile
+	db.First(&expired, "name = ?", "expired")
+	if expired.PurgedAt == nil {
+		t.Error("expired export not marked purged")
+	}
+
+	// Nothing left to do on a second run
+	if result, err := CleanExports(ctx, db, store, now); err != nil || result != (CleanupResult{}) {
+		t.Errorf("second run = %+v, %v", result, err)
+	}
+}
@@ -0,0 +1,29 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// MinSecretLength is the fewest bytes a signing secret may have, the key size
+// of HMAC-SHA256
+const MinSecretLength = 32
+
+// signingSecrets are the variables holding signing secrets. JWT_SECRET is
+// required, the others replace it for their own use when set.
+var signingSecrets = []string{"JWT_SECRET", "TRACKING_SECRET", "DOWNLOAD_SECRET", "MASKING_SECRET"}
+
+// CheckSecrets returns an error when JWT_SECRET is unset or any signing
+// secret that is set is shorter than MinSecretLength.
+func CheckSecrets() error {
+	if os.Getenv("JWT_SECRET") == "" {
+		return errors.New("JWT_SECRET is not set")
+	}
+	for _, name := range signingSecrets {
+		if secret := os.Getenv(name); secret != "" && len(secret) < MinSecretLength {
+			return fmt.Errorf("%s is shorter than %d characters", name, MinSecretLength)
+		}
+	}
+	return nil
+}
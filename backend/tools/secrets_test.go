@@ -0,0 +1,37 @@
+package tools
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckSecrets(t *testing.T) {
+	strong := strings.Repeat("s", MinSecretLength)
+	cases := []struct {
+		name    string
+		env     map[string]string
+		wantErr string
+	}{
+		{"unset", map[string]string{"JWT_SECRET": ""}, "JWT_SECRET is not set"},
+		{"short", map[string]string{"JWT_SECRET": "your_jwt_secret"}, "JWT_SECRET is shorter"},
+		{"strong", map[string]string{"JWT_SECRET": strong}, ""},
+		{"short override", map[string]string{"JWT_SECRET": strong, "DOWNLOAD_SECRET": "secret"}, "DOWNLOAD_SECRET is shorter"},
+		{"strong overrides", map[string]string{"JWT_SECRET": strong, "TRACKING_SECRET": strong, "MASKING_SECRET": strong}, ""},
+		// An override that is only a strong value still needs JWT_SECRET
+		{"override only", map[string]string{"JWT_SECRET": "", "TRACKING_SECRET": strong}, "JWT_SECRET is not set"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, name := range signingSecrets {
+				t.Setenv(name, tc.env[name])
+			}
+			err := CheckSecrets()
+			if tc.wantErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Errorf("got %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
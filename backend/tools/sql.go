@@ -1,21 +1,794 @@
 package tools
 
 import (
-    "regexp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	pg_query "github.com/pganalyze/pg_query_go/v6"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
-// isSelectOnly checks that the SQL starts with SELECT or WITH and contains no forbidden statements.
-func IsSelectOnly(query string) bool {
-    // Allow leading whitespace and comments
-    trimmed := regexp.MustCompile(`(?i)^\s*`).ReplaceAllString(query, "")
-    // Must start with SELECT or WITH
-    match, _ := regexp.MatchString(`(?i)^(WITH|SELECT)`, trimmed)
-    if !match {
-        return false
-    }
-    // Disallow semicolons to avoid multiple statements
-    if regexp.MustCompile(`;`).MatchString(query) {
-        return false
-    }
-    return true
-}
\ No newline at end of file
+// defaultAllowedFunctions are the functions admin queries may call unless
+// SQL_ALLOWED_FUNCTIONS overrides them.
+var defaultAllowedFunctions = []string{
+	"count", "sum", "avg", "min", "max", "stddev", "variance",
+	"percentile_cont", "percentile_disc", "mode", "string_agg",
+	"round", "floor", "ceil", "abs",
+	"lower", "upper", "trim", "btrim", "length", "substring", "substr", "concat",
+	"extract", "date_part", "date_trunc", "to_char",
+}
+
+// SQLPolicy lists the relations and functions a query may reference.
+// Names are lower case; tables may be schema qualified ("public.alumni").
+type SQLPolicy struct {
+	Tables    map[string]bool
+	Functions map[string]bool
+}
+
+// SQLViolation describes why ValidateQuery rejected a query and which node caused it.
+type SQLViolation struct {
+	Reason   string `json:"reason"`
+	Node     string `json:"node"`
+	Name     string `json:"name,omitempty"`
+	Location int    `json:"location"`
+}
+
+func (v *SQLViolation) Error() string {
+	if v.Name != "" {
+		return fmt.Sprintf("%s: %s %q at position %d", v.Reason, v.Node, v.Name, v.Location)
+	}
+	return fmt.Sprintf("%s: %s at position %d", v.Reason, v.Node, v.Location)
+}
+
+// DefaultSQLPolicy builds the policy from SQL_ALLOWED_TABLES (defaulting to
+// FIXED_TABLE) and SQL_ALLOWED_FUNCTIONS, both comma separated.
+func DefaultSQLPolicy() SQLPolicy {
+	tables := os.Getenv("SQL_ALLOWED_TABLES")
+	if tables == "" {
+		tables = os.Getenv("FIXED_TABLE")
+	}
+
+	functions := defaultAllowedFunctions
+	if env := os.Getenv("SQL_ALLOWED_FUNCTIONS"); env != "" {
+		functions = strings.Split(env, ",")
+	}
+
+	return SQLPolicy{
+		Tables:    toSet(strings.Split(tables, ",")),
+		Functions: toSet(functions),
+	}
+}
+
+func toSet(names []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, name := range names {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			set[name] = true
+		}
+	}
+	return set
+}
+
+// ValidateQuery parses query with the Postgres parser and checks that it is a
+// single SELECT that only reads allowed tables and calls allowed functions.
+// It returns a *SQLViolation when the query parses but breaks the policy.
+func ValidateQuery(query string, policy SQLPolicy) error {
+	tree, err := pg_query.ParseToJSON(query)
+	if err != nil {
+		return fmt.Errorf("invalid SQL: %w", err)
+	}
+
+	var parsed struct {
+		Stmts []struct {
+			Stmt map[string]interface{} `json:"stmt"`
+		} `json:"stmts"`
+	}
+	if err := json.Unmarshal([]byte(tree), &parsed); err != nil {
+		return err
+	}
+
+	if len(parsed.Stmts) != 1 {
+		return &SQLViolation{Reason: "exactly one statement is allowed", Node: "RawStmt"}
+	}
+
+	stmt := parsed.Stmts[0].Stmt
+	selectStmt, ok := stmt["SelectStmt"].(map[string]interface{})
+	if !ok {
+		for kind := range stmt {
+			return &SQLViolation{Reason: "only SELECT statements are allowed", Node: kind}
+		}
+		return errors.New("invalid SQL: empty statement")
+	}
+
+	w := sqlWalker{policy: policy}
+	if v := w.walkSelect(selectStmt, map[string]bool{}); v != nil {
+		return v
+	}
+	return nil
+}
+
+// sqlWalker walks the JSON form of a pg_query parse tree.
+// scope holds the CTE names visible at the current point of the query.
+type sqlWalker struct {
+	policy SQLPolicy
+}
+
+func (w sqlWalker) walk(node interface{}, scope map[string]bool) *SQLViolation {
+	switch n := node.(type) {
+	case []interface{}:
+		for _, item := range n {
+			if v := w.walk(item, scope); v != nil {
+				return v
+			}
+		}
+	case map[string]interface{}:
+		for _, key := range sortedKeys(n) {
+			if v := w.walkNode(key, n[key], scope); v != nil {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+func (w sqlWalker) walkNode(kind string, value interface{}, scope map[string]bool) *SQLViolation {
+	fields, _ := value.(map[string]interface{})
+
+	switch kind {
+	case "SelectStmt":
+		return w.walkSelect(fields, scope)
+	case "InsertStmt", "UpdateStmt", "DeleteStmt", "MergeStmt":
+		return &SQLViolation{Reason: "data-modifying statements are not allowed", Node: kind, Location: nodeLocation(fields)}
+	case "intoClause":
+		return &SQLViolation{Reason: "SELECT INTO is not allowed", Node: "IntoClause"}
+	case "LockingClause":
+		return &SQLViolation{Reason: "row locking is not allowed", Node: kind}
+	case "RangeVar":
+		return w.checkRelation(fields, scope)
+	case "FuncCall":
+		if v := w.checkFunction(fields); v != nil {
+			return v
+		}
+	}
+	return w.walk(value, scope)
+}
+
+// walkSelect handles the WITH clause so CTE names only count as relations
+// where Postgres would actually resolve them to the CTE.
+func (w sqlWalker) walkSelect(stmt map[string]interface{}, scope map[string]bool) *SQLViolation {
+	inner := copyScope(scope)
+
+	if with, ok := stmt["withClause"].(map[string]interface{}); ok {
+		recursive, _ := with["recursive"].(bool)
+		ctes, _ := with["ctes"].([]interface{})
+
+		if recursive {
+			for _, cte := range ctes {
+				inner[cteName(cte)] = true
+			}
+		}
+		for _, cte := range ctes {
+			if v := w.walk(cte, copyScope(inner)); v != nil {
+				return v
+			}
+			inner[cteName(cte)] = true
+		}
+	}
+
+	for _, key := range sortedKeys(stmt) {
+		if key == "withClause" {
+			continue
+		}
+		if v := w.walkNode(key, stmt[key], inner); v != nil {
+			return v
+		}
+	}
+	return nil
+}
+
+func (w sqlWalker) checkRelation(rel map[string]interface{}, scope map[string]bool) *SQLViolation {
+	catalog, _ := rel["catalogname"].(string)
+	schema, _ := rel["schemaname"].(string)
+	name, _ := rel["relname"].(string)
+	schema, name = strings.ToLower(schema), strings.ToLower(name)
+
+	qualified := name
+	if schema != "" {
+		qualified = schema + "." + name
+	}
+
+	allowed := catalog == "" && (w.policy.Tables[qualified] ||
+		(schema == "" && scope[name]) ||
+		((schema == "" || schema == "public") && w.policy.Tables[name]))
+	if !allowed {
+		return &SQLViolation{Reason: "table is not in the allowlist", Node: "RangeVar", Name: qualified, Location: nodeLocation(rel)}
+	}
+	return nil
+}
+
+func (w sqlWalker) checkFunction(call map[string]interface{}) *SQLViolation {
+	parts := make([]string, 0, 2)
+	names, _ := call["funcname"].([]interface{})
+	for _, part := range names {
+		if str, ok := part.(map[string]interface{})["String"].(map[string]interface{}); ok {
+			sval, _ := str["sval"].(string)
+			parts = append(parts, strings.ToLower(sval))
+		}
+	}
+
+	qualified := strings.Join(parts, ".")
+	name := ""
+	if len(parts) > 0 {
+		name = parts[len(parts)-1]
+	}
+
+	// Schema qualified calls are only accepted for built-ins in pg_catalog
+	allowed := w.policy.Functions[name] && (len(parts) == 1 || (len(parts) == 2 && parts[0] == "pg_catalog"))
+	if !allowed {
+		return &SQLViolation{Reason: "function is not in the allowlist", Node: "FuncCall", Name: qualified, Location: nodeLocation(call)}
+	}
+	return nil
+}
+
+func cteName(cte interface{}) string {
+	node, _ := cte.(map[string]interface{})
+	fields, _ := node["CommonTableExpr"].(map[string]interface{})
+	name, _ := fields["ctename"].(string)
+	return strings.ToLower(name)
+}
+
+func nodeLocation(fields map[string]interface{}) int {
+	location, _ := fields["location"].(float64)
+	return int(location)
+}
+
+func copyScope(scope map[string]bool) map[string]bool {
+	copied := make(map[string]bool, len(scope))
+	for name := range scope {
+		copied[name] = true
+	}
+	return copied
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ColumnSource tells where a result column comes from: the table columns it
+// is computed from, "*" standing for every column of a table, whether it is
+// one of them as stored, and whether it counts rows.
+type ColumnSource struct {
+	Columns []string `json:"columns"`
+	Direct  bool     `json:"direct"`
+	Count   bool     `json:"count"`
+}
+
+// Uses reports whether the column is computed from the table column name
+func (s ColumnSource) Uses(name string) bool {
+	for _, column := range s.Columns {
+		if column == "*" || strings.EqualFold(column, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ColumnSource) add(other ColumnSource) {
+	for _, column := range other.Columns {
+		if !s.has(column) {
+			s.Columns = append(s.Columns, column)
+		}
+	}
+}
+
+func (s ColumnSource) has(column string) bool {
+	for _, known := range s.Columns {
+		if known == column {
+			return true
+		}
+	}
+	return false
+}
+
+// QueryLineage maps the result columns of a SELECT to their sources, so that
+// masking and the small-cell check follow a column through aliases,
+// expressions, subqueries and CTEs rather than trusting its name.
+type QueryLineage struct {
+	outputs []lineageOutput
+	// all holds every table column the query reads
+	all ColumnSource
+	// opaque is set when result columns cannot be told apart by position
+	opaque bool
+}
+
+// lineageOutput is one column of a SELECT, or with star all columns of a
+// table, which keep their names
+type lineageOutput struct {
+	name   string
+	source ColumnSource
+	star   bool
+}
+
+// maxLineagePasses bounds resolving a recursive CTE, whose sources grow with
+// every pass over its recursive term
+const maxLineagePasses = 10
+
+// NewQueryLineage parses query, a single SELECT, and works out the sources
+// of its result columns.
+func NewQueryLineage(query string) (*QueryLineage, error) {
+	tree, err := pg_query.Parse(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SQL: %w", err)
+	}
+	var stmt *pg_query.SelectStmt
+	if len(tree.Stmts) == 1 {
+		stmt = tree.Stmts[0].Stmt.GetSelectStmt()
+	}
+	if stmt == nil {
+		return nil, errors.New("only a single SELECT statement can be run")
+	}
+
+	l := &QueryLineage{}
+	l.outputs = l.selectOutputs(stmt, nil)
+	return l, nil
+}
+
+// Sources returns the source of each of the result columns called names, as
+// returned by the database. The columns of a table's * are themselves; when
+// the columns cannot be matched up by position each one is taken to come
+// from every column the query reads.
+func (l *QueryLineage) Sources(names []string) []ColumnSource {
+	if l == nil {
+		return nil
+	}
+	stars := 0
+	for _, output := range l.outputs {
+		if output.star {
+			stars++
+		}
+	}
+	fixed := len(l.outputs) - stars
+
+	var sources []ColumnSource
+	switch {
+	case l.opaque:
+	case stars == 0 && fixed == len(names):
+		for _, output := range l.outputs {
+			sources = append(sources, output.source)
+		}
+	case stars == 1 && fixed <= len(names):
+		for _, output := range l.outputs {
+			if !output.star {
+				sources = append(sources, output.source)
+				continue
+			}
+			for _, name := range names[len(sources) : len(sources)+len(names)-fixed] {
+				sources = append(sources, ColumnSource{Columns: []string{name}, Direct: true})
+			}
+		}
+	case stars == len(l.outputs):
+		for _, name := range names {
+			sources = append(sources, ColumnSource{Columns: []string{name}, Direct: true})
+		}
+	}
+	if len(sources) == len(names) {
+		return sources
+	}
+
+	sources = make([]ColumnSource, len(names))
+	for i, name := range names {
+		sources[i].Columns = []string{name}
+		sources[i].add(l.all)
+	}
+	return sources
+}
+
+// lineageScope holds the CTEs and FROM items visible in one SELECT; parent
+// is the enclosing query, for correlated subqueries
+type lineageScope struct {
+	parent    *lineageScope
+	ctes      map[string][]lineageOutput
+	relations []lineageRelation
+}
+
+// lineageRelation is a FROM item: a table, or the columns of a subquery,
+// CTE or function
+type lineageRelation struct {
+	name    string
+	table   bool
+	outputs []lineageOutput
+}
+
+func (s *lineageScope) cte(name string) ([]lineageOutput, bool) {
+	for ; s != nil; s = s.parent {
+		if outputs, ok := s.ctes[name]; ok {
+			return outputs, true
+		}
+	}
+	return nil, false
+}
+
+func (l *QueryLineage) selectOutputs(stmt *pg_query.SelectStmt, parent *lineageScope) []lineageOutput {
+	if stmt == nil {
+		l.opaque = true
+		return nil
+	}
+	scope := &lineageScope{parent: parent, ctes: map[string][]lineageOutput{}}
+	if stmt.WithClause != nil {
+		l.with(stmt.WithClause, scope)
+	}
+
+	if stmt.Op != pg_query.SetOperation_SETOP_NONE {
+		return l.merge(l.selectOutputs(stmt.Larg, scope), l.selectOutputs(stmt.Rarg, scope))
+	}
+	if len(stmt.ValuesLists) > 0 {
+		var outputs []lineageOutput
+		for _, row := range stmt.ValuesLists {
+			var columns []lineageOutput
+			for i, item := range row.GetList().GetItems() {
+				columns = append(columns, lineageOutput{name: fmt.Sprintf("column%d", i+1), source: l.expr(item, scope)})
+			}
+			if outputs == nil {
+				outputs = columns
+			} else {
+				outputs = l.merge(outputs, columns)
+			}
+		}
+		return outputs
+	}
+
+	for _, item := range stmt.FromClause {
+		l.from(item, scope)
+	}
+	var outputs []lineageOutput
+	for _, item := range stmt.TargetList {
+		target := item.GetResTarget()
+		if ref := target.GetVal().GetColumnRef(); ref != nil && isStar(ref) {
+			outputs = append(outputs, l.star(ref, scope)...)
+			continue
+		}
+		name := target.GetName()
+		if name == "" {
+			name = outputName(target.GetVal())
+		}
+		outputs = append(outputs, lineageOutput{name: name, source: l.expr(target.GetVal(), scope)})
+	}
+	return outputs
+}
+
+// merge combines the columns of both sides of a UNION, INTERSECT or EXCEPT
+func (l *QueryLineage) merge(left, right []lineageOutput) []lineageOutput {
+	if len(left) != len(right) {
+		l.opaque = true
+		return left
+	}
+	merged := make([]lineageOutput, len(left))
+	for i := range left {
+		if left[i].star || right[i].star {
+			l.opaque = true
+			return left
+		}
+		source := ColumnSource{
+			Direct: left[i].source.Direct && right[i].source.Direct,
+			Count:  left[i].source.Count && right[i].source.Count,
+		}
+		source.add(left[i].source)
+		source.add(right[i].source)
+		if len(source.Columns) > 1 {
+			source.Direct = false
+		}
+		merged[i] = lineageOutput{name: left[i].name, source: source}
+	}
+	return merged
+}
+
+func (l *QueryLineage) with(with *pg_query.WithClause, scope *lineageScope) {
+	for _, node := range with.Ctes {
+		cte := node.GetCommonTableExpr()
+		stmt := cte.GetCtequery().GetSelectStmt()
+		if !with.Recursive {
+			scope.ctes[cte.Ctename] = renamed(l.selectOutputs(stmt, scope), cte.Aliascolnames)
+			continue
+		}
+		// A recursive CTE reads itself: starting from its non-recursive term,
+		// go over it until its sources stop growing
+		var outputs []lineageOutput
+		if stmt.GetOp() != pg_query.SetOperation_SETOP_NONE {
+			outputs = renamed(l.selectOutputs(stmt.Larg, scope), cte.Aliascolnames)
+		}
+		for pass := 0; pass < maxLineagePasses; pass++ {
+			scope.ctes[cte.Ctename] = outputs
+			next := renamed(l.selectOutputs(stmt, scope), cte.Aliascolnames)
+			if sameOutputs(next, outputs) {
+				break
+			}
+			outputs = next
+		}
+		scope.ctes[cte.Ctename] = outputs
+	}
+}
+
+func (l *QueryLineage) from(node *pg_query.Node, scope *lineageScope) {
+	switch {
+	case node.GetRangeVar() != nil:
+		rel := node.GetRangeVar()
+		name := rel.Relname
+		if rel.Alias != nil {
+			name = rel.Alias.Aliasname
+		}
+		if outputs, ok := scope.cte(rel.Relname); ok && rel.Schemaname == "" {
+			scope.relations = append(scope.relations, lineageRelation{name: name, outputs: renamed(outputs, rel.Alias.GetColnames())})
+			return
+		}
+		// Renaming a table's columns hides which is which
+		if len(rel.Alias.GetColnames()) > 0 {
+			l.opaque = true
+		}
+		scope.relations = append(scope.relations, lineageRelation{name: name, table: true})
+	case node.GetRangeSubselect() != nil:
+		sub := node.GetRangeSubselect()
+		outputs := l.selectOutputs(sub.GetSubquery().GetSelectStmt(), scope)
+		scope.relations = append(scope.relations, lineageRelation{name: sub.GetAlias().GetAliasname(), outputs: renamed(outputs, sub.GetAlias().GetColnames())})
+	case node.GetJoinExpr() != nil:
+		join := node.GetJoinExpr()
+		l.from(join.Larg, scope)
+		l.from(join.Rarg, scope)
+	case node.GetRangeFunction() != nil:
+		// Every column of a function in FROM comes from all of its arguments
+		fn := node.GetRangeFunction()
+		source := l.expr(node, scope)
+		source.Direct = false
+		name := fn.GetAlias().GetAliasname()
+		if name == "" {
+			name = outputName(fn.Functions[0].GetList().GetItems()[0])
+		}
+		relation := lineageRelation{name: name, outputs: []lineageOutput{{name: name, source: source}}}
+		if colnames := fn.GetAlias().GetColnames(); len(colnames) > 0 {
+			relation.outputs = nil
+			for _, column := range colnames {
+				relation.outputs = append(relation.outputs, lineageOutput{name: column.GetString_().GetSval(), source: source})
+			}
+		}
+		scope.relations = append(scope.relations, relation)
+	default:
+		l.opaque = true
+	}
+}
+
+// star expands * or relation.* to the columns of the FROM items
+func (l *QueryLineage) star(ref *pg_query.ColumnRef, scope *lineageScope) []lineageOutput {
+	relation := refRelation(ref)
+	var outputs []lineageOutput
+	for _, rel := range scope.relations {
+		switch {
+		case relation != "" && rel.name != relation:
+		case rel.table:
+			outputs = append(outputs, lineageOutput{star: true})
+		default:
+			outputs = append(outputs, rel.outputs...)
+		}
+	}
+	if len(outputs) == 0 {
+		outputs = append(outputs, lineageOutput{star: true})
+	}
+	return outputs
+}
+
+// column resolves a column reference: to a column of a subquery, CTE or
+// function in scope, the whole row of a FROM item, or a table column
+func (l *QueryLineage) column(ref *pg_query.ColumnRef, scope *lineageScope) ColumnSource {
+	name := ref.Fields[len(ref.Fields)-1].GetString_().GetSval()
+	relation := refRelation(ref)
+
+	for s := scope; s != nil; s = s.parent {
+		var derived ColumnSource
+		tables := false
+		for _, rel := range s.relations {
+			if relation != "" && rel.name != relation {
+				continue
+			}
+			for _, output := range rel.outputs {
+				if !output.star && output.name == name {
+					return output.source
+				}
+			}
+			tables = tables || rel.table || hasStar(rel.outputs)
+			derived.add(rowSource(rel))
+		}
+		// A FROM item named like the column stands for its whole row
+		if relation == "" && len(ref.Fields) == 1 {
+			for _, rel := range s.relations {
+				if rel.name == name {
+					return rowSource(rel)
+				}
+			}
+		}
+		// Without a table to come from, the column is one of the derived ones
+		if len(derived.Columns) > 0 && !tables {
+			return derived
+		}
+		if tables {
+			break
+		}
+	}
+
+	l.all.add(ColumnSource{Columns: []string{name}})
+	return ColumnSource{Columns: []string{name}, Direct: true}
+}
+
+// rowSource is the source of a whole row of rel
+func rowSource(rel lineageRelation) ColumnSource {
+	if rel.table {
+		return ColumnSource{Columns: []string{"*"}}
+	}
+	var source ColumnSource
+	for _, output := range rel.outputs {
+		if output.star {
+			source.add(ColumnSource{Columns: []string{"*"}})
+		}
+		source.add(output.source)
+	}
+	return source
+}
+
+// expr works out the source of an expression: the union of the columns it
+// reads, a column as is when it is a bare reference, or a count
+func (l *QueryLineage) expr(node *pg_query.Node, scope *lineageScope) ColumnSource {
+	switch {
+	case node == nil:
+		return ColumnSource{}
+	case node.GetColumnRef() != nil:
+		ref := node.GetColumnRef()
+		if !isStar(ref) {
+			return l.column(ref, scope)
+		}
+		var source ColumnSource
+		for _, output := range l.star(ref, scope) {
+			if output.star {
+				source.add(ColumnSource{Columns: []string{"*"}})
+			}
+			source.add(output.source)
+		}
+		return source
+	case node.GetFuncCall() != nil:
+		call := node.GetFuncCall()
+		switch outputName(node) {
+		case "count":
+			return ColumnSource{Count: true}
+		case "sum":
+			// Summing counts, e.g. of a breakdown, is still a count
+			if len(call.Args) == 1 {
+				if source := l.expr(call.Args[0], scope); source.Count {
+					return source
+				}
+			}
+		}
+	case node.GetTypeCast() != nil:
+		source := l.expr(node.GetTypeCast().Arg, scope)
+		source.Direct = false
+		return source
+	case node.GetSubLink() != nil:
+		link := node.GetSubLink()
+		source := l.expr(link.Testexpr, scope)
+		for _, output := range l.selectOutputs(link.GetSubselect().GetSelectStmt(), scope) {
+			if output.star {
+				source.add(ColumnSource{Columns: []string{"*"}})
+			}
+			source.add(output.source)
+		}
+		return source
+	}
+
+	var source ColumnSource
+	l.walk(node.ProtoReflect(), scope, &source)
+	return source
+}
+
+// walk adds the sources of every expression below m to source
+func (l *QueryLineage) walk(m protoreflect.Message, scope *lineageScope, source *ColumnSource) {
+	visit := func(child protoreflect.Message) {
+		if node, ok := child.Interface().(*pg_query.Node); ok {
+			source.add(l.expr(node, scope))
+		} else {
+			l.walk(child, scope, source)
+		}
+	}
+	m.Range(func(field protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+		switch {
+		case field.Kind() != protoreflect.MessageKind || field.IsMap():
+		case field.IsList():
+			for i := 0; i < value.List().Len(); i++ {
+				visit(value.List().Get(i).Message())
+			}
+		default:
+			visit(value.Message())
+		}
+		return true
+	})
+}
+
+// outputName is the name Postgres gives a result column without an alias
+func outputName(node *pg_query.Node) string {
+	switch {
+	case node.GetColumnRef() != nil:
+		fields := node.GetColumnRef().Fields
+		if name := fields[len(fields)-1].GetString_().GetSval(); name != "" {
+			return name
+		}
+	case node.GetFuncCall() != nil:
+		names := node.GetFuncCall().Funcname
+		return strings.ToLower(names[len(names)-1].GetString_().GetSval())
+	case node.GetTypeCast() != nil:
+		if name := outputName(node.GetTypeCast().Arg); name != "?column?" {
+			return name
+		}
+		names := node.GetTypeCast().GetTypeName().GetNames()
+		if len(names) > 0 {
+			return names[len(names)-1].GetString_().GetSval()
+		}
+	case node.GetCaseExpr() != nil:
+		return "case"
+	case node.GetCoalesceExpr() != nil:
+		return "coalesce"
+	case node.GetMinMaxExpr() != nil:
+		if node.GetMinMaxExpr().Op == pg_query.MinMaxOp_IS_GREATEST {
+			return "greatest"
+		}
+		return "least"
+	}
+	return "?column?"
+}
+
+func isStar(ref *pg_query.ColumnRef) bool {
+	return len(ref.Fields) > 0 && ref.Fields[len(ref.Fields)-1].GetAStar() != nil
+}
+
+// refRelation is the FROM item a column reference is qualified with, if any
+func refRelation(ref *pg_query.ColumnRef) string {
+	if len(ref.Fields) < 2 {
+		return ""
+	}
+	return ref.Fields[len(ref.Fields)-2].GetString_().GetSval()
+}
+
+func hasStar(outputs []lineageOutput) bool {
+	for _, output := range outputs {
+		if output.star {
+			return true
+		}
+	}
+	return false
+}
+
+// renamed gives the first columns of outputs the names of an alias list
+func renamed(outputs []lineageOutput, names []*pg_query.Node) []lineageOutput {
+	renamed := append([]lineageOutput{}, outputs...)
+	for i, name := range names {
+		if i < len(renamed) && !renamed[i].star {
+			renamed[i].name = name.GetString_().GetSval()
+		}
+	}
+	return renamed
+}
+
+func sameOutputs(a, b []lineageOutput) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].name != b[i].name || a[i].star != b[i].star || a[i].source.Count != b[i].source.Count ||
+			a[i].source.Direct != b[i].source.Direct || len(a[i].source.Columns) != len(b[i].source.Columns) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,130 @@
+package tools
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+var testPolicy = SQLPolicy{
+	Tables:    toSet([]string{"alumni", "public.prodi"}),
+	Functions: toSet(defaultAllowedFunctions),
+}
+
+func TestValidateQuery(t *testing.T) {
+	accepted := []string{
+		"SELECT nim, nama FROM alumni WHERE ipk > 3.5",
+		"SELECT * FROM public.alumni",
+		"SELECT kode_prodi, count(*) FROM alumni JOIN public.prodi USING (kode_prodi) GROUP BY 1",
+		"SELECT pg_catalog.count(*) FROM alumni",
+		"WITH lulusan AS (SELECT * FROM alumni) SELECT upper(nama) FROM lulusan",
+		// The CTE shadows the users table, so users is never read
+		"WITH users AS (SELECT nim FROM alumni) SELECT * FROM users",
+		"WITH RECURSIVE n AS (SELECT 1 AS i UNION ALL SELECT i + 1 FROM n WHERE i < 5) SELECT * FROM n",
+		"SELECT nim FROM alumni -- trailing comment",
+	}
+	for _, query := range accepted {
+		if err := ValidateQuery(query, testPolicy); err != nil {
+			t.Errorf("%s: %v", query, err)
+		}
+	}
+}
+
+func TestValidateQueryRejects(t *testing.T) {
+	cases := []struct {
+		name  string
+		query string
+		node  string
+		value string
+	}{
+		{"multiple statements", "SELECT 1; SELECT 2", "RawStmt", ""},
+		{"delete", "DELETE FROM alumni", "DeleteStmt", ""},
+		{"update", "UPDATE alumni SET ipk = 4", "UpdateStmt", ""},
+		{"data-modifying CTE", "WITH x AS (DELETE FROM alumni RETURNING *) SELECT * FROM x", "DeleteStmt", ""},
+		{"insert in nested CTE", "SELECT * FROM (WITH x AS (INSERT INTO alumni DEFAULT VALUES RETURNING *) SELECT * FROM x) s", "InsertStmt", ""},
+		{"select into", "SELECT * INTO copy FROM alumni", "IntoClause", ""},
+		{"row locking", "SELECT * FROM alumni FOR UPDATE", "LockingClause", ""},
+		{"pg_sleep", "SELECT pg_sleep(10)", "FuncCall", "pg_sleep"},
+		{"pg_sleep in filter", "SELECT nim FROM alumni WHERE ipk > 3 OR pg_sleep(10) IS NULL", "FuncCall", "pg_sleep"},
+		{"pg_read_file", "SELECT pg_read_file('/etc/passwd')", "FuncCall", "pg_read_file"},
+		{"qualified pg_read_file", "SELECT pg_catalog.pg_read_file('/etc/passwd')", "FuncCall", "pg_catalog.pg_read_file"},
+		{"dblink", "SELECT * FROM dblink('host=db', 'SELECT password FROM users') AS t(p text)", "FuncCall", "dblink"},
+		{"shadowed function", "SELECT public.count(*) FROM alumni", "FuncCall", "public.count"},
+		{"users", "SELECT email, password FROM users", "RangeVar", "users"},
+		{"users in subquery", "SELECT nim FROM alumni WHERE nama IN (SELECT name FROM users)", "RangeVar", "users"},
+		{"qualified users", "SELECT * FROM public.users", "RangeVar", "public.users"},
+		{"other schema", "SELECT * FROM backup.alumni", "RangeVar", "backup.alumni"},
+		{"catalog table", "SELECT * FROM pg_catalog.pg_authid", "RangeVar", "pg_catalog.pg_authid"},
+		{"other database", "SELECT * FROM flow.public.alumni", "RangeVar", "public.alumni"},
+		{"qualified prodi outside public", "SELECT * FROM backup.prodi", "RangeVar", "backup.prodi"},
+		// A non-recursive CTE cannot see itself, so the inner users is the table
+		{"CTE reading the table it shadows", "WITH users AS (SELECT * FROM users) SELECT * FROM users", "RangeVar", "users"},
+		{"CTE out of scope", "SELECT * FROM (WITH u AS (SELECT 1) SELECT * FROM u) s, u", "RangeVar", "u"},
+		{"qualified CTE name", "WITH users AS (SELECT nim FROM alumni) SELECT * FROM public.users", "RangeVar", "public.users"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateQuery(tc.query, testPolicy)
+			var v *SQLViolation
+			if !errors.As(err, &v) {
+				t.Fatalf("want a violation, got %v", err)
+			}
+			if v.Node != tc.node || v.Name != tc.value {
+				t.Errorf("got %s %q (%v), want %s %q", v.Node, v.Name, v, tc.node, tc.value)
+			}
+		})
+	}
+
+	if err := ValidateQuery("SELEC nim FROM alumni", testPolicy); err == nil || errors.As(err, new(*SQLViolation)) {
+		t.Errorf("syntax error reported as %v", err)
+	}
+}
+
+func TestQueryLineage(t *testing.T) {
+	cases := []struct {
+		query string
+		names string
+		// want lists each column's sources, = marking a column as stored and # a count
+		want string
+	}{
+		{"SELECT nama AS n, upper(nama), kode_prodi AS prodi FROM alumni", "n upper prodi", "=nama nama =kode_prodi"},
+		{"SELECT kode_prodi, count(*) AS banyak FROM alumni GROUP BY 1", "kode_prodi banyak", "=kode_prodi #"},
+		{"SELECT *, upper(a.nama) AS besar FROM alumni a", "nim nama besar", "=nim =nama nama"},
+		{"WITH a AS (SELECT nim AS id, nama FROM alumni) SELECT x.id, x.nama::text FROM a x", "id nama", "=nim nama"},
+		{"SELECT p, n FROM (SELECT kode_prodi, count(*) FROM alumni GROUP BY 1) s(p, n)", "p n", "=kode_prodi #"},
+		{"SELECT p, sum(n) FROM (SELECT kode_prodi p, tahun_lulus, count(*) n FROM alumni GROUP BY 1, 2) s GROUP BY p", "p sum", "=kode_prodi #"},
+		{"SELECT coalesce FROM (SELECT coalesce(nama, '-') FROM alumni) s", "coalesce", "nama"},
+		{"SELECT x FROM (SELECT nama || '' FROM alumni) s(x)", "x", "nama"},
+		{"SELECT (SELECT max(nama) FROM alumni) AS x", "x", "nama"},
+		{"SELECT nim FROM alumni UNION SELECT nama FROM alumni", "nim", "nim+nama"},
+		{"SELECT a FROM alumni a", "a", "*"},
+		{"WITH RECURSIVE r(x) AS (SELECT nim FROM alumni UNION ALL SELECT x || nama FROM r, alumni) SELECT x FROM r", "x", "nim+nama"},
+		// Two stars and an expression cannot be told apart, so each column may come from anything read
+		{"SELECT a.*, b.*, upper(a.nama) FROM alumni a, prodi b", "nim nama kode_prodi upper", "nim+nama nama kode_prodi+nama upper+nama"},
+	}
+	for _, tc := range cases {
+		lineage, err := NewQueryLineage(tc.query)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.query, err)
+		}
+		var got []string
+		for _, source := range lineage.Sources(strings.Fields(tc.names)) {
+			prefix := ""
+			switch {
+			case source.Count:
+				prefix = "#"
+			case source.Direct:
+				prefix = "="
+			}
+			got = append(got, prefix+strings.Join(source.Columns, "+"))
+		}
+		if strings.Join(got, " ") != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.query, strings.Join(got, " "), tc.want)
+		}
+	}
+
+	if _, err := NewQueryLineage("DELETE FROM alumni"); err == nil {
+		t.Error("lineage of a DELETE")
+	}
+}
@@ -0,0 +1,145 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const (
+	// s3DialTimeout bounds connecting to the S3 server
+	s3DialTimeout = 10 * time.Second
+	// s3ResponseTimeout bounds waiting for the headers of a response. Bodies
+	// are streamed and only limited by the request context.
+	s3ResponseTimeout = time.Minute
+)
+
+// S3Config configures an S3Storage. Endpoint is the server URL, e.g.
+// http://localhost:9000 for a local MinIO or https://s3.ap-southeast-1.amazonaws.com.
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+}
+
+// S3Storage keeps objects in a bucket of an S3 compatible server such as
+// MinIO, addressed path-style (Endpoint/Bucket/key).
+type S3Storage struct {
+	bucket string
+	client *minio.Client
+}
+
+// NewS3Storage checks config and returns a storage for its bucket. Region
+// defaults to us-east-1, which MinIO accepts unless configured otherwise.
+func NewS3Storage(config S3Config) (*S3Storage, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, errors.New("S3_ENDPOINT and S3_BUCKET are required for S3 storage")
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(config.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" || endpoint.Path != "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT %q", config.Endpoint)
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+
+	secure := endpoint.Scheme == "https"
+	transport, err := minio.DefaultTransport(secure)
+	if err != nil {
+		return nil, err
+	}
+	transport.DialContext = (&net.Dialer{Timeout: s3DialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.ResponseHeaderTimeout = s3ResponseTimeout
+
+	client, err := minio.New(endpoint.Host, &minio.Options{
+		Creds:        credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure:       secure,
+		Region:       config.Region,
+		BucketLookup: minio.BucketLookupPath,
+		Transport:    transport,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &S3Storage{bucket: config.Bucket, client: client}, nil
+}
+
+// s3Error turns a missing object into ErrObjectNotFound
+func s3Error(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return ErrObjectNotFound
+	}
+	return err
+}
+
+func (s *S3Storage) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	if !ValidKey(key) {
+		return fmt.Errorf("invalid storage key %q", key)
+	}
+	// Uploads are streamed without hashing them first
+	_, err := s.client.PutObject(ctx, s.bucket, key, body, size, minio.PutObjectOptions{
+		ContentType:          contentType,
+		DisableContentSha256: true,
+	})
+	return err
+}
+
+func (s *S3Storage) Open(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	if !ValidKey(key) {
+		return nil, ObjectInfo{}, fmt.Errorf("invalid storage key %q", key)
+	}
+	object, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, ObjectInfo{}, s3Error(err)
+	}
+	// The object is only requested once it is read or its info asked for
+	stat, err := object.Stat()
+	if err != nil {
+		object.Close()
+		return nil, ObjectInfo{}, s3Error(err)
+	}
+	return object, ObjectInfo{Key: key, Size: stat.Size, ModTime: stat.LastModified}, nil
+}
+
+func (s *S3Storage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	if !ValidKey(key) {
+		return ObjectInfo{}, fmt.Errorf("invalid storage key %q", key)
+	}
+	stat, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, s3Error(err)
+	}
+	return ObjectInfo{Key: key, Size: stat.Size, ModTime: stat.LastModified}, nil
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	if !ValidKey(key) {
+		return fmt.Errorf("invalid storage key %q", key)
+	}
+	err := s3Error(s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{}))
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (s *S3Storage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	for object := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		objects = append(objects, ObjectInfo{Key: object.Key, Size: object.Size, ModTime: object.LastModified})
+	}
+	return objects, nil
+}
@@ -0,0 +1,179 @@
+package tools
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStorage exercises the Storage contract shared by every implementation
+func testStorage(t *testing.T, store Storage) {
+	ctx := context.Background()
+	put := func(key, content string) {
+		t.Helper()
+		if err := store.Put(ctx, key, strings.NewReader(content), int64(len(content)), ContentType(key)); err != nil {
+			t.Fatalf("Put %s: %v", key, err)
+		}
+	}
+
+	put("req-abc.csv", "nim,nama\n")
+	put("req-abc.csv", "nim,nama\n13519999,Siti\n")
+	put("emailAttachments/surat izin+1.pdf", "%PDF-1.4")
+
+	info, err := store.Stat(ctx, "req-abc.csv")
+	if err != nil || info.Size != 23 || info.ModTime.IsZero() {
+		t.Errorf("Stat = %+v, %v", info, err)
+	}
+
+	body, info, err := store.Open(ctx, "emailAttachments/surat izin+1.pdf")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	content, _ := io.ReadAll(body)
+	body.Close()
+	if string(content) != "%PDF-1.4" || info.Size != 8 {
+		t.Errorf("Open = %q, %+v", content, info)
+	}
+
+	objects, err := store.List(ctx, "")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	var keys []string
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "emailAttachments/surat izin+1.pdf,req-abc.csv" {
+		t.Errorf("List = %v", keys)
+	}
+	if objects, err := store.List(ctx, "emailAttachments/"); err != nil || len(objects) != 1 {
+		t.Errorf("List with prefix = %+v, %v", objects, err)
+	}
+
+	if err := store.Delete(ctx, "req-abc.csv"); err != nil {
+		t.Errorf("Delete: %v", err)
+	}
+	if err := store.Delete(ctx, "req-abc.csv"); err != nil {
+		t.Errorf("Delete of a missing key: %v", err)
+	}
+	if _, err := store.Stat(ctx, "req-abc.csv"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("Stat after Delete: %v", err)
+	}
+	if _, _, err := store.Open(ctx, "req-missing.csv"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("Open of a missing key: %v", err)
+	}
+
+	for _, key := range []string{"", "/etc/passwd", "../secret", "a/../../b", "a//b"} {
+		if err := store.Put(ctx, key, strings.NewReader("x"), 1, ""); err == nil {
+			t.Errorf("Put accepted key %q", key)
+		}
+	}
+}
+
+func TestLocalStorage(t *testing.T) {
+	testStorage(t, &LocalStorage{Dir: t.TempDir()})
+}
+
+// fakeS3 is an in-memory, path-style S3 server that checks requests are signed
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=minio/") || r.Header.Get("X-Amz-Date") == "" {
+		http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/exports/")
+	if r.URL.Path == "/exports" || r.URL.Path == "/exports/" {
+		type content struct {
+			Key          string
+			Size         int
+			LastModified time.Time
+		}
+		var result struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Contents []content
+		}
+		for key, data := range f.objects {
+			if strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+				result.Contents = append(result.Contents, content{key, len(data), time.Now().UTC()})
+			}
+		}
+		xml.NewEncoder(w).Encode(result)
+		return
+	}
+
+	data, found := f.objects[key]
+	switch r.Method {
+	case http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		f.objects[key] = body
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet, http.MethodHead:
+		if !found {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	}
+}
+
+func TestS3Storage(t *testing.T) {
+	server := httptest.NewServer(&fakeS3{objects: map[string][]byte{}})
+	defer server.Close()
+
+	store, err := NewS3Storage(S3Config{Endpoint: server.URL, Bucket: "exports", AccessKey: "minio", SecretKey: "minio123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, store)
+
+	unsigned, _ := NewS3Storage(S3Config{Endpoint: server.URL, Bucket: "exports", AccessKey: "someone", SecretKey: "x"})
+	if _, err := unsigned.Stat(context.Background(), "req-abc.csv"); err == nil || errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("rejected request: want an access error, got %v", err)
+	}
+}
+
+// TestS3StorageMinIO runs against a real server, e.g.
+//
+//	docker run -p 9000:9000 minio/minio server /data
+//
+// with S3_TEST_ENDPOINT=http://localhost:9000 and an existing S3_TEST_BUCKET.
+func TestS3StorageMinIO(t *testing.T) {
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT not set")
+	}
+	store, err := NewS3Storage(S3Config{
+		Endpoint:  endpoint,
+		Bucket:    os.Getenv("S3_TEST_BUCKET"),
+		AccessKey: os.Getenv("S3_TEST_ACCESS_KEY"),
+		SecretKey: os.Getenv("S3_TEST_SECRET_KEY"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, store)
+}
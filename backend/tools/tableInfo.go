@@ -0,0 +1,40 @@
+package tools
+
+import "gorm.io/gorm"
+
+// ColumnInfo is a column of a table or view as reported by pg_catalog
+type ColumnInfo struct {
+	ColumnName string `db:"column_name" json:"column_name"`
+	DataType   string `db:"data_type" json:"data_type"`
+}
+
+// TableColumns lists the columns of a table, view or materialized view in order.
+func TableColumns(db *gorm.DB, tableName string) ([]ColumnInfo, error) {
+	query := `
+        SELECT
+            a.attname                           AS column_name,
+            pg_catalog.format_type(a.atttypid, a.atttypmod) AS data_type,
+            a.attnum                            AS ordinal_position
+            FROM pg_attribute a
+            JOIN pg_class c ON a.attrelid = c.oid
+            JOIN pg_namespace n ON c.relnamespace = n.oid
+            WHERE c.relkind IN ('r','v','m')
+            AND a.attnum > 0
+            AND NOT a.attisdropped
+            AND c.relname = $1
+            ORDER BY a.attnum;
+    `
+
+	var columns []ColumnInfo
+	err := db.Raw(query, tableName).Scan(&columns).Error
+	return columns, err
+}
+
+// ColumnTypes maps column name to declared type, e.g. "ipk" -> "numeric(3,2)".
+func ColumnTypes(columns []ColumnInfo) map[string]string {
+	types := make(map[string]string, len(columns))
+	for _, col := range columns {
+		types[col.ColumnName] = col.DataType
+	}
+	return types
+}
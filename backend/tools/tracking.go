@@ -0,0 +1,51 @@
+package tools
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"os"
+
+	"github.com/google/uuid"
+)
+
+// trackingMACSize is how many bytes of the HMAC a tracking token carries
+const trackingMACSize = 16
+
+var errInvalidTrackingToken = errors.New("invalid tracking token")
+
+// trackingSecret signs tracking tokens: TRACKING_SECRET, or JWT_SECRET when unset
+func trackingSecret() []byte {
+	if secret := os.Getenv("TRACKING_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	return []byte(os.Getenv("JWT_SECRET"))
+}
+
+func trackingMAC(id uuid.UUID) []byte {
+	mac := hmac.New(sha256.New, trackingSecret())
+	mac.Write([]byte("tracking:"))
+	mac.Write(id[:])
+	return mac.Sum(nil)[:trackingMACSize]
+}
+
+// TrackingToken returns the token that lets a requester follow data request
+// id without logging in: the ID and its HMAC, URL-safe base64 encoded.
+func TrackingToken(id uuid.UUID) string {
+	return base64.RawURLEncoding.EncodeToString(append(id[:], trackingMAC(id)...))
+}
+
+// ParseTrackingToken returns the data request ID of a token made by TrackingToken.
+func ParseTrackingToken(token string) (uuid.UUID, error) {
+	raw, err := base64.RawURLEncoding.Strict().DecodeString(token)
+	if err != nil || len(raw) != len(uuid.UUID{})+trackingMACSize {
+		return uuid.Nil, errInvalidTrackingToken
+	}
+
+	id, err := uuid.FromBytes(raw[:len(uuid.UUID{})])
+	if err != nil || !hmac.Equal(raw[len(uuid.UUID{}):], trackingMAC(id)) {
+		return uuid.Nil, errInvalidTrackingToken
+	}
+	return id, nil
+}
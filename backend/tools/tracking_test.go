@@ -0,0 +1,41 @@
+package tools
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestTrackingToken(t *testing.T) {
+	t.Setenv("TRACKING_SECRET", "tracking-secret")
+	id := uuid.New()
+	token := TrackingToken(id)
+
+	parsed, err := ParseTrackingToken(token)
+	if err != nil || parsed != id {
+		t.Fatalf("ParseTrackingToken = %v, %v; want %v", parsed, err, id)
+	}
+
+	// Flip one character of the MAC
+	tampered := []byte(token)
+	if tampered[len(tampered)-1] == 'A' {
+		tampered[len(tampered)-1] = 'B'
+	} else {
+		tampered[len(tampered)-1] = 'A'
+	}
+	for name, bad := range map[string]string{
+		"tampered":  string(tampered),
+		"bare id":   id.String(),
+		"truncated": token[:len(token)-4],
+		"empty":     "",
+	} {
+		if _, err := ParseTrackingToken(bad); err == nil {
+			t.Errorf("%s token accepted", name)
+		}
+	}
+
+	t.Setenv("TRACKING_SECRET", "another-secret")
+	if _, err := ParseTrackingToken(token); err == nil {
+		t.Error("token signed with another secret accepted")
+	}
+}
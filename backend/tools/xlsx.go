@@ -0,0 +1,133 @@
+package tools
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+const xlsxSheet = "Sheet1"
+
+// cellKind decides how a column's values are encoded
+type cellKind int
+
+const (
+	textCell cellKind = iota
+	numberCell
+	dateCell
+	timestampCell
+	boolCell
+)
+
+// timeLayouts are the ways dates show up in CSV exports and query results
+var timeLayouts = []string{
+	"2006-01-02 15:04:05 -0700 MST",
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// kindOf maps a Postgres type name ("numeric(3,2)", "DATE", "timestamp with time zone") to a cell kind
+func kindOf(dataType string) cellKind {
+	t := strings.ToLower(dataType)
+	switch {
+	case strings.HasPrefix(t, "timestamp"):
+		return timestampCell
+	case t == "date":
+		return dateCell
+	case t == "bool" || t == "boolean":
+		return boolCell
+	case strings.HasPrefix(t, "numeric"), strings.HasPrefix(t, "decimal"),
+		strings.HasPrefix(t, "int"), t == "smallint", t == "bigint",
+		t == "real", strings.HasPrefix(t, "double"), strings.HasPrefix(t, "float"):
+		return numberCell
+	}
+	return textCell
+}
+
+// xlsxEncoder streams rows into a workbook. The first row holds the column
+// names and the second their types, so typed cells can be told apart.
+type xlsxEncoder struct {
+	out           io.Writer
+	file          *excelize.File
+	stream        *excelize.StreamWriter
+	dateStyle     int
+	datetimeStyle int
+	rows          int
+}
+
+func newXLSXEncoder(out io.Writer) (*xlsxEncoder, error) {
+	file := excelize.NewFile()
+	stream, err := file.NewStreamWriter(xlsxSheet)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &xlsxEncoder{out: out, file: file, stream: stream}
+	if e.dateStyle, err = file.NewStyle(&excelize.Style{NumFmt: 14}); err != nil {
+		return nil, err
+	}
+	if e.datetimeStyle, err = file.NewStyle(&excelize.Style{NumFmt: 22}); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *xlsxEncoder) begin(cols []resultColumn) error {
+	header := make([]interface{}, len(cols))
+	types := make([]interface{}, len(cols))
+	for i, col := range cols {
+		header[i] = col.Name
+		types[i] = col.Type
+	}
+
+	if err := e.setRow(header); err != nil {
+		return err
+	}
+	return e.setRow(types)
+}
+
+func (e *xlsxEncoder) row(cols []resultColumn, values []interface{}) error {
+	row := make([]interface{}, len(values))
+	for i, val := range values {
+		switch v := val.(type) {
+		case json.Number:
+			// Excel stores every number as a double anyway
+			if f, err := v.Float64(); err == nil {
+				row[i] = f
+			} else {
+				row[i] = v.String()
+			}
+		case time.Time:
+			style := e.datetimeStyle
+			if cols[i].Kind == dateCell {
+				style = e.dateStyle
+			}
+			row[i] = excelize.Cell{StyleID: style, Value: v}
+		default:
+			row[i] = v
+		}
+	}
+	return e.setRow(row)
+}
+
+func (e *xlsxEncoder) setRow(values []interface{}) error {
+	e.rows++
+	cell, err := excelize.CoordinatesToCellName(1, e.rows)
+	if err != nil {
+		return err
+	}
+	return e.stream.SetRow(cell, values)
+}
+
+func (e *xlsxEncoder) Close() error {
+	defer e.file.Close()
+	if err := e.stream.Flush(); err != nil {
+		return err
+	}
+	_, err := e.file.WriteTo(e.out)
+	return err
+}
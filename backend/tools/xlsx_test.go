@@ -0,0 +1,60 @@
+package tools
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/xuri/excelize/v2"
+)
+
+func TestXLSXOutput(t *testing.T) {
+	file, err := excelize.OpenReader(bytes.NewReader(writeTyped(t, "xlsx")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	rows, err := file.GetRows(xlsxSheet, excelize.Options{RawCellValue: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("%d rows: %v", len(rows), rows)
+	}
+	if rows[0][0] != "nim" || rows[0][8] != "nim" || rows[1][1] != "numeric(3,2)" || rows[1][5] != "timestamp with time zone" {
+		t.Errorf("header rows: %v", rows[:2])
+	}
+
+	// Numbers, dates and booleans are typed cells (numbers carry no type
+	// attribute), text stays text
+	cells := map[string]struct {
+		kind  excelize.CellType
+		value string
+	}{
+		"A3": {excelize.CellTypeInlineString, "13520001"},
+		"B3": {excelize.CellTypeUnset, "3.595"},
+		"C3": {excelize.CellTypeUnset, "45534"},
+		"D3": {excelize.CellTypeUnset, "2020"},
+		"E3": {excelize.CellTypeBool, "1"},
+		"G3": {excelize.CellTypeUnset, "1.5"},
+	}
+	for cell, want := range cells {
+		kind, _ := file.GetCellType(xlsxSheet, cell)
+		value, _ := file.GetCellValue(xlsxSheet, cell, excelize.Options{RawCellValue: true})
+		if kind != want.kind || value != want.value {
+			t.Errorf("%s: %v %q, want %v %q", cell, kind, value, want.kind, want.value)
+		}
+	}
+
+	// Dates show as dates
+	for cell, want := range map[string]string{"C3": "08-30-24", "F3": "9/1/24 08:30"} {
+		if value, _ := file.GetCellValue(xlsxSheet, cell); value != want {
+			t.Errorf("%s shows %q, want %q", cell, value, want)
+		}
+	}
+
+	// The NULL row is written without any cells
+	if value, _ := file.GetCellValue(xlsxSheet, "A4"); rows[2][8] != "kedua" || value != "" {
+		t.Errorf("rows: %v", rows)
+	}
+}
@@ -0,0 +1,326 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"grad_deploy/models"
+)
+
+// Email template IDs, one per notification sent to requesters
+const (
+	TemplateRequestReceived  = "request_received"
+	TemplateRequestApproved  = "request_approved"
+	TemplateRequestRejected  = "request_rejected"
+	TemplateRequestRevision  = "request_needs_revision"
+	TemplateRequestCompleted = "request_completed"
+	// TemplateExportPassword carries the password of a protected export,
+	// sent apart from the email with the file
+	TemplateExportPassword = "export_password"
+	// TemplateAccountInvite and TemplatePasswordReset go to admin accounts
+	// with a link to set a password
+	TemplateAccountInvite = "account_invite"
+	TemplatePasswordReset = "password_reset"
+)
+
+// EmailLanguages are the languages every template is available in
+var EmailLanguages = []string{"id", "en"}
+
+// statusTemplates picks the notification for a request entering a status
+var statusTemplates = map[string]string{
+	models.StatusPending:          TemplateRequestReceived,
+	models.StatusApproved:         TemplateRequestApproved,
+	models.StatusRejected:         TemplateRequestRejected,
+	models.StatusRequiresRevision: TemplateRequestRevision,
+	models.StatusCompleted:        TemplateRequestCompleted,
+}
+
+// emailTemplate is one language variant of a notification. Subject, Body and
+// Button are text/templates executed with an emailView.
+type emailTemplate struct {
+	Subject string
+	Body    string
+	Button  string
+}
+
+var emailTemplateSources = map[string]map[string]emailTemplate{
+	TemplateRequestReceived: {
+		"id": {
+			Subject: "Permintaan Data Tracer Diterima",
+			Body: "Permintaan data Anda untuk keperluan {{.Request.Purpose}} telah kami terima dan akan segera ditinjau. " +
+				"Nomor permintaan: {{.Request.ID}}. " +
+				"Ringkasan: data dalam format {{.Request.Format}}" +
+				"{{if .Request.Columns}}, kolom {{.Request.Columns}}{{end}}" +
+				"{{if or .Request.YearFrom .Request.YearTo}}, tahun {{if .Request.YearFrom}}{{.Request.YearFrom}}{{end}}–{{if .Request.YearTo}}{{.Request.YearTo}}{{end}}{{end}}." +
+				"{{if .URL}} Anda dapat memantau status permintaan melalui tautan di bawah ini.{{end}}",
+			Button: "Lihat status permintaan",
+		},
+		"en": {
+			Subject: "Tracer Data Request Received",
+			Body: "We have received your data request for {{.Request.Purpose}} and will review it shortly. " +
+				"Request number: {{.Request.ID}}. " +
+				"Summary: data in {{.Request.Format}} format" +
+				"{{if .Request.Columns}}, columns {{.Request.Columns}}{{end}}" +
+				"{{if or .Request.YearFrom .Request.YearTo}}, years {{if .Request.YearFrom}}{{.Request.YearFrom}}{{end}}–{{if .Request.YearTo}}{{.Request.YearTo}}{{end}}{{end}}." +
+				"{{if .URL}} You can follow the status of your request with the link below.{{end}}",
+			Button: "View request status",
+		},
+	},
+	TemplateRequestApproved: {
+		"id": {
+			Subject: "Permintaan Data Tracer Disetujui",
+			Body:    "Permintaan data Anda untuk keperluan {{.Request.Purpose}} telah disetujui. Data dalam format {{.Request.Format}} sedang kami siapkan.",
+		},
+		"en": {
+			Subject: "Tracer Data Request Approved",
+			Body:    "Your data request for {{.Request.Purpose}} has been approved. We are now preparing the data in {{.Request.Format}} format.",
+		},
+	},
+	TemplateRequestRejected: {
+		"id": {
+			Subject: "Permintaan Data Tracer Ditolak",
+			Body:    "Mohon maaf, permintaan data Anda untuk keperluan {{.Request.Purpose}} tidak dapat kami penuhi.{{if .Request.StatusNote}} Alasan: {{.Request.StatusNote}}{{end}}",
+		},
+		"en": {
+			Subject: "Tracer Data Request Rejected",
+			Body:    "We are sorry, but your data request for {{.Request.Purpose}} cannot be fulfilled.{{if .Request.StatusNote}} Reason: {{.Request.StatusNote}}{{end}}",
+		},
+	},
+	TemplateRequestRevision: {
+		"id": {
+			Subject: "Permintaan Data Tracer Perlu Direvisi",
+			Body:    "Permintaan data Anda untuk keperluan {{.Request.Purpose}} perlu direvisi sebelum dapat kami proses.{{if .Request.StatusNote}} Catatan: {{.Request.StatusNote}}{{end}}",
+			Button:  "Revisi permintaan",
+		},
+		"en": {
+			Subject: "Tracer Data Request Needs Revision",
+			Body:    "Your data request for {{.Request.Purpose}} needs to be revised before we can process it.{{if .Request.StatusNote}} Notes: {{.Request.StatusNote}}{{end}}",
+			Button:  "Revise request",
+		},
+	},
+	TemplateRequestCompleted: {
+		"id": {
+			Subject: "Permintaan Data Tracer Selesai",
+			Body:    "Data Anda telah siap untuk diunduh. Silakan klik tautan di bawah ini untuk mengunduh data Anda.",
+			Button:  "Unduh data",
+		},
+		"en": {
+			Subject: "Tracer Data Request Completed",
+			Body:    "Your data is ready. Please use the link below to download it.",
+			Button:  "Download dataset",
+		},
+	},
+	TemplateExportPassword: {
+		"id": {
+			Subject: "Kata Sandi Data Tracer",
+			Body: "Data yang kami kirimkan{{if .File}} ({{.File}}){{end}} dilindungi kata sandi. " +
+				"Gunakan kata sandi berikut untuk membukanya: {{.Password}} " +
+				"Jangan teruskan email ini bersama datanya.",
+		},
+		"en": {
+			Subject: "Tracer Data Password",
+			Body: "The data we sent you{{if .File}} ({{.File}}){{end}} is password protected. " +
+				"Use this password to open it: {{.Password}} " +
+				"Please do not forward this email together with the data.",
+		},
+	},
+	TemplateAccountInvite: {
+		"id": {
+			Subject: "Undangan Akun Tracer Study",
+			Body: "Anda diundang untuk menggunakan sistem permintaan data Tracer Study ITB sebagai {{.User.Role}} dengan email {{.User.Email}}. " +
+				"Silakan buat kata sandi Anda melalui tautan di bawah ini{{if .Expires}} sebelum {{.Expires}}{{end}}.",
+			Button: "Buat kata sandi",
+		},
+		"en": {
+			Subject: "Tracer Study Account Invitation",
+			Body: "You have been invited to the ITB Tracer Study data request system as {{.User.Role}} with the email {{.User.Email}}. " +
+				"Please set your password with the link below{{if .Expires}} before {{.Expires}}{{end}}.",
+			Button: "Set password",
+		},
+	},
+	TemplatePasswordReset: {
+		"id": {
+			Subject: "Atur Ulang Kata Sandi Tracer Study",
+			Body: "Kami menerima permintaan untuk mengatur ulang kata sandi akun {{.User.Email}}. " +
+				"Tautan di bawah ini hanya dapat digunakan sekali{{if .Expires}} dan berlaku sampai {{.Expires}}{{end}}. " +
+				"Abaikan email ini jika Anda tidak memintanya.",
+			Button: "Atur ulang kata sandi",
+		},
+		"en": {
+			Subject: "Reset Your Tracer Study Password",
+			Body: "We received a request to reset the password of {{.User.Email}}. " +
+				"The link below can only be used once{{if .Expires}} and is valid until {{.Expires}}{{end}}. " +
+				"Ignore this email if you did not ask for it.",
+			Button: "Reset password",
+		},
+	},
+}
+
+// layoutText holds the fixed wording of the HTML layout in one language
+type layoutText struct {
+	Dear       string
+	Hello      string
+	Download   string
+	CopyLink   string
+	Attached   string
+	Regards    string
+	Team       string
+	SentTo     string
+	SubjectFor string
+	For        string
+	Unexpected string
+}
+
+var layoutTexts = map[string]layoutText{
+	"id": {
+		Dear:       "Yth.",
+		Hello:      "Halo,",
+		Download:   "Unduh data",
+		CopyLink:   "Jika tombol tidak berfungsi, salin dan tempel tautan ini ke browser Anda:",
+		Attached:   "Terlampir: dataset (jika tersedia) — harap perlakukan data sebagai rahasia jika diperlukan. Jika Anda membutuhkan dataset dalam format lain atau membutuhkan dokumentasi tambahan (kamus data, contoh baris, atau skema), balas email ini dan kami akan memberikannya.",
+		Regards:    "Salam hormat,",
+		Team:       "Tim Tracer Study ITB",
+		SentTo:     "Dikirim ke:",
+		SubjectFor: "Subjek:",
+		For:        "Untuk",
+		Unexpected: "Jika Anda tidak merasa meminta email ini, harap beri tahu pengirim dan hapus pesan ini.",
+	},
+	"en": {
+		Dear:       "Dear",
+		Hello:      "Hello,",
+		Download:   "Download dataset",
+		CopyLink:   "If the button does not work, copy and paste this link into your browser:",
+		Attached:   "Attached: dataset (if available) — please treat the data as confidential where required. If you need the dataset in another format or need additional documentation (data dictionary, sample rows or schema), reply to this email and we will provide it.",
+		Regards:    "Kind regards,",
+		Team:       "ITB Tracer Study Team",
+		SentTo:     "Sent to:",
+		SubjectFor: "Subject:",
+		For:        "For",
+		Unexpected: "If you weren't expecting this email, please notify the sender and delete the message.",
+	},
+}
+
+type parsedTemplate struct {
+	subject, body, button *template.Template
+}
+
+var emailTemplates = parseEmailTemplates()
+
+func parseEmailTemplates() map[string]map[string]parsedTemplate {
+	parsed := make(map[string]map[string]parsedTemplate)
+	for id, variants := range emailTemplateSources {
+		parsed[id] = make(map[string]parsedTemplate)
+		for lang, source := range variants {
+			name := id + "." + lang
+			parsed[id][lang] = parsedTemplate{
+				subject: template.Must(template.New(name + ".subject").Parse(source.Subject)),
+				body:    template.Must(template.New(name + ".body").Parse(source.Body)),
+				button:  template.Must(template.New(name + ".button").Parse(source.Button)),
+			}
+		}
+	}
+	return parsed
+}
+
+// EmailTemplateIDs lists the registered templates in alphabetical order.
+func EmailTemplateIDs() []string {
+	ids := make([]string, 0, len(emailTemplates))
+	for id := range emailTemplates {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// TemplateForStatus returns the notification for a request entering status, if there is one.
+func TemplateForStatus(status string) (string, bool) {
+	id, ok := statusTemplates[status]
+	return id, ok
+}
+
+// NormalizeLanguage maps "" to EMAIL_LANGUAGE (default "id") and checks the
+// language is one of EmailLanguages.
+func NormalizeLanguage(language string) (string, error) {
+	language = strings.ToLower(strings.TrimSpace(language))
+	if language == "" {
+		language = strings.ToLower(os.Getenv("EMAIL_LANGUAGE"))
+	}
+	if language == "" {
+		language = "id"
+	}
+	for _, known := range EmailLanguages {
+		if language == known {
+			return language, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported email language %q", language)
+}
+
+// emailView is what templates are executed with. File and Password are only
+// set for TemplateExportPassword, User and Expires for the account templates.
+type emailView struct {
+	Request  models.DataRequest
+	URL      string
+	File     string
+	Password string
+	User     models.User
+	Expires  string
+}
+
+// RenderRequestEmail fills in template id in language for dataRequest. url is
+// the link shown as the button, if any. To is set to the requester.
+func RenderRequestEmail(id, language string, dataRequest models.DataRequest, url string) (EmailData, error) {
+	return renderEmail(id, language, emailView{Request: dataRequest, URL: url})
+}
+
+// RenderPasswordEmail fills in TemplateExportPassword in language with the
+// password of the protected file sent for dataRequest. To is set to the requester.
+func RenderPasswordEmail(language string, dataRequest models.DataRequest, file, password string) (EmailData, error) {
+	return renderEmail(TemplateExportPassword, language, emailView{Request: dataRequest, File: file, Password: password})
+}
+
+// RenderAccountEmail fills in TemplateAccountInvite or TemplatePasswordReset
+// in language for user, with url as the button and the link's expiry. To is
+// set to the user.
+func RenderAccountEmail(id, language string, user models.User, url string, expires time.Time) (EmailData, error) {
+	view := emailView{User: user, URL: url, Expires: expires.Format("02 Jan 2006 15:04 MST")}
+	return renderEmail(id, language, view)
+}
+
+func renderEmail(id, language string, view emailView) (EmailData, error) {
+	variants, ok := emailTemplates[id]
+	if !ok {
+		return EmailData{}, fmt.Errorf("unknown email template %q", id)
+	}
+	language, err := NormalizeLanguage(language)
+	if err != nil {
+		return EmailData{}, err
+	}
+	tmpl := variants[language]
+
+	render := func(t *template.Template) (string, error) {
+		var out bytes.Buffer
+		err := t.Execute(&out, view)
+		return out.String(), err
+	}
+
+	data := EmailData{To: view.Request.Email, Name: view.Request.Name, URL: view.URL, Language: language}
+	if view.User.Email != "" {
+		data.To, data.Name = view.User.Email, view.User.Name
+	}
+	if data.Subject, err = render(tmpl.subject); err != nil {
+		return EmailData{}, err
+	}
+	if data.Body, err = render(tmpl.body); err != nil {
+		return EmailData{}, err
+	}
+	if data.Button, err = render(tmpl.button); err != nil {
+		return EmailData{}, err
+	}
+	return data, nil
+}
@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"grad_deploy/models"
+)
+
+func testRequest() models.DataRequest {
+	return models.DataRequest{
+		ID:         uuid.New(),
+		Name:       "Siti",
+		Email:      "siti@example.com",
+		Format:     "CSV",
+		Purpose:    "Skripsi",
+		StatusNote: "Tujuan tidak jelas",
+	}
+}
+
+func TestRenderRequestEmailAllTemplates(t *testing.T) {
+	request := testRequest()
+	for _, id := range EmailTemplateIDs() {
+		for _, language := range EmailLanguages {
+			data, err := RenderRequestEmail(id, language, request, "http://localhost/sql/x")
+			if err != nil {
+				t.Fatalf("%s/%s: %v", id, language, err)
+			}
+			if data.Subject == "" || data.Body == "" || data.To != request.Email || data.Language != language {
+				t.Errorf("%s/%s rendered %+v", id, language, data)
+			}
+			if _, err := RenderEmailHTML(data); err != nil {
+				t.Errorf("%s/%s layout: %v", id, language, err)
+			}
+		}
+	}
+}
+
+func TestRenderRequestEmailFields(t *testing.T) {
+	request := testRequest()
+
+	rejected, err := RenderRequestEmail(TemplateRequestRejected, "en", request, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(rejected.Body, "Reason: Tujuan tidak jelas") || !strings.Contains(rejected.Body, "Skripsi") {
+		t.Errorf("rejection body: %q", rejected.Body)
+	}
+
+	received, err := RenderRequestEmail(TemplateRequestReceived, "id", request, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(received.Body, request.ID.String()) {
+		t.Errorf("received body lacks request ID: %q", received.Body)
+	}
+
+	html, err := RenderEmailHTML(received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(html, `lang="id"`) || !strings.Contains(html, "Salam hormat") {
+		t.Errorf("layout not in Indonesian")
+	}
+}
+
+func TestRenderRequestEmailDefaultsAndErrors(t *testing.T) {
+	t.Setenv("EMAIL_LANGUAGE", "en")
+	data, err := RenderRequestEmail(TemplateRequestApproved, "", testRequest(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Language != "en" {
+		t.Errorf("default language %q, want en", data.Language)
+	}
+
+	if _, err := RenderRequestEmail("no_such_template", "id", testRequest(), ""); err == nil {
+		t.Error("unknown template accepted")
+	}
+	if _, err := RenderRequestEmail(TemplateRequestApproved, "fr", testRequest(), ""); err == nil {
+		t.Error("unknown language accepted")
+	}
+}
+
+func TestTemplateForStatus(t *testing.T) {
+	if id, ok := TemplateForStatus(models.StatusRequiresRevision); !ok || id != TemplateRequestRevision {
+		t.Errorf("REQUIRES_REVISION: got %q, %v", id, ok)
+	}
+	if _, ok := TemplateForStatus(models.StatusInProgress); ok {
+		t.Error("IN_PROGRESS should have no notification")
+	}
+}
+
+func TestRenderPasswordEmail(t *testing.T) {
+	for _, language := range EmailLanguages {
+		data, err := RenderPasswordEmail(language, testRequest(), "req-abc.zip", "Xy7pQ2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(data.Body, "Xy7pQ2") || !strings.Contains(data.Body, "req-abc.zip") || data.URL != "" || data.Button != "" {
+			t.Errorf("%s: rendered %+v", language, data)
+		}
+	}
+}
+
+func TestRenderAccountEmail(t *testing.T) {
+	user := models.User{Name: "Rina", Email: "rina@example.com", Role: models.RoleAdmin}
+	expires := time.Date(2026, 10, 24, 9, 30, 0, 0, time.UTC)
+	for _, id := range []string{TemplateAccountInvite, TemplatePasswordReset} {
+		for _, language := range EmailLanguages {
+			data, err := RenderAccountEmail(id, language, user, "http://localhost:5173/invite/abc", expires)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data.To != user.Email || data.Name != "Rina" || data.URL != "http://localhost:5173/invite/abc" || data.Button == "" ||
+				!strings.Contains(data.Body, "rina@example.com") || !strings.Contains(data.Body, "24 Oct 2026 09:30 UTC") {
+				t.Errorf("%s/%s: rendered %+v", id, language, data)
+			}
+		}
+	}
+}
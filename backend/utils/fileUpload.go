@@ -1,35 +1,41 @@
 package utils
 
 import (
+	"context"
 	"mime/multipart"
-	"os"
-	"path/filepath"
-	"strings"
+	"path"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+
+	"grad_deploy/tools"
 )
 
-func HandleFileUpload(c *gin.Context, file *multipart.FileHeader, path string) (string, error) {
-	// Generate unique file name
-	fileName := uuid.New().String() + filepath.Ext(file.Filename)
-	// Storage name in server (ex, folder 'uploads')
-	uploadPath := filepath.Join("uploads", path, fileName)
-	// Simpan file di server
-	if err := c.SaveUploadedFile(file, uploadPath); err != nil {
+// HandleFileUpload checks file against policy and stores it in store under
+// dir/<uuid><ext>, with the extension of its detected type rather than the
+// one it was uploaded with. It returns that key; links to it are made with
+// tools.NewFileURL. A refused file gives an *UploadRejection.
+func HandleFileUpload(c *gin.Context, store tools.Storage, policy UploadPolicy, file *multipart.FileHeader, dir string) (string, error) {
+	kind, err := policy.Check(c.Request.Context(), file)
+	if err != nil {
 		return "", err
 	}
-	// Return URL from uploaded file
-	return "/uploads" + path + fileName, nil
-}
+	// Generate unique file name
+	key := path.Join(dir, uuid.New().String()+UploadTypes[kind])
 
-func DeleteFile(filePath string) error {
-	hostname := os.Getenv("HOSTNAME")
+	src, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
 
-	// Remove file from storage
-	if err := os.Remove(strings.TrimPrefix(filePath, hostname+"/")); err != nil {
-		return err
+	if err := store.Put(c.Request.Context(), key, src, file.Size, tools.ContentType(key)); err != nil {
+		return "", err
 	}
+	return key, nil
+}
 
-	return nil
+// DeleteFile removes the upload stored under key, as returned by HandleFileUpload
+func DeleteFile(ctx context.Context, store tools.Storage, key string) error {
+	return store.Delete(ctx, key)
 }
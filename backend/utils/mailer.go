@@ -0,0 +1,210 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"gopkg.in/gomail.v2"
+)
+
+// smtpIdleTimeout is how long an unused SMTP connection is kept open
+const smtpIdleTimeout = 30 * time.Second
+
+// Mailer delivers a composed message. EMAIL_TRANSPORT selects the
+// implementation SendEmail uses: "smtp" (default) or "file". Tests capture
+// mail with SetMailer(&MemoryMailer{}), it cannot be configured.
+type Mailer interface {
+	Send(msg *gomail.Message) error
+}
+
+var (
+	mailerMu sync.Mutex
+	mailer   Mailer
+)
+
+// NewMailer creates the mailer configured by EMAIL_TRANSPORT.
+func NewMailer() (Mailer, error) {
+	switch transport := strings.ToLower(os.Getenv("EMAIL_TRANSPORT")); transport {
+	case "", "smtp":
+		port, err := strconv.Atoi(os.Getenv("EMAIL_PORT"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid EMAIL_PORT: %w", err)
+		}
+		dialer := gomail.NewDialer(os.Getenv("EMAIL_HOST"), port, os.Getenv("EMAIL_USERNAME"), os.Getenv("EMAIL_PASSWORD"))
+		return NewSMTPMailer(dialer), nil
+	case "file":
+		dir := os.Getenv("EMAIL_DROP_DIR")
+		if dir == "" {
+			dir = "mail"
+		}
+		return &FileMailer{Dir: dir}, nil
+	default:
+		return nil, fmt.Errorf("unknown EMAIL_TRANSPORT %q", transport)
+	}
+}
+
+// SetMailer replaces the mailer SendEmail uses; nil makes the next send
+// create one from the environment again.
+func SetMailer(m Mailer) {
+	mailerMu.Lock()
+	defer mailerMu.Unlock()
+	mailer = m
+}
+
+// currentMailer returns the mailer in use, creating it on first use
+func currentMailer() (Mailer, error) {
+	mailerMu.Lock()
+	defer mailerMu.Unlock()
+	if mailer == nil {
+		m, err := NewMailer()
+		if err != nil {
+			return nil, err
+		}
+		mailer = m
+	}
+	return mailer, nil
+}
+
+// SMTPMailer sends through an SMTP server, reusing one connection for
+// consecutive messages and closing it once idle.
+type SMTPMailer struct {
+	dialer *gomail.Dialer
+
+	mu   sync.Mutex
+	conn gomail.SendCloser
+	idle *time.Timer
+}
+
+func NewSMTPMailer(dialer *gomail.Dialer) *SMTPMailer {
+	return &SMTPMailer{dialer: dialer}
+}
+
+func (m *SMTPMailer) Send(msg *gomail.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	reused := m.conn != nil
+	if err := m.send(msg); err != nil {
+		m.closeConn()
+		// The server may have dropped the connection while it was idle
+		if !reused {
+			return err
+		}
+		if err := m.send(msg); err != nil {
+			m.closeConn()
+			return err
+		}
+	}
+
+	if m.idle != nil {
+		m.idle.Stop()
+	}
+	m.idle = time.AfterFunc(smtpIdleTimeout, m.Close)
+	return nil
+}
+
+func (m *SMTPMailer) send(msg *gomail.Message) error {
+	if m.conn == nil {
+		conn, err := m.dialer.Dial()
+		if err != nil {
+			return err
+		}
+		m.conn = conn
+	}
+	return gomail.Send(m.conn, msg)
+}
+
+// Close ends the open connection, if any.
+func (m *SMTPMailer) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closeConn()
+}
+
+func (m *SMTPMailer) closeConn() {
+	if m.conn != nil {
+		m.conn.Close()
+		m.conn = nil
+	}
+}
+
+// FileMailer writes every message as an .eml file into Dir instead of sending it.
+type FileMailer struct {
+	Dir string
+}
+
+func (m *FileMailer) Send(msg *gomail.Message) error {
+	if err := os.MkdirAll(m.Dir, os.ModePerm); err != nil {
+		return err
+	}
+	name := time.Now().Format("20060102-150405") + "-" + uuid.New().String() + ".eml"
+	file, err := os.Create(filepath.Join(m.Dir, name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := msg.WriteTo(file); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// CapturedEmail is a message kept by a MemoryMailer.
+type CapturedEmail struct {
+	From    string
+	To      []string
+	Subject string
+	Raw     string
+}
+
+// MemoryMailer keeps messages in memory, for tests. When Err is set, Send
+// fails with it and keeps nothing.
+type MemoryMailer struct {
+	mu   sync.Mutex
+	Err  error
+	sent []CapturedEmail
+}
+
+func (m *MemoryMailer) Send(msg *gomail.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Err != nil {
+		return m.Err
+	}
+
+	var raw bytes.Buffer
+	if _, err := msg.WriteTo(&raw); err != nil {
+		return err
+	}
+	email := CapturedEmail{To: msg.GetHeader("To"), Raw: raw.String()}
+	if from := msg.GetHeader("From"); len(from) > 0 {
+		email.From = from[0]
+	}
+	if subject := msg.GetHeader("Subject"); len(subject) > 0 {
+		email.Subject = subject[0]
+	}
+	m.sent = append(m.sent, email)
+	return nil
+}
+
+// Sent returns the messages captured so far.
+func (m *MemoryMailer) Sent() []CapturedEmail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]CapturedEmail(nil), m.sent...)
+}
+
+// SetErr makes later sends fail with err, or succeed again when nil.
+func (m *MemoryMailer) SetErr(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Err = err
+}
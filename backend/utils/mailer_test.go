@@ -0,0 +1,222 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"gopkg.in/gomail.v2"
+)
+
+// fakeSMTP is a minimal SMTP server that records delivered messages and can
+// be told to reject recipients.
+type fakeSMTP struct {
+	listener net.Listener
+	mu       sync.Mutex
+	reject   bool
+	conns    []net.Conn
+	messages []string
+}
+
+func startFakeSMTP(t *testing.T) *fakeSMTP {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeSMTP{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+
+	return server
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	s.mu.Lock()
+	s.conns = append(s.conns, conn)
+	s.mu.Unlock()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) { fmt.Fprint(conn, line+"\r\n") }
+
+	reply("220 localhost fake SMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.Fields(line + " x")[0])
+		switch command {
+		case "RCPT":
+			s.mu.Lock()
+			reject := s.reject
+			s.mu.Unlock()
+			if reject {
+				reply("550 mailbox unavailable")
+			} else {
+				reply("250 OK")
+			}
+		case "DATA":
+			reply("354 end with <CRLF>.<CRLF>")
+			var message strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				message.WriteString(line)
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, message.String())
+			s.mu.Unlock()
+			reply("250 OK")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func (s *fakeSMTP) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeSMTP) setReject(reject bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reject = reject
+}
+
+func (s *fakeSMTP) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// dropConnections closes every open connection, as a server timing out idle clients would
+func (s *fakeSMTP) dropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *fakeSMTP) delivered() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.messages...)
+}
+
+func testMessage(subject string) *gomail.Message {
+	msg := gomail.NewMessage()
+	msg.SetHeader("From", "noreply@example.com")
+	msg.SetHeader("To", "alumni@example.com")
+	msg.SetHeader("Subject", subject)
+	msg.SetBody("text/plain", "Data siap")
+	return msg
+}
+
+func TestSMTPMailerReusesConnection(t *testing.T) {
+	server := startFakeSMTP(t)
+	mailer := NewSMTPMailer(gomail.NewDialer("127.0.0.1", server.port(), "", ""))
+	defer mailer.Close()
+
+	for _, subject := range []string{"first", "second"} {
+		if err := mailer.Send(testMessage(subject)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := server.connections(); got != 1 {
+		t.Errorf("opened %d connections, want 1", got)
+	}
+
+	// A dropped connection is redialed transparently
+	server.dropConnections()
+	if err := mailer.Send(testMessage("third")); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(server.delivered()); got != 3 {
+		t.Errorf("delivered %d messages, want 3", got)
+	}
+}
+
+func TestSMTPMailerRejected(t *testing.T) {
+	server := startFakeSMTP(t)
+	server.setReject(true)
+	mailer := NewSMTPMailer(gomail.NewDialer("127.0.0.1", server.port(), "", ""))
+	defer mailer.Close()
+
+	if err := mailer.Send(testMessage("rejected")); err == nil {
+		t.Error("rejected recipient did not fail")
+	}
+
+	server.setReject(false)
+	if err := mailer.Send(testMessage("accepted")); err != nil {
+		t.Errorf("send after rejection: %v", err)
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	mailer := &FileMailer{Dir: dir}
+	if err := mailer.Send(testMessage("staged")); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("found %d .eml files, want 1", len(files))
+	}
+	raw, _ := os.ReadFile(files[0])
+	if !strings.Contains(string(raw), "Subject: staged") {
+		t.Errorf("unexpected message:\n%s", raw)
+	}
+}
+
+func TestNewMailer(t *testing.T) {
+	cases := map[string]interface{}{
+		"":     &SMTPMailer{},
+		"smtp": &SMTPMailer{},
+		"file": &FileMailer{},
+	}
+	t.Setenv("EMAIL_PORT", "2525")
+	for transport, want := range cases {
+		t.Setenv("EMAIL_TRANSPORT", transport)
+		mailer, err := NewMailer()
+		if err != nil {
+			t.Fatalf("%q: %v", transport, err)
+		}
+		if fmt.Sprintf("%T", mailer) != fmt.Sprintf("%T", want) {
+			t.Errorf("%q: got %T, want %T", transport, mailer, want)
+		}
+	}
+
+	// Mail kept in memory would silently go nowhere in production
+	for _, transport := range []string{"carrier-pigeon", "memory"} {
+		t.Setenv("EMAIL_TRANSPORT", transport)
+		if _, err := NewMailer(); err == nil {
+			t.Errorf("%q accepted", transport)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// clamdChunkSize is how much of a file is sent per INSTREAM chunk
+const clamdChunkSize = 64 << 10
+
+// defaultScanTimeout bounds a scan unless UPLOAD_SCAN_TIMEOUT is set
+const defaultScanTimeout = 30 * time.Second
+
+// ScanResult is the verdict of a Scanner; Threat names what was found
+type ScanResult struct {
+	Clean  bool
+	Threat string
+}
+
+// Scanner checks uploaded content for malware before it is stored.
+// UPLOAD_SCANNER selects the implementation: "" (none) or "clamd".
+type Scanner interface {
+	Scan(ctx context.Context, content io.Reader) (ScanResult, error)
+}
+
+// NewScanner creates the scanner configured by UPLOAD_SCANNER, or nil when
+// uploads are not scanned.
+func NewScanner() (Scanner, error) {
+	switch scanner := strings.ToLower(os.Getenv("UPLOAD_SCANNER")); scanner {
+	case "", "none":
+		return nil, nil
+	case "clamd":
+		addr := os.Getenv("CLAMD_ADDR")
+		if addr == "" {
+			addr = "localhost:3310"
+		}
+		timeout, err := time.ParseDuration(os.Getenv("UPLOAD_SCAN_TIMEOUT"))
+		if err != nil || timeout <= 0 {
+			timeout = defaultScanTimeout
+		}
+		return &ClamdScanner{Network: "tcp", Addr: addr, Timeout: timeout}, nil
+	default:
+		return nil, fmt.Errorf("unknown UPLOAD_SCANNER %q", scanner)
+	}
+}
+
+// ClamdScanner streams content to a clamd daemon with the INSTREAM command
+type ClamdScanner struct {
+	Network string
+	Addr    string
+	Timeout time.Duration
+}
+
+func (s *ClamdScanner) Scan(ctx context.Context, content io.Reader) (ScanResult, error) {
+	dialer := net.Dialer{Timeout: s.Timeout}
+	conn, err := dialer.DialContext(ctx, s.Network, s.Addr)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer conn.Close()
+	if s.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.Timeout))
+	}
+
+	// zINSTREAM, then chunks prefixed with their big-endian length, then an empty chunk
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return ScanResult{}, err
+	}
+	chunk := make([]byte, clamdChunkSize)
+	for {
+		n, err := content.Read(chunk)
+		if n > 0 {
+			if err := binary.Write(conn, binary.BigEndian, uint32(n)); err != nil {
+				return ScanResult{}, err
+			}
+			if _, err := conn.Write(chunk[:n]); err != nil {
+				return ScanResult{}, err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ScanResult{}, err
+		}
+	}
+	if err := binary.Write(conn, binary.BigEndian, uint32(0)); err != nil {
+		return ScanResult{}, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !(errors.Is(err, io.EOF) && reply != "") {
+		return ScanResult{}, err
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamdReply reads "stream: OK", "stream: <threat> FOUND" or "<reason> ERROR"
+func parseClamdReply(reply string) (ScanResult, error) {
+	verdict := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case verdict == "OK":
+		return ScanResult{Clean: true}, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return ScanResult{Threat: strings.TrimSuffix(verdict, " FOUND")}, nil
+	default:
+		return ScanResult{}, fmt.Errorf("clamd: %s", reply)
+	}
+}
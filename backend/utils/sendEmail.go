@@ -2,14 +2,22 @@ package utils
 
 import (
 	"bytes"
+	_ "embed"
+	"errors"
 	"html/template"
+	"io"
 	"log"
 	"os"
-	"strconv"
 
 	"gopkg.in/gomail.v2"
 )
 
+//go:embed template/email.html
+var emailLayoutSource string
+
+// emailLayout is the HTML layout every email is rendered into
+var emailLayout = template.Must(template.New("email.html").Parse(emailLayoutSource))
+
 // EmailData holds the data for email template
 type EmailData struct {
 	To      string
@@ -18,56 +26,78 @@ type EmailData struct {
 	Name    string
 	Button  string
 	URL     string
-	// Attachments holds file paths to attach to the email
-	Attachments []string
+	// Language of the layout wording, see EmailLanguages; "" uses the default
+	Language string
+	// Attachments are the files to attach to the email
+	Attachments []Attachment
 }
 
-// SendEmail sends an email using Gomail with a HTML template
-func SendEmail(data EmailData) error {
-	// Setup email details
-	from := os.Getenv("EMAIL_FROM")
-	username := os.Getenv("EMAIL_USERNAME")
-	password := os.Getenv("EMAIL_PASSWORD")
-	host := os.Getenv("EMAIL_HOST")
-	port := os.Getenv("EMAIL_PORT")
+// Attachment is a file attached to an email
+type Attachment struct {
+	Name    string
+	Content []byte
+}
 
-	portInt, err := strconv.Atoi(port)
+// SendEmail renders the HTML template for data and sends it with the configured Mailer
+func SendEmail(data EmailData) error {
+	mailer, err := currentMailer()
 	if err != nil {
-		log.Printf("Invalid port: %v", err)
+		log.Printf("Error configuring mailer: %v", err)
 		return err
 	}
 
-	// Parse the email template
-	tmpl, err := template.ParseFiles("./utils/template/email.html")
+	message, err := NewEmailMessage(data)
 	if err != nil {
-		log.Printf("Error parsing template: %v", err)
 		return err
 	}
+	return mailer.Send(message)
+}
 
-	// Prepare the body using the template
-	var body bytes.Buffer
-	if err := tmpl.Execute(&body, data); err != nil {
-		log.Printf("Error executing template: %v", err)
-		return err
+// NewEmailMessage builds the message for data from EMAIL_FROM and the HTML template
+func NewEmailMessage(data EmailData) (*gomail.Message, error) {
+	if data.To == "" {
+		return nil, errors.New("email has no recipient")
 	}
 
-	// Setup Gomail
-	mailer := gomail.NewMessage()
-	mailer.SetHeader("From", from)
-	mailer.SetHeader("To", data.To)
-	mailer.SetHeader("Subject", data.Subject)
-	mailer.SetBody("text/html", body.String())
+	body, err := RenderEmailHTML(data)
+	if err != nil {
+		return nil, err
+	}
 
-	dialer := gomail.NewDialer(host, portInt, username, password)
+	message := gomail.NewMessage()
+	message.SetHeader("From", os.Getenv("EMAIL_FROM"))
+	message.SetHeader("To", data.To)
+	message.SetHeader("Subject", data.Subject)
+	message.SetBody("text/html", body)
 
 	// Attach files if any
-	for _, fpath := range data.Attachments {
-		mailer.Attach(fpath)
+	for _, attachment := range data.Attachments {
+		content := attachment.Content
+		message.Attach(attachment.Name, gomail.SetCopyFunc(func(w io.Writer) error {
+			_, err := w.Write(content)
+			return err
+		}))
 	}
-	// Send email
-	if err := dialer.DialAndSend(mailer); err != nil {
-		return err
+	return message, nil
+}
+
+// RenderEmailHTML renders data into the HTML layout in its language
+func RenderEmailHTML(data EmailData) (string, error) {
+	language, err := NormalizeLanguage(data.Language)
+	if err != nil {
+		return "", err
 	}
+	data.Language = language
 
-	return nil
+	// Prepare the body using the template
+	var body bytes.Buffer
+	view := struct {
+		EmailData
+		Text layoutText
+	}{data, layoutTexts[language]}
+	if err := emailLayout.Execute(&body, view); err != nil {
+		log.Printf("Error executing template: %v", err)
+		return "", err
+	}
+	return body.String(), nil
 }
@@ -0,0 +1,256 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// defaultUploadMaxBytes limits uploads unless UPLOAD_MAX_BYTES is set
+const defaultUploadMaxBytes = 10 << 20
+
+// sniffLen is how much of an upload is read to detect its type
+const sniffLen = 512
+
+// textSniffLen is how much of a text upload is parsed to tell CSV from plain text
+const textSniffLen = 64 << 10
+
+// UploadTypes maps the upload types that can be allowed to the extension
+// they are stored with
+var UploadTypes = map[string]string{
+	"csv":  ".csv",
+	"xlsx": ".xlsx",
+	"json": ".json",
+	"zip":  ".zip",
+}
+
+// UploadPolicy decides which uploaded files are accepted: at most MaxBytes,
+// of one of the Allowed types detected from the content, and clean according
+// to Scanner when one is set.
+type UploadPolicy struct {
+	MaxBytes int64
+	Allowed  []string
+	Scanner  Scanner
+}
+
+// UploadRejection explains why an upload was refused; Status is the HTTP
+// status to answer with.
+type UploadRejection struct {
+	Status int
+	Reason string
+}
+
+func (r *UploadRejection) Error() string {
+	return r.Reason
+}
+
+// DefaultUploadPolicy reads the policy from UPLOAD_MAX_BYTES (default 10 MiB),
+// UPLOAD_ALLOWED_TYPES (comma separated, default every UploadTypes entry) and
+// UPLOAD_SCANNER (see NewScanner).
+func DefaultUploadPolicy() (UploadPolicy, error) {
+	policy := UploadPolicy{MaxBytes: defaultUploadMaxBytes, Allowed: []string{"csv", "xlsx", "json", "zip"}}
+	if max, err := strconv.ParseInt(os.Getenv("UPLOAD_MAX_BYTES"), 10, 64); err == nil && max > 0 {
+		policy.MaxBytes = max
+	}
+	if allowed := os.Getenv("UPLOAD_ALLOWED_TYPES"); allowed != "" {
+		policy.Allowed = nil
+		for _, kind := range strings.Split(allowed, ",") {
+			kind = strings.ToLower(strings.TrimSpace(kind))
+			if _, known := UploadTypes[kind]; !known {
+				return policy, fmt.Errorf("unknown upload type %q in UPLOAD_ALLOWED_TYPES", kind)
+			}
+			policy.Allowed = append(policy.Allowed, kind)
+		}
+	}
+
+	scanner, err := NewScanner()
+	policy.Scanner = scanner
+	return policy, err
+}
+
+// Check validates file against the policy and returns its detected type.
+// A refused file gives an *UploadRejection; other errors mean the file
+// could not be checked.
+func (p UploadPolicy) Check(ctx context.Context, file *multipart.FileHeader) (string, error) {
+	if p.MaxBytes > 0 && file.Size > p.MaxBytes {
+		return "", &UploadRejection{http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("file is %d bytes, the limit is %d", file.Size, p.MaxBytes)}
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	kind, err := DetectUploadType(src, file.Size)
+	if err != nil {
+		return "", err
+	}
+	allowed := false
+	for _, a := range p.Allowed {
+		allowed = allowed || a == kind
+	}
+	if !allowed {
+		return "", &UploadRejection{http.StatusUnsupportedMediaType,
+			fmt.Sprintf("content type %s is not allowed, expected one of %s", kind, strings.Join(p.Allowed, ", "))}
+	}
+
+	if p.Scanner != nil {
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		result, err := p.Scanner.Scan(ctx, src)
+		if err != nil {
+			return "", &UploadRejection{http.StatusServiceUnavailable, "file could not be scanned: " + err.Error()}
+		}
+		if !result.Clean {
+			return "", &UploadRejection{http.StatusUnprocessableEntity, "file failed the malware scan: " + result.Threat}
+		}
+	}
+	return kind, nil
+}
+
+// DetectUploadType sniffs the content of an upload of size bytes, ignoring
+// its name: "xlsx" or "zip" for zip archives depending on their entries,
+// "json" for valid JSON and "csv" for consistent comma separated text, which
+// may be a single column of several lines. Only the first textSniffLen bytes
+// are parsed as CSV, JSON is validated as a stream.
+// Anything else is reported as the MIME type http.DetectContentType finds.
+func DetectUploadType(src multipart.File, size int64) (string, error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	head = head[:n]
+	if n == 0 {
+		return "", &UploadRejection{http.StatusUnsupportedMediaType, "file is empty"}
+	}
+
+	if bytes.HasPrefix(head, []byte("PK\x03\x04")) {
+		archive, err := zip.NewReader(src, size)
+		if err != nil {
+			return "", &UploadRejection{http.StatusUnsupportedMediaType, "file is not a valid zip archive"}
+		}
+		for _, entry := range archive.File {
+			if entry.Name == "xl/workbook.xml" {
+				return "xlsx", nil
+			}
+		}
+		return "zip", nil
+	}
+
+	detected := http.DetectContentType(head)
+	if !strings.HasPrefix(detected, "text/plain") {
+		return detected, nil
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	prefix := make([]byte, textSniffLen)
+	n, err = io.ReadFull(src, prefix)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	prefix = prefix[:n]
+	complete := int64(n) >= size
+	if !complete {
+		prefix = trimPartialRune(prefix)
+	}
+	if !utf8.Valid(prefix) {
+		return detected, nil
+	}
+
+	trimmed := bytes.TrimSpace(prefix)
+	if bytes.HasPrefix(trimmed, []byte("{")) || bytes.HasPrefix(trimmed, []byte("[")) {
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		if validJSON(src) {
+			return "json", nil
+		}
+	}
+	if sniffCSV(prefix, complete) {
+		return "csv", nil
+	}
+	return detected, nil
+}
+
+// trimPartialRune drops the bytes of a rune cut off at the end of prefix
+func trimPartialRune(prefix []byte) []byte {
+	for i := 1; i <= utf8.UTFMax && i <= len(prefix); i++ {
+		if utf8.RuneStart(prefix[len(prefix)-i]) {
+			if !utf8.FullRune(prefix[len(prefix)-i:]) {
+				return prefix[:len(prefix)-i]
+			}
+			break
+		}
+	}
+	return prefix
+}
+
+// validJSON reports whether r holds exactly one JSON object or array,
+// without keeping it in memory
+func validJSON(r io.Reader) bool {
+	decoder := json.NewDecoder(r)
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return false
+		}
+		if delim, ok := token.(json.Delim); ok {
+			if delim == '{' || delim == '[' {
+				depth++
+			} else {
+				depth--
+			}
+		}
+		if depth == 0 {
+			break
+		}
+	}
+	_, err := decoder.Token()
+	return err == io.EOF
+}
+
+// sniffCSV reports whether prefix reads as CSV: rows of the same number of
+// fields, and more than one field or more than one row. A single column
+// holding semicolons or tabs is taken for text separated by those instead.
+// When prefix is not complete, the row it cuts off is ignored.
+func sniffCSV(prefix []byte, complete bool) bool {
+	reader := csv.NewReader(bytes.NewReader(prefix))
+	rows, fields := 0, 0
+	otherSeparator := false
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		// Past the end of the prefix the row is cut off
+		if !complete && reader.InputOffset() >= int64(len(prefix)) {
+			break
+		}
+		// csv.Reader rejects rows whose field count differs from the first
+		if err != nil {
+			return false
+		}
+		rows, fields = rows+1, len(record)
+		otherSeparator = otherSeparator || (fields == 1 && strings.ContainsAny(record[0], ";\t"))
+	}
+	if fields == 1 {
+		return rows > 1 && !otherSeparator
+	}
+	return rows > 0
+}
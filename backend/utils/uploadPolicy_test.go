@@ -0,0 +1,190 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// eicar is the standard antivirus test string
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// uploadedFile returns content as if it had been uploaded in a form under name
+func uploadedFile(t *testing.T, name string, content []byte) *multipart.FileHeader {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, _ := writer.CreateFormFile("file", name)
+	part.Write(content)
+	writer.Close()
+
+	form, err := multipart.NewReader(&body, writer.Boundary()).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { form.RemoveAll() })
+	return form.File["file"][0]
+}
+
+func zipWith(t *testing.T, names ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, name := range names {
+		w, _ := archive.Create(name)
+		w.Write([]byte("<x/>"))
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDetectUploadType(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content []byte
+		want    string
+	}{
+		{"data.csv", []byte("nim,nama\n13519999,Siti\n"), "csv"},
+		{"nim.csv", []byte("nim\n13519999\n13519998"), "csv"},
+		{"note.csv", []byte("just one line\n"), "text/plain; charset=utf-8"},
+		{"data.tsv", []byte("nim\tnama\n13519999\tSiti\n"), "text/plain; charset=utf-8"},
+		{"data.csv", []byte("nim,nama\n13519999\n"), "text/plain; charset=utf-8"},
+		{"large.csv", []byte("nim,nama\n" + strings.Repeat("13519999,\"Siti\nNur\"\n", 10000)), "csv"},
+		{"large.csv", []byte("nim,nama\n" + strings.Repeat("13519999,Siti\n", 10000) + "13519999\n"), "csv"},
+		{"large.csv", []byte("nim,nama\n" + strings.Repeat("13519999,Siti Ä\n", 10000)), "csv"},
+		{"large.json", []byte(`[` + strings.Repeat(`{"nim": "13519999"},`, 10000) + `{}]`), "json"},
+		{"large.json", []byte(`[` + strings.Repeat(`{"nim": "13519999"},`, 10000) + `{}`), "text/plain; charset=utf-8"},
+		{"two.json", []byte(`{"nim": 1} {"nim": 2}`), "text/plain; charset=utf-8"},
+		{"data.txt", []byte("nim;nama\n13519999;Siti\n"), "text/plain; charset=utf-8"},
+		{"data.json", []byte(` [{"nim": "13519999"}]`), "json"},
+		{"data.csv", []byte(`{"nim": `), "text/plain; charset=utf-8"},
+		{"data.xlsx", zipWith(t, "[Content_Types].xml", "xl/workbook.xml"), "xlsx"},
+		{"data.xlsx", zipWith(t, "data.csv"), "zip"},
+		{"data.csv", []byte("%PDF-1.4\n"), "application/pdf"},
+		{"data.csv", append([]byte("MZ\x90\x00\x03\x00\x00\x00"), make([]byte, 100)...), "application/octet-stream"},
+	} {
+		file := uploadedFile(t, tc.name, tc.content)
+		src, _ := file.Open()
+		got, err := DetectUploadType(src, file.Size)
+		src.Close()
+		if err != nil || got != tc.want {
+			t.Errorf("%s %q: got %q, %v; want %q", tc.name, tc.content[:min(len(tc.content), 12)], got, err, tc.want)
+		}
+	}
+
+	file := uploadedFile(t, "broken.zip", []byte("PK\x03\x04 not really"))
+	src, _ := file.Open()
+	defer src.Close()
+	var rejection *UploadRejection
+	if _, err := DetectUploadType(src, file.Size); !errors.As(err, &rejection) {
+		t.Errorf("broken zip: want a rejection, got %v", err)
+	}
+}
+
+// fakeClamd answers INSTREAM scans like clamd, finding eicar; it returns its address
+func fakeClamd(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				command := make([]byte, len("zINSTREAM\x00"))
+				if _, err := io.ReadFull(conn, command); err != nil || string(command) != "zINSTREAM\x00" {
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+				var content []byte
+				for {
+					var size uint32
+					if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					chunk := make([]byte, size)
+					if _, err := io.ReadFull(conn, chunk); err != nil {
+						return
+					}
+					content = append(content, chunk...)
+				}
+				if bytes.Contains(content, []byte(eicar)) {
+					conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+				} else {
+					conn.Write([]byte("stream: OK\x00"))
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestUploadPolicy(t *testing.T) {
+	csvContent := []byte("nim,nama\n13519999,Siti\n")
+	scanner := &ClamdScanner{Network: "tcp", Addr: fakeClamd(t), Timeout: 5 * time.Second}
+	policy := UploadPolicy{MaxBytes: 1024, Allowed: []string{"csv", "xlsx"}, Scanner: scanner}
+	ctx := context.Background()
+
+	if kind, err := policy.Check(ctx, uploadedFile(t, "data.bin", csvContent)); err != nil || kind != "csv" {
+		t.Errorf("clean csv: got %q, %v", kind, err)
+	}
+
+	for name, tc := range map[string]struct {
+		policy  UploadPolicy
+		content []byte
+		status  int
+	}{
+		"too large":    {policy, []byte(strings.Repeat("a,b\n", 300)), http.StatusRequestEntityTooLarge},
+		"json":         {policy, []byte(`{"nim": "13519999"}`), http.StatusUnsupportedMediaType},
+		"empty":        {policy, nil, http.StatusUnsupportedMediaType},
+		"infected":     {policy, []byte("nim,nama\n13519999," + eicar + "\n"), http.StatusUnprocessableEntity},
+		"scanner down": {UploadPolicy{MaxBytes: 1024, Allowed: []string{"csv"}, Scanner: &ClamdScanner{Network: "tcp", Addr: "127.0.0.1:1", Timeout: time.Second}}, csvContent, http.StatusServiceUnavailable},
+	} {
+		_, err := tc.policy.Check(ctx, uploadedFile(t, "data.csv", tc.content))
+		var rejection *UploadRejection
+		if !errors.As(err, &rejection) || rejection.Status != tc.status || rejection.Reason == "" {
+			t.Errorf("%s: want rejection %d, got %v", name, tc.status, err)
+		}
+	}
+}
+
+func TestDefaultUploadPolicy(t *testing.T) {
+	t.Setenv("UPLOAD_MAX_BYTES", "2048")
+	t.Setenv("UPLOAD_ALLOWED_TYPES", "CSV, zip")
+	t.Setenv("UPLOAD_SCANNER", "clamd")
+	t.Setenv("CLAMD_ADDR", "clamav:3310")
+	policy, err := DefaultUploadPolicy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner, ok := policy.Scanner.(*ClamdScanner)
+	if policy.MaxBytes != 2048 || strings.Join(policy.Allowed, ",") != "csv,zip" || !ok || scanner.Addr != "clamav:3310" {
+		t.Errorf("unexpected policy %+v", policy)
+	}
+
+	t.Setenv("UPLOAD_ALLOWED_TYPES", "exe")
+	if _, err := DefaultUploadPolicy(); err == nil {
+		t.Error("unknown upload type accepted")
+	}
+}
@@ -0,0 +1,248 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"grad_deploy/initializers"
+	"grad_deploy/models"
+	"grad_deploy/tools"
+	"grad_deploy/utils"
+)
+
+// emailPollInterval is how often the idle worker looks for emails due for a retry
+const emailPollInterval = 10 * time.Second
+
+// Delivery is retried with exponential backoff: defaultEmailRetryBase after the
+// first failure, doubling up to maxEmailRetryDelay, for EMAIL_MAX_ATTEMPTS
+// attempts in total.
+const (
+	defaultEmailMaxAttempts = 5
+	defaultEmailRetryBase   = 30 * time.Second
+	maxEmailRetryDelay      = time.Hour
+)
+
+// An email being delivered holds a lease on itself, like a running export
+// job: its worker renews heartbeat_at every emailHeartbeatInterval, and an
+// email whose heartbeat is older than emailLeaseTimeout has lost its worker,
+// e.g. to a crash or restart, and is queued again.
+const (
+	emailHeartbeatInterval = 30 * time.Second
+	emailLeaseTimeout      = 2 * time.Minute
+)
+
+// emailWake wakes the idle worker as soon as an email is queued
+var emailWake = make(chan struct{}, 1)
+
+// StartEmailWorker starts the worker that delivers the outbox and requeues
+// the emails whose worker went away.
+func StartEmailWorker() {
+	go emailWorker()
+}
+
+// QueueEmail adds email to the outbox and wakes the worker. From, Status and
+// NextAttemptAt are filled in.
+func QueueEmail(email *models.EmailHistory) error {
+	email.From = os.Getenv("EMAIL_FROM")
+	email.Status = models.EmailQueued
+	email.NextAttemptAt = time.Now()
+	if err := initializers.FlowDB.Create(email).Error; err != nil {
+		return err
+	}
+
+	select {
+	case emailWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func emailWorker() {
+	for {
+		requeueStaleEmails(time.Now())
+		for claimEmail() {
+		}
+
+		select {
+		case <-emailWake:
+		case <-time.After(emailPollInterval):
+		}
+	}
+}
+
+// requeueStaleEmails queues the emails whose lease expired before now again.
+// Emails claimed before heartbeats existed count from their last update.
+func requeueStaleEmails(now time.Time) {
+	result := initializers.FlowDB.Model(&models.EmailHistory{}).
+		Where("status = ? AND COALESCE(heartbeat_at, claimed_at, updated_at) < ?", models.EmailSending, now.Add(-emailLeaseTimeout)).
+		Update("status", models.EmailQueued)
+	if result.Error != nil {
+		log.Printf("Failed to requeue interrupted emails: %v", result.Error)
+	} else if result.RowsAffected > 0 {
+		log.Printf("Requeued %d emails that lost their worker", result.RowsAffected)
+	}
+}
+
+// claimEmail delivers the oldest email that is due, if any, and reports whether one was found.
+func claimEmail() bool {
+	email, ok := claimNextEmail(time.Now())
+	if ok {
+		deliverEmail(email)
+	}
+	return ok
+}
+
+// claimNextEmail marks the oldest email due at now as sending and returns it
+func claimNextEmail(now time.Time) (models.EmailHistory, bool) {
+	// SQLite (in tests) has a single writer anyway
+	lock := ""
+	if initializers.FlowDB.Dialector.Name() == "postgres" {
+		lock = "FOR UPDATE SKIP LOCKED"
+	}
+
+	var email models.EmailHistory
+	err := initializers.FlowDB.Raw(`
+		UPDATE email_histories SET status = ?, claimed_at = ?, heartbeat_at = ?, updated_at = ?
+		WHERE id = (
+			SELECT id FROM email_histories WHERE status = ? AND next_attempt_at <= ?
+			ORDER BY next_attempt_at LIMIT 1 `+lock+`
+		)
+		RETURNING *`, models.EmailSending, now, now, now, models.EmailQueued, now).Scan(&email).Error
+	if err != nil {
+		log.Printf("Failed to claim email: %v", err)
+		return email, false
+	}
+	return email, email.Status == models.EmailSending
+}
+
+// leasedEmail selects email for as long as this delivery of it holds the
+// lease, i.e. it was not requeued and claimed again meanwhile
+func leasedEmail(email models.EmailHistory) *gorm.DB {
+	return initializers.FlowDB.Model(&models.EmailHistory{}).
+		Where("id = ? AND status = ? AND claimed_at = ?", email.ID, models.EmailSending, email.ClaimedAt)
+}
+
+// keepEmailLease renews the heartbeat of email until ctx is done
+func keepEmailLease(ctx context.Context, email models.EmailHistory) {
+	ticker := time.NewTicker(emailHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			leasedEmail(email).Update("heartbeat_at", now)
+		}
+	}
+}
+
+// deliverEmail makes one delivery attempt and records the outcome: sent,
+// queued again for a later retry, or failed once the attempts run out.
+func deliverEmail(email models.EmailHistory) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go keepEmailLease(ctx, email)
+
+	attachments, err := loadAttachments(email)
+	if err == nil {
+		err = utils.SendEmail(utils.EmailData{
+			To:          email.To,
+			Subject:     email.Subject,
+			Body:        email.Body,
+			Name:        email.Name,
+			URL:         email.URL,
+			Button:      email.Button,
+			Language:    email.Language,
+			Attachments: attachments,
+		})
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{}
+	if err == nil {
+		updates["status"] = models.EmailSent
+		updates["sent_at"] = &now
+		updates["error_message"] = ""
+
+		if email.DataRequestID != nil {
+			tools.RecordEvent(initializers.FlowDB, models.DataRequestEvent{
+				DataRequestID: *email.DataRequestID,
+				Type:          models.EventEmailSent,
+				Details:       email.To,
+				Note:          email.Subject,
+				ActorID:       email.QueuedBy,
+			})
+		}
+	} else {
+		attempts := email.RetryCount + 1
+		updates["retry_count"] = attempts
+		updates["error_message"] = err.Error()
+		if attempts >= emailMaxAttempts() {
+			updates["status"] = models.EmailFailed
+		} else {
+			updates["status"] = models.EmailQueued
+			updates["next_attempt_at"] = now.Add(emailRetryDelay(attempts))
+		}
+	}
+
+	// A delivery that lost its lease leaves the email to the one that took over
+	result := leasedEmail(email).Updates(updates)
+	if result.Error != nil {
+		log.Printf("Failed to update email %d: %v", email.ID, result.Error)
+	} else if result.RowsAffected == 0 {
+		log.Printf("Email %d was requeued, dropping the outcome of this delivery", email.ID)
+	}
+}
+
+// loadAttachments reads the files email.Attachments refers to from the storage
+func loadAttachments(email models.EmailHistory) ([]utils.Attachment, error) {
+	var attachments []utils.Attachment
+	for _, key := range strings.Split(email.Attachments, ",") {
+		if key == "" {
+			continue
+		}
+		file, _, err := initializers.Storage.Open(context.Background(), key)
+		if err != nil {
+			return nil, fmt.Errorf("attachment %s: %w", key, err)
+		}
+		content, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("attachment %s: %w", key, err)
+		}
+		attachments = append(attachments, utils.Attachment{Name: path.Base(key), Content: content})
+	}
+	return attachments, nil
+}
+
+func emailMaxAttempts() int {
+	attempts, err := strconv.Atoi(os.Getenv("EMAIL_MAX_ATTEMPTS"))
+	if err != nil || attempts < 1 {
+		return defaultEmailMaxAttempts
+	}
+	return attempts
+}
+
+// emailRetryDelay is how long to wait after the given number of failed attempts
+func emailRetryDelay(attempts int) time.Duration {
+	delay := defaultEmailRetryBase
+	if base, err := time.ParseDuration(os.Getenv("EMAIL_RETRY_BASE")); err == nil && base > 0 {
+		delay = base
+	}
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= maxEmailRetryDelay {
+			return maxEmailRetryDelay
+		}
+	}
+	return delay
+}
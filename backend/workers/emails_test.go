@@ -0,0 +1,185 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+
+	"grad_deploy/initializers"
+	"grad_deploy/models"
+	"grad_deploy/tools"
+	"grad_deploy/utils"
+)
+
+// setupOutbox points FlowDB at an in-memory database with the outbox table
+// and captures mail in memory.
+func setupOutbox(t *testing.T) *utils.MemoryMailer {
+	t.Helper()
+	t.Setenv("EMAIL_FROM", "noreply@example.com")
+	mailer := &utils.MemoryMailer{}
+	utils.SetMailer(mailer)
+	t.Cleanup(func() { utils.SetMailer(nil) })
+
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&models.EmailHistory{}); err != nil {
+		t.Fatal(err)
+	}
+	initializers.FlowDB = db
+	return mailer
+}
+
+func queueTestEmail(t *testing.T) models.EmailHistory {
+	t.Helper()
+	email := models.EmailHistory{To: "alumni@example.com", Subject: "Data siap", Body: "Silakan unduh", URL: "http://localhost/sql/x"}
+	if err := QueueEmail(&email); err != nil {
+		t.Fatal(err)
+	}
+	return email
+}
+
+// claim takes the email due at now from the outbox, like the worker does
+func claim(t *testing.T, now time.Time) models.EmailHistory {
+	t.Helper()
+	email, ok := claimNextEmail(now)
+	if !ok {
+		t.Fatal("no email to claim")
+	}
+	return email
+}
+
+func reload(t *testing.T, email models.EmailHistory) models.EmailHistory {
+	t.Helper()
+	var stored models.EmailHistory
+	if err := initializers.FlowDB.First(&stored, email.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+func TestDeliverEmail(t *testing.T) {
+	mailer := setupOutbox(t)
+
+	email := queueTestEmail(t)
+	if email.Status != models.EmailQueued || email.From != "noreply@example.com" {
+		t.Fatalf("queued email: %+v", email)
+	}
+
+	deliverEmail(claim(t, time.Now()))
+
+	stored := reload(t, email)
+	if stored.Status != models.EmailSent || stored.SentAt == nil || stored.RetryCount != 0 {
+		t.Errorf("after delivery: %+v", stored)
+	}
+	sent := mailer.Sent()
+	if len(sent) != 1 || sent[0].Subject != "Data siap" || !strings.Contains(sent[0].Raw, "http://localhost/sql/x") {
+		t.Errorf("mailer received %+v", sent)
+	}
+}
+
+func TestDeliverEmailAttachments(t *testing.T) {
+	mailer := setupOutbox(t)
+	initializers.Storage = &tools.LocalStorage{Dir: t.TempDir()}
+	content := "nim,nama\n13519999,Siti\n"
+	key := "emailAttachments/abc/req-abc.csv"
+	if err := initializers.Storage.Put(context.Background(), key, strings.NewReader(content), int64(len(content)), "text/csv"); err != nil {
+		t.Fatal(err)
+	}
+
+	email := queueTestEmail(t)
+	initializers.FlowDB.Model(&email).Update("attachments", key)
+	deliverEmail(claim(t, time.Now()))
+
+	sent := mailer.Sent()
+	if len(sent) != 1 || !strings.Contains(sent[0].Raw, `filename="req-abc.csv"`) {
+		t.Errorf("mailer received %+v", sent)
+	}
+
+	// A missing attachment is retried like any delivery failure
+	email = queueTestEmail(t)
+	initializers.FlowDB.Model(&email).Update("attachments", "emailAttachments/gone/req-gone.csv")
+	deliverEmail(claim(t, time.Now()))
+	if stored := reload(t, email); stored.Status != models.EmailQueued || stored.RetryCount != 1 || !strings.Contains(stored.ErrorMessage, "req-gone.csv") {
+		t.Errorf("after missing attachment: %+v", stored)
+	}
+}
+
+func TestDeliverEmailRetries(t *testing.T) {
+	mailer := setupOutbox(t)
+	mailer.SetErr(errors.New("550 mailbox unavailable"))
+	t.Setenv("EMAIL_MAX_ATTEMPTS", "2")
+	t.Setenv("EMAIL_RETRY_BASE", "1m")
+
+	email := queueTestEmail(t)
+	before := time.Now()
+	deliverEmail(claim(t, before))
+
+	stored := reload(t, email)
+	if stored.Status != models.EmailQueued || stored.RetryCount != 1 || stored.ErrorMessage == "" {
+		t.Fatalf("after first failure: %+v", stored)
+	}
+	if wait := stored.NextAttemptAt.Sub(before); wait < time.Minute || wait > 2*time.Minute {
+		t.Errorf("next attempt in %v, want about 1m", wait)
+	}
+
+	deliverEmail(claim(t, stored.NextAttemptAt))
+
+	stored = reload(t, email)
+	if stored.Status != models.EmailFailed || stored.RetryCount != 2 {
+		t.Errorf("after last attempt: %+v", stored)
+	}
+	if sent := mailer.Sent(); len(sent) != 0 {
+		t.Errorf("rejected email was delivered: %+v", sent)
+	}
+}
+
+func TestRequeueStaleEmails(t *testing.T) {
+	setupOutbox(t)
+	email := queueTestEmail(t)
+	claimed := claim(t, time.Now())
+
+	// A worker still renewing its lease keeps the email
+	requeueStaleEmails(time.Now().Add(emailLeaseTimeout / 2))
+	if stored := reload(t, email); stored.Status != models.EmailSending {
+		t.Fatalf("live claim requeued: %+v", stored)
+	}
+
+	// Once the heartbeat is older than the lease the email is queued again,
+	// and the worker that lost it does not record its outcome
+	requeueStaleEmails(time.Now().Add(2 * emailLeaseTimeout))
+	if stored := reload(t, email); stored.Status != models.EmailQueued {
+		t.Fatalf("stale claim kept: %+v", stored)
+	}
+	reclaimed := claim(t, time.Now().Add(time.Second))
+	deliverEmail(claimed)
+	if stored := reload(t, email); stored.Status != models.EmailSending || !stored.ClaimedAt.Equal(*reclaimed.ClaimedAt) {
+		t.Errorf("lost lease overwrote the new claim: %+v", stored)
+	}
+	deliverEmail(reclaimed)
+	if stored := reload(t, email); stored.Status != models.EmailSent {
+		t.Errorf("after delivery: %+v", stored)
+	}
+}
+
+func TestEmailRetryDelay(t *testing.T) {
+	t.Setenv("EMAIL_RETRY_BASE", "")
+	cases := map[int]time.Duration{
+		1:  30 * time.Second,
+		2:  time.Minute,
+		3:  2 * time.Minute,
+		20: maxEmailRetryDelay,
+	}
+	for attempts, want := range cases {
+		if got := emailRetryDelay(attempts); got != want {
+			t.Errorf("emailRetryDelay(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
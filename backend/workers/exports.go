@@ -0,0 +1,217 @@
+package workers
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+
+	"grad_deploy/initializers"
+	"grad_deploy/models"
+	"grad_deploy/tools"
+)
+
+// exportPollInterval is how often idle workers look for queued jobs they were not woken for
+const exportPollInterval = 5 * time.Second
+
+// defaultExportTimeout applies to export jobs unless EXPORT_STATEMENT_TIMEOUT is set
+const defaultExportTimeout = 10 * time.Minute
+
+// A running job holds a lease on itself: its worker renews heartbeat_at every
+// exportHeartbeatInterval, and a job whose heartbeat is older than
+// exportLeaseTimeout has lost its worker, e.g. to a crash, and is queued again.
+const (
+	exportHeartbeatInterval = 30 * time.Second
+	exportLeaseTimeout      = 2 * time.Minute
+)
+
+// exportWake wakes an idle worker as soon as a job is queued
+var exportWake = make(chan struct{}, 1)
+
+// StartExportWorkers starts EXPORT_WORKERS (default 2) workers that execute
+// queued export jobs and requeue the ones whose worker went away.
+func StartExportWorkers() {
+	workers, err := strconv.Atoi(os.Getenv("EXPORT_WORKERS"))
+	if err != nil || workers < 1 {
+		workers = 2
+	}
+	for i := 0; i < workers; i++ {
+		go exportWorker()
+	}
+}
+
+// NotifyExport tells the workers a new job is waiting.
+func NotifyExport() {
+	select {
+	case exportWake <- struct{}{}:
+	default:
+	}
+}
+
+func exportWorker() {
+	for {
+		requeueStaleExports(time.Now())
+		for claimExportJob() {
+		}
+
+		select {
+		case <-exportWake:
+		case <-time.After(exportPollInterval):
+		}
+	}
+}
+
+// requeueStaleExports queues the running jobs whose lease expired before now
+// again. Jobs claimed before heartbeats existed count from when they started.
+func requeueStaleExports(now time.Time) {
+	result := initializers.FlowDB.Model(&models.ExportJob{}).
+		Where("status = ? AND COALESCE(heartbeat_at, started_at) < ?", models.ExportRunning, now.Add(-exportLeaseTimeout)).
+		Updates(map[string]interface{}{"status": models.ExportQueued, "rows_written": 0})
+	if result.Error != nil {
+		log.Printf("Failed to requeue stale export jobs: %v", result.Error)
+	} else if result.RowsAffected > 0 {
+		log.Printf("Requeued %d export jobs that lost their worker", result.RowsAffected)
+	}
+}
+
+// claimExportJob runs the oldest queued job, if any, and reports whether one was found.
+func claimExportJob() bool {
+	job, ok := claimNextExport(time.Now())
+	if ok {
+		runExportJob(job)
+	}
+	return ok
+}
+
+// claimNextExport marks the oldest queued job as running from now and returns it
+func claimNextExport(now time.Time) (models.ExportJob, bool) {
+	// SKIP LOCKED lets the workers of several instances claim side by side,
+	// SQLite (in tests) has a single writer anyway
+	lock := ""
+	if initializers.FlowDB.Dialector.Name() == "postgres" {
+		lock = "FOR UPDATE SKIP LOCKED"
+	}
+
+	var job models.ExportJob
+	err := initializers.FlowDB.Raw(`
+		UPDATE export_jobs SET status = ?, started_at = ?, heartbeat_at = ?
+		WHERE id = (
+			SELECT id FROM export_jobs WHERE status = ?
+			ORDER BY created_at LIMIT 1 `+lock+`
+		)
+		RETURNING *`, models.ExportRunning, now, now, models.ExportQueued).Scan(&job).Error
+	if err != nil {
+		log.Printf("Failed to claim export job: %v", err)
+		return job, false
+	}
+	return job, job.Status == models.ExportRunning
+}
+
+// leased selects job for as long as this run of it holds the lease, i.e. it
+// was not requeued and claimed again meanwhile
+func leased(job models.ExportJob) *gorm.DB {
+	return initializers.FlowDB.Model(&models.ExportJob{}).
+		Where("id = ? AND status = ? AND started_at = ?", job.ID, models.ExportRunning, job.StartedAt)
+}
+
+// keepExportLease renews the heartbeat of job until ctx is done. The export
+// is cancelled when the lease was lost.
+func keepExportLease(ctx context.Context, cancel context.CancelFunc, job models.ExportJob) {
+	ticker := time.NewTicker(exportHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			result := leased(job).Update("heartbeat_at", now)
+			if result.Error == nil && result.RowsAffected == 0 {
+				log.Printf("Export job %s was requeued, stopping this run", job.ID)
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+func runExportJob(job models.ExportJob) {
+	limits := tools.QueryLimits{Timeout: defaultExportTimeout, MaxRows: job.RowLimit}
+	if timeout, err := time.ParseDuration(os.Getenv("EXPORT_STATEMENT_TIMEOUT")); err == nil && timeout > 0 {
+		limits.Timeout = timeout
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go keepExportLease(ctx, cancel, job)
+
+	progress := func(rows int) {
+		leased(job).Update("rows_written", rows)
+	}
+	mask, err := tools.NewMasking(job.MaskingProfile, job.DataRequestID)
+	var name string
+	var stats tools.QueryStats
+	if err == nil {
+		name, stats, err = tools.ExportQuery(ctx, initializers.DB, initializers.Storage, job.SQL, nil, job.Format, limits, mask, progress)
+	}
+	if err == nil {
+		err = tools.RecordExport(initializers.FlowDB, initializers.Storage, models.ExportFile{
+			Name:           name,
+			Format:         job.Format,
+			Rows:           stats.Rows,
+			DataRequestID:  job.DataRequestID,
+			CreatedBy:      &job.RequestedBy,
+			MaskingProfile: job.MaskingProfile,
+		})
+	}
+
+	finished := time.Now()
+	updates := map[string]interface{}{
+		"rows_written": stats.Rows,
+		"truncated":    stats.Truncated,
+		"finished_at":  &finished,
+	}
+	if stats.Disclosure != nil {
+		updates["small_cell_rows"] = stats.Disclosure.AffectedRows
+	}
+	if err != nil {
+		updates["status"] = models.ExportFailed
+		updates["error"] = err.Error()
+	} else {
+		updates["status"] = models.ExportCompleted
+		updates["file_name"] = name
+	}
+
+	// A run that lost its lease leaves the job to the run that took over
+	result := leased(job).Updates(updates)
+	if result.Error != nil {
+		log.Printf("Failed to update export job %s: %v", job.ID, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		log.Printf("Export job %s was requeued, dropping the result of this run", job.ID)
+		if err == nil {
+			tools.DiscardExport(initializers.FlowDB, initializers.Storage, name, job.Format)
+		}
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	if job.DataRequestID != nil {
+		tools.RecordEvent(initializers.FlowDB, models.DataRequestEvent{
+			DataRequestID: *job.DataRequestID,
+			Type:          models.EventExported,
+			Details:       name + "." + job.Format,
+			ActorID:       &job.RequestedBy,
+		})
+	}
+
+	history := models.RequestHistory{SQL: job.SQL, Date: finished}
+	if err := initializers.FlowDB.Create(&history).Error; err != nil {
+		log.Printf("Failed to save request history for export %s: %v", job.ID, err)
+	}
+}
@@ -0,0 +1,142 @@
+package workers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"grad_deploy/initializers"
+	"grad_deploy/models"
+)
+
+// setupExportJobs points FlowDB at an in-memory database with an export_jobs table
+func setupExportJobs(t *testing.T) {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Exec(`CREATE TABLE export_jobs (
+		id TEXT PRIMARY KEY, sql TEXT NOT NULL, format TEXT NOT NULL DEFAULT 'csv',
+		status TEXT NOT NULL DEFAULT 'QUEUED', row_limit INTEGER NOT NULL,
+		rows_written INTEGER NOT NULL DEFAULT 0, truncated BOOLEAN NOT NULL DEFAULT false,
+		small_cell_rows INTEGER NOT NULL DEFAULT 0, file_name TEXT, error TEXT,
+		requested_by TEXT, data_request_id TEXT, masking_profile TEXT,
+		created_at DATETIME NOT NULL, started_at DATETIME, heartbeat_at DATETIME, finished_at DATETIME)`).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	initializers.FlowDB = db
+}
+
+// addExportJob stores a job created at created with the given status
+func addExportJob(t *testing.T, status string, created time.Time, started, heartbeat *time.Time) models.ExportJob {
+	t.Helper()
+	job := models.ExportJob{
+		ID: uuid.New(), SQL: "SELECT 1", Format: "csv", Status: status, RowLimit: 10, RowsWritten: 3,
+		CreatedAt: created, StartedAt: started, HeartbeatAt: heartbeat,
+	}
+	if err := initializers.FlowDB.Create(&job).Error; err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func reloadJob(t *testing.T, job models.ExportJob) models.ExportJob {
+	t.Helper()
+	var stored models.ExportJob
+	if err := initializers.FlowDB.First(&stored, "id = ?", job.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+func TestClaimNextExport(t *testing.T) {
+	setupExportJobs(t)
+	now := time.Now()
+	second := addExportJob(t, models.ExportQueued, now.Add(-time.Minute), nil, nil)
+	first := addExportJob(t, models.ExportQueued, now.Add(-time.Hour), nil, nil)
+	addExportJob(t, models.ExportCompleted, now.Add(-2*time.Hour), nil, nil)
+	addExportJob(t, models.ExportRunning, now.Add(-3*time.Hour), &now, &now)
+
+	for _, want := range []models.ExportJob{first, second} {
+		job, ok := claimNextExport(now)
+		if !ok || job.ID != want.ID || job.Status != models.ExportRunning || job.StartedAt == nil || job.HeartbeatAt == nil {
+			t.Fatalf("claimed %+v (%v), want %s", job, ok, want.ID)
+		}
+		if stored := reloadJob(t, want); stored.Status != models.ExportRunning || !stored.HeartbeatAt.Equal(now) {
+			t.Errorf("stored: %+v", stored)
+		}
+	}
+
+	if job, ok := claimNextExport(now); ok {
+		t.Errorf("claimed %+v with nothing queued", job)
+	}
+}
+
+func TestRequeueStaleExports(t *testing.T) {
+	setupExportJobs(t)
+	now := time.Now()
+	fresh, stale, old := now.Add(-time.Minute), now.Add(-exportLeaseTimeout-time.Second), now.Add(-time.Hour)
+
+	alive := addExportJob(t, models.ExportRunning, old, &old, &fresh)
+	lost := addExportJob(t, models.ExportRunning, old, &old, &stale)
+	// Started before heartbeats were kept
+	legacy := addExportJob(t, models.ExportRunning, old, &old, nil)
+	justStarted := addExportJob(t, models.ExportRunning, old, &fresh, nil)
+	done := addExportJob(t, models.ExportCompleted, old, &old, &stale)
+
+	requeueStaleExports(now)
+
+	for job, status := range map[models.ExportJob]string{
+		alive:       models.ExportRunning,
+		lost:        models.ExportQueued,
+		legacy:      models.ExportQueued,
+		justStarted: models.ExportRunning,
+		done:        models.ExportCompleted,
+	} {
+		stored := reloadJob(t, job)
+		if stored.Status != status {
+			t.Errorf("job started %v, heartbeat %v: status %s, want %s", job.StartedAt, job.HeartbeatAt, stored.Status, status)
+		}
+		if status == models.ExportQueued && stored.RowsWritten != 0 {
+			t.Errorf("requeued job kept its progress: %+v", stored)
+		}
+	}
+}
+
+func TestExportLease(t *testing.T) {
+	setupExportJobs(t)
+	now := time.Now()
+	addExportJob(t, models.ExportQueued, now.Add(-time.Hour), nil, nil)
+
+	job, ok := claimNextExport(now.Add(-time.Hour))
+	if !ok {
+		t.Fatal("nothing claimed")
+	}
+	if result := leased(job).Update("heartbeat_at", now.Add(-time.Hour)); result.Error != nil || result.RowsAffected != 1 {
+		t.Fatalf("heartbeat of the running job: %v, %d rows", result.Error, result.RowsAffected)
+	}
+
+	// The worker went quiet, another one takes the job over
+	requeueStaleExports(now)
+	taken, ok := claimNextExport(now)
+	if !ok || taken.ID != job.ID {
+		t.Fatalf("requeued job not claimed again: %+v", taken)
+	}
+
+	// The first run can no longer touch the job, the second one can
+	if result := leased(job).Updates(map[string]interface{}{"status": models.ExportFailed}); result.Error != nil || result.RowsAffected != 0 {
+		t.Errorf("lost lease still updates: %v, %d rows", result.Error, result.RowsAffected)
+	}
+	if result := leased(taken).Update("heartbeat_at", now); result.Error != nil || result.RowsAffected != 1 {
+		t.Errorf("new lease: %v, %d rows", result.Error, result.RowsAffected)
+	}
+	if stored := reloadJob(t, job); stored.Status != models.ExportRunning {
+		t.Errorf("status: %s", stored.Status)
+	}
+}
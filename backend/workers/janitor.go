@@ -0,0 +1,40 @@
+package workers
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"grad_deploy/initializers"
+	"grad_deploy/tools"
+)
+
+// defaultCleanupInterval is how often the janitor runs unless EXPORT_CLEANUP_INTERVAL is set
+const defaultCleanupInterval = time.Hour
+
+// StartExportJanitor starts the worker that deletes expired exports and
+// orphaned uploads every EXPORT_CLEANUP_INTERVAL (default an hour).
+func StartExportJanitor() {
+	interval, err := time.ParseDuration(os.Getenv("EXPORT_CLEANUP_INTERVAL"))
+	if err != nil || interval <= 0 {
+		interval = defaultCleanupInterval
+	}
+
+	go func() {
+		for {
+			cleanExports()
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func cleanExports() {
+	result, err := tools.CleanExports(context.Background(), initializers.FlowDB, initializers.Storage, time.Now())
+	if err != nil {
+		log.Printf("Export cleanup failed: %v", err)
+	}
+	if result.Expired > 0 || result.Orphans > 0 {
+		log.Printf("Export cleanup deleted %d expired exports and %d orphaned uploads (%d bytes)", result.Expired, result.Orphans, result.Bytes)
+	}
+}
@@ -1,4 +1,4 @@
-import React, { useState } from 'react';
+import React, { useState, useEffect, useCallback } from 'react';
 
 export default function StatusManager({ 
   currentStatus, 
@@ -9,6 +9,46 @@ export default function StatusManager({
   const [notes, setNotes] = useState('');
   const [loading, setLoading] = useState(false);
   const [emailLoading, setEmailLoading] = useState(false);
+  const [timeline, setTimeline] = useState([]);
+
+  const fetchTimeline = useCallback(async () => {
+    try {
+      const response = await fetch(`${import.meta.env.VITE_API_URL}/data-requests/${requestId}/timeline`, {
+        headers: {
+          'Authorization': `Bearer ${localStorage.getItem('token')}`
+        }
+      });
+      if (response.ok) {
+        const data = await response.json();
+        setTimeline(data.timeline || []);
+      }
+    } catch (error) {
+      console.error('Timeline fetch error:', error);
+    }
+  }, [requestId]);
+
+  useEffect(() => {
+    fetchTimeline();
+  }, [fetchTimeline]);
+
+  const describeEvent = (event) => {
+    switch (event.type) {
+      case 'CREATED':
+        return 'Request submitted';
+      case 'STATUS_CHANGED':
+        return `${getStatusInfo(event.from).label} → ${getStatusInfo(event.to).label}`;
+      case 'NOTE':
+        return 'Note added';
+      case 'SQL_EDITED':
+        return 'SQL query edited';
+      case 'EXPORTED':
+        return `Exported ${event.details}`;
+      case 'EMAIL_SENT':
+        return `Email sent to ${event.details}`;
+      default:
+        return event.type;
+    }
+  };
 
   const statusOptions = [
     { value: 'PENDING', label: 'Pending Review', color: '#ffc107', bgColor: '#fff3cd' },
@@ -33,7 +73,7 @@ export default function StatusManager({
     
     try {
       // API call to update status
-      const response = await fetch(`${import.meta.env.VITE_API_URL}/data-requests/${requestId}`, {
+      const response = await fetch(`${import.meta.env.VITE_API_URL}/data-requests/${requestId}/status`, {
         method: 'PUT',
         headers: {
           'Content-Type': 'application/json',
@@ -41,7 +81,7 @@ export default function StatusManager({
         },
         body: JSON.stringify({
           status: selectedStatus,
-          admin_notes: notes
+          notes: notes
         })
       });
 
@@ -50,6 +90,8 @@ export default function StatusManager({
         if (onStatusUpdate) {
           onStatusUpdate(updatedRequest);
         }
+        setNotes('');
+        fetchTimeline();
         alert('✅ Status updated successfully!');
       } else {
         throw new Error('Failed to update status');
@@ -253,15 +295,16 @@ export default function StatusManager({
             📝 Status History
           </h4>
           <div style={{ fontSize: '0.9rem', color: '#6c757d' }}>
-            <div style={{ marginBottom: '0.5rem' }}>
-              • {new Date().toLocaleDateString()} - Current: {getStatusInfo(currentStatus).label}
-            </div>
-            <div style={{ marginBottom: '0.5rem' }}>
-              • {new Date(Date.now() - 86400000).toLocaleDateString()} - Created: Pending Review
-            </div>
-            <div style={{ fontStyle: 'italic', marginTop: '0.5rem' }}>
-              Complete history would be loaded from backend API
-            </div>
+            {timeline.length === 0 && (
+              <div style={{ fontStyle: 'italic' }}>No history recorded yet</div>
+            )}
+            {timeline.map(event => (
+              <div key={event.id} style={{ marginBottom: '0.5rem' }}>
+                • {new Date(event.created_at).toLocaleString()} - {describeEvent(event)}
+                {event.actor && ` by ${event.actor.name}`}
+                {event.note && <div style={{ marginLeft: '1rem', fontStyle: 'italic' }}>“{event.note}”</div>}
+              </div>
+            ))}
           </div>
         </div>
       </div>